@@ -3,22 +3,317 @@ package main
 import (
 	"context"
 	"flag"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	// The image is built from scratch, without a zoneinfo database for
+	// --timezone.
+	_ "time/tzdata"
+
 	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
 	"github.com/argoproj-labs/argocd-metric-ext-server/internal/server"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 )
 
 func main() {
 	var port int
+	var bindAddress string
+	var basePath string
 	var enableTLS bool
+	var tlsCertFile string
+	var tlsKeyFile string
 	var skipPrometheusTLSVerify bool
+	var corsAllowedOrigins string
+	var rowDeadline time.Duration
+	var defaultDuration string
+	var defaultStep string
+	var maxDuration time.Duration
+	var negativeCacheTTL time.Duration
+	var prometheusHeaderName string
+	var prometheusOrgID string
+	var userAgent string
+	var queryTimeout time.Duration
+	var queryMaxAttempts int
+	var queryRetryBaseDelay time.Duration
+	var maxConcurrentQueries int
+	var queryQueueTimeout time.Duration
+	var adminToken string
+	var breakerFailures int
+	var breakerCooldown time.Duration
+	var maxQuerySeries int
+	var maxThresholds int
+	var strictThresholdValues bool
+	var thresholdConcurrency int
+	var thresholdTimeout time.Duration
+	var streamSeriesThreshold int
+	var maxResponseBytes int
+	var cacheMaxAge time.Duration
+	var cacheNoStore bool
+	var queryOffset time.Duration
+	var timezone string
+	var ginMode string
+	var logLevel string
+	var logFormat string
+	var debugResponseBodies bool
+	var configPath string
+	var clientRateLimit float64
+	var clientRateBurst int
+	var clientRateLimitHeader string
+	var readTimeout time.Duration
+	var writeTimeout time.Duration
+	var idleTimeout time.Duration
+	var maxHeaderBytes int
+	var prometheusBasicAuthUser string
+	var prometheusBasicAuthPasswordFile string
+	var prometheusMaxIdleConns int
+	var prometheusMaxIdleConnsPerHost int
+	var prometheusIdleConnTimeout time.Duration
+	var prometheusProxyURL string
 	flag.IntVar(&port, "port", 9003, "Listening Port")
+	flag.StringVar(&configPath, "configPath", envOrDefault("CONFIG_PATH", "app/config.json"), "Comma separated configuration files, or directories of .json configuration files, merged into the configuration")
+	flag.StringVar(&bindAddress, "bindAddress", envOrDefault("BIND_ADDRESS", "0.0.0.0"), "IP address the server listens on, e.g. 127.0.0.1 behind a sidecar proxy")
+	flag.StringVar(&basePath, "basePath", os.Getenv("BASE_PATH"), "Path prefixing every route of the server, e.g. /extensions/metrics when mounted at a sub-path of a proxy (default the root)")
 	flag.BoolVar(&enableTLS, "enableTLS", true, "Run server with TLS (default true)")
+	flag.StringVar(&tlsCertFile, "tlsCertFile", os.Getenv("TLS_CERT_FILE"), "PEM encoded certificate served with TLS, e.g. mounted from a Secret (default a generated self-signed certificate)")
+	flag.StringVar(&tlsKeyFile, "tlsKeyFile", os.Getenv("TLS_KEY_FILE"), "PEM encoded private key of the certificate served with TLS")
+	flag.DurationVar(&readTimeout, "readTimeout", 30*time.Second, "How long the server reads a request, headers and body, 0 for unlimited")
+	flag.DurationVar(&writeTimeout, "writeTimeout", 2*time.Minute, "How long the server writes the response of a request, live graphs excepted, 0 for unlimited")
+	flag.DurationVar(&idleTimeout, "idleTimeout", 2*time.Minute, "How long idle keep-alive connections are kept open, 0 for readTimeout")
+	flag.IntVar(&maxHeaderBytes, "maxHeaderBytes", 1<<20, "Maximum size in bytes of the request headers")
 	flag.BoolVar(&skipPrometheusTLSVerify, "skipPrometheusTLSVerify", false, "Skip TLS certificate verification when connecting to Prometheus (default false)")
+	flag.StringVar(&corsAllowedOrigins, "corsAllowedOrigins", os.Getenv("CORS_ALLOWED_ORIGINS"), "Comma separated list of origins allowed to make cross-origin requests, * allows any origin (default disabled)")
+	flag.DurationVar(&rowDeadline, "rowDeadline", 10*time.Second, "Default deadline budget for querying all the graphs of a row, overridable per request with ?budget")
+	flag.StringVar(&defaultDuration, "defaultDuration", envOrDefault("DEFAULT_DURATION", "1h"), "Duration of graph queries without a duration query param")
+	flag.StringVar(&defaultStep, "defaultStep", envOrDefault("DEFAULT_STEP", "1m"), "Step of graph range queries")
+	flag.DurationVar(&maxDuration, "maxDuration", 0, "Maximum duration of graph queries, e.g. 720h, longer requests failing with a 400 (default unlimited)")
+	flag.DurationVar(&negativeCacheTTL, "negativeCacheTTL", 0, "How long query errors and empty results are cached, at most 1m (default disabled)")
+	flag.StringVar(&prometheusHeaderName, "prometheusHeaderName", envOrDefault("PROMETHEUS_HEADER_NAME", "apikey"), "Header the PROMETHEUS_APIKEY is sent in, e.g. X-Api-Key")
+	flag.StringVar(&prometheusOrgID, "prometheusOrgID", os.Getenv("PROMETHEUS_ORG_ID"), "Tenant sent as X-Scope-OrgID to multi-tenant Cortex or Mimir")
+	flag.StringVar(&prometheusBasicAuthUser, "prometheusBasicAuthUser", os.Getenv("PROMETHEUS_BASIC_AUTH_USER"), "User of the basic auth of the Prometheus requests, e.g. behind an nginx (default disabled)")
+	flag.StringVar(&prometheusBasicAuthPasswordFile, "prometheusBasicAuthPasswordFile", os.Getenv("PROMETHEUS_BASIC_AUTH_PASSWORD_FILE"), "File holding the password of prometheusBasicAuthUser, e.g. mounted from a Secret")
+	flag.IntVar(&prometheusMaxIdleConns, "prometheusMaxIdleConns", 100, "Maximum number of idle connections kept open to every Prometheus datasource, 0 for unlimited")
+	flag.IntVar(&prometheusMaxIdleConnsPerHost, "prometheusMaxIdleConnsPerHost", 32, "Maximum number of idle connections kept open to every Prometheus host, e.g. about maxConcurrentQueries so that concurrent queries reuse connections")
+	flag.DurationVar(&prometheusIdleConnTimeout, "prometheusIdleConnTimeout", 90*time.Second, "How long idle connections to Prometheus are kept open, 0 for unlimited")
+	flag.StringVar(&prometheusProxyURL, "prometheusProxyURL", os.Getenv("PROMETHEUS_PROXY_URL"), "URL of the proxy the Prometheus requests are sent through, e.g. http://proxy:3128 (default the proxy of HTTP_PROXY, HTTPS_PROXY and NO_PROXY)")
+	flag.StringVar(&userAgent, "userAgent", os.Getenv("USER_AGENT"), "User-Agent of the Prometheus requests (default argocd-metric-ext-server/<version>)")
+	flag.DurationVar(&queryTimeout, "queryTimeout", 30*time.Second, "Timeout of a single Prometheus query, retries included")
+	flag.IntVar(&queryMaxAttempts, "queryMaxAttempts", 3, "Number of attempts of a Prometheus query failing with a transient error (network error, 502, 503 or 504)")
+	flag.DurationVar(&queryRetryBaseDelay, "queryRetryBaseDelay", 200*time.Millisecond, "Base delay of the exponential backoff between query attempts")
+	flag.IntVar(&maxConcurrentQueries, "maxConcurrentQueries", 20, "Maximum number of concurrent Prometheus queries, 0 for unlimited")
+	flag.DurationVar(&queryQueueTimeout, "queryQueueTimeout", 5*time.Second, "How long a query waits for a free slot before failing with a 429, 0 to fail immediately")
+	flag.IntVar(&breakerFailures, "breakerFailures", 5, "Number of consecutive failures of a datasource after which its queries fail fast with a 503 for breakerCooldown, 0 to disable the circuit breakers")
+	flag.DurationVar(&breakerCooldown, "breakerCooldown", 30*time.Second, "How long the queries of a failing datasource fail fast before a probe query is let through")
+	flag.Float64Var(&clientRateLimit, "clientRateLimit", 0, "Number of API requests per second every client can make, 429 being returned above it (default disabled)")
+	flag.IntVar(&clientRateBurst, "clientRateBurst", 20, "Number of API requests a client can make at once before being limited to clientRateLimit")
+	flag.StringVar(&clientRateLimitHeader, "clientRateLimitHeader", os.Getenv("CLIENT_RATE_LIMIT_HEADER"), "Request header identifying the client of the rate limit, e.g. Argocd-Username (default the client IP address)")
+	flag.StringVar(&adminToken, "adminToken", os.Getenv("ADMIN_TOKEN"), "Bearer token of the admin endpoints such as POST /api/reload (default disabled)")
+	flag.IntVar(&maxQuerySeries, "maxQuerySeries", 0, "Number of series above which graph queries fail, checked with a count() query before running them (default unlimited)")
+	flag.IntVar(&maxThresholds, "maxThresholds", 20, "Maximum number of thresholds of a graph, each of which is a query, larger graphs failing config validation, 0 for unlimited")
+	flag.BoolVar(&strictThresholdValues, "strictThresholdValues", false, "Reject configs with threshold values that are not numbers, which are otherwise executed as queries (default false)")
+	flag.IntVar(&thresholdConcurrency, "thresholdConcurrency", 4, "Maximum number of thresholds of a graph queried at once, 0 for unlimited")
+	flag.DurationVar(&thresholdTimeout, "thresholdTimeout", 10*time.Second, "Timeout of the threshold queries of a graph, thresholds not completing in time being returned with an error rather than failing the graph, 0 for unlimited")
+	flag.IntVar(&streamSeriesThreshold, "streamSeriesThreshold", 0, "Number of series above which graph results are streamed as newline delimited JSON (default disabled)")
+	flag.IntVar(&maxResponseBytes, "maxResponseBytes", 0, "Size in bytes above which graph and row responses fail with a 413 (default unlimited)")
+	flag.DurationVar(&cacheMaxAge, "cacheMaxAge", 0, "max-age of the Cache-Control header of graph responses (default the step of the graph)")
+	flag.BoolVar(&cacheNoStore, "cacheNoStore", false, "Mark graph responses no-store so that browsers and proxies do not cache them (default false)")
+	flag.DurationVar(&queryOffset, "queryOffset", 0, "How far back from now graph queries end, e.g. 30s to hide the trailing gap of delayed remote writes, overridable per dashboard with queryOffset")
+	flag.StringVar(&timezone, "timezone", envOrDefault("TIMEZONE", "UTC"), "IANA name of the timezone calendar range presets such as today are aligned to, e.g. Europe/Paris")
+	flag.StringVar(&ginMode, "ginMode", envOrDefault("GIN_MODE", gin.ReleaseMode), "Mode of the gin engine: release, or debug to print routes and debug warnings")
+	flag.StringVar(&logLevel, "logLevel", os.Getenv("LOG_LEVEL"), "Minimum level of the logs: debug, info, warn or error (default info, debug when NUMAFLOW_DEBUG is true)")
+	flag.StringVar(&logFormat, "logFormat", os.Getenv("LOG_FORMAT"), "Format of the logs: json or console (default json, console when NUMAFLOW_DEBUG is true)")
+	flag.BoolVar(&debugResponseBodies, "debugResponseBodies", false, "Log the body of graph responses at debug level, besides their summary (default false)")
 	flag.Parse()
-	logger := logging.NewLogger().Named("metric-sever")
+	baseLogger, err := logging.New(logging.Options{Level: logLevel, Format: logFormat})
+	if err != nil {
+		logging.NewLogger().Fatal(err)
+	}
+	logger := baseLogger.Named("metric-server")
+	defaultDurationValue := parsePositiveDuration(logger, "defaultDuration", defaultDuration)
+	defaultStepValue := parsePositiveDuration(logger, "defaultStep", defaultStep)
+	if ginMode != gin.ReleaseMode && ginMode != gin.DebugMode && ginMode != gin.TestMode {
+		logger.Fatalf("Invalid value %q for ginMode: must be release, debug or test", ginMode)
+	}
+	validateListenAddress(logger, bindAddress, port)
+	if strings.ContainsAny(basePath, ":*?#") {
+		logger.Fatalf("Invalid value %q for basePath: must be a plain path, without parameters, wildcards, query or fragment", basePath)
+	}
+	if prometheusMaxIdleConns < 0 || prometheusMaxIdleConnsPerHost < 0 || prometheusIdleConnTimeout < 0 {
+		logger.Fatalf("Invalid Prometheus connection pool [maxIdleConns: %d, maxIdleConnsPerHost: %d, idleConnTimeout: %s]: must not be negative", prometheusMaxIdleConns, prometheusMaxIdleConnsPerHost, prometheusIdleConnTimeout)
+	}
+	if readTimeout < 0 || writeTimeout < 0 || idleTimeout < 0 {
+		logger.Fatalf("Invalid server timeouts [read: %s, write: %s, idle: %s]: must not be negative", readTimeout, writeTimeout, idleTimeout)
+	}
+	if maxHeaderBytes <= 0 {
+		logger.Fatalf("Invalid value %d for maxHeaderBytes: must be positive", maxHeaderBytes)
+	}
+	if maxDuration < 0 || (maxDuration > 0 && maxDuration < defaultDurationValue) {
+		logger.Fatalf("Invalid value %s for maxDuration: must not be negative nor shorter than defaultDuration", maxDuration)
+	}
+	if breakerFailures < 0 {
+		logger.Fatalf("Invalid value %d for breakerFailures: must not be negative", breakerFailures)
+	}
+	if breakerFailures > 0 && breakerCooldown <= 0 {
+		logger.Fatalf("Invalid value %s for breakerCooldown: must be positive", breakerCooldown)
+	}
+	if clientRateLimit < 0 || clientRateBurst < 1 {
+		logger.Fatalf("Invalid client rate limit [rate: %g, burst: %d]: the rate must not be negative and the burst must be positive", clientRateLimit, clientRateBurst)
+	}
+	if maxThresholds < 0 {
+		logger.Fatalf("Invalid value %d for maxThresholds: must not be negative", maxThresholds)
+	}
+	if thresholdConcurrency < 0 || thresholdTimeout < 0 {
+		logger.Fatalf("Invalid threshold limits [concurrency: %d, timeout: %s]: must not be negative", thresholdConcurrency, thresholdTimeout)
+	}
+	if cacheMaxAge < 0 {
+		logger.Fatalf("Invalid value %s for cacheMaxAge: must not be negative", cacheMaxAge)
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		logger.Fatalf("Invalid value %q for timezone: %v", timezone, err)
+	}
+	prometheusBasicAuthPassword := readBasicAuthPassword(logger, prometheusBasicAuthUser, prometheusBasicAuthPasswordFile)
+	prometheusProxy := parseProxyURL(logger, prometheusProxyURL)
+	if queryOffset < 0 {
+		logger.Fatalf("Invalid value %s for queryOffset: must not be negative", queryOffset)
+	}
 	ctx := context.Background()
 	defer ctx.Done()
 
-	metricsServer := server.NewO11yServer(logger, port, enableTLS, skipPrometheusTLSVerify)
+	metricsServer := server.NewO11yServer(logger, server.Options{
+		Port:                          port,
+		ConfigPaths:                   splitList(configPath),
+		BindAddress:                   bindAddress,
+		BasePath:                      basePath,
+		GinMode:                       ginMode,
+		EnableTLS:                     enableTLS,
+		ReadTimeout:                   readTimeout,
+		WriteTimeout:                  writeTimeout,
+		IdleTimeout:                   idleTimeout,
+		MaxHeaderBytes:                maxHeaderBytes,
+		TLSCertFile:                   tlsCertFile,
+		TLSKeyFile:                    tlsKeyFile,
+		SkipPrometheusTLSVerify:       skipPrometheusTLSVerify,
+		CORSAllowedOrigins:            splitList(corsAllowedOrigins),
+		RowDeadline:                   rowDeadline,
+		DefaultDuration:               defaultDurationValue,
+		DefaultStep:                   defaultStepValue,
+		MaxDuration:                   maxDuration,
+		NegativeCacheTTL:              negativeCacheTTL,
+		PrometheusHeaderName:          prometheusHeaderName,
+		PrometheusOrgID:               prometheusOrgID,
+		PrometheusBasicAuthUser:       prometheusBasicAuthUser,
+		PrometheusBasicAuthPassword:   prometheusBasicAuthPassword,
+		PrometheusMaxIdleConns:        prometheusMaxIdleConns,
+		PrometheusMaxIdleConnsPerHost: prometheusMaxIdleConnsPerHost,
+		PrometheusIdleConnTimeout:     prometheusIdleConnTimeout,
+		PrometheusProxyURL:            prometheusProxy,
+		UserAgent:                     userAgent,
+		QueryOffset:                   queryOffset,
+		Timezone:                      location,
+		QueryTimeout:                  queryTimeout,
+		QueryMaxAttempts:              queryMaxAttempts,
+		QueryRetryBaseDelay:           queryRetryBaseDelay,
+		MaxConcurrentQueries:          maxConcurrentQueries,
+		QueryQueueTimeout:             queryQueueTimeout,
+		AdminToken:                    adminToken,
+		ClientRateLimit:               clientRateLimit,
+		ClientRateBurst:               clientRateBurst,
+		ClientRateLimitHeader:         clientRateLimitHeader,
+		BreakerFailures:               breakerFailures,
+		BreakerCooldown:               breakerCooldown,
+		MaxQuerySeries:                maxQuerySeries,
+		MaxThresholds:                 maxThresholds,
+		StrictThresholdValues:         strictThresholdValues,
+		ThresholdConcurrency:          thresholdConcurrency,
+		ThresholdTimeout:              thresholdTimeout,
+		StreamSeriesThreshold:         streamSeriesThreshold,
+		MaxResponseBytes:              maxResponseBytes,
+		CacheMaxAge:                   cacheMaxAge,
+		CacheNoStore:                  cacheNoStore,
+		DebugResponseBodies:           debugResponseBodies,
+	})
 	metricsServer.Run(ctx)
 }
+
+// envOrDefault returns the value of the environment variable name, or def
+// when it is not set.
+func envOrDefault(name string, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+// parsePositiveDuration parses the value of a duration flag, exiting when it
+// is not a valid positive duration.
+func parsePositiveDuration(logger *zap.SugaredLogger, name string, value string) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		logger.Fatalf("Invalid value %q for %s: must be a positive duration", value, name)
+	}
+	return duration
+}
+
+// validateListenAddress checks the bindAddress and port flags the server
+// listens on, exiting when the address is neither empty, i.e. all the
+// interfaces, nor an IP address, or the port is out of range.
+func validateListenAddress(logger *zap.SugaredLogger, bindAddress string, port int) {
+	if bindAddress != "" && net.ParseIP(bindAddress) == nil {
+		logger.Fatalf("Invalid value %q for bindAddress: must be an IP address, or empty for all the interfaces", bindAddress)
+	}
+	if port < 1 || port > 65535 {
+		logger.Fatalf("Invalid value %d for port: must be between 1 and 65535", port)
+	}
+}
+
+// readBasicAuthPassword returns the password of the Prometheus basic auth
+// user read from passwordFile, exiting when only one of them is set, when
+// the file can not be read, or when a PROMETHEUS_APIKEY is also set.
+func readBasicAuthPassword(logger *zap.SugaredLogger, user string, passwordFile string) string {
+	if user == "" && passwordFile == "" {
+		return ""
+	}
+	if user == "" || passwordFile == "" {
+		logger.Fatal("Invalid basic auth: both prometheusBasicAuthUser and prometheusBasicAuthPasswordFile are required")
+	}
+	if os.Getenv("PROMETHEUS_APIKEY") != "" {
+		logger.Fatal("Invalid basic auth: can not be combined with PROMETHEUS_APIKEY")
+	}
+	password, err := os.ReadFile(passwordFile)
+	if err != nil {
+		logger.Fatalf("Invalid value %q for prometheusBasicAuthPasswordFile: %v", passwordFile, err)
+	}
+	return strings.TrimRight(string(password), "\r\n")
+}
+
+// parseProxyURL parses the value of the prometheusProxyURL flag, exiting
+// when it is not an http, https or socks5 URL. It returns nil when empty.
+func parseProxyURL(logger *zap.SugaredLogger, value string) *url.URL {
+	if value == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil || proxyURL.Host == "" {
+		logger.Fatalf("Invalid value %q for prometheusProxyURL: must be a URL such as http://proxy:3128", value)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		logger.Fatalf("Invalid value %q for prometheusProxyURL: the scheme must be http, https or socks5", value)
+	}
+	return proxyURL
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
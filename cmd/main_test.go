@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+)
+
+// newTestLogger returns a logger whose Fatal calls panic rather than exit,
+// so that the rejected flag values can be tested.
+func newTestLogger(t *testing.T) *zap.SugaredLogger {
+	return zaptest.NewLogger(t, zaptest.WrapOptions(zap.WithFatalHook(zapcore.WriteThenPanic))).Sugar()
+}
+
+func TestParsePositiveDuration(t *testing.T) {
+	logger := newTestLogger(t)
+	assert.Equal(t, time.Hour, parsePositiveDuration(logger, "defaultDuration", "1h"))
+	assert.Equal(t, 30*time.Second, parsePositiveDuration(logger, "defaultStep", "30s"))
+	for _, value := range []string{"", "forever", "1d", "0s", "-1m"} {
+		assert.Panics(t, func() { parsePositiveDuration(logger, "defaultStep", value) }, value)
+	}
+}
+
+func TestValidateListenAddress(t *testing.T) {
+	logger := newTestLogger(t)
+	for _, tt := range []struct {
+		bindAddress string
+		port        int
+	}{
+		{"", 9003},
+		{"0.0.0.0", 9003},
+		{"127.0.0.1", 8080},
+		{"::1", 443},
+		{"::", 65535},
+	} {
+		assert.NotPanics(t, func() { validateListenAddress(logger, tt.bindAddress, tt.port) }, tt.bindAddress)
+	}
+	for _, tt := range []struct {
+		bindAddress string
+		port        int
+	}{
+		{"localhost", 9003},
+		{"127.0.0.1:9003", 9003},
+		{"[::1]", 9003},
+		{"127.0.0.1", 0},
+		{"127.0.0.1", -1},
+		{"127.0.0.1", 65536},
+	} {
+		assert.Panics(t, func() { validateListenAddress(logger, tt.bindAddress, tt.port) }, tt.bindAddress)
+	}
+}
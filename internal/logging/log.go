@@ -2,13 +2,40 @@ package logging
 
 import (
 	"context"
+	"fmt"
 	"os"
 
 	zap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// Formats of the logs.
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Options configures the loggers built by New. Empty fields default to the
+// development settings when NUMAFLOW_DEBUG is true, i.e. debug level and
+// console format, and to info level and JSON format otherwise.
+type Options struct {
+	// Level is the minimum level of the logs: debug, info, warn or error.
+	Level string
+	// Format is the encoding of the logs: json or console.
+	Format string
+}
+
 // NewLogger returns a new zap.SugaredLogger
 func NewLogger() *zap.SugaredLogger {
+	logger, err := New(Options{})
+	if err != nil {
+		panic(err)
+	}
+	return logger
+}
+
+// New returns a new zap.SugaredLogger configured with options.
+func New(options Options) (*zap.SugaredLogger, error) {
 	var config zap.Config
 	debugMode, ok := os.LookupEnv("NUMAFLOW_DEBUG")
 	if ok && debugMode == "true" {
@@ -16,13 +43,30 @@ func NewLogger() *zap.SugaredLogger {
 	} else {
 		config = zap.NewProductionConfig()
 	}
-	// Config customization goes here if any
+	if options.Level != "" {
+		level, err := zapcore.ParseLevel(options.Level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", options.Level, err)
+		}
+		config.Level = zap.NewAtomicLevelAt(level)
+	}
+	switch options.Format {
+	case "":
+	case FormatJSON:
+		config.Encoding = FormatJSON
+		config.EncoderConfig = zap.NewProductionEncoderConfig()
+	case FormatConsole:
+		config.Encoding = FormatConsole
+		config.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be json or console", options.Format)
+	}
 	config.OutputPaths = []string{"stdout"}
 	logger, err := config.Build()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return logger.Named("numaflow").Sugar()
+	return logger.Named("numaflow").Sugar(), nil
 }
 
 type loggerKey struct{}
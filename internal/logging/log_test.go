@@ -0,0 +1,27 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestNew(t *testing.T) {
+	t.Setenv("NUMAFLOW_DEBUG", "false")
+	logger, err := New(Options{Level: "warn", Format: FormatConsole})
+	assert.NoError(t, err)
+	named := logger.Named("metric-server").Desugar().Core()
+	assert.False(t, named.Enabled(zap.InfoLevel), "named loggers honor the level")
+	assert.True(t, named.Enabled(zap.WarnLevel))
+
+	logger, err = New(Options{})
+	assert.NoError(t, err)
+	assert.True(t, logger.Desugar().Core().Enabled(zap.InfoLevel))
+	assert.False(t, logger.Desugar().Core().Enabled(zap.DebugLevel))
+
+	_, err = New(Options{Level: "verbose"})
+	assert.ErrorContains(t, err, `invalid log level "verbose"`)
+	_, err = New(Options{Format: "logfmt"})
+	assert.EqualError(t, err, `invalid log format "logfmt": must be json or console`)
+}
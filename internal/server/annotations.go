@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Annotation configures a query whose series are overlaid on a graph as
+// events, such as deployments from changes() or alerts from ALERTS, rather
+// than drawn as series.
+type Annotation struct {
+	Name            string `json:"name"`
+	QueryExpression string `json:"queryExpression"`
+	Color           string `json:"color,omitempty"`
+	// TextFormat is the template of the text of the events, rendered
+	// against the labels of their series like the legendFormat of graphs.
+	// Events are labeled with the full label set of their series when
+	// empty.
+	TextFormat string `json:"textFormat,omitempty"`
+}
+
+// AnnotationEvent is an event of an annotation: a run of consecutive steps
+// where a series of the annotation query has a non-zero value.
+type AnnotationEvent struct {
+	Annotation string `json:"annotation"`
+	Color      string `json:"color,omitempty"`
+	// Time is the first sample of the event and End its last one, equal to
+	// Time for events of a single step.
+	Time   model.Time   `json:"time"`
+	End    model.Time   `json:"end"`
+	Text   string       `json:"text"`
+	Labels model.Metric `json:"labels"`
+}
+
+// validate checks the settings of the annotation.
+func (a Annotation) validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("annotation must have a name")
+	}
+	if a.QueryExpression == "" {
+		return fmt.Errorf("annotation %s must have a queryExpression", a.Name)
+	}
+	if a.TextFormat != "" {
+		if _, err := parseLegendFormat(a.TextFormat); err != nil {
+			return fmt.Errorf("annotation %s has an invalid textFormat: %w", a.Name, err)
+		}
+	}
+	return nil
+}
+
+// executeAnnotations executes the annotation queries of a graph over r and
+// returns their events, sorted by time.
+func executeAnnotations(ctx context.Context, annotations []Annotation, env map[string][]string, r v1.Range, pp *PrometheusProvider) ([]AnnotationEvent, error) {
+	var events []AnnotationEvent
+	for _, annotation := range annotations {
+		result, _, err := executeGraphQuery(ctx, annotation.QueryExpression, env, r, pp)
+		if err != nil {
+			return nil, fmt.Errorf("annotation %s: %w", annotation.Name, err)
+		}
+		matrix, ok := matrixOf(result)
+		if !ok {
+			return nil, fmt.Errorf("annotation %s query must return a matrix, got %T", annotation.Name, result)
+		}
+		events = append(events, annotationEvents(matrix, annotation, r.Step)...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time < events[j].Time })
+	return events, nil
+}
+
+// annotationEvents returns the events of the series of an annotation: every
+// run of non-zero samples at most step apart is an event, so that an alert
+// firing for an hour is a single event rather than one per step. Zero and
+// NaN samples, as well as missing ones, end an event.
+func annotationEvents(matrix model.Matrix, annotation Annotation, step time.Duration) []AnnotationEvent {
+	l := newLegender(annotation.TextFormat)
+	var events []AnnotationEvent
+	for _, series := range matrix {
+		// current is the index of the event of the series still going on, or
+		// -1.
+		current := -1
+		for _, pair := range series.Values {
+			value := float64(pair.Value)
+			if value == 0 || math.IsNaN(value) {
+				current = -1
+				continue
+			}
+			if current >= 0 && pair.Timestamp.Sub(events[current].End) <= step {
+				events[current].End = pair.Timestamp
+				continue
+			}
+			events = append(events, AnnotationEvent{
+				Annotation: annotation.Name,
+				Color:      annotation.Color,
+				Time:       pair.Timestamp,
+				End:        pair.Timestamp,
+				Text:       l.legend(series.Metric),
+				Labels:     series.Metric,
+			})
+			current = len(events) - 1
+		}
+	}
+	return events
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotationEvents(t *testing.T) {
+	series := func(metric model.Metric, values ...float64) *model.SampleStream {
+		stream := &model.SampleStream{Metric: metric}
+		for i, v := range values {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(i * 60000), Value: model.SampleValue(v)})
+		}
+		return stream
+	}
+	gap := series(model.Metric{"alertname": "Gap"}, 1, 1)
+	gap.Values[1].Timestamp = 180000
+	matrix := model.Matrix{
+		series(model.Metric{"alertname": "HighCPU"}, 1, 1, 1, 0, 1),
+		series(model.Metric{"alertname": "Deploy"}, 0, 2, 0, 0),
+		gap,
+	}
+	events := annotationEvents(matrix, Annotation{Name: "alerts", Color: "red", TextFormat: "{{ .alertname }}"}, time.Minute)
+	assert.Equal(t, []AnnotationEvent{
+		{Annotation: "alerts", Color: "red", Time: 0, End: 120000, Text: "HighCPU", Labels: model.Metric{"alertname": "HighCPU"}},
+		{Annotation: "alerts", Color: "red", Time: 240000, End: 240000, Text: "HighCPU", Labels: model.Metric{"alertname": "HighCPU"}},
+		{Annotation: "alerts", Color: "red", Time: 60000, End: 60000, Text: "Deploy", Labels: model.Metric{"alertname": "Deploy"}},
+		{Annotation: "alerts", Color: "red", Time: 0, End: 0, Text: "Gap", Labels: model.Metric{"alertname": "Gap"}},
+		{Annotation: "alerts", Color: "red", Time: 180000, End: 180000, Text: "Gap", Labels: model.Metric{"alertname": "Gap"}},
+	}, events)
+}
+
+func TestExecuteAnnotations(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{
+		Name:            "graph",
+		QueryExpression: "up",
+		Annotations: []Annotation{
+			{Name: "deployments", QueryExpression: "changes(kube_deployment_status_observed_generation[1m]) > 0"},
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("query") == "up" {
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a"}, "values": [[1700000000, "1"], [1700000060, "1"]]}]}}`))
+			return
+		}
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"deployment": "web"}, "values": [[1700000060, "1"]]}]}}`))
+	})
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []AnnotationEvent{{
+		Annotation: "deployments",
+		Time:       1700000060000,
+		End:        1700000060000,
+		Text:       `{deployment="web"}`,
+		Labels:     model.Metric{"deployment": "web"},
+	}}, response.Annotations)
+}
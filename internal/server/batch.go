@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchQueries bounds the number of graphs of a batch request.
+const maxBatchQueries = 100
+
+// BatchQuery is a graph of a batch request. Its result is keyed by ID, which
+// defaults to application/groupKind/row/graph.
+type BatchQuery struct {
+	ID          string `json:"id,omitempty"`
+	Application string `json:"application"`
+	GroupKind   string `json:"groupKind"`
+	Row         string `json:"row"`
+	Graph       string `json:"graph"`
+	// Duration overrides the duration of the request for this graph.
+	Duration string `json:"duration,omitempty"`
+}
+
+// key returns the key of the result of q.
+func (q BatchQuery) key() string {
+	if q.ID != "" {
+		return q.ID
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", q.Application, q.GroupKind, q.Row, q.Graph)
+}
+
+// BatchRequest is the body of a batch request.
+type BatchRequest struct {
+	Queries []BatchQuery `json:"queries"`
+}
+
+// BatchResponse is the response of a batch request, keyed by query.
+type BatchResponse struct {
+	Results map[string]GraphResult `json:"results"`
+}
+
+// executeBatch queries the graphs of a batch request concurrently within a
+// deadline budget, like executeRow. Every graph is queried with the query
+// params of the request, and graphs that can not be found are reported with
+// an error status without failing the other ones.
+func (pp *PrometheusProvider) executeBatch(ctx *gin.Context) {
+	req, err := pp.newGraphRequest(ctx)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	budget, err := requestBudget(ctx, pp.options)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	var batch BatchRequest
+	if err := ctx.ShouldBindJSON(&batch); err != nil {
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, "Invalid batch request: "+err.Error())
+		return
+	}
+	if len(batch.Queries) == 0 || len(batch.Queries) > maxBatchQueries {
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Batch request must have between 1 and %d queries", maxBatchQueries))
+		return
+	}
+
+	seen := map[string]bool{}
+	failed := map[string]GraphResult{}
+	var queries []graphQuery
+	for _, q := range batch.Queries {
+		key := q.key()
+		if seen[key] {
+			writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Duplicate batch query %q", key))
+			return
+		}
+		seen[key] = true
+		graph, graphReq, err := pp.batchGraph(q, req)
+		if err != nil {
+			failed[key] = GraphResult{Status: graphStatusError, Error: err.Error()}
+			continue
+		}
+		queries = append(queries, graphQuery{key: key, graph: graph, req: graphReq})
+	}
+	results := pp.queryGraphs(ctx.Request.Context(), budget, queries)
+	for key, result := range failed {
+		results[key] = result
+	}
+	body, err := pp.marshalResponse(BatchResponse{Results: results})
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// batchGraph returns the graph of a batch query along with the request it
+// is queried with, derived from req.
+func (pp *PrometheusProvider) batchGraph(q BatchQuery, req graphRequest) (*Graph, graphRequest, error) {
+	req.application, req.groupKind, req.row, req.graph = q.Application, q.GroupKind, q.Row, q.Graph
+	if q.Duration != "" {
+		duration, err := parseDuration(q.Duration)
+		if err != nil {
+			return nil, req, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid duration %q: %s", q.Duration, err))
+		}
+		req.duration = duration
+	}
+	row, err := pp.getRow(&req)
+	if err != nil {
+		return nil, req, err
+	}
+	graph := row.getGraph(req.graph)
+	if graph == nil {
+		return nil, req, newNotFoundError("Requested Graph not found")
+	}
+	return graph, req, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// executeTestBatch runs a batch request with body against pp.
+func executeTestBatch(pp *PrometheusProvider, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/api/batch?namespace=shop&budget=10s", strings.NewReader(body))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	pp.executeBatch(ctx)
+	return w
+}
+
+func TestExecuteBatch(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: `up{namespace="{{.namespace}}"}`}, `[]`)
+
+	w := executeTestBatch(pp, `{"queries": [
+		{"id": "last hour", "application": "app", "groupKind": "pod", "row": "row", "graph": "graph"},
+		{"application": "app", "groupKind": "pod", "row": "row", "graph": "graph", "duration": "7d"},
+		{"id": "missing", "application": "app", "groupKind": "pod", "row": "row", "graph": "memory"},
+		{"id": "invalid", "application": "app", "groupKind": "pod", "row": "row", "graph": "graph", "duration": "1mo"}
+	]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response BatchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Results, 4)
+	assert.Equal(t, graphStatusOK, response.Results["last hour"].Status)
+	assert.Equal(t, graphStatusOK, response.Results["app/pod/row/graph"].Status)
+	assert.Equal(t, GraphResult{Status: graphStatusError, Error: "Requested Graph not found"}, response.Results["missing"])
+	assert.Equal(t, graphStatusError, response.Results["invalid"].Status)
+	assert.Contains(t, response.Results["invalid"].Error, `Invalid duration "1mo"`)
+
+	w = executeTestBatch(pp, `{"queries": [
+		{"application": "app", "groupKind": "pod", "row": "row", "graph": "graph"},
+		{"application": "app", "groupKind": "pod", "row": "row", "graph": "graph", "duration": "1d"}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Duplicate batch query \"app/pod/row/graph\"`)
+
+	w = executeTestBatch(pp, `{"queries": []}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExecuteBatchTimeout(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: `up`}, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.FormValue("query"), "slow") {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+	row := pp.config.Applications[0].DefaultDashboard.Rows[0]
+	row.Graphs = append(row.Graphs, &Graph{Name: "slow", QueryExpression: `slow`})
+
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/api/batch?budget=200ms", strings.NewReader(`{"queries": [
+		{"id": "fast", "application": "app", "groupKind": "pod", "row": "row", "graph": "graph"},
+		{"id": "slow", "application": "app", "groupKind": "pod", "row": "row", "graph": "slow"}
+	]}`))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	pp.executeBatch(ctx)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response BatchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, graphStatusOK, response.Results["fast"].Status, "the completed graph is reported")
+	assert.Equal(t, timedOutGraph, response.Results["slow"])
+}
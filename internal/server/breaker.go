@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// States of a circuitBreaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops querying a datasource that failed failures times in
+// a row, failing its queries fast with a 503 for cooldown rather than
+// letting every graph wait for the query timeout. Once the cooldown is
+// over, a single probe query is let through: the breaker closes when it
+// succeeds and opens again when it fails.
+type circuitBreaker struct {
+	name      string
+	failures  int
+	cooldown  time.Duration
+	metrics   *serverMetrics
+	now       func() time.Time
+	mu        sync.Mutex
+	state     string
+	failed    int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(name string, failures int, cooldown time.Duration, metrics *serverMetrics) *circuitBreaker {
+	b := &circuitBreaker{name: name, failures: failures, cooldown: cooldown, metrics: metrics, now: time.Now, state: breakerClosed}
+	metrics.setBreakerOpen(name, false)
+	return b
+}
+
+// allow returns a 503 error when the breaker is open, or half-open with
+// its probe query in flight. It turns an open breaker whose cooldown is
+// over half-open, letting the query through as the probe. It always allows
+// queries on a nil breaker, i.e. when the breaker is disabled.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == breakerOpen && !b.now().Before(b.openUntil):
+		b.state = breakerHalfOpen
+		return nil
+	case b.state == breakerClosed:
+		return nil
+	}
+	b.metrics.queryShortCircuited(b.name)
+	return &queryError{
+		status:  http.StatusServiceUnavailable,
+		code:    errCodeUnavailable,
+		message: fmt.Sprintf("datasource %s is unavailable after %d consecutive failures, retrying in %s", b.name, b.failed, b.retryIn().Round(time.Second)),
+	}
+}
+
+// retryIn returns how long until the breaker lets a probe query through.
+func (b *circuitBreaker) retryIn() time.Duration {
+	if wait := b.openUntil.Sub(b.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// record records the outcome of a query let through by allow. Only errors
+// of an unreachable or failing backend count as failures: PromQL errors,
+// for instance, come from a healthy one.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isBackendFailure(err) {
+		if b.state != breakerClosed {
+			b.metrics.setBreakerOpen(b.name, false)
+		}
+		b.state = breakerClosed
+		b.failed = 0
+		return
+	}
+	b.failed++
+	if b.state == breakerHalfOpen || b.failed >= b.failures {
+		b.state = breakerOpen
+		b.openUntil = b.now().Add(b.cooldown)
+		b.metrics.setBreakerOpen(b.name, true)
+	}
+}
+
+// abort releases a query let through by allow whose outcome tells nothing
+// about the backend, e.g. a query cancelled by the client. An aborted probe
+// leaves the breaker open, letting the next query through as the probe.
+func (b *circuitBreaker) abort() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// isBackendFailure reports whether err tells that the backend is down:
+// a transient error, or a query timing out.
+func isBackendFailure(err error) bool {
+	if _, ok := rateLimitedError(err); ok {
+		return false
+	}
+	return isTransientError(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// BreakerState is the state of the circuit breaker of a datasource, as
+// reported by the self-test.
+type BreakerState struct {
+	Datasource string `json:"datasource"`
+	State      string `json:"state"`
+	// Failures is the number of consecutive failures of the datasource.
+	Failures int `json:"failures"`
+}
+
+// snapshot returns the state of the breaker.
+func (b *circuitBreaker) snapshot() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerState{Datasource: b.name, State: b.state, Failures: b.failed}
+}
+
+// newBreakers returns a circuit breaker per datasource of pp, keyed by the
+// name its queries carry in their context, or nil when the breakers are
+// disabled.
+func (pp *PrometheusProvider) newBreakers() map[string]*circuitBreaker {
+	if pp.options.BreakerFailures <= 0 {
+		return nil
+	}
+	breakers := map[string]*circuitBreaker{
+		"": newCircuitBreaker(pp.providerName(), pp.options.BreakerFailures, pp.options.BreakerCooldown, pp.metrics),
+	}
+	for name := range pp.datasources {
+		if name == pp.config.Provider.Name {
+			breakers[name] = breakers[""]
+			continue
+		}
+		breakers[name] = newCircuitBreaker(name, pp.options.BreakerFailures, pp.options.BreakerCooldown, pp.metrics)
+	}
+	return breakers
+}
+
+// breaker returns the circuit breaker of the datasource the queries of ctx
+// are sent to, or nil when the breakers are disabled.
+func (pp *PrometheusProvider) breaker(ctx context.Context) *circuitBreaker {
+	return pp.breakers[datasourceFromContext(ctx)]
+}
+
+// breakerStates returns the state of the circuit breakers, sorted by
+// datasource.
+func (pp *PrometheusProvider) breakerStates() []BreakerState {
+	seen := map[*circuitBreaker]bool{}
+	var states []BreakerState
+	for _, b := range pp.breakers {
+		if !seen[b] {
+			seen[b] = true
+			states = append(states, b.snapshot())
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Datasource < states[j].Datasource })
+	return states
+}
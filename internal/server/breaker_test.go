@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newCircuitBreaker("prometheus", 2, 30*time.Second, nil)
+	b.now = func() time.Time { return now }
+	down := &statusError{statusCode: http.StatusServiceUnavailable}
+
+	assert.NoError(t, b.allow())
+	b.record(down)
+	assert.Equal(t, BreakerState{Datasource: "prometheus", State: breakerClosed, Failures: 1}, b.snapshot())
+	b.record(&v1.Error{Type: v1.ErrBadData, Msg: "parse error"})
+	assert.Equal(t, 0, b.snapshot().Failures, "PromQL errors come from a healthy backend")
+
+	b.record(down)
+	b.record(context.DeadlineExceeded)
+	assert.Equal(t, breakerOpen, b.snapshot().State)
+	err := b.allow()
+	assert.EqualError(t, err, "datasource prometheus is unavailable after 2 consecutive failures, retrying in 30s")
+	var qe *queryError
+	if assert.ErrorAs(t, err, &qe) {
+		assert.Equal(t, http.StatusServiceUnavailable, qe.status)
+		assert.Equal(t, errCodeUnavailable, qe.code)
+	}
+
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, b.allow(), "a probe is let through after the cooldown")
+	assert.Equal(t, breakerHalfOpen, b.snapshot().State)
+	assert.Error(t, b.allow(), "a single probe is let through")
+	b.record(down)
+	assert.Equal(t, breakerOpen, b.snapshot().State, "a failed probe opens the breaker again")
+	assert.Error(t, b.allow())
+
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, b.allow())
+	b.abort()
+	assert.Equal(t, breakerOpen, b.snapshot().State)
+	assert.NoError(t, b.allow(), "the next query probes after an aborted probe")
+	b.record(nil)
+	assert.Equal(t, BreakerState{Datasource: "prometheus", State: breakerClosed}, b.snapshot())
+
+	var disabled *circuitBreaker
+	assert.NoError(t, disabled.allow())
+}
+
+func TestQueryCircuitBreaker(t *testing.T) {
+	var queries int
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	pp.options.BreakerFailures = 2
+	pp.options.BreakerCooldown = time.Minute
+	pp.options.QueryMaxAttempts = 1
+	pp.breakers = pp.newBreakers()
+
+	for i := 0; i < 2; i++ {
+		w := executeTestGraph(pp, nil)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	}
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"datasource_unavailable"`)
+	assert.Equal(t, 2, queries, "queries fail fast once the breaker is open")
+
+	check := pp.breakerCheck()
+	assert.Equal(t, checkWarn, check.Status)
+	assert.Contains(t, check.Message, "(open after 2 failures)")
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// maxNegativeCacheTTL bounds the negative cache TTL so a recovered backend
+// is not masked for long.
+const maxNegativeCacheTTL = time.Minute
+
+// maxCacheEntries is the number of entries above which expired entries are
+// purged when a new one is added.
+const maxCacheEntries = 1000
+
+type cacheEntry struct {
+	value   model.Value
+	err     error
+	expires time.Time
+}
+
+// resultCache caches negative query results, errors and empty results, for
+// a short time so a persistently broken graph does not hit the provider on
+// every refresh. A nil resultCache caches nothing.
+type resultCache struct {
+	mu          sync.Mutex
+	negativeTTL time.Duration
+	entries     map[string]cacheEntry
+}
+
+// newResultCache returns a cache for negative results, or nil when
+// negativeTTL is not positive.
+func newResultCache(negativeTTL time.Duration) *resultCache {
+	if negativeTTL <= 0 {
+		return nil
+	}
+	if negativeTTL > maxNegativeCacheTTL {
+		negativeTTL = maxNegativeCacheTTL
+	}
+	return &resultCache{negativeTTL: negativeTTL, entries: map[string]cacheEntry{}}
+}
+
+// cacheKey identifies a range query of a tenant. The range is keyed by its
+// duration and step rather than its bounds, which move with every request.
+func cacheKey(tenant string, query string, r v1.Range) string {
+	return fmt.Sprintf("%s|%s|%s|%s", tenant, r.End.Sub(r.Start), r.Step, query)
+}
+
+type fixedRangeKey struct{}
+
+// withFixedRange returns a copy of ctx whose queries are evaluated at a fixed
+// time rather than now, so that their results are cached by their bounds.
+func withFixedRange(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fixedRangeKey{}, true)
+}
+
+// fixedRangeFromContext returns whether the queries of ctx are evaluated at
+// a fixed time.
+func fixedRangeFromContext(ctx context.Context) bool {
+	fixed, _ := ctx.Value(fixedRangeKey{}).(bool)
+	return fixed
+}
+
+// get returns the cached result of key, if any.
+func (c *resultCache) get(key string) (model.Value, error, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, nil, false
+	}
+	return entry.value, entry.err, true
+}
+
+// putNegative caches the result of key when it is an error or an empty
+// result. Errors caused by ctx being done are not cached.
+func (c *resultCache) putNegative(ctx context.Context, key string, value model.Value, err error) {
+	if c == nil || ctx.Err() != nil {
+		return
+	}
+	if _, samples := countSeries(value); err == nil && samples > 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, err: err, expires: now.Add(c.negativeTTL)}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultCacheNegative(t *testing.T) {
+	assert.Nil(t, newResultCache(0))
+	assert.Equal(t, maxNegativeCacheTTL, newResultCache(time.Hour).negativeTTL)
+
+	cache := newResultCache(time.Minute)
+	ctx := context.Background()
+
+	cache.putNegative(ctx, "data", model.Matrix{{Values: []model.SamplePair{{Value: 1}}}}, nil)
+	_, _, ok := cache.get("data")
+	assert.False(t, ok, "results with data are not cached")
+
+	cache.putNegative(ctx, "empty", model.Matrix{}, nil)
+	value, err, ok := cache.get("empty")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, model.Matrix{}, value)
+
+	cache.putNegative(ctx, "error", nil, errors.New("bad_data"))
+	_, err, ok = cache.get("error")
+	assert.True(t, ok)
+	assert.EqualError(t, err, "bad_data")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	cache.putNegative(cancelled, "cancelled", nil, context.Canceled)
+	_, _, ok = cache.get("cancelled")
+	assert.False(t, ok, "errors of cancelled requests are not cached")
+
+	cache.entries["error"] = cacheEntry{err: errors.New("bad_data"), expires: time.Now().Add(-time.Second)}
+	_, _, ok = cache.get("error")
+	assert.False(t, ok, "expired entries are not served")
+}
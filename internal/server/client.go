@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+)
+
+// Prometheus API endpoints whose path can be overridden per provider.
+const (
+	queryEndpoint      = "/api/v1/query"
+	queryRangeEndpoint = "/api/v1/query_range"
+)
+
+// prometheusClient wraps the prometheus api.Client to adapt the outgoing
+// requests to the provider configuration.
+type prometheusClient struct {
+	api.Client
+	// paths maps API endpoints to the path they are served at, relative
+	// to the provider address.
+	paths map[string]string
+	// method is the HTTP method of the queries. The prometheus client
+	// POSTs them, so that long queries do not hit URL length limits, and
+	// falls back to GET when the server rejects the POST. With GET they
+	// are always sent as GET.
+	method string
+	// params are added to the params of every query, e.g. the Thanos
+	// options of a thanos datasource.
+	params url.Values
+}
+
+func newPrometheusClient(client api.Client, config provider) (*prometheusClient, error) {
+	paths := map[string]string{}
+	for endpoint, path := range map[string]string{
+		queryEndpoint:      config.QueryPath,
+		queryRangeEndpoint: config.QueryRangePath,
+	} {
+		if path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q for %s must start with /", path, endpoint)
+		}
+		if _, err := url.Parse(path); err != nil {
+			return nil, fmt.Errorf("invalid path %q for %s: %s", path, endpoint, err)
+		}
+		paths[endpoint] = path
+	}
+	switch config.QueryMethod {
+	case "", http.MethodPost, http.MethodGet:
+	default:
+		return nil, fmt.Errorf("invalid query method %q: must be GET or POST", config.QueryMethod)
+	}
+	switch config.Type {
+	case "", providerTypePrometheus, providerTypeThanos:
+	default:
+		return nil, fmt.Errorf("invalid provider type %q: must be prometheus or thanos", config.Type)
+	}
+	return &prometheusClient{Client: client, paths: paths, method: config.QueryMethod, params: config.queryParams()}, nil
+}
+
+func (c *prometheusClient) URL(ep string, args map[string]string) *url.URL {
+	if path, ok := c.paths[ep]; ok {
+		ep = path
+	}
+	return c.Client.URL(ep, args)
+}
+
+// statusError is returned for upstream responses whose status is handled by
+// the server instead of the prometheus client, such as gateway errors that
+// are worth retrying.
+type statusError struct {
+	statusCode int
+	// retryAfter is the delay a rate limited response asked for with its
+	// Retry-After header, if any.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server error: %d %s", e.statusCode, http.StatusText(e.statusCode))
+}
+
+func (c *prometheusClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	if len(c.params) > 0 && c.isQuery(req) {
+		var err error
+		if req, err = withParams(req, c.params); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.method == http.MethodGet && req.Method == http.MethodPost {
+		var err error
+		if req, err = formToQuery(req); err != nil {
+			return nil, nil, err
+		}
+	}
+	resp, body, err := c.Client.Do(ctx, req)
+	if err != nil {
+		return resp, body, err
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return resp, body, &statusError{statusCode: resp.StatusCode}
+	case http.StatusTooManyRequests:
+		return resp, body, &statusError{statusCode: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	return resp, body, nil
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, either a
+// number of seconds or an HTTP date, or 0 when it is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// isQuery reports whether req is an instant or range query.
+func (c *prometheusClient) isQuery(req *http.Request) bool {
+	return req.URL.Path == c.URL(queryEndpoint, nil).Path || req.URL.Path == c.URL(queryRangeEndpoint, nil).Path
+}
+
+// withParams returns req with params set in its form body, for POST
+// requests, or in its URL query.
+func withParams(req *http.Request, params url.Values) (*http.Request, error) {
+	query := req.URL.Query()
+	if req.Method == http.MethodPost {
+		form, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the query form: %w", err)
+		}
+		if query, err = url.ParseQuery(string(form)); err != nil {
+			return nil, fmt.Errorf("error parsing the query form: %w", err)
+		}
+	}
+	for name, values := range params {
+		query[name] = values
+	}
+	encoded := query.Encode()
+	withParams := req.Clone(req.Context())
+	if req.Method != http.MethodPost {
+		withParams.URL.RawQuery = encoded
+		return withParams, nil
+	}
+	withParams.Body = io.NopCloser(strings.NewReader(encoded))
+	withParams.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(encoded)), nil
+	}
+	withParams.ContentLength = int64(len(encoded))
+	return withParams, nil
+}
+
+// formToQuery returns a GET request sending the form of a POST request as
+// URL query params.
+func formToQuery(req *http.Request) (*http.Request, error) {
+	form, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the query form: %w", err)
+	}
+	get := req.Clone(req.Context())
+	get.Method = http.MethodGet
+	get.URL.RawQuery = string(form)
+	get.Body = nil
+	get.GetBody = nil
+	get.ContentLength = 0
+	get.Header.Del("Content-Type")
+	return get, nil
+}
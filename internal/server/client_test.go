@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusClientPaths(t *testing.T) {
+	client, err := api.NewClient(api.Config{Address: "http://prometheus:9090/proxy"})
+	assert.NoError(t, err)
+
+	promClient, err := newPrometheusClient(client, provider{QueryRangePath: "/range/api/v1/query_range"})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://prometheus:9090/proxy/api/v1/query", promClient.URL(queryEndpoint, nil).String())
+	assert.Equal(t, "http://prometheus:9090/proxy/range/api/v1/query_range", promClient.URL(queryRangeEndpoint, nil).String())
+
+	_, err = newPrometheusClient(client, provider{QueryPath: "api/v1/query"})
+	assert.Error(t, err)
+}
+
+func TestHeaderRoundTripperRedact(t *testing.T) {
+	rt := &headerRoundTripper{secretHeaders: map[string]bool{"X-Api-Key": true}}
+	assert.Equal(t, "[REDACTED]", rt.redact("x-api-key", "secret"))
+	assert.Equal(t, "[REDACTED]", rt.redact("X-API-KEY", []string{"secret"}))
+	assert.Equal(t, "tenant", rt.redact("X-Scope-OrgID", "tenant"))
+}
+
+func TestPrometheusClientQueryMethod(t *testing.T) {
+	tests := []struct {
+		method         string
+		expectedMethod string
+	}{
+		{method: "", expectedMethod: http.MethodPost},
+		{method: http.MethodPost, expectedMethod: http.MethodPost},
+		{method: http.MethodGet, expectedMethod: http.MethodGet},
+	}
+	for _, tt := range tests {
+		var method, query string
+		prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.NoError(t, r.ParseForm())
+			method, query = r.Method, r.Form.Get("query")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+		}))
+		client, err := api.NewClient(api.Config{Address: prometheus.URL})
+		assert.NoError(t, err)
+		promClient, err := newPrometheusClient(client, provider{QueryMethod: tt.method})
+		assert.NoError(t, err)
+
+		_, _, err = v1.NewAPI(promClient).QueryRange(context.Background(), `up{pod=~"a|b"}`, v1.Range{Start: time.Now().Add(-time.Hour), End: time.Now(), Step: time.Minute})
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expectedMethod, method)
+		assert.Equal(t, `up{pod=~"a|b"}`, query)
+		prometheus.Close()
+	}
+
+	client, err := api.NewClient(api.Config{Address: "http://prometheus:9090"})
+	assert.NoError(t, err)
+	_, err = newPrometheusClient(client, provider{QueryMethod: "PUT"})
+	assert.EqualError(t, err, `invalid query method "PUT": must be GET or POST`)
+}
+
+func TestPrometheusClientThanosParams(t *testing.T) {
+	partialResponse := true
+	tests := []struct {
+		name     string
+		config   provider
+		expected url.Values
+	}{
+		{name: "prometheus", config: provider{}, expected: url.Values{}},
+		{
+			name:     "thanos defaults",
+			config:   provider{Type: providerTypeThanos},
+			expected: url.Values{"dedup": {"true"}, "partial_response": {"false"}},
+		},
+		{
+			name: "thanos options",
+			config: provider{Type: providerTypeThanos, QueryMethod: http.MethodGet, Thanos: &ThanosOptions{
+				PartialResponse: &partialResponse,
+				ReplicaLabels:   []string{"replica", "prometheus_replica"},
+			}},
+			expected: url.Values{"dedup": {"true"}, "partial_response": {"true"}, "replicaLabels[]": {"replica", "prometheus_replica"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{}
+			prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, r.ParseForm())
+				for _, name := range []string{"dedup", "partial_response", "replicaLabels[]"} {
+					if values, ok := r.Form[name]; ok {
+						params[name] = values
+					}
+				}
+				assert.Equal(t, "up", r.Form.Get("query"))
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+			}))
+			defer prometheus.Close()
+			client, err := api.NewClient(api.Config{Address: prometheus.URL})
+			assert.NoError(t, err)
+			promClient, err := newPrometheusClient(client, tt.config)
+			assert.NoError(t, err)
+
+			_, _, err = v1.NewAPI(promClient).QueryRange(context.Background(), "up", v1.Range{Start: time.Now().Add(-time.Hour), End: time.Now(), Step: time.Minute})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, params)
+		})
+	}
+
+	client, err := api.NewClient(api.Config{Address: "http://prometheus:9090"})
+	assert.NoError(t, err)
+	_, err = newPrometheusClient(client, provider{Type: "cortex"})
+	assert.EqualError(t, err, `invalid provider type "cortex": must be prometheus or thanos`)
+}
+
+func TestPrometheusBasicAuth(t *testing.T) {
+	var authorization string
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	}))
+	defer prometheus.Close()
+	options := Options{PrometheusBasicAuthUser: "grafana", PrometheusBasicAuthPassword: "s3cret"}
+
+	pp := NewPrometheusProvider(&MetricsConfigProvider{Provider: provider{Address: prometheus.URL}}, logging.NewLogger(), options)
+	assert.NoError(t, pp.init())
+	_, _, err := pp.provider.QueryRange(context.Background(), "up", v1.Range{Start: time.Now().Add(-time.Hour), End: time.Now(), Step: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, "Basic Z3JhZmFuYTpzM2NyZXQ=", authorization)
+	assert.Equal(t, []string{"Authorization"}, pp.authHeaders, "the credentials are redacted in logs")
+
+	pp = NewPrometheusProvider(&MetricsConfigProvider{
+		Provider: provider{Address: prometheus.URL, Headers: map[string]string{"authorization": "Bearer token"}},
+	}, logging.NewLogger(), options)
+	assert.EqualError(t, pp.init(), "basic auth can not be combined with an Authorization header")
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// formatCompact requests graph results in the columnar CompactData format.
+const formatCompact = "compact"
+
+// CompactData is the data of a graph response in the compact format: the
+// label names and the timestamps are listed once for all the series,
+// instead of a label set and [timestamp, "value"] pairs per series.
+type CompactData struct {
+	// Labels are the label names of all the series, sorted.
+	Labels []string `json:"labels"`
+	// Timestamps are the timestamps of all the samples, in seconds since
+	// the epoch, sorted.
+	Timestamps []float64       `json:"timestamps"`
+	Series     []CompactSeries `json:"series"`
+}
+
+// CompactSeries is a series of a CompactData.
+type CompactSeries struct {
+	// Labels holds the value of every label of CompactData.Labels, empty
+	// when the series does not have it.
+	Labels []string `json:"labels"`
+	Legend string   `json:"legend"`
+	// Values holds the value of the series at every timestamp of
+	// CompactData.Timestamps, null when it has no sample at that time or
+	// its value is NaN or infinite.
+	Values []*float64 `json:"values"`
+}
+
+// compactMatrix returns matrix in the compact format, rendering the legend
+// of every series with legendFormat.
+func compactMatrix(matrix model.Matrix, legendFormat string) CompactData {
+	names := map[model.LabelName]bool{}
+	times := map[model.Time]bool{}
+	for _, stream := range matrix {
+		for name := range stream.Metric {
+			names[name] = true
+		}
+		for _, pair := range stream.Values {
+			times[pair.Timestamp] = true
+		}
+	}
+	data := CompactData{Labels: make([]string, 0, len(names)), Timestamps: make([]float64, 0, len(times)), Series: make([]CompactSeries, 0, len(matrix))}
+	for name := range names {
+		data.Labels = append(data.Labels, string(name))
+	}
+	sort.Strings(data.Labels)
+	timestamps := make([]model.Time, 0, len(times))
+	for ts := range times {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	index := make(map[model.Time]int, len(timestamps))
+	for i, ts := range timestamps {
+		index[ts] = i
+		data.Timestamps = append(data.Timestamps, float64(ts)/1000)
+	}
+
+	l := newLegender(legendFormat)
+	for _, stream := range matrix {
+		series := CompactSeries{Labels: make([]string, len(data.Labels)), Legend: l.legend(stream.Metric), Values: make([]*float64, len(timestamps))}
+		for i, name := range data.Labels {
+			series.Labels[i] = string(stream.Metric[model.LabelName(name)])
+		}
+		for _, pair := range stream.Values {
+			value := float64(pair.Value)
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			series.Values[index[pair.Timestamp]] = &value
+		}
+		data.Series = append(data.Series, series)
+	}
+	return data
+}
+
+// setCompactData sets the data of the response to result like setData,
+// series being in the compact format. Vector results are set in the default
+// format.
+func (data *AggregatedResponse) setCompactData(result model.Value, legendFormat string) error {
+	if err := data.setData(result, legendFormat); err != nil {
+		return err
+	}
+	matrix, ok := matrixOf(result)
+	if !ok {
+		return nil
+	}
+	var err error
+	data.Data, err = json.Marshal(compactMatrix(matrix, legendFormat))
+	if err != nil {
+		return fmt.Errorf("error marshaling the data: %s", err)
+	}
+	return nil
+}
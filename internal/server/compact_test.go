@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactMatrix(t *testing.T) {
+	matrix := model.Matrix{
+		{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1700000000000, Value: 1}, {Timestamp: 1700000060000, Value: model.SampleValue(math.NaN())}}},
+		{Metric: model.Metric{"pod": "b", "node": "n1"}, Values: []model.SamplePair{{Timestamp: 1700000060000, Value: 2.5}, {Timestamp: 1700000120000, Value: 3}}},
+	}
+	body, err := json.Marshal(compactMatrix(matrix, "{{ .pod }}"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"labels": ["node", "pod"],
+		"timestamps": [1700000000, 1700000060, 1700000120],
+		"series": [
+			{"labels": ["", "a"], "legend": "a", "values": [1, null, null]},
+			{"labels": ["n1", "b"], "legend": "b", "values": [null, 2.5, 3]}
+		]
+	}`, string(body))
+
+	body, err = json.Marshal(compactMatrix(model.Matrix{}, ""))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"labels": [], "timestamps": [], "series": []}`, string(body))
+}
+
+func TestExecuteCompactFormat(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"},
+		`[{"metric": {"pod": "a"}, "values": [[1700000000, "1"], [1700000060, "2"]]}]`)
+
+	w := executeTestGraph(pp, map[string]string{"format": "compact"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Data       CompactData     `json:"data"`
+		ResultType model.ValueType `json:"resultType"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, model.ValMatrix, response.ResultType)
+	assert.Equal(t, []string{"pod"}, response.Data.Labels)
+	assert.Equal(t, []float64{1700000000, 1700000060}, response.Data.Timestamps)
+	require.Len(t, response.Data.Series, 1)
+	assert.Equal(t, []string{"a"}, response.Data.Series[0].Labels)
+	require.Len(t, response.Data.Series[0].Values, 2)
+	assert.Equal(t, 2.0, *response.Data.Series[0].Values[1])
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// periodLabel labels the series of the previous period of a graph requested
+// with ?compare, set to periodPrevious.
+const (
+	periodLabel    = "period"
+	periodPrevious = "previous"
+)
+
+// comparePeriods are the named periods of ?compare.
+var comparePeriods = map[string]time.Duration{
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// parseComparePeriod parses the period of ?compare: day, week or a
+// duration.
+func parseComparePeriod(value string) (time.Duration, error) {
+	if period, ok := comparePeriods[value]; ok {
+		return period, nil
+	}
+	period, err := parseDuration(value)
+	if err != nil || period <= 0 {
+		return 0, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid compare period %q: must be day, week or a positive duration", value))
+	}
+	return period, nil
+}
+
+type rangeShiftKey struct{}
+
+// withRangeShift returns a copy of ctx whose queries are shifted back by
+// shift, so that their results are cached apart from the unshifted ones.
+func withRangeShift(ctx context.Context, shift time.Duration) context.Context {
+	return context.WithValue(ctx, rangeShiftKey{}, shift)
+}
+
+// rangeShiftFromContext returns how far back the queries of ctx are shifted.
+func rangeShiftFromContext(ctx context.Context) time.Duration {
+	shift, _ := ctx.Value(rangeShiftKey{}).(time.Duration)
+	return shift
+}
+
+// executePreviousPeriod executes the queries of a graph over r shifted back
+// by period, returning their series moved forward by period onto the axis of
+// r and labeled as the previous period.
+func executePreviousPeriod(ctx context.Context, graph *Graph, env map[string][]string, r v1.Range, period time.Duration, pp *PrometheusProvider) (model.Matrix, error) {
+	shifted := v1.Range{Start: r.Start.Add(-period), End: r.End.Add(-period), Step: r.Step}
+	result, warnings, _, err := executeGraphDatasources(withRangeShift(ctx, period), graph, env, shifted, pp)
+	if err != nil {
+		return nil, err
+	}
+	if len(warnings) > 0 {
+		return nil, fmt.Errorf("query warnings: %s", warnings)
+	}
+	matrix, ok := matrixOf(result)
+	if !ok {
+		return nil, fmt.Errorf("previous period comparison requires a matrix result, got %T", result)
+	}
+	if graph.Relabel != nil {
+		matrix = relabelMatrix(matrix, graph.Relabel)
+	}
+	return shiftMatrix(matrix, period), nil
+}
+
+// shiftMatrix returns a copy of matrix whose samples are moved forward by
+// shift, labeled as the previous period.
+func shiftMatrix(matrix model.Matrix, shift time.Duration) model.Matrix {
+	shifted := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		metric := series.Metric.Clone()
+		metric[periodLabel] = periodPrevious
+		values := make([]model.SamplePair, len(series.Values))
+		for i, pair := range series.Values {
+			values[i] = model.SamplePair{Timestamp: pair.Timestamp.Add(shift), Value: pair.Value}
+		}
+		shifted = append(shifted, &model.SampleStream{Metric: metric, Values: values})
+	}
+	return shifted
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseComparePeriod(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{value: "day", expected: 24 * time.Hour},
+		{value: "week", expected: 7 * 24 * time.Hour},
+		{value: "2w", expected: 14 * 24 * time.Hour},
+		{value: "1h", expected: time.Hour},
+		{value: "month", err: true},
+		{value: "-1h", err: true},
+	}
+	for _, tt := range tests {
+		period, err := parseComparePeriod(tt.value)
+		if tt.err {
+			assert.Error(t, err, tt.value)
+			continue
+		}
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.expected, period, tt.value)
+	}
+}
+
+func TestExecuteCompare(t *testing.T) {
+	var ends []float64
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up", Relabel: &Relabel{Drop: []string{"instance"}}}, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		end, err := strconv.ParseFloat(r.Form.Get("end"), 64)
+		require.NoError(t, err)
+		ends = append(ends, end)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a", "instance": "i"}, "values": [[` + r.Form.Get("end") + `, "1"]]}]}}`))
+	})
+
+	w := executeTestGraph(pp, map[string]string{"at": "2023-11-14T22:13:20Z", "compare": "day"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []float64{1700000000, 1700000000 - 86400}, ends)
+	var response AggregatedResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	var previous model.Matrix
+	require.NoError(t, json.Unmarshal(response.Previous, &previous))
+	assert.Equal(t, model.Matrix{{
+		Metric: model.Metric{"pod": "a", periodLabel: periodPrevious},
+		Values: []model.SamplePair{{Timestamp: 1700000000000, Value: 1}},
+	}}, previous, "the previous day is moved onto the axis of the graph")
+
+	w = executeTestGraph(pp, map[string]string{"compare": "month"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
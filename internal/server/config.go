@@ -1,9 +1,16 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 )
 
 type Threshold struct {
@@ -13,6 +20,116 @@ type Threshold struct {
 	Value           string `json:"value"`
 	Unit            string `json:"unit"`
 	QueryExpression string `json:"queryExpression"`
+	// Operator is the comparison the latest graph values are evaluated
+	// against the threshold with: gt (the default), gte, lt or lte.
+	Operator string `json:"operator,omitempty"`
+	// Format formats the breaching value of the threshold, defaulting to
+	// the format of the graph.
+	Format *ValueFormat `json:"format,omitempty"`
+	// Instant runs the query of the threshold at the end of the range of
+	// the graph only, its latest values being returned at every step.
+	// Otherwise Duration, e.g. 15m, bounds the range it is queried over to
+	// the end of the range of the graph, the whole range being queried
+	// when empty.
+	Instant  bool   `json:"instant,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// ValueFormat configures how the latest and threshold values of a graph
+// are formatted for display. The series themselves are left untouched.
+type ValueFormat struct {
+	// Decimals is the number of decimal places, 2 by default.
+	Decimals *int `json:"decimals,omitempty"`
+	// Scale scales values to the prefix of their unit keeping them
+	// readable: si for k, M, G, ... and m, µ, n, or binary for Ki, Mi,
+	// Gi, ... Values in a known bytes or time unit are scaled from B or s.
+	Scale string `json:"scale,omitempty"`
+}
+
+// maxDecimals bounds ValueFormat.Decimals.
+const maxDecimals = 10
+
+func (f *ValueFormat) decimals() int {
+	if f.Decimals == nil {
+		return 2
+	}
+	return *f.Decimals
+}
+
+func (f *ValueFormat) validate() error {
+	if f.Decimals != nil && (*f.Decimals < 0 || *f.Decimals > maxDecimals) {
+		return fmt.Errorf("invalid decimals %d: must be between 0 and %d", *f.Decimals, maxDecimals)
+	}
+	switch f.Scale {
+	case "", scaleSI, scaleBinary:
+		return nil
+	}
+	return fmt.Errorf("invalid scale %q: must be si or binary", f.Scale)
+}
+
+// Baseline configures a query whose series are subtracted from the graph
+// series, producing a "current minus baseline" delta.
+type Baseline struct {
+	QueryExpression string `json:"queryExpression"`
+	// ReplaceData returns the delta series in place of the raw series
+	// instead of alongside them.
+	ReplaceData bool `json:"replaceData"`
+}
+
+// TopN keeps the series of a graph ranked highest, summing the others into
+// a single other series so that high cardinality graphs stay readable.
+type TopN struct {
+	// Count is the number of series kept.
+	Count int `json:"count"`
+	// RankBy is the value series are ranked by: max, the default, last,
+	// avg or sum.
+	RankBy string `json:"rankBy,omitempty"`
+}
+
+// rankBy returns the ranking of the series, max by default.
+func (t *TopN) rankBy() string {
+	if t.RankBy == "" {
+		return rankByMax
+	}
+	return t.RankBy
+}
+
+func (t *TopN) validate() error {
+	if t.Count < 1 {
+		return fmt.Errorf("invalid count %d: must be a positive number of series", t.Count)
+	}
+	if !validRankBy(t.rankBy()) {
+		return fmt.Errorf("invalid rankBy %q: must be max, last, avg or sum", t.RankBy)
+	}
+	return nil
+}
+
+// Relabel configures the labels of the series returned for a graph, e.g. to
+// remove noisy labels from the legend.
+type Relabel struct {
+	// Drop lists the labels removed from the series.
+	Drop []string `json:"drop,omitempty"`
+	// Rename maps label names to the name they are returned as.
+	Rename map[string]string `json:"rename,omitempty"`
+}
+
+// GraphQuery is one of several queries plotted on the same graph. Its series
+// are labeled with the query alias so they can be told apart.
+type GraphQuery struct {
+	Name            string `json:"name"`
+	Legend          string `json:"legend"`
+	QueryExpression string `json:"queryExpression"`
+}
+
+// alias returns the value used to label the series of the query at index i.
+func (q GraphQuery) alias(i int) string {
+	if q.Legend != "" {
+		return q.Legend
+	}
+	if q.Name != "" {
+		return q.Name
+	}
+	return fmt.Sprintf("query%d", i+1)
 }
 
 type Graph struct {
@@ -25,7 +142,61 @@ type Graph struct {
 	Thresholds      []Threshold `json:"thresholds"`
 	QueryExpression string      `json:"queryExpression"`
 	YAxisUnit       string      `json:"yAxisUnit"`
-	ValueRounding   int         `json:"valueRounding"`
+	// DisplayUnit is the unit the series are converted to from YAxisUnit,
+	// e.g. GiB for a graph of a metric in bytes. Both must be known units
+	// of the same dimension.
+	DisplayUnit   string    `json:"displayUnit,omitempty"`
+	ValueRounding int       `json:"valueRounding"`
+	Baseline      *Baseline `json:"baseline,omitempty"`
+	// Annotations are overlaid on the graph as events.
+	Annotations []Annotation `json:"annotations,omitempty"`
+	// Queries takes precedence over QueryExpression when set.
+	Queries []GraphQuery `json:"queries,omitempty"`
+	// Quantiles generates the queries of graphs of the quantile type, in
+	// place of QueryExpression and Queries.
+	Quantiles *Quantiles `json:"quantiles,omitempty"`
+	// Credentials names the credential set the queries of the graph are
+	// sent with, on top of the provider default authentication.
+	Credentials string `json:"credentials,omitempty"`
+	// Datasources names the datasources the queries of the graph are run
+	// against concurrently, instead of the provider. Their series are
+	// merged, labeled with DatasourceLabel, datasource by default, set to
+	// the name of the datasource they come from.
+	Datasources     []string `json:"datasources,omitempty"`
+	DatasourceLabel string   `json:"datasourceLabel,omitempty"`
+	// Step is the resolution of the queries of the graph, as a Go
+	// duration, or auto to scale it with the duration of the request.
+	// Graphs without one use the server default step.
+	Step string `json:"step,omitempty"`
+	// Relabel drops or renames labels of the returned series.
+	Relabel *Relabel `json:"relabel,omitempty"`
+	// TopN keeps the top series of the graph, summing the others into a
+	// single series, unless the request sets ?maxSeries.
+	TopN *TopN `json:"topN,omitempty"`
+	// Gaps configures how the missing steps of the series are returned,
+	// left as is when nil.
+	Gaps *Gaps `json:"gaps,omitempty"`
+	// Format formats the latest values of the series.
+	Format *ValueFormat `json:"format,omitempty"`
+	// LegendFormat is the template of the legend of the series, rendered
+	// against their labels, e.g. {{ .pod }}. Series are labeled with their
+	// full label set when empty.
+	LegendFormat string `json:"legendFormat,omitempty"`
+}
+
+// step returns the configured step of the graph, or 0 if it has none.
+func (g *Graph) step() (time.Duration, error) {
+	if g.Step == "" || g.Step == stepAuto {
+		return 0, nil
+	}
+	step, err := time.ParseDuration(g.Step)
+	if err != nil {
+		return 0, err
+	}
+	if step <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return step, nil
 }
 
 type Row struct {
@@ -52,6 +223,121 @@ type Dashboard struct {
 	Rows         []*Row   `json:"rows"`
 	ProviderType string   `json:"providerType"`
 	Intervals    []string `json:"intervals"`
+	// Default marks the dashboard served for the resources of the
+	// application that have no dashboard of their own.
+	Default bool `json:"default,omitempty"`
+	// QueryOffset shifts the end of the queries of the dashboard back from
+	// now, as a Go duration, e.g. to hide the trailing gap of delayed
+	// remote writes. The server default offset is used when empty.
+	QueryOffset string `json:"queryOffset,omitempty"`
+	// Ranges are the time range presets offered by the dashboard, which
+	// graph requests select with ?range.
+	Ranges []TimeRange `json:"ranges,omitempty"`
+}
+
+// TimeRange is a named time range preset of a dashboard, e.g. "Last 24h".
+type TimeRange struct {
+	Name string `json:"name"`
+	// Duration and Step are Go durations. Graphs use their own step when
+	// the preset has none.
+	Duration string `json:"duration,omitempty"`
+	Step     string `json:"step,omitempty"`
+	// Since starts the range at the beginning of the current day, week or
+	// month in the server timezone instead of Duration before its end,
+	// e.g. for a "Today" preset.
+	Since string `json:"since,omitempty"`
+}
+
+// Calendar periods of TimeRange.Since.
+const (
+	sinceDay   = "day"
+	sinceWeek  = "week"
+	sinceMonth = "month"
+)
+
+// parse returns the duration and step of the preset, the step being 0 when
+// it has none. The duration is 0 for presets with a Since period, which
+// depends on the time of the request.
+func (tr TimeRange) parse() (time.Duration, time.Duration, error) {
+	if tr.Since != "" {
+		if tr.Since != sinceDay && tr.Since != sinceWeek && tr.Since != sinceMonth {
+			return 0, 0, fmt.Errorf("invalid since %q: must be day, week or month", tr.Since)
+		}
+		if tr.Duration != "" {
+			return 0, 0, fmt.Errorf("can not have both a duration and since")
+		}
+		step, err := tr.step()
+		return 0, step, err
+	}
+	duration, err := parseDuration(tr.Duration)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid duration %q: %w", tr.Duration, err)
+	}
+	if duration <= 0 {
+		return 0, 0, fmt.Errorf("invalid duration %q: must be positive", tr.Duration)
+	}
+	step, err := tr.step()
+	if err != nil {
+		return 0, 0, err
+	}
+	return duration, step, nil
+}
+
+// step returns the step of the preset, or 0 when it has none.
+func (tr TimeRange) step() (time.Duration, error) {
+	if tr.Step == "" {
+		return 0, nil
+	}
+	step, err := parseDuration(tr.Step)
+	if err != nil {
+		return 0, fmt.Errorf("invalid step %q: %w", tr.Step, err)
+	}
+	if step <= 0 {
+		return 0, fmt.Errorf("invalid step %q: must be positive", tr.Step)
+	}
+	return step, nil
+}
+
+// periodStart returns the beginning of the calendar period since, i.e. the
+// current day, week or month, of t in loc. Weeks start on Monday.
+func periodStart(t time.Time, since string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	year, month, day := t.Date()
+	switch since {
+	case sinceWeek:
+		monday := day - (int(t.Weekday())+6)%7
+		return time.Date(year, month, monday, 0, 0, 0, 0, loc)
+	case sinceMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	}
+}
+
+// getRange returns the time range preset with the given name, or nil.
+func (d *Dashboard) getRange(name string) *TimeRange {
+	for i := range d.Ranges {
+		if d.Ranges[i].Name == name {
+			return &d.Ranges[i]
+		}
+	}
+	return nil
+}
+
+// queryOffset returns the query offset of the dashboard, or def if it has
+// none.
+func (d *Dashboard) queryOffset(def time.Duration) (time.Duration, error) {
+	if d.QueryOffset == "" {
+		return def, nil
+	}
+	offset, err := time.ParseDuration(d.QueryOffset)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return offset, nil
 }
 
 func (d *Dashboard) getRow(name string) *Row {
@@ -68,45 +354,527 @@ type Application struct {
 	Default          bool         `json:"default"`
 	DefaultDashboard *Dashboard   `json:"defaultDashboard"`
 	Dashboards       []*Dashboard `json:"dashboards"`
+	// ApplicationLabels scopes the queries of the application to its
+	// workload: every entry, e.g. namespace or instance, is set as a
+	// template variable of the queries, taking precedence over the request
+	// query params.
+	ApplicationLabels map[string]string `json:"applicationLabels,omitempty"`
+	// QueryPolicy restricts the metrics and functions the Prometheus
+	// queries of the application may use.
+	QueryPolicy *QueryPolicy `json:"queryPolicy,omitempty"`
+	// EnforcedLabels are set as label matchers on every selector of the
+	// Prometheus queries of the application, e.g. namespace, overriding
+	// the matchers of the same labels the queries have.
+	EnforcedLabels map[string]string `json:"enforcedLabels,omitempty"`
 }
 
+// queryEnv returns the template variables of the queries of the
+// application: env with the application labels set.
+func (a Application) queryEnv(env map[string][]string) map[string][]string {
+	if len(a.ApplicationLabels) == 0 {
+		return env
+	}
+	scoped := make(map[string][]string, len(env)+len(a.ApplicationLabels))
+	for k, v := range env {
+		scoped[k] = v
+	}
+	for k, v := range a.ApplicationLabels {
+		scoped[k] = []string{v}
+	}
+	return scoped
+}
+
+// dashboards returns the dashboards of the application, including the
+// default one.
+func (a Application) dashboards() []*Dashboard {
+	if a.DefaultDashboard == nil {
+		return a.Dashboards
+	}
+	return append([]*Dashboard{a.DefaultDashboard}, a.Dashboards...)
+}
+
+// dashboardNotFound returns the error of a request for the dashboard of
+// groupKind when getDashBoard returns nil: a no_dashboards error when the
+// application has none configured, else a not_found error listing the
+// group kinds of its dashboards.
+func (a Application) dashboardNotFound(groupKind string) *queryError {
+	dashboards := a.dashboards()
+	if len(dashboards) == 0 {
+		return &queryError{status: http.StatusBadRequest, code: errCodeNoDashboards, message: fmt.Sprintf("Application %s has no dashboards configured", a.Name)}
+	}
+	groupKinds := make([]string, 0, len(dashboards))
+	for _, dash := range dashboards {
+		groupKinds = append(groupKinds, dash.GroupKind)
+	}
+	sort.Strings(groupKinds)
+	return &queryError{status: http.StatusBadRequest, code: errCodeNotFound, message: fmt.Sprintf("Requested Dashboard %s not found", groupKind), available: groupKinds}
+}
+
+// getDashBoard returns the dashboard of the resource groupKind: the
+// dashboard with that groupKind, else the dashboard marked as default, else
+// the defaultDashboard of the application. It returns nil when none
+// applies.
 func (a Application) getDashBoard(groupKind string) *Dashboard {
 	for _, dash := range a.Dashboards {
-		fmt.Println(dash.GroupKind, groupKind)
 		if dash.GroupKind == groupKind {
 			return dash
 		}
 	}
+	if a.DefaultDashboard != nil && a.DefaultDashboard.GroupKind == groupKind {
+		return a.DefaultDashboard
+	}
+	for _, dash := range a.Dashboards {
+		if dash.Default {
+			return dash
+		}
+	}
 	return a.DefaultDashboard
 }
 
 type provider struct {
-	Name      string              `json:"name"`
-	Address   string              `json:"address"`
-	Default   bool                `json:"default"`
-	TLSConfig config.TLSConfig    `json:"TLSConfig"`
-	Headers   map[string]string   `json:"headers,omitempty"`
+	Name      string           `json:"name"`
+	Address   string           `json:"address"`
+	Default   bool             `json:"default"`
+	TLSConfig config.TLSConfig `json:"TLSConfig"`
+	// FallbackAddresses are the addresses queries fail over to, in order,
+	// when Address can not be connected to, e.g. the other replica of an
+	// HA Prometheus pair.
+	FallbackAddresses []string `json:"fallbackAddresses,omitempty"`
+	// Headers are sent with every query. Their values are redacted from
+	// logs.
+	Headers map[string]string `json:"headers,omitempty"`
+	// QueryPath and QueryRangePath override the path of the instant and
+	// range query endpoints, relative to Address, for proxies that do not
+	// serve them at the standard /api/v1/query and /api/v1/query_range.
+	QueryPath      string `json:"queryPath,omitempty"`
+	QueryRangePath string `json:"queryRangePath,omitempty"`
+	// QueryMethod is the HTTP method of the queries: POST, the default, or
+	// GET for proxies that do not accept POST queries.
+	QueryMethod string `json:"queryMethod,omitempty"`
+	// SkipTLSVerify disables the verification of the certificate of the
+	// datasource, e.g. for an internal staging Prometheus. The
+	// --skipPrometheusTLSVerify flag applies when unset.
+	SkipTLSVerify *bool `json:"skipTLSVerify,omitempty"`
+	// Type is the kind of the datasource: prometheus, the default, or
+	// thanos for a Thanos Query, whose queries are sent the Thanos options.
+	Type   string         `json:"type,omitempty"`
+	Thanos *ThanosOptions `json:"thanos,omitempty"`
+	// Tenant sends the queries to the tenants of the user, derived from
+	// the identity forwarded by Argo CD, instead of --prometheusOrgID.
+	Tenant *TenantConfig `json:"tenant,omitempty"`
+}
+
+// Types of datasources.
+const (
+	providerTypePrometheus = "prometheus"
+	providerTypeThanos     = "thanos"
+)
+
+// ThanosOptions are the Thanos Query params sent with the queries of a
+// thanos datasource.
+type ThanosOptions struct {
+	// Dedup deduplicates the series of HA Prometheus replicas. Defaults to
+	// true.
+	Dedup *bool `json:"dedup,omitempty"`
+	// PartialResponse returns the data of the available stores when some of
+	// them fail, instead of failing the query. Defaults to false, so that
+	// graphs do not silently show partial data.
+	PartialResponse *bool `json:"partialResponse,omitempty"`
+	// ReplicaLabels overrides the replica labels Thanos Query deduplicates
+	// on.
+	ReplicaLabels []string `json:"replicaLabels,omitempty"`
+}
+
+// queryParams returns the params sent with every query of the datasource,
+// i.e. the Thanos options of a thanos datasource.
+func (p provider) queryParams() url.Values {
+	if p.Type != providerTypeThanos {
+		return nil
+	}
+	options := ThanosOptions{}
+	if p.Thanos != nil {
+		options = *p.Thanos
+	}
+	dedup, partialResponse := true, false
+	if options.Dedup != nil {
+		dedup = *options.Dedup
+	}
+	if options.PartialResponse != nil {
+		partialResponse = *options.PartialResponse
+	}
+	params := url.Values{
+		"dedup":            {strconv.FormatBool(dedup)},
+		"partial_response": {strconv.FormatBool(partialResponse)},
+	}
+	if len(options.ReplicaLabels) > 0 {
+		params["replicaLabels[]"] = options.ReplicaLabels
+	}
+	return params
+}
+
+// skipTLSVerify reports whether the certificate of the datasource is not
+// verified, def applying when the datasource does not say.
+func (p provider) skipTLSVerify(def bool) bool {
+	if p.SkipTLSVerify == nil {
+		return def
+	}
+	return *p.SkipTLSVerify
+}
+
+// Credential is a named set of headers that graphs can send their queries
+// with. Header values are read from environment variables, e.g. populated
+// from a Secret, so they stay out of the config.
+type Credential struct {
+	// HeadersFromEnv maps header names to the environment variable
+	// holding their value.
+	HeadersFromEnv map[string]string `json:"headersFromEnv"`
 }
 
 type MetricsConfigProvider struct {
-	Applications []Application `json:"applications"`
-	Provider     provider      `json:"provider"`
+	Applications []Application         `json:"applications"`
+	Provider     provider              `json:"provider"`
+	Credentials  map[string]Credential `json:"credentials,omitempty"`
+	// Datasources are additional Prometheus instances, e.g. one per
+	// cluster, graphs can query by name along with the provider.
+	Datasources []provider `json:"datasources,omitempty"`
+	// QueryTemplates are named snippets, e.g. a common label selector, the
+	// query expressions of every graph can include with
+	// {{ template "name" . }}.
+	QueryTemplates map[string]string `json:"queryTemplates,omitempty"`
 }
 
+// validateQueryTemplates checks that the query templates parse and do not
+// use the name of the query expression template.
+func (p *MetricsConfigProvider) validateQueryTemplates() []error {
+	names := make([]string, 0, len(p.QueryTemplates))
+	for name := range p.QueryTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if name == "" || name == queryTemplateName {
+			errs = append(errs, fmt.Errorf("query template name %q is not allowed", name))
+			continue
+		}
+		if _, err := parseQueryTemplate("", map[string]string{name: p.QueryTemplates[name]}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// datasourceLabel is the default label identifying the datasource of the
+// series of graphs querying several datasources.
+const datasourceLabel = "datasource"
+
+// validateDatasources checks that the datasources have an address and a
+// unique name, which may not be the name of the provider, and that no
+// fallback address of the provider or datasources is empty.
+func (p *MetricsConfigProvider) validateDatasources() []error {
+	var errs []error
+	names := map[string]bool{p.Provider.Name: p.Provider.Name != ""}
+	for _, ds := range p.Datasources {
+		switch {
+		case ds.Name == "":
+			errs = append(errs, fmt.Errorf("datasource %s: has no name", ds.Address))
+		case names[ds.Name]:
+			errs = append(errs, fmt.Errorf("duplicate datasource %q", ds.Name))
+		case ds.Address == "":
+			errs = append(errs, fmt.Errorf("datasource %s: has no address", ds.Name))
+		}
+		names[ds.Name] = true
+	}
+	for _, ds := range append([]provider{p.Provider}, p.Datasources...) {
+		name := ds.Name
+		if name == "" {
+			name = redactedAddress(ds.Address)
+		}
+		for _, address := range ds.FallbackAddresses {
+			if address == "" {
+				errs = append(errs, fmt.Errorf("datasource %s: has an empty fallback address", name))
+			}
+		}
+	}
+	return errs
+}
+
+// hasDatasource returns whether name is the name of the provider or of one
+// of the datasources.
+func (p *MetricsConfigProvider) hasDatasource(name string) bool {
+	if name == p.Provider.Name {
+		return true
+	}
+	for _, ds := range p.Datasources {
+		if ds.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getApp returns the application named name, else the application marked
+// as default. It returns nil when there is neither.
 func (p *MetricsConfigProvider) getApp(name string) *Application {
-	var defaultApp Application
+	var defaultApp *Application
 	for _, app := range p.Applications {
+		app := app
 		if app.Name == name {
 			return &app
 		}
 		if app.Default {
-			defaultApp = app
+			defaultApp = &app
 		}
 	}
-	return &defaultApp
+	return defaultApp
 }
 
 type O11yConfig struct {
 	Prometheus *MetricsConfigProvider `json:"prometheus"`
 	Wavefront  *MetricsConfigProvider `json:"wavefront"`
 }
+
+// validate checks the consistency of the config and the graph settings
+// that can not be checked by decoding it alone. All the problems found are
+// reported at once.
+func (c *O11yConfig) validate() error {
+	var errs []error
+	for _, providerConfig := range []*MetricsConfigProvider{c.Prometheus, c.Wavefront} {
+		if providerConfig == nil {
+			continue
+		}
+		errs = append(errs, providerConfig.validateDatasources()...)
+		errs = append(errs, providerConfig.validateQueryTemplates()...)
+		for _, app := range providerConfig.Applications {
+			for name := range app.ApplicationLabels {
+				if !model.LabelName(name).IsValid() {
+					errs = append(errs, fmt.Errorf("application %s: invalid application label name %q", app.Name, name))
+				}
+			}
+			if app.QueryPolicy != nil {
+				if err := app.QueryPolicy.validate(); err != nil {
+					errs = append(errs, fmt.Errorf("application %s: query policy: %w", app.Name, err))
+				}
+			}
+			if err := validateEnforcedLabels(app.EnforcedLabels); err != nil {
+				errs = append(errs, fmt.Errorf("application %s: %w", app.Name, err))
+			}
+			defaults := 0
+			for _, dash := range app.dashboards() {
+				errs = append(errs, dash.validate(app.Name)...)
+				if dash.Default {
+					defaults++
+				}
+				for _, row := range dash.Rows {
+					for _, graph := range row.Graphs {
+						for _, name := range graph.Datasources {
+							if name == "" || !providerConfig.hasDatasource(name) {
+								errs = append(errs, fmt.Errorf("application %s, dashboard %s, row %s, graph %s: unknown datasource %q", app.Name, dash.GroupKind, row.Name, graph.Name, name))
+							}
+						}
+					}
+				}
+			}
+			if defaults > 1 {
+				errs = append(errs, fmt.Errorf("application %s: has %d dashboards marked as default", app.Name, defaults))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks that the dashboard has rows with unique names, each with
+// graphs with unique names, and checks the settings of its graphs.
+func (d *Dashboard) validate(appName string) []error {
+	var errs []error
+	prefix := fmt.Sprintf("application %s, dashboard %s", appName, d.GroupKind)
+	if len(d.Rows) == 0 {
+		errs = append(errs, fmt.Errorf("%s: has no rows", prefix))
+	}
+	if _, err := d.queryOffset(0); err != nil {
+		errs = append(errs, fmt.Errorf("%s: invalid query offset %q: %w", prefix, d.QueryOffset, err))
+	}
+	ranges := map[string]bool{}
+	for _, tr := range d.Ranges {
+		if tr.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: range without a name", prefix))
+		} else if ranges[tr.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate range %q", prefix, tr.Name))
+		}
+		ranges[tr.Name] = true
+		if _, _, err := tr.parse(); err != nil {
+			errs = append(errs, fmt.Errorf("%s, range %s: %w", prefix, tr.Name, err))
+		}
+	}
+	rows := map[string]bool{}
+	for _, row := range d.Rows {
+		if rows[row.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate row %q", prefix, row.Name))
+		}
+		rows[row.Name] = true
+		rowPrefix := fmt.Sprintf("%s, row %s", prefix, row.Name)
+		if len(row.Graphs) == 0 {
+			errs = append(errs, fmt.Errorf("%s: has no graphs", rowPrefix))
+		}
+		graphs := map[string]bool{}
+		for _, graph := range row.Graphs {
+			if graphs[graph.Name] {
+				errs = append(errs, fmt.Errorf("%s: duplicate graph %q", rowPrefix, graph.Name))
+			}
+			graphs[graph.Name] = true
+			for _, err := range graph.validate() {
+				errs = append(errs, fmt.Errorf("%s, graph %s: %w", rowPrefix, graph.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkLimits checks the graphs of the config against the limits of the
+// server options, which the config can not be validated against alone.
+func (c *O11yConfig) checkLimits(options Options) error {
+	var errs []error
+	for _, providerConfig := range []*MetricsConfigProvider{c.Prometheus, c.Wavefront} {
+		if providerConfig == nil {
+			continue
+		}
+		for _, app := range providerConfig.Applications {
+			for _, dash := range app.dashboards() {
+				for _, row := range dash.Rows {
+					for _, graph := range row.Graphs {
+						if err := graph.checkThresholds(options.MaxThresholds); err != nil {
+							errs = append(errs, fmt.Errorf("application %s, dashboard %s, row %s, graph %s: %w", app.Name, dash.GroupKind, row.Name, graph.Name, err))
+						}
+					}
+				}
+			}
+		}
+	}
+	if options.StrictThresholdValues {
+		errs = append(errs, c.thresholdValueQueries()...)
+	}
+	return errors.Join(errs...)
+}
+
+// thresholdValueQueries returns an error for every threshold of the config
+// whose value is not a number, and is therefore executed as a query. Such
+// values are rejected with StrictThresholdValues and only warned about
+// otherwise.
+func (c *O11yConfig) thresholdValueQueries() []error {
+	var errs []error
+	for _, providerConfig := range []*MetricsConfigProvider{c.Prometheus, c.Wavefront} {
+		if providerConfig == nil {
+			continue
+		}
+		for _, app := range providerConfig.Applications {
+			for _, dash := range app.dashboards() {
+				for _, row := range dash.Rows {
+					for _, graph := range row.Graphs {
+						for _, threshold := range graph.Thresholds {
+							if _, ok := threshold.literal(); threshold.Value != "" && !ok {
+								errs = append(errs, fmt.Errorf("application %s, dashboard %s, row %s, graph %s: threshold %s value %q is not a number, queries should be set in queryExpression", app.Name, dash.GroupKind, row.Name, graph.Name, threshold.Key, threshold.Value))
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkThresholds returns an error when the graph has more than max
+// thresholds, each of which is a query. Unlimited when max is zero.
+func (g *Graph) checkThresholds(max int) error {
+	if max > 0 && len(g.Thresholds) > max {
+		return fmt.Errorf("has %d thresholds, more than the limit of %d", len(g.Thresholds), max)
+	}
+	return nil
+}
+
+// validate checks the settings of the graph.
+func (g *Graph) validate() []error {
+	var errs []error
+	if _, err := g.step(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid step %q: %w", g.Step, err))
+	}
+	if g.Relabel != nil {
+		for from, to := range g.Relabel.Rename {
+			if !model.LabelName(to).IsValid() {
+				errs = append(errs, fmt.Errorf("can not rename label %s to invalid label name %q", from, to))
+			}
+		}
+	}
+	if g.Format != nil {
+		if err := g.Format.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("format: %w", err))
+		}
+	}
+	if g.TopN != nil {
+		if err := g.TopN.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("topN: %w", err))
+		}
+	}
+	if g.Gaps != nil {
+		if err := g.Gaps.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("gaps: %w", err))
+		}
+	}
+	switch {
+	case g.GraphType == graphTypeQuantile && g.Quantiles == nil:
+		errs = append(errs, fmt.Errorf("quantile graph has no quantiles"))
+	case g.GraphType != graphTypeQuantile && g.Quantiles != nil:
+		errs = append(errs, fmt.Errorf("quantiles are only used by quantile graphs"))
+	case g.Quantiles != nil:
+		if g.QueryExpression != "" || len(g.Queries) > 0 {
+			errs = append(errs, fmt.Errorf("quantile graph has a queryExpression or queries, its queries being generated"))
+		}
+		if err := g.Quantiles.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("quantiles: %w", err))
+		}
+	}
+	if g.DatasourceLabel != "" && !model.LabelName(g.DatasourceLabel).IsValid() {
+		errs = append(errs, fmt.Errorf("invalid datasource label name %q", g.DatasourceLabel))
+	}
+	if g.LegendFormat != "" {
+		if _, err := parseLegendFormat(g.LegendFormat); err != nil {
+			errs = append(errs, fmt.Errorf("invalid legendFormat: %w", err))
+		}
+	}
+	annotations := map[string]bool{}
+	for _, annotation := range g.Annotations {
+		if err := annotation.validate(); err != nil {
+			errs = append(errs, err)
+		} else if annotations[annotation.Name] {
+			errs = append(errs, fmt.Errorf("duplicate annotation %q", annotation.Name))
+		}
+		annotations[annotation.Name] = true
+	}
+	for _, threshold := range g.Thresholds {
+		if threshold.Format != nil {
+			if err := threshold.Format.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("threshold %s format: %w", threshold.Key, err))
+			}
+		}
+		if threshold.Value == "" && threshold.QueryExpression == "" {
+			errs = append(errs, fmt.Errorf("threshold %s has neither a value nor a queryExpression", threshold.Key))
+		}
+		if threshold.Instant || threshold.Duration != "" {
+			if err := threshold.validateRange(); err != nil {
+				errs = append(errs, fmt.Errorf("threshold %s %w", threshold.Key, err))
+			}
+		}
+		if !validOperator(threshold.Operator) {
+			errs = append(errs, fmt.Errorf("threshold %s has an invalid operator %q", threshold.Key, threshold.Operator))
+		}
+		if err := checkUnits(threshold.Unit, g.YAxisUnit); err != nil {
+			errs = append(errs, fmt.Errorf("threshold %s: %w", threshold.Key, err))
+		}
+	}
+	if g.DisplayUnit != "" {
+		if err := checkDisplayUnit(g.YAxisUnit, g.DisplayUnit); err != nil {
+			errs = append(errs, fmt.Errorf("invalid displayUnit: %w", err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphStep(t *testing.T) {
+	options := Options{DefaultStep: time.Minute}
+	tests := []struct {
+		name       string
+		graphStep  string
+		reqStep    time.Duration
+		resolution string
+		duration   time.Duration
+		expected   time.Duration
+	}{
+		{name: "server default", expected: time.Minute},
+		{name: "graph step", graphStep: "5s", expected: 5 * time.Second},
+		{name: "request step overrides graph step", graphStep: "5s", reqStep: 5 * time.Minute, expected: 5 * time.Minute},
+		{name: "step raised to bound the points", graphStep: "5s", duration: 30 * 24 * time.Hour, expected: 236 * time.Second},
+		{name: "request step raised to bound the points", reqStep: time.Second, duration: 24 * time.Hour, expected: 8 * time.Second},
+		{name: "auto graph step", graphStep: "auto", duration: time.Hour, expected: 8 * time.Second},
+		{name: "auto graph step scales with the duration", graphStep: "auto", duration: 7 * 24 * time.Hour, expected: 1210 * time.Second},
+		{name: "auto graph step of short durations", graphStep: "auto", duration: time.Minute, expected: time.Second},
+		{name: "resolution overrides graph step", graphStep: "5s", resolution: resolutionLow, duration: time.Hour, expected: 15 * time.Second},
+		{name: "high resolution", resolution: resolutionHigh, duration: 24 * time.Hour, expected: 87 * time.Second},
+		{name: "request step overrides resolution", reqStep: time.Minute, resolution: resolutionHigh, duration: 24 * time.Hour, expected: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := graphStep(&Graph{Step: tt.graphStep}, graphRequest{step: tt.reqStep, resolution: tt.resolution, duration: tt.duration}, options)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, step)
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	configWithStep := func(step string) *O11yConfig {
+		return &O11yConfig{Prometheus: &MetricsConfigProvider{
+			Applications: []Application{{
+				Name: "app",
+				DefaultDashboard: &Dashboard{
+					GroupKind: "pod",
+					Rows:      []*Row{{Name: "row", Graphs: []*Graph{{Name: "graph", Step: step}}}},
+				},
+			}},
+		}}
+	}
+
+	assert.NoError(t, configWithStep("").validate())
+	assert.NoError(t, configWithStep("30s").validate())
+	assert.ErrorContains(t, configWithStep("fast").validate(), `graph graph: invalid step "fast"`)
+	assert.ErrorContains(t, configWithStep("-1m").validate(), "must be positive")
+}
+
+func TestConfigValidateRelabel(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{
+			Name: "app",
+			DefaultDashboard: &Dashboard{
+				GroupKind: "pod",
+				Rows: []*Row{{Name: "row", Graphs: []*Graph{{
+					Name:    "graph",
+					Relabel: &Relabel{Rename: map[string]string{"job": "my-service"}},
+				}}}},
+			},
+		}},
+	}}
+	assert.ErrorContains(t, config.validate(), `can not rename label job to invalid label name "my-service"`)
+}
+
+func TestConfigValidateConsistency(t *testing.T) {
+	graphs := func(names ...string) []*Graph {
+		var graphs []*Graph
+		for _, name := range names {
+			graphs = append(graphs, &Graph{Name: name})
+		}
+		return graphs
+	}
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{
+			{Name: "valid", DefaultDashboard: &Dashboard{GroupKind: "pod", Rows: []*Row{{Name: "pod", Graphs: graphs("cpu", "memory")}}}},
+			{Name: "app", Dashboards: []*Dashboard{
+				{GroupKind: "deployment"},
+				{GroupKind: "pod", Rows: []*Row{
+					{Name: "pod", Graphs: graphs("cpu", "cpu")},
+					{Name: "container"},
+					{Name: "pod", Graphs: graphs("memory")},
+				}},
+			}},
+		},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"application app, dashboard deployment: has no rows",
+		`application app, dashboard pod, row pod: duplicate graph "cpu"`,
+		"application app, dashboard pod, row container: has no graphs",
+		`application app, dashboard pod: duplicate row "pod"`,
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestDashboardQueryOffset(t *testing.T) {
+	offset, err := (&Dashboard{}).queryOffset(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, offset, "the default offset is used when the dashboard has none")
+
+	offset, err = (&Dashboard{QueryOffset: "30s"}).queryOffset(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, offset)
+
+	_, err = (&Dashboard{QueryOffset: "-30s"}).queryOffset(time.Minute)
+	assert.EqualError(t, err, "must not be negative")
+}
+
+func TestGetDashBoard(t *testing.T) {
+	deployment := &Dashboard{GroupKind: "deployment"}
+	workload := &Dashboard{GroupKind: "workload", Default: true}
+	fallback := &Dashboard{GroupKind: "pod"}
+
+	tests := []struct {
+		name      string
+		app       Application
+		groupKind string
+		expected  *Dashboard
+	}{
+		{name: "exact match", app: Application{Dashboards: []*Dashboard{deployment, workload}, DefaultDashboard: fallback}, groupKind: "deployment", expected: deployment},
+		{name: "exact match of the default dashboard", app: Application{Dashboards: []*Dashboard{deployment, workload}, DefaultDashboard: fallback}, groupKind: "pod", expected: fallback},
+		{name: "dashboard marked as default", app: Application{Dashboards: []*Dashboard{deployment, workload}, DefaultDashboard: fallback}, groupKind: "statefulset", expected: workload},
+		{name: "default dashboard", app: Application{Dashboards: []*Dashboard{deployment}, DefaultDashboard: fallback}, groupKind: "statefulset", expected: fallback},
+		{name: "no match", app: Application{Dashboards: []*Dashboard{deployment}}, groupKind: "statefulset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Same(t, tt.expected, tt.app.getDashBoard(tt.groupKind))
+		})
+	}
+}
+
+func TestDashboardNotFound(t *testing.T) {
+	empty := Application{Name: "shop"}
+	err := empty.dashboardNotFound("deployment")
+	assert.Equal(t, errCodeNoDashboards, err.code)
+	assert.Equal(t, "Application shop has no dashboards configured", err.message)
+	assert.Empty(t, err.available)
+
+	app := Application{Name: "shop", Dashboards: []*Dashboard{{GroupKind: "pod"}, {GroupKind: "deployment"}}, DefaultDashboard: &Dashboard{GroupKind: "workload"}}
+	err = app.dashboardNotFound("statefulset")
+	assert.Equal(t, errCodeNotFound, err.code)
+	assert.Equal(t, "Requested Dashboard statefulset not found", err.message)
+	assert.Equal(t, []string{"deployment", "pod", "workload"}, err.available)
+}
+
+func TestConfigValidateDefaultDashboards(t *testing.T) {
+	rows := []*Row{{Name: "pod", Graphs: []*Graph{{Name: "cpu"}}}}
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", Dashboards: []*Dashboard{
+			{GroupKind: "deployment", Default: true, Rows: rows},
+			{GroupKind: "statefulset", Default: true, Rows: rows},
+		}}},
+	}}
+	assert.EqualError(t, config.validate(), "application app: has 2 dashboards marked as default")
+}
+
+func TestConfigValidateRanges(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows:      []*Row{{Name: "pod", Graphs: []*Graph{{Name: "cpu"}}}},
+			Ranges: []TimeRange{
+				{Name: "Last 15m", Duration: "15m"},
+				{Name: "Last 24h", Duration: "24h", Step: "5m"},
+				{Name: "Last 24h", Duration: "1d"},
+				{Name: "Last month", Duration: "1mo"},
+				{Duration: "1h", Step: "-1m"},
+				{Name: "Today", Since: "day", Step: "5m"},
+				{Name: "This year", Since: "year"},
+				{Name: "Yesterday", Since: "day", Duration: "24h"},
+			},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		`application app, dashboard pod: duplicate range "Last 24h"`,
+		`application app, dashboard pod, range Last month: invalid duration "1mo": must be a duration such as 30m, 12h or 7d`,
+		"application app, dashboard pod: range without a name",
+		`application app, dashboard pod, range : invalid step "-1m": must be positive`,
+		`application app, dashboard pod, range This year: invalid since "year": must be day, week or month`,
+		"application app, dashboard pod, range Yesterday: can not have both a duration and since",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestApplicationQueryEnv(t *testing.T) {
+	env := map[string][]string{"namespace": {"other"}, "pod": {"web-0"}}
+	app := Application{Name: "shop", ApplicationLabels: map[string]string{"namespace": "shop", "instance": "shop-web"}}
+	assert.Equal(t, map[string][]string{
+		"namespace": {"shop"},
+		"instance":  {"shop-web"},
+		"pod":       {"web-0"},
+	}, app.queryEnv(env))
+	assert.Equal(t, []string{"other"}, env["namespace"], "the request env is left untouched")
+
+	assert.Equal(t, env, Application{Name: "shop"}.queryEnv(env))
+}
+
+func TestConfigValidateApplicationLabels(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{
+			Name:              "shop",
+			ApplicationLabels: map[string]string{"app.kubernetes.io/instance": "shop"},
+			DefaultDashboard:  &Dashboard{GroupKind: "pod", Rows: []*Row{{Name: "pod", Graphs: []*Graph{{Name: "cpu"}}}}},
+		}},
+	}}
+	assert.EqualError(t, config.validate(), `application shop: invalid application label name "app.kubernetes.io/instance"`)
+}
+
+func TestConfigValidateQueryTemplates(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		QueryTemplates: map[string]string{"selector": `namespace="{{ .namespace }}"`, "query": "up", "broken": "{{ .pod"},
+	}}
+	err := config.validate()
+	assert.ErrorContains(t, err, "error parsing query template broken")
+	assert.ErrorContains(t, err, `query template name "query" is not allowed`)
+	assert.NotContains(t, err.Error(), "selector")
+}
+
+func TestConfigValidateFormat(t *testing.T) {
+	decimals := -1
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{{
+				Name:       "memory",
+				Format:     &ValueFormat{Scale: "iec"},
+				Thresholds: []Threshold{{Key: "max", Value: "1", Format: &ValueFormat{Decimals: &decimals}}},
+			}}}},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		`application app, dashboard pod, row pod, graph memory: format: invalid scale "iec": must be si or binary`,
+		"application app, dashboard pod, row pod, graph memory: threshold max format: invalid decimals -1: must be between 0 and 10",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestConfigValidateDisplayUnit(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{
+				{Name: "memory", YAxisUnit: "B", DisplayUnit: "GiB"},
+				{Name: "latency", YAxisUnit: "s", DisplayUnit: "GiB"},
+				{Name: "requests", YAxisUnit: "requests", DisplayUnit: "ms"},
+			}}},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"application app, dashboard pod, row pod, graph latency: invalid displayUnit: can not convert s to GiB",
+		`application app, dashboard pod, row pod, graph requests: invalid displayUnit: can not convert unknown unit "requests" to ms`,
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestConfigValidateSeriesOptions(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{
+				{Name: "errors", Gaps: &Gaps{Mode: gapsValue}, TopN: &TopN{Count: 5, RankBy: rankBySum}},
+				{Name: "latency", Gaps: &Gaps{Mode: "zero"}},
+				{Name: "requests", Gaps: &Gaps{Mode: gapsConnect, Value: 1}},
+				{Name: "pods", TopN: &TopN{Count: 0}},
+				{Name: "containers", TopN: &TopN{Count: 5, RankBy: "min"}},
+			}}},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		`application app, dashboard pod, row pod, graph latency: gaps: invalid mode "zero": must be leave, null, connect or value`,
+		"application app, dashboard pod, row pod, graph requests: gaps: value 1 is only used in value mode",
+		"application app, dashboard pod, row pod, graph pods: topN: invalid count 0: must be a positive number of series",
+		`application app, dashboard pod, row pod, graph containers: topN: invalid rankBy "min": must be max, last, avg or sum`,
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestConfigValidateThresholdValue(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{{
+				Name: "cpu",
+				Thresholds: []Threshold{
+					{Key: "literal", Value: " 0.8 "},
+					{Key: "query", QueryExpression: "cpu_limit"},
+					{Key: "expression", Value: "cpu_limit * 0.8"},
+					{Key: "empty"},
+					{Key: "instant", QueryExpression: "cpu_limit", Instant: true},
+					{Key: "recent", QueryExpression: "cpu_limit", Duration: "15m"},
+					{Key: "both", QueryExpression: "cpu_limit", Instant: true, Duration: "15m"},
+					{Key: "negative", QueryExpression: "cpu_limit", Duration: "-15m"},
+					{Key: "constant", Value: "0.8", Instant: true},
+				},
+			}}}},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"application app, dashboard pod, row pod, graph cpu: threshold empty has neither a value nor a queryExpression",
+		"application app, dashboard pod, row pod, graph cpu: threshold both can not be both instant and set a duration",
+		`application app, dashboard pod, row pod, graph cpu: threshold negative has an invalid duration "-15m": must be a positive duration`,
+		"application app, dashboard pod, row pod, graph cpu: threshold constant has a value, which is not queried, and can not be instant nor set a duration",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestConfigStrictThresholdValues(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{{
+				Name: "cpu",
+				Thresholds: []Threshold{
+					{Key: "literal", Value: "0.8"},
+					{Key: "query", QueryExpression: "cpu_limit"},
+					{Key: "expression", Value: "cpu_limit * 0.8"},
+				},
+			}}}},
+		}}},
+	}}
+	assert.NoError(t, config.validate())
+	assert.NoError(t, config.checkLimits(Options{}), "threshold values that are not numbers are only warned about by default")
+	expected := `application app, dashboard pod, row pod, graph cpu: threshold expression value "cpu_limit * 0.8" is not a number, queries should be set in queryExpression`
+	assert.EqualError(t, errors.Join(config.thresholdValueQueries()...), expected)
+	assert.EqualError(t, config.checkLimits(Options{StrictThresholdValues: true}), expected)
+}
+
+func TestConfigValidateAnnotations(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{{
+				Name: "cpu",
+				Annotations: []Annotation{
+					{Name: "alerts", QueryExpression: "ALERTS", TextFormat: "{{ .alertname }}"},
+					{Name: "alerts", QueryExpression: "ALERTS"},
+					{QueryExpression: "ALERTS"},
+					{Name: "deployments"},
+					{Name: "restarts", QueryExpression: "changes(up[1m])", TextFormat: "{{ .pod"},
+				},
+			}}}},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		`application app, dashboard pod, row pod, graph cpu: duplicate annotation "alerts"`,
+		"application app, dashboard pod, row pod, graph cpu: annotation must have a name",
+		"application app, dashboard pod, row pod, graph cpu: annotation deployments must have a queryExpression",
+		`application app, dashboard pod, row pod, graph cpu: annotation restarts has an invalid textFormat: template: legend:1: unclosed action`,
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestConfigCheckLimits(t *testing.T) {
+	thresholds := func(n int) []Threshold {
+		return make([]Threshold, n)
+	}
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{
+				{Name: "cpu", Thresholds: thresholds(2)},
+				{Name: "memory", Thresholds: thresholds(3)},
+			}}},
+		}}},
+	}}
+	assert.NoError(t, config.checkLimits(Options{}), "thresholds are unlimited by default")
+	assert.NoError(t, config.checkLimits(Options{MaxThresholds: 3}))
+	assert.EqualError(t, config.checkLimits(Options{MaxThresholds: 2}), "application app, dashboard pod, row pod, graph memory: has 3 thresholds, more than the limit of 2")
+}
+
+func TestPeriodStart(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.NoError(t, err)
+	// Wednesday 2024-05-15 23:30 UTC is Thursday 01:30 in Paris.
+	now := time.Date(2024, 5, 15, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		since    string
+		loc      *time.Location
+		expected time.Time
+	}{
+		{since: sinceDay, loc: time.UTC, expected: time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)},
+		{since: sinceDay, loc: paris, expected: time.Date(2024, 5, 16, 0, 0, 0, 0, paris)},
+		{since: sinceWeek, loc: time.UTC, expected: time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)},
+		{since: sinceMonth, loc: paris, expected: time.Date(2024, 5, 1, 0, 0, 0, 0, paris)},
+	}
+	for _, tt := range tests {
+		assert.True(t, tt.expected.Equal(periodStart(now, tt.since, tt.loc)), "%s in %s", tt.since, tt.loc)
+	}
+	sunday := time.Date(2024, 5, 19, 12, 0, 0, 0, time.UTC)
+	assert.True(t, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC).Equal(periodStart(sunday, sinceWeek, time.UTC)), "weeks start on Monday")
+}
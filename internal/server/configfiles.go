@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// configFiles returns the configuration files of paths, in order: the
+// files themselves and the .json files of the directories, sorted by name.
+// Hidden entries are skipped, such as the ..data directory of a mounted
+// ConfigMap.
+func configFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the configuration: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the configuration: %w", err)
+		}
+		found := false
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+				continue
+			}
+			file := filepath.Join(path, name)
+			if info, err := os.Stat(file); err != nil || info.IsDir() {
+				continue
+			}
+			files = append(files, file)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("error reading the configuration: no .json file in directory %s", path)
+		}
+	}
+	return files, nil
+}
+
+// readConfigFiles reads the configuration files of paths and merges them
+// into a single configuration.
+func readConfigFiles(paths []string) (O11yConfig, error) {
+	files, err := configFiles(paths)
+	if err != nil {
+		return O11yConfig{}, err
+	}
+	var config O11yConfig
+	var errs []error
+	sources := configSources{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return config, fmt.Errorf("error reading the configuration: %w", err)
+		}
+		var fileConfig O11yConfig
+		if err := json.Unmarshal(data, &fileConfig); err != nil {
+			return config, fmt.Errorf("error parsing the configuration %s: %w", file, err)
+		}
+		errs = append(errs, sources.merge(&config.Prometheus, fileConfig.Prometheus, "prometheus", file)...)
+		errs = append(errs, sources.merge(&config.Wavefront, fileConfig.Wavefront, "wavefront", file)...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return config, fmt.Errorf("error merging the configuration files: %w", err)
+	}
+	return config, nil
+}
+
+// configSources records the file every merged setting comes from, keyed by
+// its path in the configuration, to name both files of a conflict.
+type configSources map[string]string
+
+// set records that key is set by file, returning an error naming the other
+// file already setting it, if any.
+func (s configSources) set(key string, file string) error {
+	if previous, ok := s[key]; ok && previous != file {
+		return fmt.Errorf("%s is set in both %s and %s", key, previous, file)
+	}
+	s[key] = file
+	return nil
+}
+
+// merge merges the provider configuration of a file into dst. The provider
+// and every credential and query template set must be defined by a single
+// file, datasources and applications being appended. Applications defined
+// by several files have their dashboards merged, a group kind having a
+// single dashboard.
+func (s configSources) merge(dst **MetricsConfigProvider, src *MetricsConfigProvider, name string, file string) []error {
+	if src == nil {
+		return nil
+	}
+	if *dst == nil {
+		*dst = &MetricsConfigProvider{}
+	}
+	config := *dst
+	var errs []error
+	if !reflect.DeepEqual(src.Provider, provider{}) {
+		if err := s.set(name+".provider", file); err != nil {
+			errs = append(errs, err)
+		} else {
+			config.Provider = src.Provider
+		}
+	}
+	for credName, cred := range src.Credentials {
+		if err := s.set(fmt.Sprintf("%s.credentials %s", name, credName), file); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if config.Credentials == nil {
+			config.Credentials = map[string]Credential{}
+		}
+		config.Credentials[credName] = cred
+	}
+	for templateName, body := range src.QueryTemplates {
+		if err := s.set(fmt.Sprintf("%s.queryTemplates %s", name, templateName), file); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if config.QueryTemplates == nil {
+			config.QueryTemplates = map[string]string{}
+		}
+		config.QueryTemplates[templateName] = body
+	}
+	config.Datasources = append(config.Datasources, src.Datasources...)
+	for _, app := range src.Applications {
+		errs = append(errs, s.mergeApplication(config, app, name, file)...)
+	}
+	return errs
+}
+
+// mergeApplication merges an application of a file into config.
+func (s configSources) mergeApplication(config *MetricsConfigProvider, app Application, name string, file string) []error {
+	var errs []error
+	prefix := fmt.Sprintf("%s application %s", name, app.Name)
+	for _, dash := range app.dashboards() {
+		if err := s.set(fmt.Sprintf("%s dashboard %s", prefix, dash.GroupKind), file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Applications are only merged across files, a file defining the same
+	// application twice being left as is.
+	var existing *Application
+	if previous, ok := s[prefix]; ok && previous != file {
+		for i := range config.Applications {
+			if config.Applications[i].Name == app.Name {
+				existing = &config.Applications[i]
+				break
+			}
+		}
+	}
+	if existing == nil {
+		config.Applications = append(config.Applications, app)
+		if _, ok := s[prefix]; !ok {
+			s[prefix] = file
+			s.setApplication(prefix, app, file)
+		}
+		return errs
+	}
+	if app.DefaultDashboard != nil {
+		if err := s.set(prefix+" defaultDashboard", file); err != nil {
+			errs = append(errs, err)
+		} else {
+			existing.DefaultDashboard = app.DefaultDashboard
+		}
+	}
+	if app.ApplicationLabels != nil {
+		if err := s.set(prefix+" applicationLabels", file); err != nil {
+			errs = append(errs, err)
+		} else {
+			existing.ApplicationLabels = app.ApplicationLabels
+		}
+	}
+	if app.QueryPolicy != nil {
+		if err := s.set(prefix+" queryPolicy", file); err != nil {
+			errs = append(errs, err)
+		} else {
+			existing.QueryPolicy = app.QueryPolicy
+		}
+	}
+	if app.EnforcedLabels != nil {
+		if err := s.set(prefix+" enforcedLabels", file); err != nil {
+			errs = append(errs, err)
+		} else {
+			existing.EnforcedLabels = app.EnforcedLabels
+		}
+	}
+	existing.Default = existing.Default || app.Default
+	existing.Dashboards = append(existing.Dashboards, app.Dashboards...)
+	return errs
+}
+
+// setApplication records the settings of an application first defined by
+// file.
+func (s configSources) setApplication(prefix string, app Application, file string) {
+	if app.DefaultDashboard != nil {
+		s[prefix+" defaultDashboard"] = file
+	}
+	if app.ApplicationLabels != nil {
+		s[prefix+" applicationLabels"] = file
+	}
+	if app.QueryPolicy != nil {
+		s[prefix+" queryPolicy"] = file
+	}
+	if app.EnforcedLabels != nil {
+		s[prefix+" enforcedLabels"] = file
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFiles writes the given configuration files to a new directory,
+// returning its path.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	return dir
+}
+
+func TestLoadConfigDirectory(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"provider.json": `{"prometheus": {"provider": {"address": "http://prometheus:9090"}}}`,
+		"team-a.json": `{"prometheus": {"applications": [{"name": "shop",
+			"applicationLabels": {"namespace": "shop"},
+			"dashboards": [{"groupKind": "pod", "rows": [{"name": "row", "graphs": [{"name": "cpu"}]}]}]
+		}]}}`,
+		"team-b.json": `{"prometheus": {"applications": [
+			{"name": "shop", "dashboards": [{"groupKind": "deployment", "rows": [{"name": "row", "graphs": [{"name": "cpu"}]}]}]},
+			{"name": "billing", "dashboards": [{"groupKind": "pod", "rows": [{"name": "row", "graphs": [{"name": "cpu"}]}]}]}
+		]}}`,
+		"README.md":           "not a configuration file",
+		"..data/ignored.json": `{"prometheus": {"provider": {"address": "http://other:9090"}}}`,
+		".hidden-old.json":    `not json`,
+	})
+
+	config, err := loadConfig([]string{dir}, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://prometheus:9090", config.Prometheus.Provider.Address)
+	assert.Len(t, config.Prometheus.Applications, 2)
+	shop := config.Prometheus.getApp("shop")
+	assert.Equal(t, map[string]string{"namespace": "shop"}, shop.ApplicationLabels)
+	assert.NotNil(t, shop.getDashBoard("pod"))
+	assert.NotNil(t, shop.getDashBoard("deployment"), "the dashboards of an application are merged across files")
+	assert.Equal(t, "billing", config.Prometheus.Applications[1].Name)
+
+	single := filepath.Join(dir, "provider.json")
+	extra := writeConfigFiles(t, map[string]string{"apps.json": `{"prometheus": {"applications": [{"name": "app", "dashboards": [{"groupKind": "pod", "rows": [{"name": "row", "graphs": [{"name": "cpu"}]}]}]}]}}`})
+	config, err = loadConfig([]string{single, filepath.Join(extra, "apps.json")}, Options{})
+	assert.NoError(t, err, "files can be listed one by one")
+	assert.Equal(t, "app", config.Prometheus.Applications[0].Name)
+}
+
+func TestLoadConfigConflicts(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.json": `{"prometheus": {
+			"provider": {"address": "http://prometheus:9090"},
+			"queryTemplates": {"selector": "namespace=\"shop\""},
+			"applications": [{"name": "shop", "queryPolicy": {"functions": ["rate"]},
+				"dashboards": [{"groupKind": "pod", "rows": [{"name": "row", "graphs": [{"name": "cpu"}]}]}]}]
+		}}`,
+		"b.json": `{"prometheus": {
+			"provider": {"address": "http://thanos:9090"},
+			"queryTemplates": {"selector": "namespace=\"demo\""},
+			"applications": [{"name": "shop", "queryPolicy": {"functions": ["sum"]},
+				"dashboards": [{"groupKind": "pod", "rows": [{"name": "row", "graphs": [{"name": "memory"}]}]}]}]
+		}}`,
+	})
+	a, b := filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json")
+
+	_, err := loadConfig([]string{dir}, Options{})
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"error merging the configuration files: prometheus.provider is set in both " + a + " and " + b,
+		"prometheus.queryTemplates selector is set in both " + a + " and " + b,
+		"prometheus application shop dashboard pod is set in both " + a + " and " + b,
+		"prometheus application shop queryPolicy is set in both " + a + " and " + b,
+	}, strings.Split(err.Error(), "\n"))
+
+	_, err = loadConfig([]string{writeConfigFiles(t, nil)}, Options{})
+	assert.ErrorContains(t, err, "no .json file in directory")
+
+	_, err = loadConfig([]string{filepath.Join(dir, "missing.json")}, Options{})
+	assert.ErrorContains(t, err, "error reading the configuration")
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedValue replaces the secret values of the configuration served by
+// GET /api/config.
+const redactedValue = "<redacted>"
+
+// redacted returns a copy of the configuration without secrets, for
+// operators to check the configuration the server runs with.
+func (c O11yConfig) redacted() O11yConfig {
+	return O11yConfig{Prometheus: c.Prometheus.redacted(), Wavefront: c.Wavefront.redacted()}
+}
+
+// redacted returns a copy of the provider configuration with the header
+// values and the address passwords of its datasources redacted. Private
+// keys of TLSConfig are redacted when marshaled. Credentials only name the
+// environment variables holding the secrets, which are kept.
+func (p *MetricsConfigProvider) redacted() *MetricsConfigProvider {
+	if p == nil {
+		return nil
+	}
+	config := *p
+	config.Provider = p.Provider.redacted()
+	config.Datasources = make([]provider, len(p.Datasources))
+	for i, datasource := range p.Datasources {
+		config.Datasources[i] = datasource.redacted()
+	}
+	return &config
+}
+
+// redacted returns a copy of the datasource with its header values and the
+// password of its addresses redacted.
+func (p provider) redacted() provider {
+	if len(p.Headers) > 0 {
+		headers := make(map[string]string, len(p.Headers))
+		for name := range p.Headers {
+			headers[name] = redactedValue
+		}
+		p.Headers = headers
+	}
+	p.Address = redactedAddress(p.Address)
+	if len(p.FallbackAddresses) > 0 {
+		addresses := make([]string, len(p.FallbackAddresses))
+		for i, address := range p.FallbackAddresses {
+			addresses[i] = redactedAddress(address)
+		}
+		p.FallbackAddresses = addresses
+	}
+	return p
+}
+
+// effectiveConfig returns the configuration the server is serving, once
+// merged and expanded, with its secrets redacted.
+func (ms *O11yServer) effectiveConfig(ctx *gin.Context) {
+	ms.mu.RLock()
+	config := ms.config.redacted()
+	ms.mu.RUnlock()
+	ctx.JSON(http.StatusOK, config)
+}
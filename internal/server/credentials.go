@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// graphCredentials holds the resolved headers of a named credential set.
+type graphCredentials struct {
+	name    string
+	headers map[string]string
+}
+
+type credentialsKey struct{}
+
+// withCredentials returns a copy of ctx whose queries are sent with the
+// headers of creds.
+func withCredentials(ctx context.Context, creds *graphCredentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, creds)
+}
+
+// credentialsFromContext returns the credentials the queries of ctx are sent
+// with, or nil for the provider default ones.
+func credentialsFromContext(ctx context.Context) *graphCredentials {
+	creds, _ := ctx.Value(credentialsKey{}).(*graphCredentials)
+	return creds
+}
+
+// resolveCredentials reads the header values of the credential sets of the
+// config from the environment, and checks that every credential set
+// referenced by a graph is defined.
+func resolveCredentials(config *MetricsConfigProvider) (map[string]*graphCredentials, error) {
+	resolved := make(map[string]*graphCredentials, len(config.Credentials))
+	for name, credential := range config.Credentials {
+		creds := &graphCredentials{name: name, headers: make(map[string]string, len(credential.HeadersFromEnv))}
+		for header, envName := range credential.HeadersFromEnv {
+			value, ok := os.LookupEnv(envName)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("credentials %s: environment variable %s for header %s is not set", name, envName, header)
+			}
+			creds.headers[header] = value
+		}
+		resolved[name] = creds
+	}
+
+	var missing []string
+	for _, app := range config.Applications {
+		for _, dashboard := range app.dashboards() {
+			for _, row := range dashboard.Rows {
+				for _, graph := range row.Graphs {
+					if graph.Credentials != "" && resolved[graph.Credentials] == nil {
+						missing = append(missing, fmt.Sprintf("%s/%s/%s/%s: %s", app.Name, dashboard.GroupKind, row.Name, graph.Name, graph.Credentials))
+					}
+				}
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("graphs reference undefined credentials: %v", missing)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveCredentials(t *testing.T) {
+	t.Setenv("TEAM_A_APIKEY", "secret")
+	config := &MetricsConfigProvider{
+		Credentials: map[string]Credential{
+			"team-a": {HeadersFromEnv: map[string]string{"apikey": "TEAM_A_APIKEY"}},
+		},
+		Applications: []Application{
+			{Name: "app", Dashboards: []*Dashboard{{GroupKind: "pod", Rows: []*Row{{Name: "row", Graphs: []*Graph{{Name: "graph", Credentials: "team-a"}}}}}}},
+		},
+	}
+	credentials, err := resolveCredentials(config)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"apikey": "secret"}, credentials["team-a"].headers)
+
+	config.Applications[0].Dashboards[0].Rows[0].Graphs[0].Credentials = "team-b"
+	_, err = resolveCredentials(config)
+	assert.ErrorContains(t, err, "app/pod/row/graph: team-b")
+
+	config.Credentials["team-c"] = Credential{HeadersFromEnv: map[string]string{"apikey": "TEAM_C_APIKEY"}}
+	_, err = resolveCredentials(config)
+	assert.ErrorContains(t, err, "TEAM_C_APIKEY")
+}
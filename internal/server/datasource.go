@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+type datasourceKey struct{}
+
+// withDatasource returns a copy of ctx whose queries are sent to the named
+// datasource.
+func withDatasource(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, datasourceKey{}, name)
+}
+
+// datasourceFromContext returns the datasource the queries of ctx are sent
+// to, or an empty string for the provider.
+func datasourceFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(datasourceKey{}).(string)
+	return name
+}
+
+// api returns the client of the datasource the queries of ctx are sent to.
+func (pp *PrometheusProvider) api(ctx context.Context) (v1.API, error) {
+	name := datasourceFromContext(ctx)
+	if name == "" {
+		return pp.provider, nil
+	}
+	client, ok := pp.datasources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown datasource %s", name)
+	}
+	return client, nil
+}
+
+// datasourceName returns the name of the datasource the queries of ctx are
+// sent to, as reported in the diagnostics.
+func (pp *PrometheusProvider) datasourceName(ctx context.Context) string {
+	if name := datasourceFromContext(ctx); name != "" {
+		return name
+	}
+	return pp.providerName()
+}
+
+// executeGraphDatasources executes the queries of a graph against each of
+// its datasources concurrently, or against the provider when it has none.
+// The series of the datasources are merged into a single matrix, labeled
+// with the datasource they come from. Datasources failing while others
+// succeed are reported in the returned failures rather than failing the
+// graph; the graph fails when they all do.
+func executeGraphDatasources(ctx context.Context, graph *Graph, env map[string][]string, r v1.Range, pp *PrometheusProvider) (model.Value, v1.Warnings, []string, error) {
+	if len(graph.Datasources) == 0 {
+		result, warnings, err := executeGraphQueries(ctx, graph, env, r, pp)
+		return result, warnings, nil, err
+	}
+
+	results := make([]model.Value, len(graph.Datasources))
+	errs := make([]error, len(graph.Datasources))
+	var wg sync.WaitGroup
+	for i, name := range graph.Datasources {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i], _, errs[i] = executeGraphQueries(withDatasource(ctx, name), graph, env, r, pp)
+		}(i, name)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	label := model.LabelName(graph.DatasourceLabel)
+	if label == "" {
+		label = datasourceLabel
+	}
+	merged := model.Matrix{}
+	var failures []string
+	var firstErr error
+	for i, name := range graph.Datasources {
+		if errs[i] == nil {
+			if _, ok := results[i].(model.Matrix); !ok {
+				errs[i] = fmt.Errorf("must return a matrix, got %T", results[i])
+			}
+		}
+		if errs[i] != nil {
+			pp.logger.Warnf("Error querying datasource %s of graph %s: %v", name, graph.Name, errs[i])
+			failures = append(failures, fmt.Sprintf("datasource %s failed: %s", name, errs[i]))
+			if firstErr == nil {
+				firstErr = datasourceError(name, errs[i])
+			}
+			continue
+		}
+		for _, series := range results[i].(model.Matrix) {
+			metric := series.Metric.Clone()
+			metric[label] = model.LabelValue(name)
+			merged = append(merged, &model.SampleStream{Metric: metric, Values: series.Values})
+		}
+	}
+	if len(failures) == len(graph.Datasources) {
+		return nil, nil, nil, firstErr
+	}
+	return merged, nil, failures, nil
+}
+
+// datasourceError prefixes err with the name of the datasource it comes
+// from, keeping the status and code of a queryError.
+func datasourceError(name string, err error) error {
+	var qe *queryError
+	if errors.As(err, &qe) {
+		return &queryError{status: qe.status, code: qe.code, message: fmt.Sprintf("datasource %s: %s", name, qe.message)}
+	}
+	return fmt.Errorf("datasource %s: %w", name, err)
+}
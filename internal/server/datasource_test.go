@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestDatasource serves a fake Prometheus returning series, or failing
+// with a 500 when series is empty.
+func newTestDatasource(t *testing.T, series string) string {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if series == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "errorType": "internal", "error": "datasource down"}`))
+			return
+		}
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": ` + series + `}}`))
+	}))
+	t.Cleanup(ds.Close)
+	return ds.URL
+}
+
+func TestExecuteGraphDatasources(t *testing.T) {
+	series := `[{"metric": {"pod": "a"}, "values": [[1700000000, "1"]]}]`
+	graph := &Graph{Name: "graph", QueryExpression: "up", Datasources: []string{"eu", "us", "down"}, DatasourceLabel: "cluster"}
+	config := &MetricsConfigProvider{
+		Provider: provider{Name: "eu", Address: newTestDatasource(t, series)},
+		Datasources: []provider{
+			{Name: "us", Address: newTestDatasource(t, series)},
+			{Name: "down", Address: newTestDatasource(t, "")},
+		},
+		Applications: []Application{{
+			Name:             "app",
+			Default:          true,
+			DefaultDashboard: &Dashboard{GroupKind: "pod", Rows: []*Row{{Name: "row", Graphs: []*Graph{graph}}}},
+		}},
+	}
+	pp := NewPrometheusProvider(config, logging.NewLogger(), Options{DefaultDuration: time.Hour, DefaultStep: time.Minute})
+	assert.NoError(t, pp.init())
+
+	w := executeTestGraph(pp, map[string]string{"diag": "true"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	var matrix model.Matrix
+	assert.NoError(t, json.Unmarshal(response.Data, &matrix))
+	if assert.Len(t, matrix, 2) {
+		assert.Equal(t, model.Metric{"pod": "a", "cluster": "eu"}, matrix[0].Metric)
+		assert.Equal(t, model.Metric{"pod": "a", "cluster": "us"}, matrix[1].Metric)
+	}
+	if assert.Len(t, response.Warnings, 1) {
+		assert.True(t, strings.HasPrefix(response.Warnings[0], "datasource down failed: "), response.Warnings[0])
+	}
+	assert.ElementsMatch(t, []string{"eu", "us", "down"}, response.Diagnostics.ProvidersTried)
+
+	graph.Datasources = []string{"down"}
+	w = executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "datasource down")
+}
+
+func TestConfigValidateDatasources(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Provider: provider{Name: "eu", Address: "http://eu"},
+		Datasources: []provider{
+			{Name: "us", Address: "http://us"},
+			{Name: "eu", Address: "http://eu-2"},
+			{Address: "http://anonymous"},
+			{Name: "asia"},
+			{Name: "us-ha", Address: "http://us-0", FallbackAddresses: []string{"http://us-1", ""}},
+		},
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{
+				{Name: "cpu", Datasources: []string{"eu", "us", "moon"}, DatasourceLabel: "cluster-name"},
+			}}},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		`duplicate datasource "eu"`,
+		"datasource http://anonymous: has no name",
+		"datasource asia: has no address",
+		"datasource us-ha: has an empty fallback address",
+		`application app, dashboard pod, row pod, graph cpu: invalid datasource label name "cluster-name"`,
+		`application app, dashboard pod, row pod, graph cpu: unknown datasource "moon"`,
+	}, strings.Split(err.Error(), "\n"))
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// Diagnostics summarizes the effort spent answering a graph request. It is
+// only collected and returned when the request sets ?diag=true.
+type Diagnostics struct {
+	// Queries is the number of queries sent to the providers, retries
+	// included.
+	Queries int `json:"queries"`
+	// Retries is the number of queries retried after a transient error.
+	Retries int `json:"retries"`
+	// ProvidersTried lists the providers queried, in order.
+	ProvidersTried []string `json:"providersTried"`
+	// CacheHits is the number of queries answered from the cache.
+	CacheHits int `json:"cacheHits"`
+	// Series is the number of series of the graph result.
+	Series int `json:"series"`
+}
+
+// queryDiagnostics collects the Diagnostics of a request. All its methods
+// are safe to call on a nil receiver so collection can be skipped when the
+// diagnostics were not requested.
+type queryDiagnostics struct {
+	mu          sync.Mutex
+	diagnostics Diagnostics
+}
+
+type diagnosticsKey struct{}
+
+// withDiagnostics returns a copy of ctx carrying diag.
+func withDiagnostics(ctx context.Context, diag *queryDiagnostics) context.Context {
+	return context.WithValue(ctx, diagnosticsKey{}, diag)
+}
+
+// diagnosticsFromContext returns the diagnostics collected for the request of
+// ctx, or nil when they were not requested.
+func diagnosticsFromContext(ctx context.Context) *queryDiagnostics {
+	diag, _ := ctx.Value(diagnosticsKey{}).(*queryDiagnostics)
+	return diag
+}
+
+func (d *queryDiagnostics) recordQuery(providerName string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.diagnostics.Queries++
+	for _, name := range d.diagnostics.ProvidersTried {
+		if name == providerName {
+			return
+		}
+	}
+	d.diagnostics.ProvidersTried = append(d.diagnostics.ProvidersTried, providerName)
+}
+
+func (d *queryDiagnostics) recordRetry() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.diagnostics.Retries++
+}
+
+func (d *queryDiagnostics) recordCacheHit() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.diagnostics.CacheHits++
+}
+
+func (d *queryDiagnostics) recordSeries(series int) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.diagnostics.Series = series
+}
+
+// snapshot returns a copy of the diagnostics collected so far.
+func (d *queryDiagnostics) snapshot() *Diagnostics {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := d.diagnostics
+	snapshot.ProvidersTried = append([]string(nil), d.diagnostics.ProvidersTried...)
+	return &snapshot
+}
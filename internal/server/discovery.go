@@ -0,0 +1,59 @@
+package server
+
+// ApplicationSummary describes a configured application and its dashboards.
+type ApplicationSummary struct {
+	Name             string             `json:"name"`
+	Default          bool               `json:"default"`
+	DefaultDashboard *DashboardSummary  `json:"defaultDashboard,omitempty"`
+	Dashboards       []DashboardSummary `json:"dashboards"`
+}
+
+// DashboardSummary describes a dashboard by the names of its rows and graphs.
+type DashboardSummary struct {
+	Name      string       `json:"name,omitempty"`
+	GroupKind string       `json:"groupKind"`
+	Rows      []RowSummary `json:"rows"`
+}
+
+// RowSummary lists the graphs of a row.
+type RowSummary struct {
+	Name   string   `json:"name"`
+	Graphs []string `json:"graphs"`
+}
+
+func summarizeDashboard(dashboard *Dashboard) DashboardSummary {
+	summary := DashboardSummary{
+		Name:      dashboard.Name,
+		GroupKind: dashboard.GroupKind,
+		Rows:      make([]RowSummary, 0, len(dashboard.Rows)),
+	}
+	for _, row := range dashboard.Rows {
+		rowSummary := RowSummary{Name: row.Name, Graphs: make([]string, 0, len(row.Graphs))}
+		for _, graph := range row.Graphs {
+			rowSummary.Graphs = append(rowSummary.Graphs, graph.Name)
+		}
+		summary.Rows = append(summary.Rows, rowSummary)
+	}
+	return summary
+}
+
+// summarize returns the applications of the config with their dashboards.
+func (p *MetricsConfigProvider) summarize() []ApplicationSummary {
+	applications := make([]ApplicationSummary, 0, len(p.Applications))
+	for _, app := range p.Applications {
+		summary := ApplicationSummary{
+			Name:       app.Name,
+			Default:    app.Default,
+			Dashboards: make([]DashboardSummary, 0, len(app.Dashboards)),
+		}
+		if app.DefaultDashboard != nil {
+			defaultDashboard := summarizeDashboard(app.DefaultDashboard)
+			summary.DefaultDashboard = &defaultDashboard
+		}
+		for _, dashboard := range app.Dashboards {
+			summary.Dashboards = append(summary.Dashboards, summarizeDashboard(dashboard))
+		}
+		applications = append(applications, summary)
+	}
+	return applications
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// weeksDaysRE splits a duration into its leading weeks and days, which
+// time.ParseDuration does not know of, and the remaining Go duration.
+var weeksDaysRE = regexp.MustCompile(`^(?:(\d+)w)?(?:(\d+)d)?(.*)$`)
+
+// errInvalidDuration is returned for durations that are neither Go
+// durations nor a number of weeks or days.
+var errInvalidDuration = errors.New("must be a duration such as 30m, 12h or 7d")
+
+// parseDuration parses a Go duration, e.g. 90s or 1h30m, which may also be,
+// or start with, a number of weeks and days as typed in Grafana, e.g. 7d, 2w
+// or 1d12h.
+func parseDuration(s string) (time.Duration, error) {
+	matches := weeksDaysRE.FindStringSubmatch(s)
+	if matches[1] == "" && matches[2] == "" {
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, errInvalidDuration
+		}
+		return duration, nil
+	}
+	var duration time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour} {
+		if matches[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(matches[i+1], 10, 64)
+		if err != nil || n > (math.MaxInt64-int64(duration))/int64(unit) {
+			return 0, errors.New("duration out of range")
+		}
+		duration += time.Duration(n) * unit
+	}
+	if rest := matches[3]; rest != "" {
+		remainder, err := time.ParseDuration(rest)
+		if err != nil || remainder < 0 {
+			return 0, errInvalidDuration
+		}
+		if remainder > math.MaxInt64-duration {
+			return 0, errors.New("duration out of range")
+		}
+		duration += remainder
+	}
+	return duration, nil
+}
+
+// maxQueryPoints bounds the number of points of a range query, i.e. its
+// duration divided by its step. It is the limit Prometheus enforces.
+const maxQueryPoints = 11000
+
+// checkDuration fails with a 400 when duration exceeds the MaxDuration
+// option.
+func checkDuration(duration time.Duration, options Options) error {
+	if options.MaxDuration > 0 && duration > options.MaxDuration {
+		return newQueryError(http.StatusBadRequest, fmt.Sprintf("Duration %s exceeds the maximum duration of %s", duration, options.MaxDuration))
+	}
+	return nil
+}
+
+// minStep returns the smallest step keeping a query over duration within
+// maxQueryPoints, rounded up to the second.
+func minStep(duration time.Duration) time.Duration {
+	return pointsStep(duration, maxQueryPoints)
+}
+
+// stepAuto is the step of graphs whose step scales with the duration of the
+// request, as the $__interval of Grafana.
+const stepAuto = "auto"
+
+// Resolutions of ?resolution, setting the step of the queries from their
+// duration so that series have the same number of points whatever the
+// selected window.
+const (
+	resolutionHigh   = "high"
+	resolutionMedium = "medium"
+	resolutionLow    = "low"
+)
+
+// resolutionPoints is the number of points of the series of a query at each
+// resolution. Auto steps use resolutionMedium.
+var resolutionPoints = map[string]int{
+	resolutionHigh:   1000,
+	resolutionMedium: 500,
+	resolutionLow:    250,
+}
+
+// autoStep returns the step giving a query over duration the number of
+// points of resolution, rounded up to the second and at least a second.
+func autoStep(duration time.Duration, resolution string) time.Duration {
+	step := pointsStep(duration, resolutionPoints[resolution])
+	if step < time.Second {
+		return time.Second
+	}
+	return step
+}
+
+// pointsStep returns the step of a query over duration with the given
+// number of points, rounded up to the second.
+func pointsStep(duration time.Duration, points int) time.Duration {
+	step := duration / time.Duration(points)
+	if rounded := step.Truncate(time.Second); rounded < step {
+		step = rounded + time.Second
+	}
+	return step
+}
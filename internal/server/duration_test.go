@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "30m", expected: 30 * time.Minute},
+		{value: "1h30m", expected: 90 * time.Minute},
+		{value: "1d", expected: 24 * time.Hour},
+		{value: "7d", expected: 7 * 24 * time.Hour},
+		{value: "2w", expected: 14 * 24 * time.Hour},
+		{value: "1w2d", expected: 9 * 24 * time.Hour},
+		{value: "1d12h", expected: 36 * time.Hour},
+	}
+	for _, tt := range tests {
+		duration, err := parseDuration(tt.value)
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.expected, duration, tt.value)
+	}
+
+	for _, value := range []string{"", "1", "1mo", "d", "1.5d", "1d-1h", "7dd", "2d1w"} {
+		_, err := parseDuration(value)
+		assert.ErrorIs(t, err, errInvalidDuration, value)
+	}
+	_, err := parseDuration("99999999999w")
+	assert.EqualError(t, err, "duration out of range")
+}
+
+func TestExecuteDuration(t *testing.T) {
+	var start, end float64
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		start, end = formTime(t, r.Form, "start"), formTime(t, r.Form, "end")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+
+	w := executeTestGraph(pp, map[string]string{"duration": "7d"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.InDelta(t, (7 * 24 * time.Hour).Seconds(), end-start, 1)
+
+	w = executeTestGraph(pp, map[string]string{"duration": "7days"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Invalid duration \"7days\": must be a duration such as 30m, 12h or 7d`)
+}
+
+// formTime parses the unix timestamp param name of a query form.
+func formTime(t *testing.T, form url.Values, name string) float64 {
+	var ts float64
+	_, err := fmt.Sscan(form.Get(name), &ts)
+	assert.NoError(t, err, name)
+	return ts
+}
+
+func TestMaxDuration(t *testing.T) {
+	assert.NoError(t, checkDuration(30*24*time.Hour, Options{}))
+	assert.NoError(t, checkDuration(24*time.Hour, Options{MaxDuration: 24 * time.Hour}))
+	assert.EqualError(t, checkDuration(48*time.Hour, Options{MaxDuration: 24 * time.Hour}), "Duration 48h0m0s exceeds the maximum duration of 24h0m0s")
+
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"}, "[]")
+	pp.options.MaxDuration = 7 * 24 * time.Hour
+	assert.Equal(t, http.StatusOK, executeTestGraph(pp, map[string]string{"duration": "7d"}).Code)
+	w := executeTestGraph(pp, map[string]string{"duration": "8d"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "exceeds the maximum duration of 168h0m0s")
+}
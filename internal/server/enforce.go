@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// validateEnforcedLabels checks that the enforced labels of an application
+// are valid label names, other than the metric name, with a value.
+func validateEnforcedLabels(enforced map[string]string) error {
+	for _, name := range sortedLabelNames(enforced) {
+		if !model.LabelName(name).IsValid() || name == labels.MetricName {
+			return fmt.Errorf("invalid enforced label name %q", name)
+		}
+		if enforced[name] == "" {
+			return fmt.Errorf("enforced label %s has no value", name)
+		}
+	}
+	return nil
+}
+
+// enforceLabels parses query and sets the label matchers of enforced on
+// every selector, replacing the matchers of the same labels the query has,
+// so that the query can only select the series of the application whatever
+// its author or the request params made of it. Unlike application labels,
+// which are template variables, this holds for any query.
+func enforceLabels(query string, enforced map[string]string) (string, error) {
+	if len(enforced) == 0 {
+		return query, nil
+	}
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return "", &queryError{status: http.StatusBadRequest, code: errCodeInvalidQuery, message: "invalid query: " + err.Error()}
+	}
+	names := sortedLabelNames(enforced)
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		matchers := make([]*labels.Matcher, 0, len(vs.LabelMatchers)+len(names))
+		for _, m := range vs.LabelMatchers {
+			if _, ok := enforced[m.Name]; !ok {
+				matchers = append(matchers, m)
+			}
+		}
+		for _, name := range names {
+			matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, name, enforced[name]))
+		}
+		vs.LabelMatchers = matchers
+		return nil
+	})
+	return expr.String(), nil
+}
+
+// selectsEnforcedLabels reports whether every selector of query matches the
+// enforced labels exactly, so that the query, e.g. of a rule, only selects
+// the series of the application. Queries that can not be parsed do not.
+func selectsEnforcedLabels(query string, enforced map[string]string) bool {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return false
+	}
+	selects := true
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		for name, value := range enforced {
+			if !hasEqualMatcher(vs.LabelMatchers, name, value) {
+				selects = false
+			}
+		}
+		return nil
+	})
+	return selects
+}
+
+func hasEqualMatcher(matchers []*labels.Matcher, name string, value string) bool {
+	for _, m := range matchers {
+		if m.Type == labels.MatchEqual && m.Name == name && m.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// enforcedSelector returns the selector of the series of the enforced
+// labels, e.g. {namespace="shop"}.
+func enforcedSelector(enforced map[string]string) string {
+	matchers := make([]string, 0, len(enforced))
+	for _, name := range sortedLabelNames(enforced) {
+		matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, name, enforced[name]).String())
+	}
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
+
+func sortedLabelNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type enforcedLabelsKey struct{}
+
+// withEnforcedLabels returns a copy of ctx whose queries are set the label
+// matchers of enforced before they are executed.
+func withEnforcedLabels(ctx context.Context, enforced map[string]string) context.Context {
+	return context.WithValue(ctx, enforcedLabelsKey{}, enforced)
+}
+
+// enforcedLabelsFromContext returns the labels enforced on the queries of
+// ctx, or nil when they are not scoped.
+func enforcedLabelsFromContext(ctx context.Context) map[string]string {
+	enforced, _ := ctx.Value(enforcedLabelsKey{}).(map[string]string)
+	return enforced
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceLabels(t *testing.T) {
+	enforced := map[string]string{"namespace": "shop", "cluster": "prod"}
+	for _, tt := range []struct {
+		query    string
+		expected string
+	}{
+		{`up`, `up{cluster="prod",namespace="shop"}`},
+		{`up{namespace="web"}`, `up{cluster="prod",namespace="shop"}`},
+		{`up{namespace=~".+", job="kubelet"}`, `up{cluster="prod",job="kubelet",namespace="shop"}`},
+		{`sum(rate(http_requests_total{pod="a"}[5m])) / sum(rate(http_requests_total[5m]))`, `sum(rate(http_requests_total{cluster="prod",namespace="shop",pod="a"}[5m])) / sum(rate(http_requests_total{cluster="prod",namespace="shop"}[5m]))`},
+		{`max_over_time(rate(up[1m])[10m:1m])`, `max_over_time(rate(up{cluster="prod",namespace="shop"}[1m])[10m:1m])`},
+		{`vector(1)`, `vector(1)`},
+	} {
+		query, err := enforceLabels(tt.query, enforced)
+		assert.NoError(t, err, tt.query)
+		assert.Equal(t, tt.expected, query, tt.query)
+	}
+
+	query, err := enforceLabels(`up{namespace="web"}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `up{namespace="web"}`, query, "queries are left as is without enforced labels")
+
+	_, err = enforceLabels(`sum(up`, enforced)
+	assert.ErrorContains(t, err, "invalid query")
+	assert.Equal(t, http.StatusBadRequest, err.(*queryError).status)
+
+	assert.Equal(t, `{cluster="prod", namespace="shop"}`, enforcedSelector(enforced))
+}
+
+func TestValidateEnforcedLabels(t *testing.T) {
+	assert.NoError(t, validateEnforcedLabels(nil))
+	assert.NoError(t, validateEnforcedLabels(map[string]string{"namespace": "shop"}))
+	assert.EqualError(t, validateEnforcedLabels(map[string]string{"name-space": "shop"}), `invalid enforced label name "name-space"`)
+	assert.EqualError(t, validateEnforcedLabels(map[string]string{"__name__": "up"}), `invalid enforced label name "__name__"`)
+	assert.EqualError(t, validateEnforcedLabels(map[string]string{"namespace": ""}), `enforced label namespace has no value`)
+}
+
+func TestExecuteEnforcedLabels(t *testing.T) {
+	api := &mockAPI{result: testMatrix}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", QueryExpression: `rate(http_requests_total{namespace="{{.namespace}}"}[5m])`}, api)
+	pp.config.Applications[0].EnforcedLabels = map[string]string{"namespace": "shop"}
+
+	w := executeTestGraph(pp, map[string]string{"namespace": "web", "debug": "true"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{`rate(http_requests_total{namespace="shop"}[5m])`}, api.queries, "the requested namespace is overridden")
+	assert.Contains(t, w.Body.String(), `"query":"rate(http_requests_total{namespace=\"shop\"}[5m])"`, "the debug query is the executed one")
+}
+
+func TestLabelValuesEnforcedLabels(t *testing.T) {
+	var matches []string
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		matches = r.Form["match[]"]
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": ["web-0"]}`))
+	})
+	pp.config.Applications[0].EnforcedLabels = map[string]string{"namespace": "shop"}
+
+	w := getTestLabelValues(pp, "pod", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{`{namespace="shop"}`}, matches, "the values are restricted to the enforced labels without a selector")
+
+	w = getTestLabelValues(pp, "pod", url.Values{"match[]": {`kube_pod_info{namespace="web"}`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{`kube_pod_info{namespace="shop"}`}, matches)
+}
+
+func TestSelectsEnforcedLabels(t *testing.T) {
+	enforced := map[string]string{"namespace": "shop"}
+	assert.True(t, selectsEnforcedLabels(`sum(rate(http_requests_total{namespace="shop", code="500"}[5m]))`, enforced))
+	assert.True(t, selectsEnforcedLabels(`up{namespace="shop"} == 0 and on(pod) kube_pod_info{namespace="shop"}`, enforced))
+	assert.False(t, selectsEnforcedLabels(`up{namespace="shop"} == 0 and on(pod) kube_pod_info`, enforced), "every selector must match")
+	assert.False(t, selectsEnforcedLabels(`up{namespace="web"}`, enforced))
+	assert.False(t, selectsEnforcedLabels(`up{namespace=~"shop|web"}`, enforced))
+	assert.False(t, selectsEnforcedLabels(`sum(up`, enforced))
+}
+
+func TestRulesEnforcedLabels(t *testing.T) {
+	api := &mockAPI{rules: v1.RulesResult{Groups: []v1.RuleGroup{
+		{Name: "shop", File: "shop.yaml", Rules: v1.Rules{
+			v1.RecordingRule{Name: "shop:requests:rate5m", Query: `sum(rate(http_requests_total{namespace="shop"}[5m]))`, Health: v1.RuleHealthGood},
+			v1.AlertingRule{Name: "ShopDown", Query: `up{namespace="shop"} == 0`, Health: v1.RuleHealthGood, State: "inactive"},
+		}},
+		{Name: "web", File: "web.yaml", Rules: v1.Rules{
+			v1.AlertingRule{Name: "WebDown", Query: `up{namespace="web"} == 0`, Health: v1.RuleHealthBad, LastError: "web is down", State: "firing",
+				Alerts: []*v1.Alert{{State: v1.AlertStateFiring}}},
+		}},
+		{Name: "cluster", File: "cluster.yaml", Rules: v1.Rules{
+			v1.RecordingRule{Name: "cluster:requests:rate5m", Query: `sum(rate(http_requests_total[5m])) by (namespace)`, Health: v1.RuleHealthGood},
+		}},
+	}}}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph"}, api)
+	pp.config.Applications[0].EnforcedLabels = map[string]string{"namespace": "shop"}
+
+	w := getTestRules(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response RulesResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	if assert.Len(t, response.Groups, 1, "the rule groups of other namespaces are left out") {
+		assert.Equal(t, "shop", response.Groups[0].Name)
+		assert.Len(t, response.Groups[0].Rules, 2)
+	}
+	assert.NotContains(t, w.Body.String(), "web is down")
+}
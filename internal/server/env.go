@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// envReference matches ${VAR} and ${VAR:-default} references.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces the ${VAR} references of value with the value of the
+// environment variable VAR, and ${VAR:-default} references with default
+// when VAR is unset or empty. It fails if a variable without default is
+// unset.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		match := envReference.FindStringSubmatch(reference)
+		name, hasDefault, def := match[1], match[2] != "", match[3]
+		if envValue, ok := os.LookupEnv(name); ok && (envValue != "" || !hasDefault) {
+			return envValue
+		}
+		if hasDefault {
+			return def
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return reference
+	})
+	return expanded, err
+}
+
+// expandEnv expands the environment variable references of the provider
+// settings, keeping environment specific addresses and secrets out of the
+// committed config.
+func (p *MetricsConfigProvider) expandEnv() error {
+	if err := p.Provider.expandEnv("provider"); err != nil {
+		return err
+	}
+	for i := range p.Datasources {
+		if err := p.Datasources[i].expandEnv("datasource " + p.Datasources[i].Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandEnv expands the environment variable references of the name,
+// addresses, paths and header values of the datasource, errors starting
+// with what.
+func (p *provider) expandEnv(what string) error {
+	var err error
+	fields := []*string{&p.Name, &p.Address, &p.QueryPath, &p.QueryRangePath}
+	for _, field := range fields {
+		if *field, err = expandEnv(*field); err != nil {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+	}
+	for i, address := range p.FallbackAddresses {
+		if p.FallbackAddresses[i], err = expandEnv(address); err != nil {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+	}
+	for name, value := range p.Headers {
+		if p.Headers[name], err = expandEnv(value); err != nil {
+			return fmt.Errorf("%s header %s: %w", what, name, err)
+		}
+	}
+	return nil
+}
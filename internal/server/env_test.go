@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("PROMETHEUS_HOST", "prometheus.monitoring")
+	t.Setenv("EMPTY", "")
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "http://${PROMETHEUS_HOST}:9090", expected: "http://prometheus.monitoring:9090"},
+		{value: "${PROMETHEUS_PORT:-9090}", expected: "9090"},
+		{value: "${PROMETHEUS_HOST:-localhost}", expected: "prometheus.monitoring"},
+		{value: "${EMPTY:-default}", expected: "default"},
+		{value: "${EMPTY}", expected: ""},
+		{value: "$PROMETHEUS_HOST", expected: "$PROMETHEUS_HOST"},
+	}
+	for _, tt := range tests {
+		expanded, err := expandEnv(tt.value)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, expanded, tt.value)
+	}
+
+	_, err := expandEnv("http://${UNSET_PROMETHEUS_HOST}:9090")
+	assert.EqualError(t, err, "environment variable UNSET_PROMETHEUS_HOST is not set")
+}
+
+func TestMetricsConfigProviderExpandEnv(t *testing.T) {
+	t.Setenv("PROMETHEUS_URL", "http://prometheus:9090")
+	t.Setenv("PROMETHEUS_TOKEN", "secret")
+
+	config := &MetricsConfigProvider{Provider: provider{
+		Address: "${PROMETHEUS_URL}",
+		Headers: map[string]string{"Authorization": "Bearer ${PROMETHEUS_TOKEN}"},
+	}}
+	assert.NoError(t, config.expandEnv())
+	assert.Equal(t, "http://prometheus:9090", config.Provider.Address)
+	assert.Equal(t, "Bearer secret", config.Provider.Headers["Authorization"])
+
+	config.Datasources = []provider{{Name: "us-east", Address: "${PROMETHEUS_URL}"}}
+	assert.NoError(t, config.expandEnv())
+	assert.Equal(t, "http://prometheus:9090", config.Datasources[0].Address)
+
+	config.Datasources[0].Address = "${UNSET_PROMETHEUS_URL}"
+	assert.EqualError(t, config.expandEnv(), "datasource us-east: environment variable UNSET_PROMETHEUS_URL is not set")
+
+	config.Provider.Headers["X-Scope-OrgID"] = "${UNSET_TENANT}"
+	assert.EqualError(t, config.expandEnv(), "provider header X-Scope-OrgID: environment variable UNSET_TENANT is not set")
+}
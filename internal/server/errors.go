@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// Codes of the error responses, telling clients what went wrong without
+// parsing the message.
+const (
+	errCodeInvalidRequest = "invalid_request"
+	errCodeInvalidQuery   = "invalid_query"
+	errCodeNotFound       = "not_found"
+	errCodeNoDashboards   = "no_dashboards"
+	errCodeInvalidConfig  = "invalid_config"
+	errCodeUnauthorized   = "unauthorized"
+	errCodeForbidden      = "forbidden"
+	errCodeTooManyQueries = "too_many_queries"
+	errCodeRateLimited    = "rate_limited"
+	errCodeTooLarge       = "response_too_large"
+	errCodeTooManySeries  = "too_many_series"
+	errCodeQueryFailed    = "query_failed"
+	errCodeUnavailable    = "datasource_unavailable"
+	errCodeThrottled      = "datasource_rate_limited"
+	errCodeTimeout        = "timeout"
+	errCodeNotImplemented = "not_implemented"
+	errCodeInternal       = "internal"
+)
+
+// ErrorDetail describes the error of an ErrorResponse.
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID identifies the request in the server logs.
+	RequestID string `json:"requestId,omitempty"`
+	// Available lists the valid values of what was not found, e.g. the
+	// group kinds of the dashboards of the application.
+	Available []string `json:"available,omitempty"`
+}
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// writeError writes an error response with the given status, code and
+// message.
+func writeError(ctx *gin.Context, status int, code string, message string) {
+	ctx.JSON(status, ErrorResponse{Error: ErrorDetail{Code: code, Message: message, RequestID: ctx.GetString(requestIDKey)}})
+}
+
+// errorCode returns the default error code of an HTTP status.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return errCodeInvalidRequest
+	case http.StatusUnauthorized:
+		return errCodeUnauthorized
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusRequestEntityTooLarge:
+		return errCodeTooLarge
+	case http.StatusTooManyRequests:
+		return errCodeTooManyQueries
+	case http.StatusNotImplemented:
+		return errCodeNotImplemented
+	case http.StatusGatewayTimeout:
+		return errCodeTimeout
+	case http.StatusInternalServerError:
+		return errCodeInternal
+	default:
+		return errCodeQueryFailed
+	}
+}
+
+// queryError is an error carrying the HTTP status and code it is reported
+// with.
+type queryError struct {
+	status  int
+	code    string
+	message string
+	// retryAfter is sent as the Retry-After header of the response when
+	// set.
+	retryAfter time.Duration
+	// available is returned as the Available values of the response.
+	available []string
+}
+
+func (e *queryError) Error() string {
+	return e.message
+}
+
+func newQueryError(status int, message string) *queryError {
+	return &queryError{status: status, code: errorCode(status), message: message}
+}
+
+// newNotFoundError returns the error of a request for an application,
+// dashboard, row or graph that is not configured.
+func newNotFoundError(message string) *queryError {
+	return &queryError{status: http.StatusBadRequest, code: errCodeNotFound, message: message}
+}
+
+// classifyQueryError returns the error a failed Prometheus query is reported
+// with. PromQL errors, i.e. bad_data and execution errors, are reported as a
+// 400 invalid_query with the Prometheus message, since they are for the
+// dashboard author to fix. Queries rate limited by Prometheus are reported
+// as a 429 with its Retry-After delay, and queries interrupted by the query
+// timeout as a 504. Other errors, such as a Prometheus that can not be
+// reached, are reported as a 502.
+func classifyQueryError(err error) error {
+	var qe *queryError
+	if errors.As(err, &qe) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return newQueryError(http.StatusGatewayTimeout, "prometheus query did not complete within the query timeout")
+	}
+	if statusErr, ok := rateLimitedError(err); ok {
+		return &queryError{status: http.StatusTooManyRequests, code: errCodeThrottled, message: "prometheus is rate limiting queries", retryAfter: statusErr.retryAfter}
+	}
+	var apiErr *v1.Error
+	if errors.As(err, &apiErr) && (apiErr.Type == v1.ErrBadData || apiErr.Type == v1.ErrExec) {
+		return &queryError{status: http.StatusBadRequest, code: errCodeInvalidQuery, message: "invalid query: " + apiErr.Msg}
+	}
+	return newQueryError(http.StatusBadGateway, "error querying prometheus: "+err.Error())
+}
+
+// writeQueryError writes err to the response, using the status and code of
+// a queryError, or 400 and query_failed for any other error.
+func writeQueryError(ctx *gin.Context, err error) {
+	var qe *queryError
+	if errors.As(err, &qe) && qe.retryAfter > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(qe.retryAfter.Seconds()))))
+	}
+	status, detail := queryErrorDetail(ctx, err)
+	ctx.JSON(status, ErrorResponse{Error: detail})
+}
+
+// queryErrorDetail returns the status and the detail err is reported with.
+func queryErrorDetail(ctx *gin.Context, err error) (int, ErrorDetail) {
+	detail := ErrorDetail{Code: errCodeQueryFailed, Message: err.Error(), RequestID: ctx.GetString(requestIDKey)}
+	status := http.StatusBadRequest
+	var qe *queryError
+	if errors.As(err, &qe) {
+		status, detail.Code, detail.Message, detail.Available = qe.status, qe.code, qe.message, qe.available
+	}
+	return status, detail
+}
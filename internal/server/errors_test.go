@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteQueryError(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "query error",
+			err:          newQueryError(http.StatusBadRequest, "Invalid step"),
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":{"code":"invalid_request","message":"Invalid step"}}`,
+		},
+		{
+			name:         "not found error",
+			err:          newNotFoundError("Requested Row not found"),
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":{"code":"not_found","message":"Requested Row not found"}}`,
+		},
+		{
+			name:         "other errors are reported with their message",
+			err:          errors.New("connection refused"),
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":{"code":"query_failed","message":"connection refused"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeQueryError(GetTestGinContext(w), tt.err)
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.JSONEq(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestValidateQueryRequestError(t *testing.T) {
+	w := httptest.NewRecorder()
+	ctx, ms := createContextAndNewO11yServer(w)
+	MockJsonGet(ctx, map[string][]string{"Argocd-Project-Name": {"default"}}, map[string]string{}, map[string]string{"application_name": "test", "project": "default"})
+	ms.queryMetrics(ctx)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `{"error":{"code":"invalid_request","message":`)
+}
+
+func TestClassifyQueryError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   string
+		expectedMsg    string
+	}{
+		{
+			name:           "promql syntax error",
+			err:            &v1.Error{Type: v1.ErrBadData, Msg: `1:5: parse error: unexpected "}"`},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   errCodeInvalidQuery,
+			expectedMsg:    `invalid query: 1:5: parse error: unexpected "}"`,
+		},
+		{
+			name:           "promql execution error",
+			err:            &v1.Error{Type: v1.ErrExec, Msg: "many-to-many matching not allowed"},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   errCodeInvalidQuery,
+			expectedMsg:    "invalid query: many-to-many matching not allowed",
+		},
+		{
+			name:           "prometheus server error",
+			err:            &v1.Error{Type: v1.ErrServer, Msg: "server error: 500"},
+			expectedStatus: http.StatusBadGateway,
+			expectedCode:   errCodeQueryFailed,
+			expectedMsg:    "error querying prometheus: server_error: server error: 500",
+		},
+		{
+			name:           "transport error",
+			err:            errors.New("dial tcp: connection refused"),
+			expectedStatus: http.StatusBadGateway,
+			expectedCode:   errCodeQueryFailed,
+			expectedMsg:    "error querying prometheus: dial tcp: connection refused",
+		},
+		{
+			name:           "query timeout",
+			err:            fmt.Errorf("Post \"http://prometheus/api/v1/query_range\": %w", context.DeadlineExceeded),
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedCode:   errCodeTimeout,
+			expectedMsg:    "prometheus query did not complete within the query timeout",
+		},
+		{
+			name:           "query errors are kept",
+			err:            errTooManyQueries,
+			expectedStatus: http.StatusTooManyRequests,
+			expectedCode:   errCodeTooManyQueries,
+			expectedMsg:    errTooManyQueries.message,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var qe *queryError
+			assert.ErrorAs(t, classifyQueryError(tt.err), &qe)
+			assert.Equal(t, tt.expectedStatus, qe.status)
+			assert.Equal(t, tt.expectedCode, qe.code)
+			assert.Equal(t, tt.expectedMsg, qe.message)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// failoverAPI is the client of a datasource with fallback addresses, e.g.
+// the replicas of an HA Prometheus pair. Queries are sent to the endpoint
+// that answered last, the primary address at first, and fail over to the
+// next endpoints in order when it can not be connected to. Endpoints
+// answering with an error are not failed over from, the error being the
+// answer of Prometheus. The methods not used by the server are served by
+// the primary address.
+type failoverAPI struct {
+	v1.API
+	name      string
+	addresses []string
+	clients   []v1.API
+	logger    *zap.SugaredLogger
+	// preferred is the index of the endpoint queries are sent to first.
+	preferred atomic.Int32
+}
+
+// newFailoverClient creates the client of the datasource config with
+// newClient, failing over between its address and fallback addresses when
+// it has any.
+func (pp *PrometheusProvider) newFailoverClient(newClient func(config provider) (v1.API, map[string]bool, error), config provider) (v1.API, map[string]bool, error) {
+	client, secretHeaders, err := newClient(config)
+	if err != nil || len(config.FallbackAddresses) == 0 {
+		return client, secretHeaders, err
+	}
+	name := config.Name
+	if name == "" {
+		name = redactedAddress(config.Address)
+	}
+	failover := &failoverAPI{API: client, name: name, addresses: []string{config.Address}, clients: []v1.API{client}, logger: pp.logger}
+	for _, address := range config.FallbackAddresses {
+		fallback := config
+		fallback.Address = address
+		fallback.FallbackAddresses = nil
+		client, _, err := newClient(fallback)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fallback address %s: %w", redactedAddress(address), err)
+		}
+		failover.addresses = append(failover.addresses, address)
+		failover.clients = append(failover.clients, client)
+	}
+	pp.logger.Infof("Datasource %s fails over between %d addresses", name, len(failover.clients))
+	return failover, secretHeaders, nil
+}
+
+// do calls fn with the client of every endpoint in turn, starting with the
+// preferred one, until it does not fail with a connection error or ctx is
+// done. The endpoint that answered becomes the preferred one.
+func (f *failoverAPI) do(ctx context.Context, fn func(client v1.API) error) error {
+	first := int(f.preferred.Load())
+	var err error
+	for i := range f.clients {
+		index := (first + i) % len(f.clients)
+		err = fn(f.clients[index])
+		if !isConnectionError(err) {
+			if index != first && f.preferred.CompareAndSwap(int32(first), int32(index)) {
+				f.logger.Warnf("Datasource %s failed over to %s", f.name, redactedAddress(f.addresses[index]))
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		f.logger.Warnf("Error connecting to %s of datasource %s: %v", redactedAddress(f.addresses[index]), f.name, err)
+	}
+	return err
+}
+
+func (f *failoverAPI) Query(ctx context.Context, query string, ts time.Time, opts ...v1.Option) (model.Value, v1.Warnings, error) {
+	var result model.Value
+	var warnings v1.Warnings
+	err := f.do(ctx, func(client v1.API) error {
+		var err error
+		result, warnings, err = client.Query(ctx, query, ts, opts...)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (f *failoverAPI) QueryRange(ctx context.Context, query string, r v1.Range, opts ...v1.Option) (model.Value, v1.Warnings, error) {
+	var result model.Value
+	var warnings v1.Warnings
+	err := f.do(ctx, func(client v1.API) error {
+		var err error
+		result, warnings, err = client.QueryRange(ctx, query, r, opts...)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (f *failoverAPI) LabelValues(ctx context.Context, label string, matches []string, startTime time.Time, endTime time.Time) (model.LabelValues, v1.Warnings, error) {
+	var result model.LabelValues
+	var warnings v1.Warnings
+	err := f.do(ctx, func(client v1.API) error {
+		var err error
+		result, warnings, err = client.LabelValues(ctx, label, matches, startTime, endTime)
+		return err
+	})
+	return result, warnings, err
+}
+
+func (f *failoverAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	var result v1.RulesResult
+	err := f.do(ctx, func(client v1.API) error {
+		var err error
+		result, err = client.Rules(ctx)
+		return err
+	})
+	return result, err
+}
+
+// isConnectionError reports whether a query failed without reaching
+// Prometheus, e.g. with a refused connection or an unknown host, rather
+// than being answered with an error or cancelled.
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// errConnectionRefused is the error of a query to a Prometheus that is down.
+var errConnectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestIsConnectionError(t *testing.T) {
+	assert.True(t, isConnectionError(errConnectionRefused))
+	assert.False(t, isConnectionError(nil))
+	assert.False(t, isConnectionError(&v1.Error{Type: v1.ErrBadData, Msg: "parse error"}))
+	assert.False(t, isConnectionError(context.DeadlineExceeded))
+	assert.False(t, isConnectionError(context.Canceled))
+}
+
+func TestFailoverAPI(t *testing.T) {
+	primary := &mockAPI{err: errConnectionRefused}
+	secondary := &mockAPI{result: testMatrix}
+	failover := &failoverAPI{API: primary, name: "prometheus", addresses: []string{"http://a", "http://b"}, clients: []v1.API{primary, secondary}, logger: logging.NewLogger()}
+	r := v1.Range{Start: time.Unix(1700000000, 0), End: time.Unix(1700000060, 0), Step: time.Minute}
+
+	result, _, err := failover.QueryRange(context.Background(), "up", r)
+	assert.NoError(t, err)
+	assert.Equal(t, testMatrix, result)
+	assert.Len(t, primary.queries, 1)
+	assert.Equal(t, int32(1), failover.preferred.Load(), "the endpoint that answered is preferred")
+
+	_, _, err = failover.Query(context.Background(), "up", r.End)
+	assert.NoError(t, err)
+	assert.Len(t, primary.queries, 1, "the failing endpoint is not tried first anymore")
+	assert.Len(t, secondary.queries, 2)
+
+	secondary.err = &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}
+	_, _, err = failover.QueryRange(context.Background(), "up(", r)
+	assert.Equal(t, secondary.err, err, "errors answered by Prometheus are not failed over from")
+	assert.Len(t, primary.queries, 1)
+
+	secondary.err = errConnectionRefused
+	_, _, err = failover.QueryRange(context.Background(), "up", r)
+	assert.ErrorIs(t, err, errConnectionRefused, "the last connection error is returned when every endpoint is down")
+	assert.Len(t, primary.queries, 2)
+	assert.Equal(t, int32(1), failover.preferred.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = failover.QueryRange(ctx, "up", r)
+	assert.Error(t, err)
+	assert.Len(t, primary.queries, 2, "queries of a cancelled request are not failed over")
+}
+
+func TestExecuteFailover(t *testing.T) {
+	apis := map[string]*mockAPI{
+		"http://prometheus-0": {err: errConnectionRefused},
+		"http://prometheus-1": {result: testMatrix},
+	}
+	config := newTestProviderConfig("http://prometheus-0", &Graph{Name: "graph", QueryExpression: "up"})
+	config.Provider.FallbackAddresses = []string{"http://prometheus-1"}
+	pp := NewPrometheusProvider(config, logging.NewLogger(), Options{DefaultDuration: time.Hour, DefaultStep: time.Minute})
+	pp.newClient = func(config provider) (v1.API, map[string]bool, error) {
+		return apis[config.Address], nil, nil
+	}
+	assert.NoError(t, pp.init())
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.SeriesCount)
+	assert.Len(t, apis["http://prometheus-0"].queries, 1)
+	assert.Len(t, apis["http://prometheus-1"].queries, 1)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Modes of the gaps of graph series, where they went stale or were absent
+// for some steps.
+const (
+	// gapsLeave returns the samples as Prometheus does, the UI deciding how
+	// to render the missing steps.
+	gapsLeave = "leave"
+	// gapsNull marks every missing step between the first and last samples
+	// of a series with a NaN sample, returned as null in the compact
+	// format.
+	gapsNull = "null"
+	// gapsConnect interpolates the missing steps between the samples
+	// around them.
+	gapsConnect = "connect"
+	// gapsValue fills every missing step of the range of the query with a
+	// fixed value.
+	gapsValue = "value"
+)
+
+// Gaps configures how the gaps of the series of a graph are returned.
+type Gaps struct {
+	// Mode is leave, the default, null, connect or value.
+	Mode string `json:"mode"`
+	// Value is the value missing steps are filled with in value mode.
+	Value float64 `json:"value,omitempty"`
+}
+
+func (g *Gaps) validate() error {
+	switch g.Mode {
+	case "", gapsLeave, gapsNull, gapsConnect, gapsValue:
+	default:
+		return fmt.Errorf("invalid mode %q: must be leave, null, connect or value", g.Mode)
+	}
+	if math.IsNaN(g.Value) || math.IsInf(g.Value, 0) {
+		return fmt.Errorf("invalid value %g: must be a finite number", g.Value)
+	}
+	if g.Value != 0 && g.Mode != gapsValue {
+		return fmt.Errorf("value %g is only used in value mode", g.Value)
+	}
+	return nil
+}
+
+// fillGaps returns a copy of matrix with the missing steps of r of every
+// series handled according to gaps, or matrix itself when they are left
+// as is or r is not a range. A step is missing when no sample is within
+// half a step of it, so that samples on the grid of r are matched whatever
+// their millisecond rounding.
+func fillGaps(matrix model.Matrix, gaps *Gaps, r v1.Range) model.Matrix {
+	if gaps == nil || gaps.Mode == "" || gaps.Mode == gapsLeave || r.Step <= 0 {
+		return matrix
+	}
+	slotTime := func(slot int64) model.Time {
+		return model.TimeFromUnixNano(r.Start.Add(time.Duration(slot) * r.Step).UnixNano())
+	}
+	lastSlot := int64(r.End.Sub(r.Start) / r.Step)
+	filled := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		samples := series.Values
+		values := make([]model.SamplePair, 0, len(samples))
+		// fill appends the missing steps between slots from and to, both
+		// excluded, before and after being the samples around them, if any.
+		fill := func(from, to int64, before, after *model.SamplePair) {
+			for slot := from + 1; slot < to; slot++ {
+				ts := slotTime(slot)
+				var value model.SampleValue
+				switch gaps.Mode {
+				case gapsNull:
+					value = model.SampleValue(math.NaN())
+				case gapsConnect:
+					ratio := float64(ts-before.Timestamp) / float64(after.Timestamp-before.Timestamp)
+					value = before.Value + (after.Value-before.Value)*model.SampleValue(ratio)
+				default:
+					value = model.SampleValue(gaps.Value)
+				}
+				values = append(values, model.SamplePair{Timestamp: ts, Value: value})
+			}
+		}
+		if len(samples) == 0 {
+			if gaps.Mode == gapsValue {
+				fill(-1, lastSlot+1, nil, nil)
+			}
+			filled = append(filled, &model.SampleStream{Metric: series.Metric, Values: values})
+			continue
+		}
+		if gaps.Mode == gapsValue {
+			fill(-1, gridSlot(samples[0].Timestamp, r), nil, nil)
+		}
+		for i := range samples {
+			if i > 0 {
+				fill(gridSlot(samples[i-1].Timestamp, r), gridSlot(samples[i].Timestamp, r), &samples[i-1], &samples[i])
+			}
+			values = append(values, samples[i])
+		}
+		if gaps.Mode == gapsValue {
+			fill(gridSlot(samples[len(samples)-1].Timestamp, r), lastSlot+1, nil, nil)
+		}
+		filled = append(filled, &model.SampleStream{Metric: series.Metric, Values: values})
+	}
+	return filled
+}
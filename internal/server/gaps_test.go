@@ -0,0 +1,48 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFillGaps(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := v1.Range{Start: start, End: start.Add(5 * time.Minute), Step: time.Minute}
+	at := func(minutes int) model.Time {
+		return model.TimeFromUnixNano(start.Add(time.Duration(minutes) * time.Minute).UnixNano())
+	}
+	matrix := model.Matrix{
+		{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: at(1), Value: 1}, {Timestamp: at(4), Value: 4}}},
+		{Metric: model.Metric{"pod": "b"}, Values: []model.SamplePair{}},
+	}
+
+	assert.Equal(t, matrix, fillGaps(matrix, nil, r))
+	assert.Equal(t, matrix, fillGaps(matrix, &Gaps{Mode: gapsLeave}, r))
+
+	filled := fillGaps(matrix, &Gaps{Mode: gapsNull}, r)
+	assert.Len(t, filled[0].Values, 4)
+	for i, sample := range filled[0].Values {
+		assert.Equal(t, at(i+1), sample.Timestamp)
+	}
+	assert.True(t, math.IsNaN(float64(filled[0].Values[1].Value)))
+	assert.True(t, math.IsNaN(float64(filled[0].Values[2].Value)))
+	assert.Empty(t, filled[1].Values, "steps around the samples are not gaps")
+
+	filled = fillGaps(matrix, &Gaps{Mode: gapsConnect}, r)
+	assert.Equal(t, []model.SamplePair{{Timestamp: at(1), Value: 1}, {Timestamp: at(2), Value: 2}, {Timestamp: at(3), Value: 3}, {Timestamp: at(4), Value: 4}}, filled[0].Values)
+
+	filled = fillGaps(matrix, &Gaps{Mode: gapsValue, Value: -1}, r)
+	assert.Equal(t, []model.SamplePair{
+		{Timestamp: at(0), Value: -1}, {Timestamp: at(1), Value: 1}, {Timestamp: at(2), Value: -1},
+		{Timestamp: at(3), Value: -1}, {Timestamp: at(4), Value: 4}, {Timestamp: at(5), Value: -1},
+	}, filled[0].Values)
+	assert.Len(t, filled[1].Values, 6, "empty series are filled over the whole range")
+
+	assert.Len(t, matrix[0].Values, 2, "the samples of the matrix are left untouched")
+	assert.Equal(t, matrix, fillGaps(matrix, &Gaps{Mode: gapsValue}, v1.Range{Start: start, End: start}), "instant results have no gaps")
+}
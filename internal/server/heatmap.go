@@ -0,0 +1,84 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+// graphTypeHeatmap is the graphType of graphs over histogram bucket series,
+// whose response carries a Heatmap.
+const graphTypeHeatmap = "heatmap"
+
+// Heatmap is the result of a histogram graph arranged for heatmap panels:
+// the number of observations of every bucket at every timestamp.
+type Heatmap struct {
+	// Buckets are the upper bounds of the buckets, i.e. their le label,
+	// sorted in ascending order.
+	Buckets    []string     `json:"buckets"`
+	Timestamps []model.Time `json:"timestamps"`
+	// Values holds a row per bucket, with a value per timestamp. Values
+	// are per bucket rather than cumulative like the le series, and are 0
+	// where no series has a sample.
+	Values [][]float64 `json:"values"`
+}
+
+// heatmapOf groups the series of a histogram by their le label into a
+// Heatmap. Series with the same le, e.g. of different pods, are summed, and
+// series without a valid le label are left out.
+func heatmapOf(matrix model.Matrix) *Heatmap {
+	type bucket struct {
+		le     string
+		bound  float64
+		values map[model.Time]float64
+	}
+	buckets := map[string]*bucket{}
+	seen := map[model.Time]bool{}
+	for _, series := range matrix {
+		le := string(series.Metric[model.BucketLabel])
+		bound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			continue
+		}
+		b, ok := buckets[le]
+		if !ok {
+			b = &bucket{le: le, bound: bound, values: map[model.Time]float64{}}
+			buckets[le] = b
+		}
+		for _, sample := range series.Values {
+			if math.IsNaN(float64(sample.Value)) {
+				continue
+			}
+			b.values[sample.Timestamp] += float64(sample.Value)
+			seen[sample.Timestamp] = true
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, b := range buckets {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].bound < sorted[j].bound })
+	heatmap := &Heatmap{Buckets: []string{}, Timestamps: []model.Time{}, Values: [][]float64{}}
+	for ts := range seen {
+		heatmap.Timestamps = append(heatmap.Timestamps, ts)
+	}
+	sort.Slice(heatmap.Timestamps, func(i, j int) bool { return heatmap.Timestamps[i] < heatmap.Timestamps[j] })
+
+	for i, b := range sorted {
+		row := make([]float64, len(heatmap.Timestamps))
+		for j, ts := range heatmap.Timestamps {
+			row[j] = b.values[ts]
+			if i > 0 {
+				// Buckets are cumulative: keep the observations of this
+				// bucket only.
+				row[j] = math.Max(0, row[j]-sorted[i-1].values[ts])
+			}
+		}
+		heatmap.Buckets = append(heatmap.Buckets, b.le)
+		heatmap.Values = append(heatmap.Values, row)
+	}
+	return heatmap
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeatmapOf(t *testing.T) {
+	bucket := func(pod, le string, values ...model.SampleValue) *model.SampleStream {
+		stream := &model.SampleStream{Metric: model.Metric{"pod": model.LabelValue(pod), "le": model.LabelValue(le)}}
+		for i, v := range values {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(i * 60000), Value: v})
+		}
+		return stream
+	}
+	matrix := model.Matrix{
+		bucket("a", "+Inf", 10, 12),
+		bucket("a", "0.1", 4, 4),
+		bucket("a", "0.5", 8, 9),
+		bucket("b", "0.1", 1, 2),
+		bucket("b", "0.5", 1, 2),
+		bucket("b", "+Inf", 1, 2),
+		{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 0, Value: 100}}},
+	}
+
+	assert.Equal(t, &Heatmap{
+		Buckets:    []string{"0.1", "0.5", "+Inf"},
+		Timestamps: []model.Time{0, 60000},
+		Values:     [][]float64{{5, 6}, {4, 5}, {2, 3}},
+	}, heatmapOf(matrix))
+
+	assert.Equal(t, &Heatmap{Buckets: []string{}, Timestamps: []model.Time{}, Values: [][]float64{}}, heatmapOf(model.Matrix{}))
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// LabelValuesResponse is the response of a label values request.
+type LabelValuesResponse struct {
+	Label    string   `json:"label"`
+	Values   []string `json:"values"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// labelValues returns the values of a label over the requested duration,
+// sorted and deduplicated, e.g. to fill the dropdown of a query param.
+// The values can be restricted to the series of the match[] selectors, and
+// read from a datasource other than the provider with ?datasource. The
+// selectors must be allowed by the query policy of the application, which
+// requires them when it restricts the metrics.
+func (pp *PrometheusProvider) labelValues(ctx *gin.Context) {
+	label := ctx.Param("label")
+	if !model.LabelName(label).IsValid() {
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid label name %q", label))
+		return
+	}
+	app := pp.config.getApp(ctx.Param("application"))
+	if app == nil {
+		writeQueryError(ctx, newNotFoundError("Requested/Default Application not found"))
+		return
+	}
+	duration := pp.options.DefaultDuration
+	if durationStr := ctx.Query("duration"); durationStr != "" {
+		var err error
+		duration, err = parseDuration(durationStr)
+		if err != nil {
+			writeQueryError(ctx, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid duration %q: %s", durationStr, err)))
+			return
+		}
+	}
+	if err := checkDuration(duration, pp.options); err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	matches := ctx.QueryArray("match[]")
+	for _, match := range matches {
+		if _, err := parser.ParseMetricSelector(match); err != nil {
+			writeError(ctx, http.StatusBadRequest, errCodeInvalidQuery, fmt.Sprintf("Invalid selector %q: %s", match, err))
+			return
+		}
+		if app.QueryPolicy != nil {
+			if err := app.QueryPolicy.check(match); err != nil {
+				writeQueryError(ctx, err)
+				return
+			}
+		}
+	}
+	if len(matches) == 0 && app.QueryPolicy != nil && len(app.QueryPolicy.Metrics) > 0 {
+		writeQueryError(ctx, newQueryError(http.StatusForbidden, "The query policy of the application requires a match[] selector"))
+		return
+	}
+	if len(app.EnforcedLabels) > 0 {
+		if len(matches) == 0 {
+			matches = []string{enforcedSelector(app.EnforcedLabels)}
+		}
+		for i, match := range matches {
+			var err error
+			if matches[i], err = enforceLabels(match, app.EnforcedLabels); err != nil {
+				writeQueryError(ctx, err)
+				return
+			}
+		}
+	}
+
+	queryCtx, err := pp.requestContext(ctx)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+
+	end := time.Now()
+	values, warnings, err := pp.queryLabelValues(queryCtx, label, matches, end.Add(-duration), end)
+	if err != nil {
+		pp.logger.Errorf("Error querying the values of label %s: %s", label, err)
+		writeQueryError(ctx, classifyQueryError(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, LabelValuesResponse{Label: label, Values: values, Warnings: warnings})
+}
+
+// queryLabelValues returns the sorted, deduplicated values of label between
+// start and end from the datasource of ctx, within the limits, retries and
+// circuit breaker of range queries but without caching them.
+func (pp *PrometheusProvider) queryLabelValues(ctx context.Context, label string, matches []string, start time.Time, end time.Time) ([]string, []string, error) {
+	var result model.LabelValues
+	var warnings []string
+	err := pp.callAPI(ctx, "the values of label "+label, func(ctx context.Context, client v1.API) error {
+		var err error
+		result, warnings, err = client.LabelValues(ctx, label, matches, start, end)
+		return err
+	})
+	if err != nil {
+		return nil, warnings, err
+	}
+	values := make([]string, 0, len(result))
+	seen := make(map[model.LabelValue]bool, len(result))
+	for _, value := range result {
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, string(value))
+		}
+	}
+	sort.Strings(values)
+	return values, warnings, nil
+}
+
+// requestContext returns the context of the request, carrying the tenant
+// of the request and the datasource of ?datasource, if any, that the
+// queries of the request are sent to.
+func (pp *PrometheusProvider) requestContext(ctx *gin.Context) (context.Context, error) {
+	queryCtx := ctx.Request.Context()
+	tenant, err := pp.requestTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenant != "" {
+		queryCtx = withTenant(queryCtx, tenant)
+	}
+	if name := ctx.Query("datasource"); name != "" && name != pp.config.Provider.Name {
+		if !pp.config.hasDatasource(name) {
+			return nil, newNotFoundError(fmt.Sprintf("Requested Datasource %s not found", name))
+		}
+		queryCtx = withDatasource(queryCtx, name)
+	}
+	return queryCtx, nil
+}
+
+// callAPI calls fn with the client of the datasource of ctx, within the
+// concurrent query limit, timeout, retries and circuit breaker of range
+// queries. It is meant for the API calls other than queries, description
+// naming what fn requests in the logs.
+func (pp *PrometheusProvider) callAPI(ctx context.Context, description string, fn func(ctx context.Context, client v1.API) error) error {
+	client, err := pp.api(ctx)
+	if err != nil {
+		return err
+	}
+	breaker := pp.breaker(ctx)
+	if err := breaker.allow(); err != nil {
+		return err
+	}
+	callCtx := ctx
+	if pp.options.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, pp.options.QueryTimeout)
+		defer cancel()
+	}
+	err = retryWithBackoff(callCtx, pp.options.QueryMaxAttempts, pp.options.QueryRetryBaseDelay, func() error {
+		release, err := pp.limiter.acquire(callCtx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		err = fn(callCtx, client)
+		if _, ok := rateLimitedError(err); ok {
+			pp.metrics.queryRateLimited(pp.datasourceName(ctx))
+		}
+		return err
+	}, func() {
+		pp.logger.Warnf("Retrying %s after transient error", description)
+	})
+	if ctx.Err() != nil || errors.Is(err, errTooManyQueries) {
+		breaker.abort()
+	} else {
+		breaker.record(err)
+	}
+	return err
+}
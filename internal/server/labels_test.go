@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getTestLabelValues requests the values of label of the test application
+// from pp with the given query params.
+func getTestLabelValues(pp *PrometheusProvider, label string, query url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": "app", "label": label}, nil)
+	ctx.Request.URL.RawQuery = query.Encode()
+	pp.labelValues(ctx)
+	return w
+}
+
+func TestLabelValues(t *testing.T) {
+	var requested *http.Request
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		requested = r
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": ["web", "shop", "web", "api"]}`))
+	})
+
+	w := getTestLabelValues(pp, "namespace", url.Values{"match[]": {`up{job="kubelet"}`, `kube_pod_info`}, "duration": {"6h"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response LabelValuesResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, LabelValuesResponse{Label: "namespace", Values: []string{"api", "shop", "web"}}, response, "values are sorted and deduplicated")
+	assert.Equal(t, "/api/v1/label/namespace/values", requested.URL.Path)
+	assert.Equal(t, []string{`up{job="kubelet"}`, `kube_pod_info`}, requested.Form["match[]"])
+	assert.NotEmpty(t, requested.Form.Get("start"))
+
+	w = getTestLabelValues(pp, "name-with-dash", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Invalid label name \"name-with-dash\"`)
+
+	w = getTestLabelValues(pp, "namespace", url.Values{"match[]": {`sum(up)`}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeInvalidQuery)
+
+	w = getTestLabelValues(pp, "namespace", url.Values{"duration": {"forever"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = getTestLabelValues(pp, "namespace", url.Values{"datasource": {"missing"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeNotFound)
+}
+
+func TestLabelValuesPolicy(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": ["shop"]}`))
+	})
+	pp.config.Applications[0].QueryPolicy = &QueryPolicy{Metrics: []string{"kube_pod_info"}}
+
+	w := getTestLabelValues(pp, "namespace", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, "a selector is required when the metrics are restricted")
+
+	w = getTestLabelValues(pp, "namespace", url.Values{"match[]": {`up`}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = getTestLabelValues(pp, "namespace", url.Values{"match[]": {`kube_pod_info{namespace!=""}`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLabelValuesUnreachable(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	w := getTestLabelValues(pp, "namespace", nil)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeQueryFailed)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/prometheus/common/model"
+)
+
+// LegendSeries is a series of a graph response along with its legend.
+type LegendSeries struct {
+	Metric model.Metric       `json:"metric"`
+	Values []model.SamplePair `json:"values"`
+	// Legend is the legendFormat of the graph rendered against the labels
+	// of the series, or the full label set when the graph has none.
+	Legend string `json:"legend"`
+}
+
+// parseLegendFormat parses a Grafana style legend format, e.g. {{ .pod }}.
+// Labels missing from a series render as empty strings.
+func parseLegendFormat(legendFormat string) (*template.Template, error) {
+	return template.New("legend").Option("missingkey=zero").Parse(legendFormat)
+}
+
+// legender renders the legends of the series of a graph.
+type legender struct {
+	tmpl *template.Template
+}
+
+// newLegender returns a legender for legendFormat. Series are labeled with
+// their full label set when legendFormat is empty or invalid, invalid
+// formats being rejected when the config is loaded.
+func newLegender(legendFormat string) legender {
+	if legendFormat == "" {
+		return legender{}
+	}
+	tmpl, err := parseLegendFormat(legendFormat)
+	if err != nil {
+		return legender{}
+	}
+	return legender{tmpl: tmpl}
+}
+
+// legend returns the legend of the series labeled metric.
+func (l legender) legend(metric model.Metric) string {
+	if isOtherSeries(metric) {
+		return otherSeriesLegend
+	}
+	if l.tmpl == nil {
+		return metric.String()
+	}
+	labels := make(map[string]string, len(metric))
+	for name, value := range metric {
+		labels[string(name)] = string(value)
+	}
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, labels); err != nil {
+		return metric.String()
+	}
+	return buf.String()
+}
+
+// legendMatrix returns the series of matrix along with their legend.
+func legendMatrix(matrix model.Matrix, legendFormat string) []LegendSeries {
+	l := newLegender(legendFormat)
+	series := make([]LegendSeries, 0, len(matrix))
+	for _, stream := range matrix {
+		series = append(series, LegendSeries{Metric: stream.Metric, Values: stream.Values, Legend: l.legend(stream.Metric)})
+	}
+	return series
+}
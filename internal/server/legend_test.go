@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLegendMatrix(t *testing.T) {
+	matrix := model.Matrix{
+		{Metric: model.Metric{"pod": "web-0", "container": "app"}},
+		{Metric: model.Metric{"pod": "web-1"}},
+	}
+	tests := []struct {
+		legendFormat string
+		expected     []string
+	}{
+		{legendFormat: "", expected: []string{`{container="app", pod="web-0"}`, `{pod="web-1"}`}},
+		{legendFormat: "{{ .pod }}", expected: []string{"web-0", "web-1"}},
+		{legendFormat: "{{ .pod }}/{{ .container }}", expected: []string{"web-0/app", "web-1/"}},
+		{legendFormat: "{{ .pod", expected: []string{`{container="app", pod="web-0"}`, `{pod="web-1"}`}},
+	}
+	for _, tt := range tests {
+		var legends []string
+		for _, series := range legendMatrix(matrix, tt.legendFormat) {
+			legends = append(legends, series.Legend)
+		}
+		assert.Equal(t, tt.expected, legends, tt.legendFormat)
+	}
+}
+
+func TestConfigValidateLegendFormat(t *testing.T) {
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows:      []*Row{{Name: "pod", Graphs: []*Graph{{Name: "cpu", LegendFormat: "{{ .pod"}}}},
+		}}},
+	}}
+	assert.ErrorContains(t, config.validate(), "application app, dashboard pod, row pod, graph cpu: invalid legendFormat")
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// errTooManyQueries is returned for queries that found no free query slot
+// in time.
+var errTooManyQueries = newQueryError(http.StatusTooManyRequests, "Too many concurrent queries, retry later")
+
+// queryLimiter bounds the number of concurrent queries against the provider
+// so that a burst of refreshes can not overload it. Queries wait at most
+// queueTimeout for a free slot. A nil queryLimiter does not limit queries.
+type queryLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	metrics      *serverMetrics
+}
+
+// newQueryLimiter returns a limiter allowing maxConcurrent queries, or nil
+// when maxConcurrent is not positive.
+func newQueryLimiter(maxConcurrent int, queueTimeout time.Duration, metrics *serverMetrics) *queryLimiter {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &queryLimiter{
+		slots:        make(chan struct{}, maxConcurrent),
+		queueTimeout: queueTimeout,
+		metrics:      metrics,
+	}
+}
+
+// acquire waits for a free query slot, returning the function releasing it.
+// It fails with errTooManyQueries when no slot frees up within the queue
+// timeout, or with the context error when ctx is done first.
+func (l *queryLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(), nil
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		l.metrics.queriesRejected.Inc()
+		return nil, errTooManyQueries
+	}
+
+	l.metrics.queriesQueued.Inc()
+	defer l.metrics.queriesQueued.Dec()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(), nil
+	case <-timer.C:
+		l.metrics.queriesRejected.Inc()
+		return nil, errTooManyQueries
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *queryLimiter) acquired() func() {
+	l.metrics.queriesInFlight.Inc()
+	return func() {
+		l.metrics.queriesInFlight.Dec()
+		<-l.slots
+	}
+}
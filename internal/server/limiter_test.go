@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	metrics := newServerMetrics()
+	limiter := newQueryLimiter(1, 50*time.Millisecond, metrics)
+
+	release, err := limiter.acquire(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.queriesInFlight))
+
+	_, err = limiter.acquire(context.Background())
+	assert.ErrorIs(t, err, errTooManyQueries, "no slot freed up within the queue timeout")
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.queriesRejected))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.queriesQueued))
+
+	acquired := make(chan error)
+	go func() {
+		release, err := limiter.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	assert.NoError(t, <-acquired, "a queued query gets the released slot")
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.queriesInFlight))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release, err = limiter.acquire(ctx)
+	assert.NoError(t, err, "a free slot is taken even when ctx is done")
+	_, err = limiter.acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	release()
+
+	limiter = newQueryLimiter(1, 0, metrics)
+	release, err = limiter.acquire(context.Background())
+	assert.NoError(t, err)
+	_, err = limiter.acquire(context.Background())
+	assert.ErrorIs(t, err, errTooManyQueries, "queries are rejected immediately without queue timeout")
+	release()
+
+	var unlimited *queryLimiter
+	release, err = unlimited.acquire(context.Background())
+	assert.NoError(t, err)
+	release()
+}
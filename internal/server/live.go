@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minLiveInterval bounds how often live graphs are queried again.
+const minLiveInterval = 5 * time.Second
+
+// Events of a live graph stream.
+const (
+	liveEventGraph = "graph"
+	liveEventError = "error"
+)
+
+// liveInterval returns the interval live updates of graph are pushed at:
+// ?interval if set, else the step of the graph queries, at least
+// minLiveInterval.
+func liveInterval(ctx *gin.Context, graph *Graph, req graphRequest, options Options) (time.Duration, error) {
+	if value := ctx.Query("interval"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < minLiveInterval {
+			return 0, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid interval %q: must be a duration of at least %s", value, minLiveInterval))
+		}
+		return interval, nil
+	}
+	step, err := graphStep(graph, req, options)
+	if err != nil {
+		return 0, err
+	}
+	if step < minLiveInterval {
+		return minLiveInterval, nil
+	}
+	return step, nil
+}
+
+// executeLive streams a graph as Server-Sent Events: the graph is queried
+// again every interval and, when its response changed, pushed as a graph
+// event holding an AggregatedResponse. Failed queries are pushed as error
+// events holding an ErrorDetail, and the stream goes on until the client
+// disconnects.
+func (pp *PrometheusProvider) executeLive(ctx *gin.Context) {
+	req, err := pp.newGraphRequest(ctx)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	if !req.at.IsZero() {
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, "Live graphs can not be evaluated at a fixed time")
+		return
+	}
+	row, err := pp.getRow(&req)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	graph := row.getGraph(req.graph)
+	if graph == nil {
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested Graph not found")
+		return
+	}
+	interval, err := liveInterval(ctx, graph, req, pp.options)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+
+	// The stream outlives the write timeout of the server.
+	if err := http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		pp.logger.Warnf("Error clearing the write deadline of live graph %s: %v", graph.Name, err)
+	}
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last string
+	for {
+		last = pp.pushLiveGraph(ctx, graph, req, last)
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pushLiveGraph queries graph and pushes its response unless its ETag is
+// last, returning the ETag of the latest pushed response.
+func (pp *PrometheusProvider) pushLiveGraph(ctx *gin.Context, graph *Graph, req graphRequest, last string) string {
+	data, result, err := pp.evaluateGraph(ctx.Request.Context(), graph, req)
+	if err == nil {
+		err = data.setData(result, graph.LegendFormat)
+	}
+	var body []byte
+	if err == nil {
+		body, err = pp.marshalResponse(data)
+	}
+	if err != nil {
+		if ctx.Request.Context().Err() != nil {
+			return last
+		}
+		_, detail := queryErrorDetail(ctx, err)
+		ctx.SSEvent(liveEventError, detail)
+		ctx.Writer.Flush()
+		return ""
+	}
+	etag := computeETag(body)
+	if etag == last {
+		return last
+	}
+	ctx.SSEvent(liveEventGraph, json.RawMessage(body))
+	ctx.Writer.Flush()
+	return etag
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteLive(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"},
+		`[{"metric": {"pod": "a"}, "values": [[1700000000, "1"], [1700000060, "2"]]}]`)
+
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": "app", "groupkind": "pod", "row": "row", "graph": "graph"}, nil)
+	requestCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ctx.Request = ctx.Request.WithContext(requestCtx)
+	pp.executeLive(ctx)
+
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "event:graph\ndata:{"), w.Body.String())
+	assert.Contains(t, w.Body.String(), `"seriesCount":1`)
+
+	w = httptest.NewRecorder()
+	ctx = GetTestGinContext(w)
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": "app", "groupkind": "pod", "row": "row", "graph": "graph"}, map[string]string{"interval": "1s"})
+	pp.executeLive(ctx)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
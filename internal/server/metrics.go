@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes the name of the metrics of the server.
+const metricsNamespace = "argocd_metrics_server"
+
+// serverMetrics holds the metrics the server exposes on /metrics.
+type serverMetrics struct {
+	registry        *prometheus.Registry
+	queriesInFlight prometheus.Gauge
+	queriesQueued   prometheus.Gauge
+	queriesRejected prometheus.Counter
+	// responsesRejected counts the responses over MaxResponseBytes.
+	responsesRejected prometheus.Counter
+	// breakerOpen tells, per datasource, whether its circuit breaker is
+	// open, and queriesShortCircuited counts the queries it failed fast.
+	breakerOpen           *prometheus.GaugeVec
+	queriesShortCircuited *prometheus.CounterVec
+	// queriesRateLimited counts, per datasource, the queries it rejected
+	// with a 429.
+	queriesRateLimited *prometheus.CounterVec
+	// clientRequestsRejected counts, per client, the requests rejected
+	// for exceeding the client rate limit.
+	clientRequestsRejected *prometheus.CounterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		queriesInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_in_flight",
+			Help:      "Number of queries being executed against the provider.",
+		}),
+		queriesQueued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_queued",
+			Help:      "Number of queries waiting for a free query slot.",
+		}),
+		queriesRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_rejected_total",
+			Help:      "Number of queries rejected because no query slot freed up in time.",
+		}),
+		responsesRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "responses_rejected_total",
+			Help:      "Number of responses rejected for exceeding the maximum response size.",
+		}),
+		breakerOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "datasource_circuit_open",
+			Help:      "Whether the circuit breaker of the datasource is open, failing its queries fast.",
+		}, []string{"datasource"}),
+		queriesShortCircuited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_short_circuited_total",
+			Help:      "Number of queries failed fast by the open circuit breaker of their datasource.",
+		}, []string{"datasource"}),
+		queriesRateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_rate_limited_total",
+			Help:      "Number of queries rejected with a 429 by their rate limited datasource, retries included.",
+		}, []string{"datasource"}),
+		clientRequestsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "client_requests_rate_limited_total",
+			Help:      "Number of requests rejected for exceeding the rate limit of their client.",
+		}, []string{"client"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.queriesInFlight,
+		m.queriesQueued,
+		m.queriesRejected,
+		m.responsesRejected,
+		m.breakerOpen,
+		m.queriesShortCircuited,
+		m.queriesRateLimited,
+		m.clientRequestsRejected,
+	)
+	return m
+}
+
+// responseRejected records a response rejected for its size. It is a no-op
+// on a nil serverMetrics, e.g. for providers created outside of a server.
+func (m *serverMetrics) responseRejected() {
+	if m != nil {
+		m.responsesRejected.Inc()
+	}
+}
+
+// setBreakerOpen records whether the circuit breaker of datasource is open.
+// It is a no-op on a nil serverMetrics.
+func (m *serverMetrics) setBreakerOpen(datasource string, open bool) {
+	if m == nil {
+		return
+	}
+	value := 0.0
+	if open {
+		value = 1
+	}
+	m.breakerOpen.WithLabelValues(datasource).Set(value)
+}
+
+// queryShortCircuited records a query failed fast by the circuit breaker of
+// datasource. It is a no-op on a nil serverMetrics.
+func (m *serverMetrics) queryShortCircuited(datasource string) {
+	if m != nil {
+		m.queriesShortCircuited.WithLabelValues(datasource).Inc()
+	}
+}
+
+// queryRateLimited records a query rejected with a 429 by datasource. It is
+// a no-op on a nil serverMetrics.
+func (m *serverMetrics) queryRateLimited(datasource string) {
+	if m != nil {
+		m.queriesRateLimited.WithLabelValues(datasource).Inc()
+	}
+}
+
+// clientRequestRejected records a request of client rejected by the client
+// rate limiter. It is a no-op on a nil serverMetrics.
+func (m *serverMetrics) clientRequestRejected(client string) {
+	if m != nil {
+		m.clientRequestsRejected.WithLabelValues(client).Inc()
+	}
+}
+
+// handler returns the handler serving the metrics in the Prometheus
+// exposition format.
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
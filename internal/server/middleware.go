@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// corsMiddleware sets the CORS headers for requests coming from one of the
+// allowed origins and answers their preflight requests. Requests from other
+// origins get no CORS headers, and their preflight requests are rejected.
+func corsMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if !allowed["*"] && !allowed[origin] {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+		if preflight {
+			header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if requested := c.GetHeader("Access-Control-Request-Headers"); requested != "" {
+				header.Set("Access-Control-Allow-Headers", requested)
+			}
+			header.Set("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminAuthMiddleware only lets through requests bearing token in their
+// Authorization header. All requests are rejected when token is empty, so
+// admin endpoints are disabled unless a token is configured.
+func adminAuthMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			writeError(c, http.StatusForbidden, errCodeForbidden, "Admin endpoints are disabled, set --adminToken to enable them")
+			c.Abort()
+			return
+		}
+		bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			writeError(c, http.StatusUnauthorized, errCodeUnauthorized, "Invalid or missing admin token")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// accessLogMiddleware logs every request once served. Health checks, under
+// basePath, are logged at debug level so probes do not flood the logs.
+func accessLogMiddleware(logger *zap.SugaredLogger, basePath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		log := logger.Infow
+		if path := strings.TrimPrefix(c.Request.URL.Path, basePath); path == "" || path == "/" || path == "/healthz" {
+			log = logger.Debugw
+		}
+		log("Request served",
+			"requestId", c.GetString(requestIDKey),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+			"clientIP", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		)
+	}
+}
+
+// requestIDHeader carries the ID of a request, in requests and responses.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key of the request ID.
+const requestIDKey = "requestId"
+
+// maxRequestIDLength bounds the length of request IDs sent by clients.
+const maxRequestIDLength = 128
+
+// requestIDMiddleware identifies every request with the ID sent by the
+// client in X-Request-ID, or a generated one, and returns it in the
+// response X-Request-ID header.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// validRequestID reports whether a request ID sent by a client is safe to
+// log and return.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// recoveryMiddleware recovers from panics of the handlers, logging the
+// panic with its stack trace and answering a 500 error carrying the request
+// ID only, so that no internal detail leaks to the client.
+func recoveryMiddleware(logger *zap.SugaredLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Aborted on purpose, e.g. when the client went away.
+				panic(recovered)
+			}
+			logger.Errorw("Panic serving request",
+				"requestId", c.GetString(requestIDKey),
+				"method", c.Request.Method,
+				"path", c.Request.URL.Path,
+				"panic", recovered,
+				"stack", string(debug.Stack()),
+			)
+			if !c.Writer.Written() {
+				writeError(c, http.StatusInternalServerError, errCodeInternal, "Internal server error")
+			}
+			c.Abort()
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := gin.New()
+	handler.Use(corsMiddleware([]string{"http://localhost:4000"}))
+	handler.GET("/healthz", func(c *gin.Context) {
+		c.String(http.StatusOK, "healthy")
+	})
+
+	tests := []struct {
+		testName       string
+		method         string
+		origin         string
+		expectedCode   int
+		expectedOrigin string
+	}{
+		{testName: "Same origin request gets no CORS headers", method: http.MethodGet, expectedCode: 200},
+		{testName: "Allowed origin gets CORS headers", method: http.MethodGet, origin: "http://localhost:4000", expectedCode: 200, expectedOrigin: "http://localhost:4000"},
+		{testName: "Disallowed origin gets no CORS headers", method: http.MethodGet, origin: "http://evil.example", expectedCode: 200},
+		{testName: "Preflight from allowed origin is answered", method: http.MethodOptions, origin: "http://localhost:4000", expectedCode: 204, expectedOrigin: "http://localhost:4000"},
+		{testName: "Preflight from disallowed origin is rejected", method: http.MethodOptions, origin: "http://evil.example", expectedCode: 403},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(test.method, "/healthz", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			if test.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, test.expectedCode, w.Code)
+			assert.Equal(t, test.expectedOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+		})
+	}
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		testName      string
+		token         string
+		authorization string
+		expectedCode  int
+	}{
+		{testName: "Disabled without a token", authorization: "Bearer secret", expectedCode: 403},
+		{testName: "Missing authorization", token: "secret", expectedCode: 401},
+		{testName: "Wrong token", token: "secret", authorization: "Bearer wrong", expectedCode: 401},
+		{testName: "Not a bearer token", token: "secret", authorization: "secret", expectedCode: 401},
+		{testName: "Valid token", token: "secret", authorization: "Bearer secret", expectedCode: 200},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			handler := gin.New()
+			handler.POST("/api/reload", adminAuthMiddleware(test.token), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/reload", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, test.expectedCode, w.Code)
+		})
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	core, logs := observer.New(zap.DebugLevel)
+	handler := gin.New()
+	handler.Use(accessLogMiddleware(zap.New(core).Sugar(), ""))
+	handler.GET("/healthz", func(c *gin.Context) {
+		c.String(http.StatusOK, "healthy")
+	})
+	handler.GET("/api/applications", func(c *gin.Context) {
+		c.String(http.StatusOK, "[]")
+	})
+
+	for _, path := range []string{"/healthz", "/api/applications"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	entries := logs.All()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, zap.DebugLevel, entries[0].Level)
+	assert.Equal(t, zap.InfoLevel, entries[1].Level)
+	fields := entries[1].ContextMap()
+	assert.Equal(t, "GET", fields["method"])
+	assert.Equal(t, "/api/applications", fields["path"])
+	assert.EqualValues(t, http.StatusOK, fields["status"])
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	core, logs := observer.New(zap.ErrorLevel)
+	handler := gin.New()
+	handler.Use(requestIDMiddleware(), recoveryMiddleware(zap.New(core).Sugar()))
+	handler.GET("/panic", func(c *gin.Context) {
+		var dashboards map[string]*Dashboard
+		dashboards["pod"].Rows = nil
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+	assert.JSONEq(t, `{"error": {"code": "internal", "message": "Internal server error", "requestId": "req-42"}}`, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "goroutine")
+
+	entries := logs.All()
+	assert.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "req-42", fields["requestId"])
+	assert.Contains(t, fields["stack"], "runtime/debug.Stack")
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := gin.New()
+	handler.Use(requestIDMiddleware())
+	handler.GET("/healthz", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(requestIDKey))
+	})
+
+	for _, sent := range []string{"", "bad id\n", strings.Repeat("a", maxRequestIDLength+1)} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		req.Header.Set("X-Request-ID", sent)
+		handler.ServeHTTP(w, req)
+		id := w.Header().Get("X-Request-ID")
+		assert.Len(t, id, 32, "a request ID is generated for %q", sent)
+		assert.Equal(t, id, w.Body.String())
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockAPI is a Prometheus client answering every query with a canned
+// result, warnings and error, and recording the queries it receives. The
+// methods it does not implement panic through the nil embedded API.
+type mockAPI struct {
+	v1.API
+	result   model.Value
+	warnings v1.Warnings
+	err      error
+	rules    v1.RulesResult
+
+	mu      sync.Mutex
+	queries []string
+	// ranges holds the range of every range query.
+	ranges []v1.Range
+}
+
+func (m *mockAPI) Query(ctx context.Context, query string, ts time.Time, opts ...v1.Option) (model.Value, v1.Warnings, error) {
+	return m.answer(query)
+}
+
+func (m *mockAPI) QueryRange(ctx context.Context, query string, r v1.Range, opts ...v1.Option) (model.Value, v1.Warnings, error) {
+	m.mu.Lock()
+	m.ranges = append(m.ranges, r)
+	m.mu.Unlock()
+	return m.answer(query)
+}
+
+func (m *mockAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	return m.rules, m.err
+}
+
+func (m *mockAPI) answer(query string) (model.Value, v1.Warnings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries = append(m.queries, query)
+	return m.result, m.warnings, m.err
+}
+
+// newTestPrometheusProviderWithAPI returns a provider whose datasources all
+// query api rather than a live Prometheus.
+func newTestPrometheusProviderWithAPI(t *testing.T, graph *Graph, api v1.API) *PrometheusProvider {
+	pp := NewPrometheusProvider(newTestProviderConfig("http://prometheus.invalid", graph), logging.NewLogger(), Options{DefaultDuration: time.Hour, DefaultStep: time.Minute})
+	pp.newClient = func(config provider) (v1.API, map[string]bool, error) {
+		return api, nil, nil
+	}
+	assert.NoError(t, pp.init())
+	return pp
+}
+
+var (
+	testMatrix = model.Matrix{{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1700000000000, Value: 1}, {Timestamp: 1700000060000, Value: 2}}}}
+	testVector = model.Vector{{Metric: model.Metric{"pod": "a"}, Timestamp: 1700000060000, Value: 2}}
+	testScalar = &model.Scalar{Timestamp: 1700000060000, Value: 3}
+	testString = &model.String{Timestamp: 1700000060000, Value: "up"}
+)
+
+func TestExecuteGraphQueryMock(t *testing.T) {
+	r := v1.Range{Start: time.Unix(1700000000, 0), End: time.Unix(1700000060, 0), Step: time.Minute}
+	for _, tt := range []struct {
+		name     string
+		api      *mockAPI
+		expected model.Value
+		status   int
+		code     string
+		errMsg   string
+	}{
+		{name: "matrix", api: &mockAPI{result: testMatrix}, expected: testMatrix},
+		{name: "vector", api: &mockAPI{result: testVector}, expected: testVector},
+		{name: "scalar", api: &mockAPI{result: testScalar}, expected: testScalar},
+		{name: "string", api: &mockAPI{result: testString}, expected: testString},
+		{name: "empty", api: &mockAPI{result: model.Matrix{}}, expected: model.Matrix{}},
+		{name: "warnings", api: &mockAPI{result: testMatrix, warnings: v1.Warnings{"partial response"}}, expected: testMatrix, errMsg: "query warnings: [partial response]"},
+		{name: "invalid query", api: &mockAPI{err: &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}}, status: http.StatusBadRequest, code: errCodeInvalidQuery},
+		{name: "execution error", api: &mockAPI{err: &v1.Error{Type: v1.ErrExec, Msg: "many-to-many matching not allowed"}}, status: http.StatusBadRequest, code: errCodeInvalidQuery},
+		{name: "unreachable", api: &mockAPI{err: errors.New("connection refused")}, status: http.StatusBadGateway, code: errCodeQueryFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph"}, tt.api)
+			result, _, err := executeGraphQuery(context.Background(), `up{pod="{{.pod}}"}`, map[string][]string{"pod": {"a"}}, r, pp)
+			assert.Equal(t, []string{`up{pod="a"}`}, tt.api.queries)
+			assert.Equal(t, tt.expected, result)
+			switch {
+			case tt.code != "":
+				var qe *queryError
+				assert.ErrorAs(t, err, &qe)
+				assert.Equal(t, tt.status, qe.status)
+				assert.Equal(t, tt.code, qe.code)
+			case tt.errMsg != "":
+				assert.EqualError(t, err, tt.errMsg)
+			default:
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestExecuteMock(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		api    *mockAPI
+		status int
+		series int
+		empty  bool
+		code   string
+	}{
+		{name: "matrix", api: &mockAPI{result: testMatrix}, status: http.StatusOK, series: 1},
+		{name: "vector", api: &mockAPI{result: testVector}, status: http.StatusOK, series: 1},
+		{name: "scalar", api: &mockAPI{result: testScalar}, status: http.StatusOK, series: 1},
+		{name: "string", api: &mockAPI{result: testString}, status: http.StatusOK, series: 1},
+		{name: "empty", api: &mockAPI{result: model.Matrix{}}, status: http.StatusOK, empty: true},
+		{name: "warnings", api: &mockAPI{result: testMatrix, warnings: v1.Warnings{"partial response"}}, status: http.StatusBadRequest, code: errCodeQueryFailed},
+		{name: "invalid query", api: &mockAPI{err: &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}}, status: http.StatusBadRequest, code: errCodeInvalidQuery},
+		{name: "unreachable", api: &mockAPI{err: errors.New("connection refused")}, status: http.StatusBadGateway, code: errCodeQueryFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", QueryExpression: "up"}, tt.api)
+			w := executeTestGraph(pp, nil)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.code != "" {
+				assert.Contains(t, w.Body.String(), `"code":"`+tt.code+`"`)
+				return
+			}
+			var response AggregatedResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.series, response.SeriesCount)
+			assert.Equal(t, tt.empty, response.Empty)
+		})
+	}
+}
+
+func TestExecuteTopN(t *testing.T) {
+	api := &mockAPI{result: model.Matrix{
+		{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1700000000000, Value: 5}}},
+		{Metric: model.Metric{"pod": "b"}, Values: []model.SamplePair{{Timestamp: 1700000000000, Value: 1}}},
+		{Metric: model.Metric{"pod": "c"}, Values: []model.SamplePair{{Timestamp: 1700000000000, Value: 2}}},
+	}}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", QueryExpression: "up", TopN: &TopN{Count: 1, RankBy: rankByLast}}, api)
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.OtherSeries)
+	assert.Len(t, response.AllSeries, 3)
+	assert.JSONEq(t, `[
+		{"metric": {"pod": "a"}, "legend": "{pod=\"a\"}", "values": [[1700000000, "5"]]},
+		{"metric": {"other": "true"}, "legend": "Other", "values": [[1700000000, "3"]]}
+	]`, string(response.Data))
+
+	w = executeTestGraph(pp, map[string]string{"maxSeries": "2"})
+	response = AggregatedResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 0, response.OtherSeries, "?maxSeries overrides the topN of the graph")
+	assert.Equal(t, 2, response.SeriesCount)
+}
+
+func TestExecuteInstantThreshold(t *testing.T) {
+	api := &mockAPI{result: model.Matrix{{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1700000000000, Value: 5}}}}}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", QueryExpression: "usage", Thresholds: []Threshold{
+		{Key: "limit", QueryExpression: "limit", Instant: true},
+		{Key: "recent", QueryExpression: "recent", Duration: "10m"},
+	}}, api)
+
+	w := executeTestGraph(pp, map[string]string{"duration": "6h"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	ranges := map[string]v1.Range{}
+	for i, query := range api.queries {
+		ranges[query] = api.ranges[i]
+	}
+	graph := ranges["usage"]
+	assert.Equal(t, 6*time.Hour, graph.End.Sub(graph.Start))
+	assert.Equal(t, graph.End, ranges["limit"].Start, "instant thresholds are queried at the end of the graph")
+	assert.Equal(t, graph.End, ranges["limit"].End)
+	assert.Equal(t, 10*time.Minute, ranges["recent"].End.Sub(ranges["recent"].Start))
+
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	var limit model.Matrix
+	assert.NoError(t, json.Unmarshal(response.Thresholds[0].Data, &limit))
+	assert.Len(t, limit, 1)
+	assert.Len(t, limit[0].Values, 361, "instant thresholds are returned at every step of the graph")
+}
+
+func TestExecuteDebug(t *testing.T) {
+	api := &mockAPI{result: testMatrix}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", QueryExpression: `up{pod="{{.pod}}"}`}, api)
+
+	w := executeTestGraph(pp, map[string]string{"pod": "a", "duration": "1h", "step": "30s", "debug": "true"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, `up{pod="a"}`, response.Query)
+	assert.Nil(t, response.Queries)
+	assert.True(t, api.ranges[0].Start.Equal(*response.Start))
+	assert.True(t, api.ranges[0].End.Equal(*response.End))
+	assert.Equal(t, 30.0, response.Step)
+
+	w = executeTestGraph(pp, map[string]string{"pod": "a"})
+	assert.NotContains(t, w.Body.String(), `"query"`, "the query is only returned with ?debug=true")
+	assert.NotContains(t, w.Body.String(), `"start"`)
+
+	pp = newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", Queries: []GraphQuery{
+		{Name: "used", QueryExpression: `used{pod="{{.pod}}"}`},
+		{QueryExpression: "limit"},
+	}}, &mockAPI{result: testMatrix})
+	w = executeTestGraph(pp, map[string]string{"pod": "a", "debug": "true"})
+	response = AggregatedResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Empty(t, response.Query)
+	assert.Equal(t, map[string]string{"used": `used{pod="a"}`, "query2": "limit"}, response.Queries)
+}
+
+func TestExecuteEmptyAs(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		result model.Value
+		params map[string]string
+		status int
+	}{
+		{name: "empty", result: model.Matrix{}, params: map[string]string{"emptyAs": "204"}, status: http.StatusNoContent},
+		{name: "no samples", result: model.Matrix{{Metric: model.Metric{"pod": "a"}}}, params: map[string]string{"emptyAs": "204"}, status: http.StatusNoContent},
+		{name: "empty raw", result: model.Matrix{}, params: map[string]string{"emptyAs": "204", "format": "raw"}, status: http.StatusNoContent},
+		{name: "empty by default", result: model.Matrix{}, status: http.StatusOK},
+		{name: "empty as 200", result: model.Matrix{}, params: map[string]string{"emptyAs": "200"}, status: http.StatusOK},
+		{name: "matrix", result: testMatrix, params: map[string]string{"emptyAs": "204"}, status: http.StatusOK},
+		{name: "scalar", result: testScalar, params: map[string]string{"emptyAs": "204"}, status: http.StatusOK},
+		{name: "invalid", result: model.Matrix{}, params: map[string]string{"emptyAs": "404"}, status: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", QueryExpression: "up"}, &mockAPI{result: tt.result})
+			w := executeTestGraph(pp, tt.params)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusNoContent {
+				assert.Empty(t, w.Body.String())
+				assert.NotEmpty(t, w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
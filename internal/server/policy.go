@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// QueryPolicy restricts the PromQL the queries of an application may use,
+// so that dashboard authors can not run arbitrary, e.g. high cardinality
+// topk, queries against a shared Prometheus. Rendered queries are parsed
+// and rejected with a 403 before they are executed when they use a metric
+// or a function that is not allowed. An empty list allows them all.
+type QueryPolicy struct {
+	// Metrics are the metric names the queries may select. Selectors
+	// without an exact metric name, e.g. {__name__=~"http_.*"}, are
+	// rejected when set.
+	Metrics []string `json:"metrics,omitempty"`
+	// Functions are the PromQL functions and aggregation operators, e.g.
+	// rate or sum, the queries may use.
+	Functions []string `json:"functions,omitempty"`
+}
+
+// validate checks that the allowed functions are known PromQL functions or
+// aggregation operators.
+func (p *QueryPolicy) validate() error {
+	for _, name := range p.Functions {
+		if !isPromQLFunction(name) {
+			return fmt.Errorf("unknown PromQL function %q", name)
+		}
+	}
+	return nil
+}
+
+// isPromQLFunction returns whether name is a PromQL function or aggregation
+// operator.
+func isPromQLFunction(name string) bool {
+	if _, ok := parser.Functions[name]; ok {
+		return true
+	}
+	for typ, s := range parser.ItemTypeStr {
+		if s == name && typ.IsAggregator() {
+			return true
+		}
+	}
+	return false
+}
+
+// check parses query and returns a 403 error naming the first metric or
+// function it uses that is not allowed, in the order they appear in the
+// query.
+func (p *QueryPolicy) check(query string) error {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return &queryError{status: http.StatusBadRequest, code: errCodeInvalidQuery, message: "invalid query: " + err.Error()}
+	}
+	var violation string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if violation != "" {
+			return nil
+		}
+		switch n := node.(type) {
+		case *parser.Call:
+			if !allowed(p.Functions, n.Func.Name) {
+				violation = fmt.Sprintf("function %s", n.Func.Name)
+			}
+		case *parser.AggregateExpr:
+			if op := n.Op.String(); !allowed(p.Functions, op) {
+				violation = fmt.Sprintf("aggregation %s", op)
+			}
+		case *parser.VectorSelector:
+			if len(p.Metrics) == 0 {
+				return nil
+			}
+			name := selectorMetricName(n)
+			if name == "" {
+				violation = "a selector without a metric name"
+			} else if !allowed(p.Metrics, name) {
+				violation = fmt.Sprintf("metric %s", name)
+			}
+		}
+		return nil
+	})
+	if violation != "" {
+		return newQueryError(http.StatusForbidden, fmt.Sprintf("Query uses %s, which is not allowed for the application", violation))
+	}
+	return nil
+}
+
+// selectorMetricName returns the metric name a selector matches exactly, or
+// an empty string when it matches any or several metrics.
+func selectorMetricName(vs *parser.VectorSelector) string {
+	if vs.Name != "" {
+		return vs.Name
+	}
+	for _, m := range vs.LabelMatchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// allowed returns whether name is in list, or list is empty.
+func allowed(list []string, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+type queryPolicyKey struct{}
+
+// withQueryPolicy returns a copy of ctx whose queries are checked against
+// policy before they are executed.
+func withQueryPolicy(ctx context.Context, policy *QueryPolicy) context.Context {
+	return context.WithValue(ctx, queryPolicyKey{}, policy)
+}
+
+// queryPolicyFromContext returns the policy the queries of ctx are checked
+// against, or nil when they are not restricted.
+func queryPolicyFromContext(ctx context.Context) *QueryPolicy {
+	policy, _ := ctx.Value(queryPolicyKey{}).(*QueryPolicy)
+	return policy
+}
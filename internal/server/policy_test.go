@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryPolicyCheck(t *testing.T) {
+	policy := &QueryPolicy{
+		Metrics:   []string{"http_requests_total", "up"},
+		Functions: []string{"rate", "sum"},
+	}
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		err    string
+	}{
+		{name: "allowed", query: `sum(rate(http_requests_total{namespace="shop"}[5m])) by (pod)`},
+		{name: "name matcher", query: `{__name__="up"}`},
+		{name: "binary expression", query: `up == 0 or sum(up)`},
+		{name: "function", query: `irate(http_requests_total[5m])`, status: http.StatusForbidden, err: "Query uses function irate, which is not allowed for the application"},
+		{name: "aggregation", query: `topk(10, up)`, status: http.StatusForbidden, err: "Query uses aggregation topk"},
+		{name: "metric", query: `sum(rate(node_cpu_seconds_total[5m]))`, status: http.StatusForbidden, err: "Query uses metric node_cpu_seconds_total"},
+		{name: "selector without metric name", query: `{__name__=~"http_.*"}`, status: http.StatusForbidden, err: "Query uses a selector without a metric name"},
+		{name: "subquery", query: `max_over_time(rate(up[5m])[1h:])`, status: http.StatusForbidden, err: "Query uses function max_over_time"},
+		{name: "invalid query", query: `sum(`, status: http.StatusBadRequest, err: "invalid query"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.check(tt.query)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.err)
+			var qe *queryError
+			if assert.ErrorAs(t, err, &qe) {
+				assert.Equal(t, tt.status, qe.status)
+			}
+		})
+	}
+
+	assert.NoError(t, (&QueryPolicy{}).check(`topk(5, rate(node_cpu_seconds_total[5m]))`), "an empty policy allows everything")
+	assert.NoError(t, (&QueryPolicy{Functions: []string{"topk"}}).check(`topk(5, node_load1)`), "metrics are not restricted without a list")
+}
+
+func TestQueryPolicyValidate(t *testing.T) {
+	assert.NoError(t, (&QueryPolicy{Functions: []string{"rate", "histogram_quantile", "sum", "count_values"}}).validate())
+	assert.EqualError(t, (&QueryPolicy{Functions: []string{"rate", "ratee"}}).validate(), `unknown PromQL function "ratee"`)
+}
+
+func TestExecuteQueryPolicy(t *testing.T) {
+	var queries int
+	graph := &Graph{Name: "graph", QueryExpression: `topk(5, rate(http_requests_total{pod="{{.pod}}"}[5m]))`}
+	pp := newTestPrometheusProviderWithHandler(t, graph, func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+	pp.config.Applications[0].QueryPolicy = &QueryPolicy{Functions: []string{"rate", "sum"}}
+
+	w := executeTestGraph(pp, map[string]string{"pod": "web-0"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"forbidden"`)
+	assert.Contains(t, w.Body.String(), "Query uses aggregation topk")
+	assert.Equal(t, 0, queries, "rejected queries are not executed")
+
+	pp.config.Applications[0].QueryPolicy.Functions = append(pp.config.Applications[0].QueryPolicy.Functions, "topk")
+	w = executeTestGraph(pp, map[string]string{"pod": "web-0"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, queries)
+}
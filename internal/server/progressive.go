@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults and bounds of the chunks of progressive graphs.
+const (
+	defaultChunkDuration = 24 * time.Hour
+	maxChunks            = 64
+	// chunkConcurrency bounds the chunks of a graph queried at once, on
+	// top of the concurrent query limit of the server, so that the most
+	// recent chunks are returned first.
+	chunkConcurrency = 4
+)
+
+// Events of a progressive graph stream.
+const (
+	progressiveEventChunk = "chunk"
+	progressiveEventError = "error"
+	progressiveEventDone  = "done"
+)
+
+// ChunkEvent is a chunk of a progressive graph: the response of the graph
+// over the range of the chunk, or the error it failed with.
+type ChunkEvent struct {
+	// Chunk is the index of the chunk out of Chunks, 0 being the oldest.
+	Chunk  int       `json:"chunk"`
+	Chunks int       `json:"chunks"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Graph holds an AggregatedResponse for chunk events.
+	Graph json.RawMessage `json:"graph,omitempty"`
+	// Error is set for error events.
+	Error *ErrorDetail `json:"error,omitempty"`
+}
+
+// ProgressiveSummary is the last event of a progressive graph stream.
+type ProgressiveSummary struct {
+	Chunks int `json:"chunks"`
+	Failed int `json:"failed"`
+}
+
+// graphChunk is the request of a chunk of a progressive graph.
+type graphChunk struct {
+	index int
+	req   graphRequest
+}
+
+// chunkRange returns the bounds of the range of the chunk.
+func (c graphChunk) chunkRange() (time.Time, time.Time) {
+	return c.req.at.Add(-c.req.duration), c.req.at
+}
+
+// graphChunks splits the range of req into chunks of ?chunk, a day by
+// default, rounded down to a multiple of the step of the graph. Chunks are
+// returned from the most recent to the oldest, each ending a step before
+// the next one starts, and all of them being queried at the step of the
+// whole range.
+func graphChunks(ctx *gin.Context, graph *Graph, req graphRequest, options Options) ([]graphChunk, error) {
+	size := defaultChunkDuration
+	if value := ctx.Query("chunk"); value != "" {
+		var err error
+		size, err = parseDuration(value)
+		if err != nil || size <= 0 {
+			return nil, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid chunk %q: must be a positive duration", value))
+		}
+	}
+	step, err := graphStep(graph, req, options)
+	if err != nil {
+		return nil, err
+	}
+	size = size.Truncate(step)
+	if size < step {
+		size = step
+	}
+	count := int((req.duration + size - 1) / size)
+	if count > maxChunks {
+		return nil, newQueryError(http.StatusBadRequest, fmt.Sprintf("Duration %s split into chunks of %s exceeds the maximum of %d chunks", req.duration, size, maxChunks))
+	}
+	if count == 0 {
+		count = 1
+	}
+	end := req.end()
+	start := end.Add(-req.duration)
+	chunks := make([]graphChunk, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := req
+		chunk.at = end.Add(-time.Duration(i) * size)
+		chunk.duration = size - step
+		if chunk.at.Add(-chunk.duration).Before(start) {
+			chunk.duration = chunk.at.Sub(start)
+		}
+		chunk.step = step
+		chunk.resolution = ""
+		chunks = append(chunks, graphChunk{index: count - 1 - i, req: chunk})
+	}
+	return chunks, nil
+}
+
+// executeProgressive streams a graph over a long range as Server-Sent
+// Events, so that the UI can render it progressively rather than waiting
+// for a single slow query: the range is split into chunks, queried
+// concurrently, and every chunk is pushed as a chunk event as soon as it
+// completes. Failed chunks are pushed as error events, and the stream ends
+// with a done event holding a ProgressiveSummary.
+func (pp *PrometheusProvider) executeProgressive(ctx *gin.Context) {
+	req, err := pp.newGraphRequest(ctx)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	row, err := pp.getRow(&req)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	graph := row.getGraph(req.graph)
+	if graph == nil {
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested Graph not found")
+		return
+	}
+	chunks, err := graphChunks(ctx, graph, req, pp.options)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+
+	// The stream lasts as long as the slowest chunk, which may exceed the
+	// write timeout of the server.
+	if err := http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		pp.logger.Warnf("Error clearing the write deadline of progressive graph %s: %v", graph.Name, err)
+	}
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	events := make(chan ChunkEvent)
+	go pp.evaluateChunks(ctx, graph, chunks, events)
+	summary := ProgressiveSummary{Chunks: len(chunks)}
+	for event := range events {
+		name := progressiveEventChunk
+		if event.Error != nil {
+			name = progressiveEventError
+			summary.Failed++
+		}
+		ctx.SSEvent(name, event)
+		ctx.Writer.Flush()
+	}
+	if ctx.Request.Context().Err() != nil {
+		return
+	}
+	ctx.SSEvent(progressiveEventDone, summary)
+	ctx.Writer.Flush()
+}
+
+// evaluateChunks queries the chunks of graph, at most chunkConcurrency at
+// once in the order of chunks, and sends their events to events, which it
+// closes once they are all done or the request is cancelled.
+func (pp *PrometheusProvider) evaluateChunks(ctx *gin.Context, graph *Graph, chunks []graphChunk, events chan<- ChunkEvent) {
+	defer close(events)
+	requestCtx := ctx.Request.Context()
+	slots := make(chan struct{}, chunkConcurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, chunk := range chunks {
+		select {
+		case slots <- struct{}{}:
+		case <-requestCtx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(chunk graphChunk) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			event := pp.evaluateChunk(ctx, graph, chunk)
+			event.Chunks = len(chunks)
+			select {
+			case events <- event:
+			case <-requestCtx.Done():
+			}
+		}(chunk)
+	}
+}
+
+// evaluateChunk queries a chunk of graph and returns its event.
+func (pp *PrometheusProvider) evaluateChunk(ctx *gin.Context, graph *Graph, chunk graphChunk) ChunkEvent {
+	requestCtx := ctx.Request.Context()
+	event := ChunkEvent{Chunk: chunk.index}
+	event.Start, event.End = chunk.chunkRange()
+	data, err := pp.queryGraph(requestCtx, graph, chunk.req)
+	var body []byte
+	if err == nil {
+		body, err = pp.marshalResponse(data)
+	}
+	if err != nil {
+		if requestCtx.Err() == nil {
+			pp.logger.Errorf("Error querying chunk %d of graph %s: %v", chunk.index, graph.Name, err)
+		}
+		_, detail := queryErrorDetail(ctx, err)
+		event.Error = &detail
+		return event
+	}
+	event.Graph = body
+	return event
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// executeTestProgressive runs a progressive graph request against pp with
+// the given query params.
+func executeTestProgressive(pp *PrometheusProvider, queryParams map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": "app", "groupkind": "pod", "row": "row", "graph": "graph"}, queryParams)
+	pp.executeProgressive(ctx)
+	return w
+}
+
+// parseEvents returns the events of a Server-Sent Events body, in order, as
+// name and data pairs.
+func parseEvents(body string) [][2]string {
+	var events [][2]string
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var event [2]string
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := strings.CutPrefix(line, "event:"); ok {
+				event[0] = name
+			} else if data, ok := strings.CutPrefix(line, "data:"); ok {
+				event[1] = data
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestGraphChunks(t *testing.T) {
+	withChunk := func(chunk string) *gin.Context {
+		ctx := GetTestGinContext(httptest.NewRecorder())
+		MockJsonGet(ctx, http.Header{}, nil, map[string]string{"chunk": chunk})
+		return ctx
+	}
+	end := time.Unix(1700000000, 0)
+	req := graphRequest{at: end, duration: 150 * time.Minute, step: time.Minute}
+
+	chunks, err := graphChunks(withChunk("1h"), &Graph{}, req, Options{})
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 3)
+	for i, expected := range []struct {
+		index int
+		start time.Time
+		end   time.Time
+	}{
+		{index: 2, start: end.Add(-59 * time.Minute), end: end},
+		{index: 1, start: end.Add(-119 * time.Minute), end: end.Add(-time.Hour)},
+		{index: 0, start: end.Add(-150 * time.Minute), end: end.Add(-2 * time.Hour)},
+	} {
+		start, chunkEnd := chunks[i].chunkRange()
+		assert.Equal(t, expected.index, chunks[i].index)
+		assert.Equal(t, expected.start, start, "chunk %d", expected.index)
+		assert.Equal(t, expected.end, chunkEnd, "chunk %d", expected.index)
+		assert.Equal(t, time.Minute, chunks[i].req.step)
+	}
+
+	chunks, err = graphChunks(withChunk("1m"), &Graph{}, graphRequest{duration: 48 * time.Hour, step: time.Hour}, Options{})
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 48, "chunks are at least a step long")
+
+	_, err = graphChunks(withChunk("1h"), &Graph{}, graphRequest{duration: 720 * time.Hour, step: time.Minute}, Options{})
+	assert.ErrorContains(t, err, "exceeds the maximum of 64 chunks")
+
+	_, err = graphChunks(withChunk("-1h"), &Graph{}, req, Options{})
+	assert.ErrorContains(t, err, `Invalid chunk "-1h"`)
+}
+
+func TestExecuteProgressive(t *testing.T) {
+	var mu sync.Mutex
+	var starts []string
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		starts = append(starts, r.Form.Get("start"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a"}, "values": [[1700000000, "1"]]}]}}`))
+	})
+
+	w := executeTestProgressive(pp, map[string]string{"duration": "3h", "step": "1m", "chunk": "1h"})
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	events := parseEvents(w.Body.String())
+	assert.Len(t, events, 4)
+	var indexes []int
+	for _, event := range events[:3] {
+		assert.Equal(t, progressiveEventChunk, event[0])
+		var chunk ChunkEvent
+		assert.NoError(t, json.Unmarshal([]byte(event[1]), &chunk))
+		assert.Equal(t, 3, chunk.Chunks)
+		assert.Equal(t, 59*time.Minute, chunk.End.Sub(chunk.Start))
+		var graph AggregatedResponse
+		assert.NoError(t, json.Unmarshal(chunk.Graph, &graph))
+		assert.Equal(t, 1, graph.SeriesCount)
+		indexes = append(indexes, chunk.Chunk)
+	}
+	sort.Ints(indexes)
+	assert.Equal(t, []int{0, 1, 2}, indexes)
+	assert.Len(t, starts, 3, "every chunk is queried once")
+	assert.Equal(t, progressiveEventDone, events[3][0])
+	assert.JSONEq(t, `{"chunks": 3, "failed": 0}`, events[3][1])
+
+	w = executeTestProgressive(pp, map[string]string{"duration": "3h", "chunk": "forever"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExecuteProgressiveFailure(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	w := executeTestProgressive(pp, map[string]string{"duration": "2h", "step": "1m", "chunk": "1h"})
+	events := parseEvents(w.Body.String())
+	assert.Len(t, events, 3)
+	assert.Equal(t, progressiveEventError, events[0][0])
+	var chunk ChunkEvent
+	assert.NoError(t, json.Unmarshal([]byte(events[0][1]), &chunk))
+	assert.Equal(t, errCodeQueryFailed, chunk.Error.Code)
+	assert.Empty(t, chunk.Graph)
+	assert.JSONEq(t, `{"chunks": 2, "failed": 2}`, events[2][1])
+}
@@ -1,18 +1,25 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/common/model"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/version"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/api"
@@ -27,55 +34,205 @@ type ThresholdResponse struct {
 	Color string          `json:"color"`
 	Value string          `json:"value"`
 	Unit  string          `json:"unit"`
+	// Breached is set when the latest value of a graph series crosses the
+	// threshold, BreachingValue being the one furthest past it.
+	Breached       bool     `json:"breached"`
+	BreachingValue *float64 `json:"breachingValue,omitempty"`
+	// FormattedBreachingValue is BreachingValue formatted with the format
+	// of the threshold or graph, when they have one.
+	FormattedBreachingValue string `json:"formattedBreachingValue,omitempty"`
+	// Error is set for thresholds that did not complete within the
+	// threshold timeout, Data being null.
+	Error *ErrorDetail `json:"error,omitempty"`
 }
 
 // AggregatedResponse represents the final output response structure returned by execute function
 type AggregatedResponse struct {
-	Data       json.RawMessage     `json:"data"`
+	// Data holds the series of the result, scalar results being returned
+	// as a single series of a single sample and strings as no series.
+	Data json.RawMessage `json:"data"`
+	// ResultType is the type of the query result: matrix, vector, scalar
+	// or string.
+	ResultType model.ValueType `json:"resultType,omitempty"`
+	// Scalar and String hold scalar and string results.
+	Scalar *LatestSample `json:"scalar,omitempty"`
+	String *StringResult `json:"string,omitempty"`
+	// Empty is set when the query succeeded but returned no series or no
+	// samples, so the UI can tell "no data" apart from an error.
+	Empty       bool `json:"empty"`
+	SeriesCount int  `json:"seriesCount"`
+	// Latest holds the most recent sample of every series, for panels
+	// showing the current value.
+	Latest []LatestSample  `json:"latest"`
+	Delta  json.RawMessage `json:"delta,omitempty"`
+	// Raw holds the series before smoothing when requested with
+	// ?includeRaw=true.
+	Raw json.RawMessage `json:"raw,omitempty"`
+	// Previous holds the series of the previous period requested with
+	// ?compare, moved onto the time axis of Data and labeled
+	// period="previous".
+	Previous json.RawMessage `json:"previous,omitempty"`
+	// Unit is the display unit the series were converted to, their values
+	// having been multiplied by UnitFactor, so that the values in the y
+	// axis unit are the values divided by UnitFactor. Both are omitted for
+	// graphs without a display unit.
+	Unit       string              `json:"unit,omitempty"`
+	UnitFactor float64             `json:"unitFactor,omitempty"`
 	Thresholds []ThresholdResponse `json:"thresholds,omitempty"`
+	// Annotations holds the events of the annotations of the graph, sorted
+	// by time.
+	Annotations []AnnotationEvent `json:"annotations,omitempty"`
+	// AllSeries lists the keys of all the series of the result when only the
+	// top ?maxSeries, or topN, are returned, so the UI can tell which were
+	// dropped.
+	AllSeries []string `json:"allSeries,omitempty"`
+	// OtherSeries is the number of series summed into the other series of
+	// a graph with a topN, labeled other="true".
+	OtherSeries int `json:"otherSeries,omitempty"`
+	// Heatmap is set for heatmap graphs, Data still holding the series.
+	Heatmap *Heatmap `json:"heatmap,omitempty"`
+	// Diagnostics is only set when requested with ?diag=true.
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+	// Query is the query of the graph rendered against the request params,
+	// or Queries those of a graph with several queries keyed by alias, and
+	// Start, End and Step, in seconds, the range they were executed over.
+	// They are only set when requested with ?debug=true.
+	Query   string            `json:"query,omitempty"`
+	Queries map[string]string `json:"queries,omitempty"`
+	Start   *time.Time        `json:"start,omitempty"`
+	End     *time.Time        `json:"end,omitempty"`
+	Step    float64           `json:"step,omitempty"`
+	// Warnings lists the datasources that failed when the graph queries
+	// several, the series of the others being returned.
+	Warnings []string `json:"warnings,omitempty"`
+	// Timezone is the IANA name of the timezone of the server, which the
+	// UI can align the axis labels of calendar ranges to.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// StringResult is a string query result.
+type StringResult struct {
+	Timestamp model.Time `json:"timestamp"`
+	Value     string     `json:"value"`
+}
+
+// RawResponse is a query result in the format of the Prometheus HTTP API.
+type RawResponse struct {
+	Status   string      `json:"status"`
+	Data     RawData     `json:"data"`
+	Warnings v1.Warnings `json:"warnings,omitempty"`
+}
+
+// RawData is the data of a RawResponse.
+type RawData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
 }
 
 type PrometheusProvider struct {
 	logger   *zap.SugaredLogger
 	provider v1.API
 	config   *MetricsConfigProvider
-	skipTLSVerify bool
+	options  Options
+	cache    *resultCache
+	// credentials holds the resolved credential sets graphs can reference.
+	credentials map[string]*graphCredentials
+	// limiter bounds the concurrent queries of the server, shared by the
+	// providers created on reload.
+	limiter *queryLimiter
+	metrics *serverMetrics
+	// authHeaders lists the names of the secret headers sent with every
+	// query, reported by the self-test.
+	authHeaders []string
+	// datasources holds the clients of the named datasources graphs can
+	// query, the provider included when it has a name.
+	datasources map[string]v1.API
+	// breakers holds the circuit breaker of every datasource, the provider
+	// being keyed by an empty name, or nil when disabled.
+	breakers map[string]*circuitBreaker
+	// newClient creates the client of a datasource and returns the
+	// canonical names of the secret headers it sends, newAPI when nil.
+	// Tests substitute it to query a mock rather than a live Prometheus.
+	newClient func(config provider) (v1.API, map[string]bool, error)
 }
 
+// defaultPrometheusHeaderName is the header PROMETHEUS_APIKEY is sent in by
+// default.
+const defaultPrometheusHeaderName = "apikey"
+
+// orgIDHeader is the tenant header of multi-tenant Cortex and Mimir.
+const orgIDHeader = "X-Scope-OrgID"
+
+// authorizationHeader carries the basic auth credentials of the queries.
+const authorizationHeader = "Authorization"
+
+// userAgentHeader identifies the server in the Prometheus access logs.
+const userAgentHeader = "User-Agent"
+
 // Custom RoundTripper to add headers
 type headerRoundTripper struct {
 	headers map[string]string
-	rt      http.RoundTripper
+	// secretHeaders holds the canonical names of the headers whose values
+	// are redacted in logs.
+	secretHeaders map[string]bool
+	rt            http.RoundTripper
+	logger        *zap.SugaredLogger
+}
+
+// redact returns value, or a placeholder when the header name is secret.
+func (h *headerRoundTripper) redact(name string, value interface{}) interface{} {
+	if h.secretHeaders[http.CanonicalHeaderKey(name)] {
+		return "[REDACTED]"
+	}
+	return value
 }
 
 func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Log the URL being requested (without the API key for security)
-	fmt.Printf("Making request to: %s\n", req.URL.String())
+	h.logger.Debugf("Making request to: %s", req.URL.String())
 
 	// Add all headers
 	for k, v := range h.headers {
 		req.Header.Add(k, v)
 		// Log header names (but not values for security)
-		if k != "apikey" {
-			fmt.Printf("Added header: %s: %s\n", k, v)
-		} else {
-			fmt.Printf("Added header: %s: [REDACTED]\n", k)
+		h.logger.Debugf("Added header: %s: %s", k, h.redact(k, v))
+	}
+
+	// The tenant of the request overrides the default one.
+	if tenant := tenantFromContext(req.Context()); tenant != "" {
+		req.Header.Set(orgIDHeader, tenant)
+	}
+
+	// Graph credentials override the default headers, and are all secret.
+	credentialHeaders := map[string]bool{}
+	if creds := credentialsFromContext(req.Context()); creds != nil {
+		for k, v := range creds.headers {
+			req.Header.Set(k, v)
+			credentialHeaders[http.CanonicalHeaderKey(k)] = true
+			h.logger.Debugf("Set header from credentials %s: %s: [REDACTED]", creds.name, k)
 		}
 	}
 
 	// Show all request headers for debugging
-	fmt.Println("All request headers:")
 	for k, v := range req.Header {
-		if k != "apikey" {
-			fmt.Printf("  %s: %s\n", k, v)
-		} else {
-			fmt.Printf("  %s: [REDACTED]\n", k)
+		if credentialHeaders[k] {
+			h.logger.Debugf("Request header %s: [REDACTED]", k)
+			continue
 		}
+		h.logger.Debugf("Request header %s: %v", k, h.redact(k, v))
 	}
 
 	return h.rt.RoundTrip(req)
 }
 
+// providerName returns the name identifying the provider in diagnostics.
+func (pp *PrometheusProvider) providerName() string {
+	if pp.config.Provider.Name != "" {
+		return pp.config.Provider.Name
+	}
+	return pp.config.Provider.Address
+}
+
 func (pp *PrometheusProvider) getType() string {
 	return PROMETHEUS_TYPE
 }
@@ -86,134 +243,315 @@ func (pp *PrometheusProvider) getDashboard(ctx *gin.Context) {
 	groupKind := ctx.Param("groupkind")
 	app := pp.config.getApp(appName)
 	if app == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Application not found")
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested/Default Application not found")
 		return
 	}
 	dash := app.getDashBoard(groupKind)
 
 	if dash == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Dashboard not found")
+		writeQueryError(ctx, app.dashboardNotFound(groupKind))
 		return
 	}
 	dash.ProviderType = pp.getType()
 	ctx.JSON(http.StatusOK, dash)
 }
 
-func NewPrometheusProvider(prometheusConfig *MetricsConfigProvider, logger *zap.SugaredLogger, skipTLSVerify bool) *PrometheusProvider {
+func NewPrometheusProvider(prometheusConfig *MetricsConfigProvider, logger *zap.SugaredLogger, options Options) *PrometheusProvider {
 	return &PrometheusProvider{
-		config: prometheusConfig,
-		logger: logger,
-		skipTLSVerify: skipTLSVerify,
+		config:  prometheusConfig,
+		logger:  logger,
+		options: options,
+		cache:   newResultCache(options.NegativeCacheTTL),
 	}
 }
 
 func (pp *PrometheusProvider) init() error {
+	if tenant := pp.config.Provider.Tenant; tenant != nil {
+		if err := tenant.validate(); err != nil {
+			pp.logger.Errorf("Invalid tenant config: %v", err)
+			return fmt.Errorf("invalid tenant config: %w", err)
+		}
+		pp.logger.Infof("Deriving the Prometheus tenant of the queries from the identity of the requests, for %d identities", len(tenant.Tenants))
+	}
+	credentials, err := resolveCredentials(pp.config)
+	if err != nil {
+		pp.logger.Errorf("Error resolving credentials: %v", err)
+		return err
+	}
+	pp.credentials = credentials
+
+	newClient := pp.newClient
+	if newClient == nil {
+		newClient = pp.newAPI
+	}
+	client, secretHeaders, err := pp.newFailoverClient(newClient, pp.config.Provider)
+	if err != nil {
+		return err
+	}
+	pp.provider = client
+	pp.authHeaders = nil
+	for name := range secretHeaders {
+		pp.authHeaders = append(pp.authHeaders, name)
+	}
+	sort.Strings(pp.authHeaders)
+
+	pp.datasources = map[string]v1.API{}
+	if pp.config.Provider.Name != "" {
+		pp.datasources[pp.config.Provider.Name] = pp.provider
+	}
+	for _, ds := range pp.config.Datasources {
+		client, _, err := pp.newFailoverClient(newClient, ds)
+		if err != nil {
+			return fmt.Errorf("datasource %s: %w", ds.Name, err)
+		}
+		pp.datasources[ds.Name] = client
+	}
+	pp.breakers = pp.newBreakers()
+	return nil
+}
+
+// newTransport returns the transport of a datasource, keeping idle
+// connections open within the connection pool options so that repeated
+// queries reuse them rather than paying a new TLS handshake. Requests go
+// through the proxy of the options, or of the environment.
+func (pp *PrometheusProvider) newTransport() *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if pp.options.PrometheusProxyURL != nil {
+		proxy = http.ProxyURL(pp.options.PrometheusProxyURL)
+	}
+	return &http.Transport{
+		Proxy:               proxy,
+		MaxIdleConns:        pp.options.PrometheusMaxIdleConns,
+		MaxIdleConnsPerHost: pp.options.PrometheusMaxIdleConnsPerHost,
+		IdleConnTimeout:     pp.options.PrometheusIdleConnTimeout,
+	}
+}
+
+// newAPI creates the client of the datasource config, sending the server
+// headers along with its own. It returns the canonical names of the secret
+// headers it sends.
+func (pp *PrometheusProvider) newAPI(config provider) (v1.API, map[string]bool, error) {
+	name := config.Name
+	if name == "" {
+		name = config.Address
+	}
 	// Create config with headers support
 	clientConfig := api.Config{
-		Address: pp.config.Provider.Address,
+		Address: config.Address,
 	}
 
-	// Set up the transport
-	var transport *http.Transport
-
+	transport := pp.newTransport()
 	// Apply TLS skip verification if requested
-	if pp.skipTLSVerify {
-		pp.logger.Info("Skipping TLS certificate verification for Prometheus connections")
-		transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // Skip certificate verification
-			},
+	if config.skipTLSVerify(pp.options.SkipPrometheusTLSVerify) {
+		pp.logger.Infof("Skipping TLS certificate verification for datasource %s", name)
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true, // Skip certificate verification
 		}
-	} else {
-		// Use default transport with normal TLS verification
-		transport = &http.Transport{}
 	}
 
+	userAgent := pp.options.UserAgent
+	if userAgent == "" {
+		userAgent = version.UserAgent()
+	}
+	// The provider headers can override the User-Agent.
+	headers := map[string]string{userAgentHeader: userAgent}
+	secretHeaders := map[string]bool{}
+	for name, value := range config.Headers {
+		if http.CanonicalHeaderKey(name) == userAgentHeader {
+			delete(headers, userAgentHeader)
+		}
+		headers[name] = value
+		secretHeaders[http.CanonicalHeaderKey(name)] = true
+	}
 	// Check for environment variable PROMETHEUS_APIKEY
 	if apiKey := os.Getenv("PROMETHEUS_APIKEY"); apiKey != "" {
-		pp.logger.Info("Using PROMETHEUS_APIKEY from environment variable")
-		clientConfig.RoundTripper = &headerRoundTripper{
-			headers: map[string]string{"apikey": apiKey},
-			rt:      transport,
+		headerName := pp.options.PrometheusHeaderName
+		if headerName == "" {
+			headerName = defaultPrometheusHeaderName
 		}
-	} else {
-		// No headers, but still need to use our transport
-		clientConfig.RoundTripper = transport
+		pp.logger.Infof("Using PROMETHEUS_APIKEY from environment variable as %s header", headerName)
+		headers[headerName] = apiKey
+		secretHeaders[http.CanonicalHeaderKey(headerName)] = true
+	}
+	if user := pp.options.PrometheusBasicAuthUser; user != "" {
+		if secretHeaders[authorizationHeader] {
+			return nil, nil, fmt.Errorf("basic auth can not be combined with an %s header", authorizationHeader)
+		}
+		pp.logger.Infof("Using basic auth as user %s for datasource %s", user, name)
+		headers[authorizationHeader] = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pp.options.PrometheusBasicAuthPassword))
+		secretHeaders[authorizationHeader] = true
+	}
+	if pp.options.PrometheusOrgID != "" {
+		pp.logger.Infof("Using Prometheus tenant %s", pp.options.PrometheusOrgID)
+		headers[orgIDHeader] = pp.options.PrometheusOrgID
+	}
+	clientConfig.RoundTripper = &headerRoundTripper{
+		headers:       headers,
+		secretHeaders: secretHeaders,
+		rt:            transport,
+		logger:        pp.logger,
 	}
 
 	client, err := api.NewClient(clientConfig)
 	if err != nil {
 		pp.logger.Errorf("Error creating client: %v\n", err)
-		return err
+		return nil, nil, err
 	}
-	pp.provider = v1.NewAPI(client)
-	return nil
+	promClient, err := newPrometheusClient(client, config)
+	if err != nil {
+		pp.logger.Errorf("Error configuring client: %v", err)
+		return nil, nil, err
+	}
+	pp.logger.Infof("Prometheus query endpoints of %s: [query: %s, query_range: %s]", name,
+		promClient.URL(queryEndpoint, nil), promClient.URL(queryRangeEndpoint, nil))
+	return v1.NewAPI(promClient), secretHeaders, nil
 }
 
-// executeGraphQuery executes a prometheus query and returns the result.
-func executeGraphQuery(ctx *gin.Context, queryExpression string, env map[string][]string, duration time.Duration, pp *PrometheusProvider) (model.Value, v1.Warnings, error) {
-	tmpl, err := template.New("query").Parse(queryExpression)
+// queryRange runs a range query against the provider, serving recent
+// negative results from the cache. Transient errors are retried with
+// backoff within the query timeout.
+func (pp *PrometheusProvider) queryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	key := cacheKey(tenantFromContext(ctx), query, r)
+	if fixedRangeFromContext(ctx) {
+		key = fmt.Sprintf("at=%d|%s", r.End.UnixMilli(), key)
+	}
+	if shift := rangeShiftFromContext(ctx); shift != 0 {
+		key = fmt.Sprintf("shift=%s|%s", shift, key)
+	}
+	if creds := credentialsFromContext(ctx); creds != nil {
+		key = creds.name + "|" + key
+	}
+	if name := datasourceFromContext(ctx); name != "" {
+		key = name + "|" + key
+	}
+	client, err := pp.api(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error parsing query template: %s", err)
+		return nil, nil, err
+	}
+	diag := diagnosticsFromContext(ctx)
+	if value, err, ok := pp.cache.get(key); ok {
+		diag.recordCacheHit()
+		return value, nil, err
+	}
+	breaker := pp.breaker(ctx)
+	if err := breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	queryCtx := ctx
+	if pp.options.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, pp.options.QueryTimeout)
+		defer cancel()
 	}
 
-	env1 := make(map[string]string)
-	for k, v := range env {
-		env1[k] = strings.Join(v, ",")
+	var result model.Value
+	var warnings v1.Warnings
+	err = retryWithBackoff(queryCtx, pp.options.QueryMaxAttempts, pp.options.QueryRetryBaseDelay, func() error {
+		release, err := pp.limiter.acquire(queryCtx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := pp.checkSeriesCount(queryCtx, client, query, r.End); err != nil {
+			return err
+		}
+		diag.recordQuery(pp.datasourceName(ctx))
+		result, warnings, err = client.QueryRange(queryCtx, query, r)
+		if _, ok := rateLimitedError(err); ok {
+			pp.metrics.queryRateLimited(pp.datasourceName(ctx))
+		}
+		if err != nil {
+			return err
+		}
+		if matrix, ok := result.(model.Matrix); ok {
+			return pp.seriesLimitError(len(matrix))
+		}
+		return nil
+	}, func() {
+		pp.logger.Warnf("Retrying query after transient error: %s", query)
+		diag.recordRetry()
+	})
+	if ctx.Err() != nil || errors.Is(err, errTooManyQueries) {
+		breaker.abort()
+	} else {
+		breaker.record(err)
 	}
+	if errors.Is(err, errTooManyQueries) {
+		return nil, nil, err
+	}
+	pp.cache.putNegative(ctx, key, result, err)
+	return result, warnings, err
+}
 
-	buf := new(bytes.Buffer)
-	err = tmpl.Execute(buf, env1)
+// checkSeriesCount fails with a too_many_series error when query returns
+// more series than the MaxQuerySeries option at end, counted with an
+// instant count() query against client so that the series are never
+// transferred.
+func (pp *PrometheusProvider) checkSeriesCount(ctx context.Context, client v1.API, query string, end time.Time) error {
+	if pp.options.MaxQuerySeries <= 0 {
+		return nil
+	}
+	result, _, err := client.Query(ctx, "count("+query+")", end)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error executing template: %s", err)
+		return err
+	}
+	if vector, ok := result.(model.Vector); ok && len(vector) > 0 {
+		return pp.seriesLimitError(int(vector[0].Value))
 	}
+	return nil
+}
 
-	strQuery := buf.String()
-	r := v1.Range{
-		Start: time.Now().Add(-duration),
-		End:   time.Now(),
-		Step:  time.Minute,
+// seriesLimitError returns the error of a query returning series series when
+// they exceed the MaxQuerySeries option, else nil.
+func (pp *PrometheusProvider) seriesLimitError(series int) error {
+	if pp.options.MaxQuerySeries <= 0 || series <= pp.options.MaxQuerySeries {
+		return nil
+	}
+	return &queryError{
+		status:  http.StatusBadRequest,
+		code:    errCodeTooManySeries,
+		message: fmt.Sprintf("query returns %d series, more than the limit of %d: narrow the query, e.g. with more label matchers or an aggregation", series, pp.options.MaxQuerySeries),
+	}
+}
+
+// executeGraphQuery executes a prometheus query and returns the result. It
+// returns the context error without querying once ctx is done, e.g. when
+// the client went away, so the remaining queries of a graph are skipped.
+func executeGraphQuery(ctx context.Context, queryExpression string, env map[string][]string, r v1.Range, pp *PrometheusProvider) (model.Value, v1.Warnings, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	strQuery, err := renderQuery(queryExpression, env, pp.config.QueryTemplates)
+	if err != nil {
+		return nil, nil, err
+	}
+	strQuery, err = enforceLabels(strQuery, enforcedLabelsFromContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	if policy := queryPolicyFromContext(ctx); policy != nil {
+		if err := policy.check(strQuery); err != nil {
+			pp.logger.Warnf("Rejected query %s: %s", strQuery, err)
+			return nil, nil, err
+		}
 	}
 
-	fmt.Printf("Executing Prometheus query: %s\n", strQuery)
-	fmt.Printf("Time range: start=%v, end=%v, step=%v\n", r.Start, r.End, r.Step)
+	pp.logger.Debugf("Executing Prometheus query: %s, start=%v, end=%v, step=%v", strQuery, r.Start, r.End, r.Step)
 
-	result, warnings, err := pp.provider.QueryRange(ctx, strQuery, r)
+	result, warnings, err := pp.queryRange(ctx, strQuery, r)
 
+	if err != nil && ctx.Err() != nil {
+		pp.logger.Debugf("Query cancelled: %s: %s", strQuery, err)
+		return nil, warnings, ctx.Err()
+	}
 	if err != nil {
 		pp.logger.Errorf("Error querying prometheus at %s: %s, query: %s", pp.config.Provider.Address, err, strQuery)
 		pp.logger.Errorf("Provider config: Address: %s, Name: %s", pp.config.Provider.Address, pp.config.Provider.Name)
-		return nil, warnings, fmt.Errorf("error querying prometheus: %s", err)
+		return nil, warnings, classifyQueryError(err)
 	}
 
-	// Log the result type and some details
-	fmt.Printf("Query result type: %T\n", result)
-	if result != nil {
-		switch v := result.(type) {
-		case model.Matrix:
-			fmt.Printf("Matrix result with %d series\n", len(v))
-			if len(v) > 0 {
-				fmt.Printf("First series has %d samples\n", len(v[0].Values))
-				if len(v[0].Values) > 0 {
-					fmt.Printf("Sample values: %v\n", v[0].Values[0].Value)
-				} else {
-					fmt.Printf("No samples in first series\n")
-				}
-			} else {
-				fmt.Printf("No series in matrix\n")
-			}
-		case model.Vector:
-			fmt.Printf("Vector result with %d samples\n", len(v))
-		case *model.Scalar:
-			fmt.Printf("Scalar pointer result: %v\n", v.Value)
-		case *model.String:
-			fmt.Printf("String pointer result: %s\n", v.Value)
-		default:
-			fmt.Printf("Unknown result type\n")
-		}
-	} else {
-		fmt.Printf("Query result is nil\n")
-	}
+	series, samples := countSeries(result)
+	pp.logger.Debugf("Query result type: %T, %d series, %d samples", result, series, samples)
 
 	if len(warnings) > 0 {
 		pp.logger.Warnf("Query warnings: %v", warnings)
@@ -223,106 +561,954 @@ func executeGraphQuery(ctx *gin.Context, queryExpression string, env map[string]
 	return result, nil, nil
 }
 
-// execute handles the execution of a graph queryExpression and graph thresholds
-func (pp *PrometheusProvider) execute(ctx *gin.Context) {
-	app := ctx.Param("application")
-	groupKind := ctx.Param("groupkind")
-	rowName := ctx.Param("row")
-	graphName := ctx.Param("graph")
-	durationStr := ctx.Query("duration")
-	if durationStr == "" {
-		durationStr = "1h"
+// seriesAliasLabel is the label set on the series of graphs with multiple
+// queries to identify which query produced them.
+const seriesAliasLabel = "alias"
+
+// executeGraphQueries executes the queries of a graph. Graphs with a list of
+// queries, configured or generated, run them concurrently and merge the
+// resulting matrices into a single matrix, labeling every series with the
+// alias of its query.
+func executeGraphQueries(ctx context.Context, graph *Graph, env map[string][]string, r v1.Range, pp *PrometheusProvider) (model.Value, v1.Warnings, error) {
+	queries := graph.queries()
+	if len(queries) == 0 {
+		return executeGraphQuery(ctx, graph.QueryExpression, env, r, pp)
+	}
+
+	results := make([]model.Value, len(queries))
+	errs := make([]error, len(queries))
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		wg.Add(1)
+		go func(i int, query GraphQuery) {
+			defer wg.Done()
+			results[i], _, errs[i] = executeGraphQuery(ctx, query.QueryExpression, env, r, pp)
+		}(i, query)
 	}
-	duration, err := time.ParseDuration(durationStr)
+	wg.Wait()
+
+	merged := model.Matrix{}
+	for i, query := range queries {
+		if errs[i] != nil {
+			return nil, nil, fmt.Errorf("query %s: %w", query.alias(i), errs[i])
+		}
+		matrix, ok := results[i].(model.Matrix)
+		if !ok {
+			return nil, nil, fmt.Errorf("query %s must return a matrix, got %T", query.alias(i), results[i])
+		}
+		for _, series := range matrix {
+			metric := series.Metric.Clone()
+			metric[seriesAliasLabel] = model.LabelValue(query.alias(i))
+			merged = append(merged, &model.SampleStream{Metric: metric, Values: series.Values})
+		}
+	}
+	return merged, nil, nil
+}
+
+// executeBaselineQuery runs the baseline query of a graph and returns the
+// difference between the graph result and the baseline series.
+func executeBaselineQuery(ctx context.Context, baseline *Baseline, result model.Value, env map[string][]string, r v1.Range, pp *PrometheusProvider) (model.Matrix, error) {
+	current, ok := result.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("baseline comparison requires a matrix result, got %T", result)
+	}
+	baselineResult, _, err := executeGraphQuery(ctx, baseline.QueryExpression, env, r, pp)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, "Invalid duration format :"+err.Error())
-		return
+		return nil, err
+	}
+	baselineMatrix, ok := baselineResult.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("baseline query must return a matrix, got %T", baselineResult)
 	}
+	return deltaMatrix(current, baselineMatrix, r), nil
+}
+
+// graphRequest identifies a graph and the parameters it is queried with.
+type graphRequest struct {
+	application string
+	groupKind   string
+	row         string
+	graph       string
+	duration    time.Duration
+	step        time.Duration
+	// resolution computes the step from the duration when set, unless a
+	// step is requested.
+	resolution  string
+	env         map[string][]string
+	diagnostics bool
+	// debug echoes the rendered queries and their range in the response.
+	debug bool
+	// resampleTimestamps is set for POST requests resampling the graph
+	// series onto client timestamps, with resampleMethod.
+	resampleTimestamps []model.Time
+	resampleMethod     string
+	// smoothWindow is the moving average window, in samples, applied to
+	// the series when greater than 1.
+	smoothWindow int
+	includeRaw   bool
+	// maxPoints is the number of samples series are downsampled to with
+	// downsampleMode, when positive.
+	maxPoints      int
+	downsampleMode string
+	// maxSeries is the number of series kept, ranked by rankBy, when
+	// positive.
+	maxSeries int
+	rankBy    string
+	// stream writes the series as newline delimited JSON.
+	stream bool
+	// format is formatRaw for the native Prometheus response, formatPNG
+	// for an image of width by height pixels, formatCompact for an
+	// AggregatedResponse holding CompactData, empty for an
+	// AggregatedResponse.
+	format string
+	width  int
+	height int
+	// emptyNoContent answers graphs whose result has no samples with a 204
+	// rather than a 200 with empty data, requested with ?emptyAs=204.
+	emptyNoContent bool
+	// offset shifts the end of the queries back from now. It is set from
+	// the dashboard of the request by getRow.
+	offset time.Duration
+	// at is the fixed end of the queries requested with ?at, zero for now.
+	at time.Time
+	// compare is the period the graph is compared to with ?compare, the
+	// graph queries being run again shifted back by it.
+	compare time.Duration
+	// rangeName is the time range preset of the dashboard selected with
+	// ?range, applied by getRow.
+	rangeName string
+	// tenant is the tenant the queries are sent to, when derived from the
+	// identity of the request.
+	tenant string
+	// policy restricts the queries of the application, set by getRow.
+	policy *QueryPolicy
+	// enforcedLabels are the label matchers set on the queries of the
+	// application, set by getRow.
+	enforcedLabels map[string]string
+}
+
+// formatRaw requests graph results in the native Prometheus API format.
+const formatRaw = "raw"
 
-	env := ctx.Request.URL.Query()
+// maxAtSkew bounds how far in the future ?at can be, allowing for the clock
+// skew between clients and the server.
+const maxAtSkew = 5 * time.Minute
 
-	application := pp.config.getApp(app)
+// maxPointsLimit bounds ?maxPoints.
+const maxPointsLimit = 100000
+
+// maxSmoothWindow bounds the moving average window of ?smooth.
+const maxSmoothWindow = 1000
+
+// maxResampleTimestamps bounds the number of timestamps of a resample request.
+const maxResampleTimestamps = 10000
+
+// resampleRequest is the body of a POST graph request, resampling the graph
+// series onto the given timestamps (in seconds since the epoch) with the
+// nearest (default) or previous interpolation method.
+type resampleRequest struct {
+	Timestamps []float64 `json:"timestamps"`
+	Method     string    `json:"method"`
+}
+
+// parseResampleRequest reads the resample request of a POST graph request
+// into req, sorting its timestamps.
+func parseResampleRequest(ctx *gin.Context, req *graphRequest) error {
+	var resample resampleRequest
+	if err := ctx.ShouldBindJSON(&resample); err != nil {
+		return newQueryError(http.StatusBadRequest, "Invalid resample request: "+err.Error())
+	}
+	if len(resample.Timestamps) == 0 || len(resample.Timestamps) > maxResampleTimestamps {
+		return newQueryError(http.StatusBadRequest, fmt.Sprintf("Resample request must have between 1 and %d timestamps", maxResampleTimestamps))
+	}
+	switch resample.Method {
+	case "":
+		resample.Method = resampleNearest
+	case resampleNearest, resamplePrevious:
+	default:
+		return newQueryError(http.StatusBadRequest, "Invalid resample method: "+resample.Method)
+	}
+	timestamps := make([]model.Time, len(resample.Timestamps))
+	for i, ts := range resample.Timestamps {
+		timestamps[i] = model.TimeFromUnixNano(int64(ts * float64(time.Second)))
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	req.resampleTimestamps = timestamps
+	req.resampleMethod = resample.Method
+	return nil
+}
+
+// newGraphRequest builds the graphRequest of a graph or row request.
+func newGraphRequest(ctx *gin.Context, options Options) (graphRequest, error) {
+	duration := options.DefaultDuration
+	if durationStr := ctx.Query("duration"); durationStr != "" {
+		var err error
+		duration, err = parseDuration(durationStr)
+		if err != nil {
+			return graphRequest{}, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid duration %q: %s", durationStr, err))
+		}
+	}
+	smoothWindow := 0
+	if smooth := ctx.Query("smooth"); smooth != "" {
+		var err error
+		smoothWindow, err = strconv.Atoi(smooth)
+		if err != nil || smoothWindow < 1 || smoothWindow > maxSmoothWindow {
+			return graphRequest{}, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid smooth window %q: must be a number of samples between 1 and %d", smooth, maxSmoothWindow))
+		}
+	}
+	resolution := ctx.Query("resolution")
+	if _, ok := resolutionPoints[resolution]; resolution != "" && !ok {
+		return graphRequest{}, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid resolution %q: must be high, medium or low", resolution))
+	}
+	var step time.Duration
+	if stepStr := ctx.Query("step"); stepStr == stepAuto {
+		if resolution == "" {
+			resolution = resolutionMedium
+		}
+	} else if stepStr != "" {
+		var err error
+		step, err = time.ParseDuration(stepStr)
+		if err != nil || step <= 0 {
+			return graphRequest{}, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid step %q: must be a positive duration or auto", stepStr))
+		}
+	}
+	maxPoints := 0
+	if maxPointsStr := ctx.Query("maxPoints"); maxPointsStr != "" {
+		var err error
+		maxPoints, err = strconv.Atoi(maxPointsStr)
+		if err != nil || maxPoints < 2 || maxPoints > maxPointsLimit {
+			return graphRequest{}, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid maxPoints %q: must be a number of samples between 2 and %d", maxPointsStr, maxPointsLimit))
+		}
+	}
+	maxSeries := 0
+	if maxSeriesStr := ctx.Query("maxSeries"); maxSeriesStr != "" {
+		var err error
+		maxSeries, err = strconv.Atoi(maxSeriesStr)
+		if err != nil || maxSeries < 1 {
+			return graphRequest{}, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid maxSeries %q: must be a positive number of series", maxSeriesStr))
+		}
+	}
+	rankBy := ctx.DefaultQuery("rankBy", rankByMax)
+	if !validRankBy(rankBy) {
+		return graphRequest{}, newQueryError(http.StatusBadRequest, "Invalid rankBy: "+rankBy)
+	}
+	downsampleMode := ctx.DefaultQuery("downsample", downsampleMinMax)
+	switch downsampleMode {
+	case downsampleMinMax, downsampleAvg, downsampleMin, downsampleMax:
+	default:
+		return graphRequest{}, newQueryError(http.StatusBadRequest, "Invalid downsample mode: "+downsampleMode)
+	}
+	format := ctx.Query("format")
+	if format == "" && strings.Contains(ctx.GetHeader("Accept"), "image/png") {
+		format = formatPNG
+	}
+	if format != "" && format != formatRaw && format != formatPNG && format != formatCompact {
+		return graphRequest{}, newQueryError(http.StatusBadRequest, "Invalid format: "+format)
+	}
+	emptyAs := ctx.DefaultQuery("emptyAs", "200")
+	if emptyAs != "200" && emptyAs != "204" {
+		return graphRequest{}, newQueryError(http.StatusBadRequest, "Invalid emptyAs: "+emptyAs+", must be 200 or 204")
+	}
+	var at time.Time
+	if atStr := ctx.Query("at"); atStr != "" {
+		var err error
+		at, err = parseEvaluationTime(atStr)
+		if err != nil {
+			return graphRequest{}, err
+		}
+	}
+	var compare time.Duration
+	if compareStr := ctx.Query("compare"); compareStr != "" {
+		var err error
+		compare, err = parseComparePeriod(compareStr)
+		if err != nil {
+			return graphRequest{}, err
+		}
+	}
+	width, err := parseRenderSize(ctx, "width", defaultRenderWidth)
+	if err != nil {
+		return graphRequest{}, err
+	}
+	height, err := parseRenderSize(ctx, "height", defaultRenderHeight)
+	if err != nil {
+		return graphRequest{}, err
+	}
+	return graphRequest{
+		application:    ctx.Param("application"),
+		groupKind:      ctx.Param("groupkind"),
+		row:            ctx.Param("row"),
+		graph:          ctx.Param("graph"),
+		duration:       duration,
+		step:           step,
+		resolution:     resolution,
+		env:            ctx.Request.URL.Query(),
+		diagnostics:    ctx.Query("diag") == "true",
+		debug:          ctx.Query("debug") == "true",
+		smoothWindow:   smoothWindow,
+		includeRaw:     ctx.Query("includeRaw") == "true",
+		maxPoints:      maxPoints,
+		downsampleMode: downsampleMode,
+		maxSeries:      maxSeries,
+		rankBy:         rankBy,
+		stream:         ctx.Query("stream") == "true",
+		format:         format,
+		width:          width,
+		height:         height,
+		rangeName:      ctx.Query("range"),
+		at:             at,
+		compare:        compare,
+		emptyNoContent: emptyAs == "204",
+	}, nil
+}
+
+// parseEvaluationTime parses an RFC 3339 evaluation time, rejecting times
+// more than maxAtSkew in the future.
+func parseEvaluationTime(value string) (time.Time, error) {
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid at %q: must be an RFC 3339 time", value))
+	}
+	if err := checkEvaluationTime(at); err != nil {
+		return time.Time{}, err
+	}
+	return at, nil
+}
+
+// checkEvaluationTime fails with a 400 when at is more than maxAtSkew in the
+// future.
+func checkEvaluationTime(at time.Time) error {
+	if at.After(time.Now().Add(maxAtSkew)) {
+		return newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid at %s: must not be more than %s in the future", at.Format(time.RFC3339), maxAtSkew))
+	}
+	return nil
+}
+
+// end returns the end of the queries of req: its fixed ?at time, else now
+// shifted back by its offset.
+func (req graphRequest) end() time.Time {
+	if !req.at.IsZero() {
+		return req.at
+	}
+	return time.Now().Add(-req.offset)
+}
+
+// newGraphRequest builds the graphRequest of a graph, row or batch request,
+// along with the tenant of the request.
+func (pp *PrometheusProvider) newGraphRequest(ctx *gin.Context) (graphRequest, error) {
+	req, err := newGraphRequest(ctx, pp.options)
+	if err != nil {
+		return req, err
+	}
+	req.tenant, err = pp.requestTenant(ctx)
+	return req, err
+}
+
+// getRow returns the row of the requested application dashboard.
+func (pp *PrometheusProvider) getRow(req *graphRequest) (*Row, error) {
+	application := pp.config.getApp(req.application)
 	if application == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Application not found")
-		return
+		return nil, newNotFoundError("Requested/Default Application not found")
 	}
-	dashboard := application.getDashBoard(groupKind)
+	dashboard := application.getDashBoard(req.groupKind)
 	if dashboard == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Dashboard not found")
-		return
+		return nil, application.dashboardNotFound(req.groupKind)
 	}
-	row := dashboard.getRow(rowName)
+	row := dashboard.getRow(req.row)
 	if row == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested Row not found")
-		return
+		return nil, newNotFoundError("Requested Row not found")
+	}
+	offset, err := dashboard.queryOffset(pp.options.QueryOffset)
+	if err != nil {
+		return nil, fmt.Errorf("dashboard %s has an invalid query offset: %w", dashboard.GroupKind, err)
+	}
+	req.offset = offset
+	req.env = application.queryEnv(req.env)
+	req.policy = application.QueryPolicy
+	req.enforcedLabels = application.EnforcedLabels
+	if req.rangeName != "" {
+		if err := pp.applyRange(req, dashboard); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkDuration(req.duration, pp.options); err != nil {
+		return nil, err
 	}
-	graph := row.getGraph(graphName)
-	if graph != nil {
+	return row, nil
+}
 
-		var data AggregatedResponse
-		result, warnings, err := executeGraphQuery(ctx, graph.QueryExpression, env, duration, pp)
+// applyRange sets the duration, and the step unless requested with ?step or
+// ?resolution, of req from the time range preset it selects. Unknown
+// presets are ignored, falling back to the requested or default duration.
+func (pp *PrometheusProvider) applyRange(req *graphRequest, dashboard *Dashboard) error {
+	tr := dashboard.getRange(req.rangeName)
+	if tr == nil {
+		pp.logger.Debugf("Unknown range %q of dashboard %s, using duration %s", req.rangeName, dashboard.GroupKind, req.duration)
+		return nil
+	}
+	duration, step, err := tr.parse()
+	if err != nil {
+		return fmt.Errorf("range %s of dashboard %s: %w", tr.Name, dashboard.GroupKind, err)
+	}
+	if tr.Since != "" {
+		end := req.end()
+		duration = end.Sub(periodStart(end, tr.Since, pp.options.location()))
+	}
+	req.duration = duration
+	if req.step == 0 && req.resolution == "" {
+		req.step = step
+	}
+	return nil
+}
 
+// execute handles the execution of a graph queryExpression and graph thresholds
+func (pp *PrometheusProvider) execute(ctx *gin.Context) {
+	req, err := pp.newGraphRequest(ctx)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	if ctx.Request.Method == http.MethodPost {
+		if err := parseResampleRequest(ctx, &req); err != nil {
+			writeQueryError(ctx, err)
+			return
+		}
+	}
+	row, err := pp.getRow(&req)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	graph := row.getGraph(req.graph)
+	if graph == nil {
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested Graph not found")
+		return
+	}
+	step, err := graphStep(graph, req, pp.options)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	cacheHeader := cacheControl(pp.options, step)
+	if req.format == formatRaw {
+		raw, err := pp.queryRaw(ctx.Request.Context(), graph, req)
 		if err != nil {
-			pp.logger.Errorf("Error executing graph query: %v", err)
-			ctx.JSON(http.StatusBadRequest, err)
+			writeQueryError(ctx, err)
 			return
 		}
-		if len(warnings) > 0 {
-			warningMsg := fmt.Errorf("query warnings: %s", warnings)
-			pp.logger.Warnf("Query warnings: %v", warnings)
-			ctx.JSON(http.StatusBadRequest, warningMsg.Error())
+		if _, samples := countSeries(raw.Data.Result); req.emptyNoContent && samples == 0 {
+			writeNoContent(ctx, cacheHeader)
 			return
 		}
-		data.Data, err = json.Marshal(result)
+		body, err := pp.marshalResponse(raw)
 		if err != nil {
-			ctx.JSON(http.StatusBadRequest, fmt.Errorf("error marshaling the data: %s", err))
+			writeQueryError(ctx, err)
 			return
 		}
+		pp.logResponse(graph, raw.Data.Result, body)
+		ctx.Header("Cache-Control", cacheHeader)
+		writeBodyWithETag(ctx, http.StatusOK, body)
+		return
+	}
+	data, result, err := pp.evaluateGraph(ctx.Request.Context(), graph, req)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	if req.emptyNoContent && data.Empty {
+		writeNoContent(ctx, cacheHeader)
+		return
+	}
+	if req.format == formatPNG {
+		image, err := renderGraph(graph, result, data, req.width, req.height)
+		if err != nil {
+			writeQueryError(ctx, err)
+			return
+		}
+		ctx.Header("Cache-Control", cacheHeader)
+		ctx.Data(http.StatusOK, "image/png", image)
+		return
+	}
+	if matrix, ok := result.(model.Matrix); ok && req.format != formatCompact && pp.streamSeries(req, len(matrix)) {
+		ctx.Header("Cache-Control", cacheHeader)
+		writeSeriesStream(ctx, matrix, graph.LegendFormat, data)
+		return
+	}
+	setData := data.setData
+	if req.format == formatCompact {
+		setData = data.setCompactData
+	}
+	if err := setData(result, graph.LegendFormat); err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	body, err := pp.marshalResponse(data)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	pp.logResponse(graph, result, body)
+	ctx.Header("Cache-Control", cacheHeader)
+	writeBodyWithETag(ctx, http.StatusOK, body)
+}
 
-		// Log the data being returned
-		jsonString, _ := json.MarshalIndent(data, "", "  ")
-		fmt.Printf("Returning data to UI: %s\n", string(jsonString))
-		var finalResultArr []ThresholdResponse
-		if graph.Thresholds != nil {
+// logResponse logs a summary of the result of a graph at debug level: its
+// series and sample counts and the time span of its samples. The response
+// body itself is only logged with the DebugResponseBodies option, since
+// logging the body of large matrices on every request is expensive.
+func (pp *PrometheusProvider) logResponse(graph *Graph, result model.Value, body []byte) {
+	if !pp.logger.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		return
+	}
+	series, samples := countSeries(result)
+	fields := []interface{}{"graph", graph.Name, "series", series, "samples", samples, "bytes", len(body)}
+	if first, last, ok := timeBounds(result); ok {
+		fields = append(fields, "first", first.Time().UTC(), "last", last.Time().UTC())
+	}
+	pp.logger.Debugw("Returning graph data", fields...)
+	if pp.options.DebugResponseBodies {
+		pp.logger.Debugw("Graph response body", "graph", graph.Name, "body", string(body))
+	}
+}
 
-			for _, threshold := range graph.Thresholds {
-				var result model.Value
-				var warnings v1.Warnings
-				var err error
+// marshalResponse marshals a graph or row response, failing with a 413 when
+// it is larger than MaxResponseBytes.
+func (pp *PrometheusProvider) marshalResponse(v interface{}) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, newQueryError(http.StatusInternalServerError, "error marshaling the response: "+err.Error())
+	}
+	if limit := pp.options.MaxResponseBytes; limit > 0 && len(body) > limit {
+		pp.metrics.responseRejected()
+		return nil, newQueryError(http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"Response of %d bytes exceeds the limit of %d bytes, request a shorter duration, a larger step or fewer series with ?maxSeries", len(body), limit))
+	}
+	return body, nil
+}
 
-				//If threshold.value present, threshold.value gets executed else,threshold.queryExpression gets executed.
-				if threshold.Value != "" {
-					result, warnings, err = executeGraphQuery(ctx, threshold.Value, env, duration, pp)
-				} else {
-					result, warnings, err = executeGraphQuery(ctx, threshold.QueryExpression, env, duration, pp)
-				}
-				if err != nil {
-					ctx.JSON(http.StatusBadRequest, err)
-					return
-				}
-				if len(warnings) > 0 {
-					warningMsg := fmt.Errorf("query warnings: %s", warnings)
-					ctx.JSON(http.StatusBadRequest, warningMsg.Error())
-					return
-				}
-				var temp ThresholdResponse
-				temp.Unit = threshold.Unit
-				temp.Name = threshold.Name
-				temp.Value = threshold.Value
-				temp.Key = threshold.Key
-				temp.Color = threshold.Color
-				temp.Data, err = json.Marshal(result)
-				if err != nil {
-					ctx.JSON(http.StatusBadRequest, fmt.Errorf("error marshaling the threshold response: %s", err))
-					return
-				}
+// streamSeries reports whether a result with the given number of series is
+// streamed, on request or above the server threshold.
+func (pp *PrometheusProvider) streamSeries(req graphRequest, series int) bool {
+	return req.stream || (pp.options.StreamSeriesThreshold > 0 && series > pp.options.StreamSeriesThreshold)
+}
+
+// setData sets the data of the response to result, along with the legend of
+// every series and, for scalar and string results, their value.
+func (data *AggregatedResponse) setData(result model.Value, legendFormat string) error {
+	if result != nil {
+		data.ResultType = result.Type()
+	}
+	switch v := result.(type) {
+	case *model.Scalar:
+		if v != nil {
+			data.Scalar = &LatestSample{Metric: model.Metric{}, Timestamp: v.Timestamp, Value: v.Value}
+		}
+	case *model.String:
+		if v != nil {
+			data.String = &StringResult{Timestamp: v.Timestamp, Value: v.Value}
+		}
+	}
+	var err error
+	if matrix, ok := matrixOf(result); ok {
+		data.Data, err = json.Marshal(legendMatrix(matrix, legendFormat))
+	} else {
+		data.Data, err = json.Marshal(result)
+	}
+	if err != nil {
+		return fmt.Errorf("error marshaling the data: %s", err)
+	}
+	return nil
+}
+
+// graphStep returns the step of the queries of graph: the request step if
+// any, else the step of the requested resolution, else the graph step, else
+// the server default. Auto graph steps are computed from the duration at
+// the medium resolution. The step is raised to keep the queries within
+// maxQueryPoints.
+func graphStep(graph *Graph, req graphRequest, options Options) (time.Duration, error) {
+	step := req.step
+	resolution := req.resolution
+	if step == 0 && resolution == "" && graph.Step == stepAuto {
+		resolution = resolutionMedium
+	}
+	if step == 0 && resolution != "" {
+		step = autoStep(req.duration, resolution)
+	}
+	if step == 0 {
+		var err error
+		step, err = graph.step()
+		if err != nil {
+			return 0, fmt.Errorf("graph %s has an invalid step: %w", graph.Name, err)
+		}
+	}
+	if step == 0 {
+		step = options.DefaultStep
+	}
+	if lowest := minStep(req.duration); step < lowest {
+		return lowest, nil
+	}
+	return step, nil
+}
+
+// prepareGraph returns the context the queries of graph are executed with,
+// carrying the requested diagnostics, the graph credentials, the tenant and
+// the query policy of the request, and the range they share.
+func (pp *PrometheusProvider) prepareGraph(ctx context.Context, graph *Graph, req graphRequest) (context.Context, *queryDiagnostics, v1.Range, error) {
+	var diag *queryDiagnostics
+	if req.diagnostics {
+		diag = &queryDiagnostics{}
+		ctx = withDiagnostics(ctx, diag)
+	}
+	if graph.Credentials != "" {
+		creds, ok := pp.credentials[graph.Credentials]
+		if !ok {
+			return nil, nil, v1.Range{}, fmt.Errorf("graph %s references undefined credentials %s", graph.Name, graph.Credentials)
+		}
+		ctx = withCredentials(ctx, creds)
+	}
+	if req.tenant != "" {
+		ctx = withTenant(ctx, req.tenant)
+	}
+	if req.policy != nil {
+		ctx = withQueryPolicy(ctx, req.policy)
+	}
+	if len(req.enforcedLabels) > 0 {
+		ctx = withEnforcedLabels(ctx, req.enforcedLabels)
+	}
+	if !req.at.IsZero() {
+		ctx = withFixedRange(ctx)
+	}
+	// All queries of a graph share the same range so their series line up
+	// on a common step grid.
+	step, err := graphStep(graph, req, pp.options)
+	if err != nil {
+		return nil, nil, v1.Range{}, err
+	}
+	end := req.end()
+	r := v1.Range{
+		Start: end.Add(-req.duration),
+		End:   end,
+		Step:  step,
+	}
+	return ctx, diag, r, nil
+}
+
+// queryRaw executes the queries of a graph and returns their result as is,
+// without thresholds nor transformations.
+func (pp *PrometheusProvider) queryRaw(ctx context.Context, graph *Graph, req graphRequest) (*RawResponse, error) {
+	ctx, _, r, err := pp.prepareGraph(ctx, graph, req)
+	if err != nil {
+		return nil, err
+	}
+	result, warnings, failures, err := executeGraphDatasources(ctx, graph, req.env, r, pp)
+	if err != nil {
+		return nil, err
+	}
+	warnings = append(warnings, failures...)
+	return &RawResponse{
+		Status:   "success",
+		Data:     RawData{ResultType: result.Type(), Result: result},
+		Warnings: warnings,
+	}, nil
+}
+
+// queryGraph executes the queries of a graph and its thresholds.
+func (pp *PrometheusProvider) queryGraph(ctx context.Context, graph *Graph, req graphRequest) (*AggregatedResponse, error) {
+	data, result, err := pp.evaluateGraph(ctx, graph, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := data.setData(result, graph.LegendFormat); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
 
-				finalResultArr = append(finalResultArr, temp)
+// evaluateGraph executes the queries of a graph and its thresholds,
+// returning the response without its data along with the graph result.
+func (pp *PrometheusProvider) evaluateGraph(ctx context.Context, graph *Graph, req graphRequest) (*AggregatedResponse, model.Value, error) {
+	// Every threshold is a query: reject graphs over the limit before
+	// running any of them, should the config have escaped validation.
+	if err := graph.checkThresholds(pp.options.MaxThresholds); err != nil {
+		return nil, nil, &queryError{status: http.StatusBadRequest, code: errCodeInvalidConfig, message: fmt.Sprintf("graph %s %s", graph.Name, err)}
+	}
+	env := req.env
+	ctx, diag, r, err := pp.prepareGraph(ctx, graph, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data AggregatedResponse
+	// Series are converted to the display unit of the graph in the
+	// response only, once the queries evaluated in the y axis unit.
+	factor := graph.displayFactor()
+	result, warnings, failures, err := executeGraphDatasources(ctx, graph, env, r, pp)
+	if err != nil {
+		if ctx.Err() == nil {
+			pp.logger.Errorf("Error executing graph query: %v", err)
+		}
+		return nil, nil, err
+	}
+	if len(warnings) > 0 {
+		pp.logger.Warnf("Query warnings: %v", warnings)
+		return nil, nil, fmt.Errorf("query warnings: %s", warnings)
+	}
+	data.Warnings = failures
+	data.Timezone = pp.options.location().String()
+	if graph.Baseline != nil {
+		delta, err := executeBaselineQuery(ctx, graph.Baseline, result, env, r, pp)
+		if err != nil {
+			pp.logger.Errorf("Error executing baseline query: %v", err)
+			return nil, nil, err
+		}
+		if graph.Baseline.ReplaceData {
+			result = delta
+		} else {
+			if graph.Relabel != nil {
+				delta = relabelMatrix(delta, graph.Relabel)
+			}
+			data.Delta, err = json.Marshal(scaleResult(delta, factor))
+			if err != nil {
+				return nil, nil, fmt.Errorf("error marshaling the delta: %s", err)
 			}
 		}
-		data.Thresholds = finalResultArr
+	}
+	if req.compare > 0 {
+		previous, err := executePreviousPeriod(ctx, graph, env, r, req.compare, pp)
+		if err != nil {
+			return nil, nil, err
+		}
+		data.Previous, err = json.Marshal(scaleResult(previous, factor))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error marshaling the previous period: %s", err)
+		}
+	}
+	if matrix, ok := result.(model.Matrix); ok && graph.Relabel != nil {
+		result = relabelMatrix(matrix, graph.Relabel)
+	}
+	if matrix, ok := result.(model.Matrix); ok && req.smoothWindow > 1 {
+		if req.includeRaw {
+			data.Raw, err = json.Marshal(scaleResult(matrix, factor))
+			if err != nil {
+				return nil, nil, fmt.Errorf("error marshaling the raw data: %s", err)
+			}
+		}
+		result = smoothMatrix(matrix, req.smoothWindow)
+	}
+	// Gaps are handled on the step grid of the query, before resampling
+	// and downsampling move the samples off it.
+	if matrix, ok := result.(model.Matrix); ok && graph.Gaps != nil {
+		result = fillGaps(matrix, graph.Gaps, r)
+	}
+	if len(req.resampleTimestamps) > 0 {
+		matrix, ok := result.(model.Matrix)
+		if !ok {
+			return nil, nil, fmt.Errorf("resampling requires a matrix result, got %T", result)
+		}
+		result = resampleMatrix(matrix, req.resampleTimestamps, req.resampleMethod)
+	}
+	if matrix, ok := result.(model.Matrix); ok && req.maxSeries > 0 {
+		result, data.AllSeries = topSeries(matrix, req.maxSeries, req.rankBy)
+	} else if ok && graph.TopN != nil {
+		result, data.AllSeries, data.OtherSeries = topSeriesWithOther(matrix, graph.TopN)
+	}
+	if matrix, ok := result.(model.Matrix); ok && req.maxPoints > 0 {
+		result = downsampleMatrix(matrix, req.maxPoints, req.downsampleMode)
+	}
+	result = scaleResult(result, factor)
+	if factor != 1 {
+		data.Unit = graph.DisplayUnit
+		data.UnitFactor = factor
+	}
+	if matrix, ok := result.(model.Matrix); ok && graph.GraphType == graphTypeHeatmap {
+		data.Heatmap = heatmapOf(matrix)
+	}
+	series, samples := countSeries(result)
+	data.SeriesCount = series
+	data.Latest = latestSamples(result)
+	if graph.Format != nil {
+		for i := range data.Latest {
+			data.Latest[i].Formatted = formatValue(float64(data.Latest[i].Value), graph.unit(), graph.Format)
+		}
+	}
+	data.Empty = samples == 0
+
+	data.Thresholds, err = pp.evaluateThresholds(ctx, graph, result, env, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(graph.Annotations) > 0 {
+		data.Annotations, err = executeAnnotations(ctx, graph.Annotations, env, r, pp)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	diag.recordSeries(series)
+	data.Diagnostics = diag.snapshot()
+	if req.debug {
+		if err := data.setDebug(graph, env, r, pp.config.QueryTemplates, req.enforcedLabels); err != nil {
+			return nil, nil, err
+		}
+	}
 
-		ctx.JSON(http.StatusOK, data)
+	return &data, result, nil
+}
+
+// setDebug sets the queries of graph rendered against env, with the
+// enforced labels, and the range r they were executed over on the response.
+func (data *AggregatedResponse) setDebug(graph *Graph, env map[string][]string, r v1.Range, templates map[string]string, enforced map[string]string) error {
+	queries := graph.queries()
+	if len(queries) == 0 {
+		query, err := renderEnforcedQuery(graph.QueryExpression, env, templates, enforced)
+		if err != nil {
+			return err
+		}
+		data.Query = query
+	} else {
+		data.Queries = make(map[string]string, len(queries))
+		for i, query := range queries {
+			rendered, err := renderEnforcedQuery(query.QueryExpression, env, templates, enforced)
+			if err != nil {
+				return err
+			}
+			data.Queries[query.alias(i)] = rendered
+		}
+	}
+	start, end := r.Start, r.End
+	data.Start = &start
+	data.End = &end
+	data.Step = r.Step.Seconds()
+	return nil
+}
+
+// Statuses of the graphs of a row response.
+const (
+	graphStatusOK      = "ok"
+	graphStatusError   = "error"
+	graphStatusTimeout = "timeout"
+)
+
+// GraphResult is the outcome of one graph of a row request.
+type GraphResult struct {
+	Status string              `json:"status"`
+	Error  string              `json:"error,omitempty"`
+	Result *AggregatedResponse `json:"result,omitempty"`
+}
+
+var timedOutGraph = GraphResult{Status: graphStatusTimeout, Error: "graph did not complete within the deadline budget"}
+
+// RowResponse is the response of a row request, keyed by graph name.
+type RowResponse struct {
+	Graphs map[string]GraphResult `json:"graphs"`
+}
+
+// executeRow queries all the graphs of a row concurrently within a deadline
+// budget. Graphs that have not completed when the budget runs out are returned
+// with a timeout status, while completed graphs return their data.
+func (pp *PrometheusProvider) executeRow(ctx *gin.Context) {
+	req, err := pp.newGraphRequest(ctx)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	budget, err := requestBudget(ctx, pp.options)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	row, err := pp.getRow(&req)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+
+	queries := make([]graphQuery, 0, len(row.Graphs))
+	for _, graph := range row.Graphs {
+		queries = append(queries, graphQuery{key: graph.Name, graph: graph, req: req})
+	}
+	response := RowResponse{Graphs: pp.queryGraphs(ctx.Request.Context(), budget, queries)}
+	body, err := pp.marshalResponse(response)
+	if err != nil {
+		writeQueryError(ctx, err)
 		return
 	}
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// requestBudget returns the deadline budget of a row or batch request:
+// ?budget if set, else the RowDeadline option.
+func requestBudget(ctx *gin.Context, options Options) (time.Duration, error) {
+	budgetStr := ctx.Query("budget")
+	if budgetStr == "" {
+		return options.RowDeadline, nil
+	}
+	budget, err := time.ParseDuration(budgetStr)
+	if err != nil || budget <= 0 {
+		return 0, newQueryError(http.StatusBadRequest, "Invalid budget format :"+budgetStr)
+	}
+	return budget, nil
+}
+
+// graphQuery is a graph of a row or batch request, along with the request it
+// is queried with and the key of its result.
+type graphQuery struct {
+	key   string
+	graph *Graph
+	req   graphRequest
+}
+
+// queryGraphs queries graphs concurrently within a deadline budget and
+// returns their results by key. Graphs that have not completed when the
+// budget runs out are reported with a timeout status.
+func (pp *PrometheusProvider) queryGraphs(ctx context.Context, budget time.Duration, queries []graphQuery) map[string]GraphResult {
+	queryCtx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	type graphOutcome struct {
+		key    string
+		result GraphResult
+	}
+	// The channel is buffered so graphs finishing after the deadline do not
+	// block once nobody is reading anymore.
+	outcomes := make(chan graphOutcome, len(queries))
+	for _, query := range queries {
+		go func(query graphQuery) {
+			data, err := pp.queryGraph(queryCtx, query.graph, query.req)
+			result := GraphResult{Status: graphStatusOK, Result: data}
+			if err != nil {
+				result = GraphResult{Status: graphStatusError, Error: err.Error()}
+				if queryCtx.Err() == context.DeadlineExceeded {
+					result = timedOutGraph
+				}
+			}
+			outcomes <- graphOutcome{key: query.key, result: result}
+		}(query)
+	}
+
+	results := make(map[string]GraphResult, len(queries))
+collect:
+	for range queries {
+		select {
+		case outcome := <-outcomes:
+			results[outcome.key] = outcome.result
+		case <-queryCtx.Done():
+			break collect
+		}
+	}
+	// The graphs that completed before the deadline are still reported,
+	// even when the select above picked the deadline over their outcome.
+drain:
+	for len(results) < len(queries) {
+		select {
+		case outcome := <-outcomes:
+			results[outcome.key] = outcome.result
+		default:
+			break drain
+		}
+	}
+	for _, query := range queries {
+		if _, ok := results[query.key]; !ok {
+			results[query.key] = timedOutGraph
+		}
+	}
+	return results
 }
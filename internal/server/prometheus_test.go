@@ -2,9 +2,28 @@ package server
 
 import (
 	"bytes"
-	"github.com/stretchr/testify/assert"
+	"context"
+	"encoding/json"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"text/template"
+	"time"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/version"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestExpression(t *testing.T) {
@@ -17,3 +36,706 @@ func TestExpression(t *testing.T) {
 	err = tmpl.Execute(buf, env)
 	assert.NoError(t, err)
 }
+
+func TestExecuteGraphQueries(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Form.Get("query") {
+		case "used":
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a"}, "values": [[1700000000, "1"]]}, {"metric": {"pod": "b"}, "values": [[1700000000, "2"]]}]}}`))
+		default:
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a"}, "values": [[1700000000, "4"]]}]}}`))
+		}
+	}))
+	defer prometheus.Close()
+	pp := NewPrometheusProvider(&MetricsConfigProvider{Provider: provider{Address: prometheus.URL}}, logging.NewLogger(), Options{})
+	assert.NoError(t, pp.init())
+	r := v1.Range{Start: time.Unix(1700000000, 0).Add(-time.Hour), End: time.Unix(1700000000, 0), Step: time.Minute}
+
+	result, _, err := executeGraphQueries(context.Background(), &Graph{Name: "graph", Queries: []GraphQuery{
+		{Name: "used", QueryExpression: "used"},
+		{Name: "limit", Legend: "Limit", QueryExpression: "limit"},
+		{QueryExpression: "requests"},
+	}}, nil, r, pp)
+	assert.NoError(t, err)
+	data := result.(model.Matrix)
+	assert.Len(t, data, 4, "the series of every query are merged")
+	var aliases []string
+	for _, series := range data {
+		aliases = append(aliases, string(series.Metric[seriesAliasLabel])+"/"+string(series.Metric["pod"]))
+	}
+	assert.ElementsMatch(t, []string{"used/a", "used/b", "Limit/a", "query3/a"}, aliases, "every series is labeled with the alias of its query")
+
+	result, _, err = executeGraphQueries(context.Background(), &Graph{Name: "graph", QueryExpression: "used"}, nil, r, pp)
+	assert.NoError(t, err)
+	data = result.(model.Matrix)
+	assert.Len(t, data, 2)
+	for _, series := range data {
+		assert.NotContains(t, series.Metric, model.LabelName(seriesAliasLabel), "the series of single query graphs are returned as is")
+	}
+}
+
+func TestNewGraphRequestDefaults(t *testing.T) {
+	options := Options{DefaultDuration: 2 * time.Hour, DefaultStep: 5 * time.Minute}
+	ctx := GetTestGinContext(httptest.NewRecorder())
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": "app", "groupkind": "pod", "row": "row", "graph": "graph"}, nil)
+	req, err := newGraphRequest(ctx, options)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, req.duration, "the default duration is used without a duration param")
+	step, err := graphStep(&Graph{Name: "graph"}, req, options)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, step, "the default step is used without a step param")
+
+	ctx = GetTestGinContext(httptest.NewRecorder())
+	MockJsonGet(ctx, http.Header{}, nil, map[string]string{"duration": "30m"})
+	req, err = newGraphRequest(ctx, options)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, req.duration, "the duration param overrides the default")
+}
+
+func TestQueryGraphDiagnostics(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a"}, "values": [[1700000000, "1"]]}, {"metric": {"pod": "b"}, "values": [[1700000000, "2"]]}]}}`))
+	}))
+	defer prometheus.Close()
+	pp := NewPrometheusProvider(&MetricsConfigProvider{Provider: provider{Name: "main", Address: prometheus.URL}}, logging.NewLogger(), Options{})
+	assert.NoError(t, pp.init())
+	graph := &Graph{Name: "graph", QueryExpression: "up"}
+
+	data, err := pp.queryGraph(context.Background(), graph, graphRequest{duration: time.Hour, step: time.Minute})
+	assert.NoError(t, err)
+	assert.Nil(t, data.Diagnostics, "the diagnostics are only returned with ?diag=true")
+
+	data, err = pp.queryGraph(context.Background(), graph, graphRequest{duration: time.Hour, step: time.Minute, diagnostics: true})
+	assert.NoError(t, err)
+	if assert.NotNil(t, data.Diagnostics) {
+		assert.Equal(t, Diagnostics{Queries: 1, ProvidersTried: []string{"main"}, Series: 2}, *data.Diagnostics)
+	}
+}
+
+// newTestPrometheusProvider returns a provider querying a fake Prometheus
+// answering every range query with result.
+func newTestPrometheusProvider(t *testing.T, graph *Graph, result string) *PrometheusProvider {
+	return newTestPrometheusProviderWithHandler(t, graph, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": ` + result + `}}`))
+	})
+}
+
+// newTestProviderConfig returns the config of a provider at address with a
+// single application, whose default dashboard holds graph in its row.
+func newTestProviderConfig(address string, graph *Graph) *MetricsConfigProvider {
+	return &MetricsConfigProvider{
+		Provider: provider{Address: address},
+		Applications: []Application{{
+			Name:    "app",
+			Default: true,
+			DefaultDashboard: &Dashboard{
+				GroupKind: "pod",
+				Rows:      []*Row{{Name: "row", Graphs: []*Graph{graph}}},
+			},
+		}},
+	}
+}
+
+// newTestPrometheusProviderWithHandler returns a provider querying a fake
+// Prometheus served by handler.
+func newTestPrometheusProviderWithHandler(t *testing.T, graph *Graph, handler http.HandlerFunc) *PrometheusProvider {
+	prometheus := httptest.NewServer(handler)
+	t.Cleanup(prometheus.Close)
+	pp := NewPrometheusProvider(newTestProviderConfig(prometheus.URL, graph), logging.NewLogger(), Options{DefaultDuration: time.Hour, DefaultStep: time.Minute})
+	assert.NoError(t, pp.init())
+	return pp
+}
+
+// executeTestGraph runs a graph request against pp with the given query
+// params.
+func executeTestGraph(pp *PrometheusProvider, queryParams map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": "app", "groupkind": "pod", "row": "row", "graph": "graph"}, queryParams)
+	pp.execute(ctx)
+	return w
+}
+
+func TestExecuteRawFormat(t *testing.T) {
+	result := `[{"metric": {"pod": "a"}, "values": [[1700000000, "1"], [1700000060, "2"]]}]`
+	pp := newTestPrometheusProvider(t, &Graph{
+		Name:            "graph",
+		QueryExpression: "up",
+		Relabel:         &Relabel{Drop: []string{"pod"}},
+		Thresholds:      []Threshold{{Key: "max", Value: "1"}},
+	}, result)
+
+	w := executeTestGraph(pp, map[string]string{"format": "raw"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "success", "data": {"resultType": "matrix", "result": `+result+`}}`, w.Body.String())
+
+	w = executeTestGraph(pp, map[string]string{"format": "csv"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPrepareGraphOffset(t *testing.T) {
+	pp := NewPrometheusProvider(&MetricsConfigProvider{}, logging.NewLogger(), Options{DefaultStep: time.Minute})
+	before := time.Now()
+	_, _, r, err := pp.prepareGraph(context.Background(), &Graph{}, graphRequest{duration: time.Hour, offset: 30 * time.Second})
+	assert.NoError(t, err)
+	assert.WithinRange(t, r.End, before.Add(-30*time.Second), time.Now().Add(-30*time.Second))
+	assert.Equal(t, time.Hour, r.End.Sub(r.Start))
+	assert.Equal(t, time.Minute, r.Step)
+}
+
+func TestExecuteAt(t *testing.T) {
+	var ends []string
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ends = append(ends, r.Form.Get("end"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+	pp.cache = newResultCache(time.Minute)
+
+	w := executeTestGraph(pp, map[string]string{"at": "2023-11-14T22:13:20Z", "duration": "1h"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = executeTestGraph(pp, map[string]string{"at": "2023-11-14T23:13:20+01:00", "duration": "1h"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"1700000000"}, ends, "the empty result of the same fixed range is cached")
+	w = executeTestGraph(pp, map[string]string{"duration": "1h"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, ends, 2, "the live range does not share the cache of fixed ranges")
+
+	for _, at := range []string{"yesterday", "1700000000", time.Now().Add(time.Hour).Format(time.RFC3339)} {
+		w = executeTestGraph(pp, map[string]string{"at": at})
+		assert.Equal(t, http.StatusBadRequest, w.Code, at)
+	}
+}
+
+func TestExecutePNGFormat(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{
+		Name:            "graph",
+		QueryExpression: "up",
+		Thresholds:      []Threshold{{Key: "max", Color: "#e5484d", Value: "1"}},
+	}, `[{"metric": {"pod": "a"}, "values": [[1700000000, "1"], [1700000060, "2"]]}]`)
+
+	w := executeTestGraph(pp, map[string]string{"format": "png", "width": "400", "height": "200"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	config, err := png.DecodeConfig(w.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, config.Width)
+	assert.Equal(t, 200, config.Height)
+
+	w = executeTestGraph(pp, map[string]string{"format": "png", "width": "100000"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	ctx := GetTestGinContext(httptest.NewRecorder())
+	MockJsonGet(ctx, http.Header{"Accept": {"image/png"}}, nil, nil)
+	req, err := newGraphRequest(ctx, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, formatPNG, req.format)
+}
+
+func TestEvaluateGraphCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var queries int32
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{
+		Name:            "graph",
+		QueryExpression: "up",
+		Thresholds:      []Threshold{{Key: "warning", Value: "80"}, {Key: "critical", Value: "90"}},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		// The client goes away while the graph query is in flight.
+		cancel()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+
+	_, _, err := pp.evaluateGraph(ctx, pp.config.Applications[0].DefaultDashboard.Rows[0].Graphs[0], graphRequest{duration: time.Hour})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries), "the threshold queries are skipped")
+}
+
+func TestExecuteMaxResponseBytes(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"},
+		`[{"metric": {"pod": "a"}, "values": [[1700000000, "1"], [1700000060, "2"]]}]`)
+	pp.metrics = newServerMetrics()
+
+	pp.options.MaxResponseBytes = 100
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"response_too_large"`)
+	assert.Equal(t, 1.0, testutil.ToFloat64(pp.metrics.responsesRejected))
+
+	pp.options.MaxResponseBytes = 10000
+	w = executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestGetRowRange(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"}, `[]`)
+	pp.config.Applications[0].DefaultDashboard.Ranges = []TimeRange{
+		{Name: "Last 15m", Duration: "15m"},
+		{Name: "Last 7d", Duration: "168h", Step: "1h"},
+	}
+
+	tests := []struct {
+		name             string
+		req              graphRequest
+		expectedDuration time.Duration
+		expectedStep     time.Duration
+	}{
+		{name: "preset duration", req: graphRequest{rangeName: "Last 15m", duration: time.Hour}, expectedDuration: 15 * time.Minute},
+		{name: "preset step", req: graphRequest{rangeName: "Last 7d"}, expectedDuration: 168 * time.Hour, expectedStep: time.Hour},
+		{name: "requested step overrides the preset step", req: graphRequest{rangeName: "Last 7d", step: time.Minute}, expectedDuration: 168 * time.Hour, expectedStep: time.Minute},
+		{name: "unknown preset falls back to the duration", req: graphRequest{rangeName: "Last year", duration: time.Hour}, expectedDuration: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.application, req.groupKind, req.row = "app", "pod", "row"
+			_, err := pp.getRow(&req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedDuration, req.duration)
+			assert.Equal(t, tt.expectedStep, req.step)
+		})
+	}
+	pp.config.Applications[0].DefaultDashboard.Ranges = append(pp.config.Applications[0].DefaultDashboard.Ranges, TimeRange{Name: "Today", Since: sinceDay})
+	pp.options.Timezone = time.FixedZone("UTC+14", 14*60*60)
+	req := graphRequest{application: "app", groupKind: "pod", row: "row", rangeName: "Today"}
+	_, err := pp.getRow(&req)
+	assert.NoError(t, err)
+	now := time.Now().In(pp.options.Timezone)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	assert.InDelta(t, now.Sub(midnight).Seconds(), req.duration.Seconds(), 5, "today starts at midnight in the server timezone")
+}
+
+func TestPrometheusUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		headers   map[string]string
+		expected  string
+	}{
+		{name: "default", expected: version.UserAgent()},
+		{name: "flag", userAgent: "metrics-ext/staging", expected: "metrics-ext/staging"},
+		{name: "provider header", userAgent: "metrics-ext/staging", headers: map[string]string{"user-agent": "team-a"}, expected: "team-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var userAgent string
+			pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+				userAgent = r.UserAgent()
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+			})
+			pp.options.UserAgent = tt.userAgent
+			pp.config.Provider.Headers = tt.headers
+			assert.NoError(t, pp.init())
+
+			w := executeTestGraph(pp, nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.expected, userAgent)
+		})
+	}
+}
+
+func TestPrometheusSkipTLSVerify(t *testing.T) {
+	prometheus := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	}))
+	defer prometheus.Close()
+	skip, verify := true, false
+
+	tests := []struct {
+		name          string
+		global        bool
+		skipTLSVerify *bool
+		expectedCode  int
+	}{
+		{name: "verified by default", expectedCode: http.StatusBadGateway},
+		{name: "global flag", global: true, expectedCode: http.StatusOK},
+		{name: "skipped for the datasource", skipTLSVerify: &skip, expectedCode: http.StatusOK},
+		{name: "verified for the datasource despite the global flag", global: true, skipTLSVerify: &verify, expectedCode: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"}, `[]`)
+			pp.config.Provider.Address = prometheus.URL
+			pp.config.Provider.SkipTLSVerify = tt.skipTLSVerify
+			pp.options.SkipPrometheusTLSVerify = tt.global
+			pp.options.QueryMaxAttempts = 1
+			assert.NoError(t, pp.init())
+
+			w := executeTestGraph(pp, nil)
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestPrometheusConnectionReuse(t *testing.T) {
+	var connections int32
+	prometheus := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	}))
+	prometheus.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	prometheus.StartTLS()
+	defer prometheus.Close()
+
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"}, `[]`)
+	pp.config.Provider.Address = prometheus.URL
+	pp.options.SkipPrometheusTLSVerify = true
+	pp.options.PrometheusMaxIdleConns = 10
+	pp.options.PrometheusMaxIdleConnsPerHost = 5
+	pp.options.PrometheusIdleConnTimeout = time.Minute
+	transport := pp.newTransport()
+	assert.Equal(t, 10, transport.MaxIdleConns)
+	assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	assert.NoError(t, pp.init())
+
+	for i := 0; i < 3; i++ {
+		w := executeTestGraph(pp, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "queries reuse the connection")
+}
+
+func TestPrometheusProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests sent through a proxy carry the absolute URL of
+		// Prometheus.
+		proxied = append(proxied, r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	}))
+	defer proxy.Close()
+
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"}, `[]`)
+	pp.config.Provider.Address = "http://prometheus.invalid:9090"
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err)
+	pp.options.PrometheusProxyURL = proxyURL
+	assert.NoError(t, pp.init())
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, proxied, 1)
+	assert.True(t, strings.HasPrefix(proxied[0], "http://prometheus.invalid:9090/api/v1/query_range"), proxied[0])
+}
+
+func TestExecuteRateLimited(t *testing.T) {
+	queries := 0
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.Header().Set("Retry-After", "90")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	pp.metrics = newServerMetrics()
+	pp.options.QueryMaxAttempts = 3
+	pp.options.QueryTimeout = time.Second
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "90", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"datasource_rate_limited"`)
+	assert.Equal(t, 1, queries, "the query is not retried past its timeout")
+	assert.Equal(t, 1.0, testutil.ToFloat64(pp.metrics.queriesRateLimited.WithLabelValues(pp.datasourceName(context.Background()))))
+	assert.False(t, isBackendFailure(&statusError{statusCode: http.StatusTooManyRequests}), "a rate limited datasource is not failing")
+}
+
+func TestSetData(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   model.Value
+		expected string
+	}{
+		{
+			name:     "matrix",
+			result:   model.Matrix{{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}}}},
+			expected: `{"resultType": "matrix", "data": [{"metric": {"pod": "a"}, "values": [[1, "1"]], "legend": "{pod=\"a\"}"}]}`,
+		},
+		{
+			name:     "vector",
+			result:   model.Vector{{Metric: model.Metric{"pod": "a"}, Timestamp: 1000, Value: 1}},
+			expected: `{"resultType": "vector", "data": [{"metric": {"pod": "a"}, "value": [1, "1"]}]}`,
+		},
+		{
+			name:     "scalar",
+			result:   &model.Scalar{Timestamp: 1000, Value: 0.5},
+			expected: `{"resultType": "scalar", "data": [{"metric": {}, "values": [[1, "0.5"]], "legend": "{}"}], "scalar": {"metric": {}, "timestamp": 1, "value": "0.5"}}`,
+		},
+		{
+			name:     "string",
+			result:   &model.String{Timestamp: 1000, Value: "v1.2.3"},
+			expected: `{"resultType": "string", "data": [], "string": {"timestamp": 1, "value": "v1.2.3"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data AggregatedResponse
+			assert.NoError(t, data.setData(tt.result, ""))
+			body, err := json.Marshal(struct {
+				ResultType model.ValueType `json:"resultType"`
+				Data       json.RawMessage `json:"data"`
+				Scalar     *LatestSample   `json:"scalar,omitempty"`
+				String     *StringResult   `json:"string,omitempty"`
+			}{data.ResultType, data.Data, data.Scalar, data.String})
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.expected, string(body))
+		})
+	}
+}
+
+func TestMaxQuerySeries(t *testing.T) {
+	var count string
+	var rangeQueries int
+	series := `[{"metric": {"pod": "a"}, "values": [[1700000000, "1"]]}, {"metric": {"pod": "b"}, "values": [[1700000000, "1"]]}, {"metric": {"pod": "c"}, "values": [[1700000000, "1"]]}]`
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/v1/query" {
+			assert.Equal(t, "count(up)", r.Form.Get("query"))
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": [1700000000, "` + count + `"]}]}}`))
+			return
+		}
+		rangeQueries++
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": ` + series + `}}`))
+	})
+	pp.options.MaxQuerySeries = 2
+
+	count = "5"
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"too_many_series"`)
+	assert.Contains(t, w.Body.String(), "query returns 5 series, more than the limit of 2")
+	assert.Equal(t, 0, rangeQueries, "the range query is not run")
+
+	count = "2"
+	w = executeTestGraph(pp, map[string]string{"duration": "2h"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "query returns 3 series, more than the limit of 2")
+	assert.Equal(t, 1, rangeQueries)
+
+	pp.options.MaxQuerySeries = 3
+	w = executeTestGraph(pp, map[string]string{"duration": "3h"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestMaxThresholds(t *testing.T) {
+	var queries int
+	graph := &Graph{Name: "graph", QueryExpression: "up", Thresholds: []Threshold{
+		{Key: "warning", QueryExpression: "warning_level"},
+		{Key: "critical", QueryExpression: "critical_level"},
+	}}
+	pp := newTestPrometheusProviderWithHandler(t, graph, func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+	pp.options.MaxThresholds = 1
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"invalid_config"`)
+	assert.Contains(t, w.Body.String(), "graph graph has 2 thresholds, more than the limit of 1")
+	assert.Equal(t, 0, queries, "no query is run")
+
+	pp.options.MaxThresholds = 2
+	w = executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 3, queries)
+}
+
+func TestExecuteDisplayUnit(t *testing.T) {
+	result := `[{"metric": {"pod": "a"}, "values": [[1700000000, "1073741824"], [1700000060, "2147483648"]]}]`
+	pp := newTestPrometheusProvider(t, &Graph{
+		Name:            "graph",
+		QueryExpression: "memory",
+		YAxisUnit:       "B",
+		DisplayUnit:     "GiB",
+		Format:          &ValueFormat{},
+		Thresholds:      []Threshold{{Key: "limit", Value: "1.5", Unit: "GiB"}},
+	}, result)
+
+	w := executeTestGraph(pp, map[string]string{"duration": "1h"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "GiB", response.Unit)
+	assert.InDelta(t, 1.0/(1<<30), response.UnitFactor, 1e-18)
+	var data model.Matrix
+	assert.NoError(t, json.Unmarshal(response.Data, &data))
+	assert.Equal(t, []model.SamplePair{{Timestamp: 1700000000000, Value: 1}, {Timestamp: 1700000060000, Value: 2}}, data[0].Values)
+	assert.Equal(t, "2.00 GiB", response.Latest[0].Formatted)
+	assert.True(t, response.Thresholds[0].Breached, "thresholds are compared in the display unit")
+	assert.Equal(t, 2.0, *response.Thresholds[0].BreachingValue)
+
+	w = executeTestGraph(pp, map[string]string{"duration": "1h"})
+	var cached AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &cached))
+	assert.JSONEq(t, string(response.Data), string(cached.Data), "cached results are not converted twice")
+}
+
+func TestExecuteDashboardNotFound(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"}, `[]`)
+	// The application has no default dashboard, so that requests for other
+	// group kinds are not found.
+	app := &pp.config.Applications[0]
+	app.Dashboards, app.DefaultDashboard = []*Dashboard{app.DefaultDashboard, {GroupKind: "deployment"}}, nil
+	pp.config.Applications = append(pp.config.Applications, Application{Name: "empty"})
+
+	for _, tt := range []struct {
+		application string
+		code        string
+		available   []string
+	}{
+		{application: "app", code: errCodeNotFound, available: []string{"deployment", "pod"}},
+		{application: "empty", code: errCodeNoDashboards},
+	} {
+		w := httptest.NewRecorder()
+		ctx := GetTestGinContext(w)
+		MockJsonGet(ctx, http.Header{}, map[string]string{"application": tt.application, "groupkind": "statefulset", "row": "row", "graph": "graph"}, nil)
+		pp.execute(ctx)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.application)
+		var response ErrorResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, tt.code, response.Error.Code, tt.application)
+		assert.Equal(t, tt.available, response.Error.Available, tt.application)
+	}
+}
+
+func TestExecuteApplicationNotFound(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"}, `[]`)
+	request := func(application string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx := GetTestGinContext(w)
+		MockJsonGet(ctx, http.Header{}, map[string]string{"application": application, "groupkind": "pod", "row": "row", "graph": "graph"}, nil)
+		pp.execute(ctx)
+		return w
+	}
+
+	w := request("unknown")
+	assert.Equal(t, http.StatusOK, w.Code, "unknown applications fall back to the default application")
+
+	pp.config.Applications[0].Default = false
+	w = request("unknown")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, errCodeNotFound, response.Error.Code, "unknown applications are not found without a default application")
+	assert.Equal(t, "Requested/Default Application not found", response.Error.Message)
+
+	w = request("app")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestExecuteThresholds(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up", Thresholds: []Threshold{
+		{Key: "literal", Value: "1.5"},
+		{Key: "expression", QueryExpression: "limit"},
+		{Key: "both", Value: "3", QueryExpression: "ignored"},
+		{Key: "legacy", Value: "limit"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		queries = append(queries, r.Form.Get("query"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		value := "1"
+		if r.Form.Get("query") == "limit" {
+			value = "2"
+		}
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {}, "values": [[1700000000, "` + value + `"]]}]}}`))
+	})
+
+	w := executeTestGraph(pp, map[string]string{"duration": "1h", "step": "30m"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.ElementsMatch(t, []string{"up", "limit", "limit"}, queries, "literal thresholds are not queried")
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Thresholds, 4)
+	for _, threshold := range response.Thresholds {
+		var data model.Matrix
+		assert.NoError(t, json.Unmarshal(threshold.Data, &data))
+		assert.Len(t, data, 1, threshold.Key)
+		switch threshold.Key {
+		case "literal":
+			assert.Len(t, data[0].Values, 3, "a sample at every step")
+			assert.Equal(t, model.SampleValue(1.5), data[0].Values[0].Value)
+			assert.False(t, threshold.Breached)
+		case "expression":
+			assert.Equal(t, model.SampleValue(2), data[0].Values[0].Value)
+		case "both":
+			assert.Equal(t, "3", threshold.Value)
+			assert.Equal(t, model.SampleValue(3), data[0].Values[0].Value, "the value takes precedence over the queryExpression")
+		case "legacy":
+			assert.Equal(t, model.SampleValue(2), data[0].Values[0].Value, "values that are not numbers are queried")
+		}
+	}
+}
+
+func TestExecuteResolution(t *testing.T) {
+	var step string
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up", Step: "5s"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		step = r.Form.Get("step")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+
+	tests := []struct {
+		params   map[string]string
+		expected string
+	}{
+		{params: map[string]string{"duration": "1h"}, expected: "5"},
+		{params: map[string]string{"duration": "1h", "resolution": "low"}, expected: "15"},
+		{params: map[string]string{"duration": "24h", "step": "auto"}, expected: "173"},
+		{params: map[string]string{"duration": "24h", "step": "auto", "resolution": "high"}, expected: "87"},
+		{params: map[string]string{"duration": "24h", "step": "1m", "resolution": "high"}, expected: "60"},
+	}
+	for _, tt := range tests {
+		w := executeTestGraph(pp, tt.params)
+		assert.Equal(t, http.StatusOK, w.Code, "%v", tt.params)
+		assert.Equal(t, tt.expected, step, "%v", tt.params)
+	}
+
+	w := executeTestGraph(pp, map[string]string{"resolution": "ultra"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Invalid resolution \"ultra\": must be high, medium or low`)
+}
+
+func TestExecuteLogsResponse(t *testing.T) {
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up"},
+		`[{"metric": {"pod": "a"}, "values": [[1700000000, "1"], [1700000060, "2"]]}]`)
+	core, logs := observer.New(zap.DebugLevel)
+	pp.logger = zap.New(core).Sugar()
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	summaries := logs.FilterMessage("Returning graph data").AllUntimed()
+	assert.Len(t, summaries, 1)
+	fields := summaries[0].ContextMap()
+	assert.Equal(t, int64(1), fields["series"])
+	assert.Equal(t, int64(2), fields["samples"])
+	assert.Equal(t, time.Unix(1700000060, 0).UTC(), fields["last"])
+	assert.Zero(t, logs.FilterMessage("Graph response body").Len(), "bodies are only logged on request")
+
+	pp.options.DebugResponseBodies = true
+	w = executeTestGraph(pp, map[string]string{"duration": "2h"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	bodies := logs.FilterMessage("Graph response body").AllUntimed()
+	assert.Len(t, bodies, 1)
+	assert.Equal(t, w.Body.String(), bodies[0].ContextMap()["body"])
+}
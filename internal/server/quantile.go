@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// graphTypeQuantile is the graphType of graphs plotting quantiles of a
+// histogram, whose queries are generated from their Quantiles.
+const graphTypeQuantile = "quantile"
+
+// defaultQuantileWindow is the default range of the rate of the buckets of
+// quantile graphs.
+const defaultQuantileWindow = "5m"
+
+// Quantiles configures the queries of a quantile graph: a
+// histogram_quantile query per quantile, over the rate of the buckets of a
+// histogram.
+type Quantiles struct {
+	// Histogram is the base name of the histogram metric, e.g.
+	// http_request_duration_seconds, whose _bucket series are queried.
+	Histogram string `json:"histogram"`
+	// Quantiles are the quantiles plotted, between 0 and 1, e.g. 0.5, 0.9
+	// and 0.99. Their series are labeled with their alias, e.g. p99.
+	Quantiles []float64 `json:"quantiles"`
+	// Selector holds the label matchers of the bucket series, templated
+	// like queries, e.g. namespace="{{ .namespace }}".
+	Selector string `json:"selector,omitempty"`
+	// By lists the labels the quantiles are computed by, on top of le, each
+	// quantile being computed over all the bucket series otherwise.
+	By []string `json:"by,omitempty"`
+	// Window is the range of the rate of the buckets, 5m by default.
+	Window string `json:"window,omitempty"`
+}
+
+func (q *Quantiles) validate() error {
+	if !model.IsValidMetricName(model.LabelValue(q.Histogram)) {
+		return fmt.Errorf("invalid histogram %q: must be a metric name", q.Histogram)
+	}
+	if strings.HasSuffix(q.Histogram, "_bucket") {
+		return fmt.Errorf("invalid histogram %q: must be the base name of the metric, without _bucket", q.Histogram)
+	}
+	if len(q.Quantiles) == 0 {
+		return fmt.Errorf("has no quantiles")
+	}
+	seen := map[float64]bool{}
+	for _, quantile := range q.Quantiles {
+		if !(quantile >= 0 && quantile <= 1) {
+			return fmt.Errorf("invalid quantile %g: must be between 0 and 1", quantile)
+		}
+		if seen[quantile] {
+			return fmt.Errorf("duplicate quantile %g", quantile)
+		}
+		seen[quantile] = true
+	}
+	for _, label := range q.By {
+		if !model.LabelName(label).IsValid() || label == model.BucketLabel {
+			return fmt.Errorf("invalid by label %q", label)
+		}
+	}
+	if q.Window != "" {
+		if _, err := model.ParseDuration(q.Window); err != nil {
+			return fmt.Errorf("invalid window %q: %w", q.Window, err)
+		}
+	}
+	return nil
+}
+
+// queries returns a histogram_quantile query per quantile, named after the
+// quantile, e.g. p99 for 0.99.
+func (q *Quantiles) queries() []GraphQuery {
+	window := q.Window
+	if window == "" {
+		window = defaultQuantileWindow
+	}
+	by := strings.Join(append([]string{model.BucketLabel}, q.By...), ", ")
+	buckets := fmt.Sprintf("rate(%s_bucket{%s}[%s])", q.Histogram, q.Selector, window)
+	queries := make([]GraphQuery, 0, len(q.Quantiles))
+	for _, quantile := range q.Quantiles {
+		queries = append(queries, GraphQuery{
+			Name:            "p" + strconv.FormatFloat(quantile*100, 'g', 10, 64),
+			QueryExpression: fmt.Sprintf("histogram_quantile(%s, sum by (%s) (%s))", strconv.FormatFloat(quantile, 'f', -1, 64), by, buckets),
+		})
+	}
+	return queries
+}
+
+// queries returns the queries of a graph plotting several of them: those
+// generated for a quantile graph, or its configured Queries.
+func (g *Graph) queries() []GraphQuery {
+	if g.GraphType == graphTypeQuantile && g.Quantiles != nil {
+		return g.Quantiles.queries()
+	}
+	return g.Queries
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuantilesQueries(t *testing.T) {
+	quantiles := &Quantiles{Histogram: "http_request_duration_seconds", Quantiles: []float64{0.5, 0.999}}
+	assert.Equal(t, []GraphQuery{
+		{Name: "p50", QueryExpression: "histogram_quantile(0.5, sum by (le) (rate(http_request_duration_seconds_bucket{}[5m])))"},
+		{Name: "p99.9", QueryExpression: "histogram_quantile(0.999, sum by (le) (rate(http_request_duration_seconds_bucket{}[5m])))"},
+	}, quantiles.queries())
+
+	quantiles = &Quantiles{Histogram: "grpc_server_handling_seconds", Quantiles: []float64{0.99}, Selector: `namespace="{{ .namespace }}"`, By: []string{"pod"}, Window: "1m"}
+	assert.Equal(t, []GraphQuery{
+		{Name: "p99", QueryExpression: `histogram_quantile(0.99, sum by (le, pod) (rate(grpc_server_handling_seconds_bucket{namespace="{{ .namespace }}"}[1m])))`},
+	}, quantiles.queries())
+
+	graph := &Graph{GraphType: graphTypeQuantile, Quantiles: quantiles, Queries: []GraphQuery{{QueryExpression: "up"}}}
+	assert.Equal(t, quantiles.queries(), graph.queries())
+	graph.GraphType = ""
+	assert.Equal(t, graph.Queries, graph.queries(), "quantiles are only used by quantile graphs")
+}
+
+func TestQuantilesValidate(t *testing.T) {
+	assert.NoError(t, (&Quantiles{Histogram: "latency_seconds", Quantiles: []float64{0, 0.9, 1}, By: []string{"pod"}, Window: "30s"}).validate())
+	for _, tt := range []struct {
+		quantiles Quantiles
+		errMsg    string
+	}{
+		{quantiles: Quantiles{Quantiles: []float64{0.9}}, errMsg: `invalid histogram "": must be a metric name`},
+		{quantiles: Quantiles{Histogram: "latency_seconds_bucket", Quantiles: []float64{0.9}}, errMsg: `invalid histogram "latency_seconds_bucket": must be the base name of the metric, without _bucket`},
+		{quantiles: Quantiles{Histogram: "latency_seconds"}, errMsg: "has no quantiles"},
+		{quantiles: Quantiles{Histogram: "latency_seconds", Quantiles: []float64{99}}, errMsg: "invalid quantile 99: must be between 0 and 1"},
+		{quantiles: Quantiles{Histogram: "latency_seconds", Quantiles: []float64{0.9, 0.9}}, errMsg: "duplicate quantile 0.9"},
+		{quantiles: Quantiles{Histogram: "latency_seconds", Quantiles: []float64{0.9}, By: []string{"le"}}, errMsg: `invalid by label "le"`},
+		{quantiles: Quantiles{Histogram: "latency_seconds", Quantiles: []float64{0.9}, Window: "five minutes"}, errMsg: `invalid window "five minutes"`},
+	} {
+		err := tt.quantiles.validate()
+		assert.ErrorContains(t, err, tt.errMsg)
+	}
+}
+
+func TestConfigValidateQuantiles(t *testing.T) {
+	quantiles := &Quantiles{Histogram: "latency_seconds", Quantiles: []float64{0.99}}
+	config := &O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "app", DefaultDashboard: &Dashboard{
+			GroupKind: "pod",
+			Rows: []*Row{{Name: "pod", Graphs: []*Graph{
+				{Name: "latency", GraphType: graphTypeQuantile, Quantiles: quantiles},
+				{Name: "empty", GraphType: graphTypeQuantile},
+				{Name: "line", Quantiles: quantiles},
+				{Name: "both", GraphType: graphTypeQuantile, Quantiles: quantiles, QueryExpression: "up"},
+				{Name: "invalid", GraphType: graphTypeQuantile, Quantiles: &Quantiles{Histogram: "latency_seconds"}},
+			}}},
+		}}},
+	}}
+	err := config.validate()
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"application app, dashboard pod, row pod, graph empty: quantile graph has no quantiles",
+		"application app, dashboard pod, row pod, graph line: quantiles are only used by quantile graphs",
+		"application app, dashboard pod, row pod, graph both: quantile graph has a queryExpression or queries, its queries being generated",
+		"application app, dashboard pod, row pod, graph invalid: quantiles: has no quantiles",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestExecuteQuantile(t *testing.T) {
+	api := &mockAPI{result: testMatrix}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph", GraphType: graphTypeQuantile, Quantiles: &Quantiles{
+		Histogram: "latency_seconds",
+		Quantiles: []float64{0.5, 0.99},
+		Selector:  `pod="{{ .pod }}"`,
+	}}, api)
+
+	w := executeTestGraph(pp, map[string]string{"pod": "a"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	sort.Strings(api.queries)
+	assert.Equal(t, []string{
+		`histogram_quantile(0.5, sum by (le) (rate(latency_seconds_bucket{pod="a"}[5m])))`,
+		`histogram_quantile(0.99, sum by (le) (rate(latency_seconds_bucket{pod="a"}[5m])))`,
+	}, api.queries)
+
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	var data model.Matrix
+	assert.NoError(t, json.Unmarshal(response.Data, &data))
+	assert.Len(t, data, 2)
+	assert.Equal(t, model.LabelValue("p50"), data[0].Metric[seriesAliasLabel])
+	assert.Equal(t, model.LabelValue("p99"), data[1].Metric[seriesAliasLabel])
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientRateLimiter rate limits the requests of every client with a token
+// bucket of its own, so that a single client, e.g. a browser tab stuck in a
+// refresh loop, can not use up the query budget of the server shared by
+// all users. Buckets hold up to burst tokens and are refilled at rate
+// tokens per second. A nil clientRateLimiter does not limit requests.
+type clientRateLimiter struct {
+	rate    float64
+	burst   float64
+	metrics *serverMetrics
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// pruned is when the full buckets were last dropped.
+	pruned time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newClientRateLimiter returns a limiter letting every client make rate
+// requests per second with bursts of burst requests, or nil when rate is
+// not positive.
+func newClientRateLimiter(rate float64, burst int, metrics *serverMetrics) *clientRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &clientRateLimiter{rate: rate, burst: float64(burst), metrics: metrics, now: time.Now, buckets: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from the bucket of client, returning false along with
+// how long until a token is available when it is empty.
+func (l *clientRateLimiter) allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		l.metrics.clientRequestRejected(client)
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that refilled since, which are the same as new
+// ones, at most once per refill period so that the buckets of clients gone
+// for good do not pile up.
+func (l *clientRateLimiter) prune(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.pruned) < refill {
+		return
+	}
+	l.pruned = now
+	for client, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// clientKey returns the client a request is accounted to: the value of
+// header when set and sent, else the IP address of the client.
+func clientKey(c *gin.Context, header string) string {
+	if header != "" {
+		if value := strings.TrimSpace(c.GetHeader(header)); value != "" {
+			return value
+		}
+	}
+	return c.ClientIP()
+}
+
+// rateLimitMiddleware rejects the API requests of clients over their rate
+// limit with a 429 and a Retry-After header. Health checks, metrics and
+// other requests outside of basePath/api are never limited.
+func rateLimitMiddleware(limiter *clientRateLimiter, header string, basePath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.HasPrefix(c.Request.URL.Path, basePath+"/api/") {
+			c.Next()
+			return
+		}
+		ok, retryAfter := limiter.allow(clientKey(c, header))
+		if !ok {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			writeError(c, http.StatusTooManyRequests, errCodeRateLimited, fmt.Sprintf("Too many requests from this client, retry in %ds", seconds))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRateLimiter(t *testing.T) {
+	metrics := newServerMetrics()
+	limiter := newClientRateLimiter(2, 3, metrics)
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.allow("alice")
+		assert.True(t, ok, "request %d is within the burst", i)
+	}
+	ok, retryAfter := limiter.allow("alice")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.clientRequestsRejected.WithLabelValues("alice")))
+
+	ok, _ = limiter.allow("bob")
+	assert.True(t, ok, "clients have buckets of their own")
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.allow("alice")
+	assert.True(t, ok, "the bucket refilled a token")
+	ok, _ = limiter.allow("alice")
+	assert.False(t, ok)
+
+	now = now.Add(time.Minute)
+	limiter.allow("carol")
+	assert.Len(t, limiter.buckets, 1, "refilled buckets are dropped")
+
+	assert.Nil(t, newClientRateLimiter(0, 10, metrics))
+	ok, _ = (*clientRateLimiter)(nil).allow("alice")
+	assert.True(t, ok, "a nil limiter does not limit requests")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := gin.New()
+	handler.Use(rateLimitMiddleware(newClientRateLimiter(0.5, 1, nil), "Argocd-Username", ""))
+	handler.GET("/healthz", func(c *gin.Context) {
+		c.String(http.StatusOK, "healthy")
+	})
+	handler.GET("/api/applications", func(c *gin.Context) {
+		c.String(http.StatusOK, "[]")
+	})
+
+	request := func(path string, user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if user != "" {
+			req.Header.Set("Argocd-Username", user)
+		}
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("/api/applications", "alice").Code)
+	w := request("/api/applications", "alice")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"rate_limited"`)
+
+	assert.Equal(t, http.StatusOK, request("/api/applications", "bob").Code)
+	assert.Equal(t, http.StatusOK, request("/api/applications", "").Code, "clients without the header are told apart by IP")
+	assert.Equal(t, http.StatusTooManyRequests, request("/api/applications", "").Code)
+	assert.Equal(t, http.StatusOK, request("/healthz", "alice").Code, "health checks are never limited")
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReloadResponse is the response of a successful configuration reload.
+type ReloadResponse struct {
+	Provider     string `json:"provider"`
+	Applications int    `json:"applications"`
+	Dashboards   int    `json:"dashboards"`
+}
+
+// loadConfig reads the configuration files of paths, merges and validates
+// them, checking the result against the limits of options.
+func loadConfig(paths []string, options Options) (O11yConfig, error) {
+	config, err := readConfigFiles(paths)
+	if err != nil {
+		return config, err
+	}
+	for _, providerConfig := range []*MetricsConfigProvider{config.Prometheus, config.Wavefront} {
+		if providerConfig == nil {
+			continue
+		}
+		if err := providerConfig.expandEnv(); err != nil {
+			return config, err
+		}
+	}
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+	if err := config.checkLimits(options); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// newProvider creates and initializes the provider configured in config.
+func (ms *O11yServer) newProvider(config O11yConfig) (MetricsProvider, error) {
+	var provider MetricsProvider
+	switch {
+	case config.Prometheus != nil:
+		pp := NewPrometheusProvider(config.Prometheus, ms.logger, ms.options)
+		pp.limiter = ms.limiter
+		pp.metrics = ms.metrics
+		provider = pp
+	case config.Wavefront != nil:
+		token, found := os.LookupEnv("WAVEFRONT_TOKEN")
+		if !found {
+			return nil, fmt.Errorf("WAVEFRONT_TOKEN env not set")
+		}
+		provider = NewWavefrontProvider(config.Wavefront, token, ms.logger, ms.options)
+	default:
+		return nil, nil
+	}
+	if err := provider.init(); err != nil {
+		return nil, err
+	}
+	for _, err := range config.thresholdValueQueries() {
+		ms.logger.Warnf("Deprecated configuration: %v", err)
+	}
+	return provider, nil
+}
+
+// reloadConfig reads the configuration again and, when it is valid, swaps
+// it and the provider built from it for the ones in use. Requests being
+// served finish with the previous provider.
+func (ms *O11yServer) reloadConfig() (ReloadResponse, error) {
+	config, err := loadConfig(ms.configPaths, ms.options)
+	if err != nil {
+		return ReloadResponse{}, err
+	}
+	provider, err := ms.newProvider(config)
+	if err != nil {
+		return ReloadResponse{}, fmt.Errorf("error creating the provider: %w", err)
+	}
+
+	ms.mu.Lock()
+	ms.config = config
+	ms.provider = provider
+	ms.mu.Unlock()
+
+	response := ReloadResponse{}
+	if provider != nil {
+		response.Provider = provider.getType()
+	}
+	if metricsConfig := ms.metricsConfig(); metricsConfig != nil {
+		response.Applications = len(metricsConfig.Applications)
+		for _, app := range metricsConfig.Applications {
+			response.Dashboards += len(app.dashboards())
+		}
+	}
+	return response, nil
+}
+
+// reload reloads the configuration on demand, answering 400 with the
+// validation error when the new configuration is invalid, in which case the
+// current one stays in use.
+func (ms *O11yServer) reload(ctx *gin.Context) {
+	response, err := ms.reloadConfig()
+	if err != nil {
+		ms.logger.Errorf("Error reloading the configuration: %v", err)
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidConfig, err.Error())
+		return
+	}
+	ms.logger.Infof("Configuration reloaded: %d applications, %d dashboards", response.Applications, response.Dashboards)
+	ctx.JSON(http.StatusOK, response)
+}
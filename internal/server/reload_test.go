@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(config string) {
+		assert.NoError(t, os.WriteFile(configPath, []byte(config), 0o600))
+	}
+
+	w := httptest.NewRecorder()
+	ctx, ms := createContextAndNewO11yServer(w)
+	ms.configPaths = []string{configPath}
+
+	writeConfig(`{"prometheus": {
+		"provider": {"address": "http://prometheus:9090"},
+		"applications": [{"name": "app",
+			"defaultDashboard": {"groupKind": "pod", "rows": [{"name": "pod", "graphs": [{"name": "cpu"}]}]},
+			"dashboards": [{"groupKind": "deployment", "rows": [{"name": "pod", "graphs": [{"name": "cpu"}]}]}]
+		}]
+	}}`)
+	ms.reload(ctx)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"provider": "prometheus", "applications": 1, "dashboards": 2}`, w.Body.String())
+	assert.Equal(t, PROMETHEUS_TYPE, ms.currentProvider().getType())
+
+	w = httptest.NewRecorder()
+	ctx = GetTestGinContext(w)
+	writeConfig(`{"prometheus": {
+		"applications": [{"name": "other", "defaultDashboard": {"groupKind": "pod", "rows": [{"name": "row", "graphs": [{"name": "graph", "step": "fast"}]}]}}]
+	}}`)
+	ms.reload(ctx)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"invalid_config"`)
+	assert.Equal(t, "app", ms.metricsConfig().Applications[0].Name, "an invalid configuration is not applied")
+}
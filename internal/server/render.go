@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
+)
+
+// formatPNG requests graph results rendered as a PNG image.
+const formatPNG = "png"
+
+// Size of rendered graphs, overridable with ?width and ?height up to
+// maxRenderSize.
+const (
+	defaultRenderWidth  = 800
+	defaultRenderHeight = 400
+	maxRenderSize       = 4096
+)
+
+// defaultThresholdColor is the color of threshold lines without a valid
+// hex color.
+var defaultThresholdColor = drawing.ColorRed
+
+// parseRenderSize parses the size query param name of a rendered graph.
+func parseRenderSize(ctx *gin.Context, name string, def int) (int, error) {
+	value := ctx.Query(name)
+	if value == "" {
+		return def, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 || size > maxRenderSize {
+		return 0, newQueryError(http.StatusBadRequest, fmt.Sprintf("Invalid %s %q: must be a number of pixels between 1 and %d", name, value, maxRenderSize))
+	}
+	return size, nil
+}
+
+// renderGraph renders the series of result, and the thresholds of data, to
+// a PNG image titled with the graph name.
+func renderGraph(graph *Graph, result model.Value, data *AggregatedResponse, width, height int) ([]byte, error) {
+	matrix, ok := result.(model.Matrix)
+	if !ok {
+		return nil, newQueryError(http.StatusBadRequest, fmt.Sprintf("Can not render a %s result", result.Type()))
+	}
+	series := matrixSeries(matrix, chart.Style{})
+	if len(series) == 0 {
+		return nil, newQueryError(http.StatusBadRequest, "Graph returned no data to render")
+	}
+	for _, threshold := range data.Thresholds {
+		var levels model.Matrix
+		if err := json.Unmarshal(threshold.Data, &levels); err != nil {
+			continue
+		}
+		for _, stream := range levels {
+			for i, sample := range stream.Values {
+				level, err := convertUnit(float64(sample.Value), threshold.Unit, graph.unit())
+				if err != nil {
+					return nil, err
+				}
+				stream.Values[i].Value = model.SampleValue(level)
+			}
+		}
+		series = append(series, matrixSeries(levels, chart.Style{
+			StrokeColor:     thresholdColor(threshold.Color),
+			StrokeDashArray: []float64{5, 5},
+		})...)
+	}
+
+	c := chart.Chart{
+		Title:  graph.Name,
+		Width:  width,
+		Height: height,
+		XAxis:  chart.XAxis{ValueFormatter: chart.TimeMinuteValueFormatter},
+		YAxis:  chart.YAxis{Name: graph.unit()},
+		Series: series,
+	}
+	c.Elements = []chart.Renderable{chart.LegendLeft(&c)}
+	var buf bytes.Buffer
+	if err := c.Render(chart.PNG, &buf); err != nil {
+		return nil, fmt.Errorf("error rendering the graph: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// matrixSeries returns a chart series per series of matrix, drawn with
+// style. NaN samples are left out.
+func matrixSeries(matrix model.Matrix, style chart.Style) []chart.Series {
+	var series []chart.Series
+	for _, stream := range matrix {
+		ts := chart.TimeSeries{Name: stream.Metric.String(), Style: style}
+		for _, sample := range stream.Values {
+			if math.IsNaN(float64(sample.Value)) {
+				continue
+			}
+			ts.XValues = append(ts.XValues, sample.Timestamp.Time())
+			ts.YValues = append(ts.YValues, float64(sample.Value))
+		}
+		if len(ts.XValues) > 0 {
+			series = append(series, ts)
+		}
+	}
+	return series
+}
+
+// thresholdColor parses the css hex color of a threshold, e.g. #e5484d.
+func thresholdColor(color string) drawing.Color {
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) != 3 && len(hex) != 6 {
+		return defaultThresholdColor
+	}
+	for _, c := range hex {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return defaultThresholdColor
+		}
+	}
+	return drawing.ColorFromHex(hex)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+)
+
+// computeETag returns a strong ETag for a response body.
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison required for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONWithETag writes v as JSON along with an ETag computed from the
+// body. When the request If-None-Match header matches the ETag, only a 304
+// Not Modified is written.
+func writeJSONWithETag(ctx *gin.Context, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(ctx, http.StatusInternalServerError, errCodeInternal, "error marshaling the response: "+err.Error())
+		return
+	}
+	writeBodyWithETag(ctx, status, body)
+}
+
+// writeBodyWithETag writes a JSON body like writeJSONWithETag.
+func writeBodyWithETag(ctx *gin.Context, status int, body []byte) {
+	etag := computeETag(body)
+	ctx.Header("ETag", etag)
+	if etagMatches(ctx.GetHeader("If-None-Match"), etag) {
+		ctx.Status(http.StatusNotModified)
+		ctx.Writer.WriteHeaderNow()
+		return
+	}
+	ctx.Data(status, "application/json; charset=utf-8", body)
+}
+
+// writeNoContent answers a graph request whose result has no samples with a
+// 204, as requested with ?emptyAs=204.
+func writeNoContent(ctx *gin.Context, cacheHeader string) {
+	ctx.Header("Cache-Control", cacheHeader)
+	ctx.Status(http.StatusNoContent)
+	ctx.Writer.WriteHeaderNow()
+}
+
+// cacheControl returns the Cache-Control header of a graph response queried
+// with step: a response is fresh until the graph has a new sample, unless
+// options say otherwise. Responses are private, since they are served only
+// to the users allowed to see the application.
+func cacheControl(options Options, step time.Duration) string {
+	if options.CacheNoStore {
+		return "no-store"
+	}
+	maxAge := options.CacheMaxAge
+	if maxAge <= 0 {
+		maxAge = step
+	}
+	return fmt.Sprintf("private, max-age=%d", int64(maxAge/time.Second))
+}
+
+// StreamLine is a line of a streamed graph response: either one series of
+// the result or, on the last line, the rest of the response.
+type StreamLine struct {
+	Series  *LegendSeries       `json:"series,omitempty"`
+	Summary *AggregatedResponse `json:"summary,omitempty"`
+}
+
+// streamFlushInterval is the number of series written between flushes of a
+// streamed response.
+const streamFlushInterval = 100
+
+// writeSeriesStream writes matrix as newline delimited JSON, one series per
+// line along with its legend, followed by summary, so that neither the
+// server nor the client has to hold the whole encoded response. The data of
+// summary is not written.
+func writeSeriesStream(ctx *gin.Context, matrix model.Matrix, legendFormat string, summary *AggregatedResponse) {
+	ctx.Header("Content-Type", "application/x-ndjson")
+	ctx.Status(http.StatusOK)
+	encoder := json.NewEncoder(ctx.Writer)
+	for i, series := range legendMatrix(matrix, legendFormat) {
+		if err := encoder.Encode(StreamLine{Series: &series}); err != nil {
+			ctx.Error(err)
+			return
+		}
+		if (i+1)%streamFlushInterval == 0 {
+			ctx.Writer.Flush()
+		}
+	}
+	summary.Data = nil
+	if err := encoder.Encode(StreamLine{Summary: summary}); err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.Writer.Flush()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteJSONWithETag(t *testing.T) {
+	response := AggregatedResponse{Data: []byte(`[]`), Empty: true}
+
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	writeJSONWithETag(ctx, http.StatusOK, response)
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w = httptest.NewRecorder()
+		ctx = GetTestGinContext(w)
+		ctx.Request.Header.Set("If-None-Match", ifNoneMatch)
+		writeJSONWithETag(ctx, http.StatusOK, response)
+		assert.Equal(t, http.StatusNotModified, w.Code, ifNoneMatch)
+		assert.Empty(t, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ctx = GetTestGinContext(w)
+	ctx.Request.Header.Set("If-None-Match", `"other"`)
+	writeJSONWithETag(ctx, http.StatusOK, response)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+}
+
+func TestWriteSeriesStream(t *testing.T) {
+	matrix := model.Matrix{
+		{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}}},
+		{Metric: model.Metric{"pod": "b"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 2}}},
+	}
+	w := httptest.NewRecorder()
+	writeSeriesStream(GetTestGinContext(w), matrix, "pod {{ .pod }}", &AggregatedResponse{SeriesCount: 2})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	var lines []StreamLine
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line StreamLine
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	assert.Len(t, lines, 3)
+	assert.Equal(t, &LegendSeries{Metric: matrix[0].Metric, Values: matrix[0].Values, Legend: "pod a"}, lines[0].Series)
+	assert.Equal(t, &LegendSeries{Metric: matrix[1].Metric, Values: matrix[1].Values, Legend: "pod b"}, lines[1].Series)
+	assert.Nil(t, lines[2].Series)
+	assert.Equal(t, 2, lines[2].Summary.SeriesCount)
+}
+
+func TestCacheControl(t *testing.T) {
+	assert.Equal(t, "private, max-age=60", cacheControl(Options{}, time.Minute))
+	assert.Equal(t, "private, max-age=15", cacheControl(Options{CacheMaxAge: 15 * time.Second}, time.Minute))
+	assert.Equal(t, "no-store", cacheControl(Options{CacheMaxAge: 15 * time.Second, CacheNoStore: true}, time.Minute))
+
+	pp := newTestPrometheusProvider(t, &Graph{Name: "graph", QueryExpression: "up", Step: "30s"}, "[]")
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "private, max-age=30", w.Header().Get("Cache-Control"))
+
+	w = executeTestGraph(pp, map[string]string{"step": "fast"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// isTransientError reports whether a failed query is worth retrying: network
+// errors and gateway errors from a restarting or overloaded backend. Errors
+// caused by the request being cancelled are never transient.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// rateLimitedError returns the statusError of a query rejected by a rate
+// limited backend with a 429, if err is one.
+func rateLimitedError(err error) (*statusError, bool) {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusTooManyRequests {
+		return statusErr, true
+	}
+	return nil, false
+}
+
+// retryDelay returns the delay before retry number attempt of a query that
+// failed with err: the backoff delay, or the Retry-After delay of a rate
+// limited query when longer.
+func retryDelay(err error, baseDelay time.Duration, attempt int) time.Duration {
+	delay := backoffDelay(baseDelay, attempt)
+	if statusErr, ok := rateLimitedError(err); ok && statusErr.retryAfter > delay {
+		return statusErr.retryAfter
+	}
+	return delay
+}
+
+// backoffDelay returns the delay before retry number attempt (starting at 1):
+// an exponential backoff from baseDelay with jitter, between half and all of
+// baseDelay * 2^(attempt-1).
+func backoffDelay(baseDelay time.Duration, attempt int) time.Duration {
+	delay := baseDelay << (attempt - 1)
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// retryWithBackoff calls fn up to maxAttempts times, as long as it fails with
+// a transient error and ctx is not done. Rate limited queries are retried
+// after their Retry-After delay, unless ctx is done by then. onRetry is
+// called before every retry. It returns the error of the last attempt.
+func retryWithBackoff(ctx context.Context, maxAttempts int, baseDelay time.Duration, fn func() error, onRetry func()) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if attempt >= maxAttempts || !isTransientError(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := retryDelay(err, baseDelay, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		onRetry()
+	}
+}
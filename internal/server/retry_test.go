@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientError(t *testing.T) {
+	assert.False(t, isTransientError(nil))
+	assert.False(t, isTransientError(context.Canceled))
+	assert.False(t, isTransientError(&url.Error{Op: "Post", URL: "http://prometheus", Err: context.Canceled}))
+	assert.False(t, isTransientError(&v1.Error{Type: v1.ErrBadData, Msg: "parse error"}))
+	assert.False(t, isTransientError(&v1.Error{Type: v1.ErrClient, Msg: "client error: 404"}))
+	assert.True(t, isTransientError(&statusError{statusCode: 503}))
+	assert.True(t, isTransientError(&statusError{statusCode: 429}))
+	assert.True(t, isTransientError(&url.Error{Op: "Post", URL: "http://prometheus", Err: errors.New("connection reset by peer")}))
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	transient := &statusError{statusCode: 502}
+
+	attempts, retries := 0, 0
+	err := retryWithBackoff(context.Background(), 3, time.Millisecond, func() error {
+		attempts++
+		if attempts < 2 {
+			return transient
+		}
+		return nil
+	}, func() { retries++ })
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 1, retries)
+
+	attempts = 0
+	err = retryWithBackoff(context.Background(), 3, time.Millisecond, func() error {
+		attempts++
+		return transient
+	}, func() {})
+	assert.Equal(t, transient, err)
+	assert.Equal(t, 3, attempts, "gives up after the max attempts")
+
+	attempts = 0
+	badData := &v1.Error{Type: v1.ErrBadData}
+	err = retryWithBackoff(context.Background(), 3, time.Millisecond, func() error {
+		attempts++
+		return badData
+	}, func() {})
+	assert.Equal(t, badData, err)
+	assert.Equal(t, 1, attempts, "non transient errors are not retried")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts = 0
+	err = retryWithBackoff(ctx, 3, time.Hour, func() error {
+		attempts++
+		cancel()
+		return transient
+	}, func() {})
+	assert.Equal(t, transient, err)
+	assert.Equal(t, 1, attempts, "retries stop when the context is done")
+}
+
+func TestExecuteGraphQueryTimeout(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		<-r.Context().Done()
+	}))
+	defer prometheus.Close()
+	pp := NewPrometheusProvider(&MetricsConfigProvider{Provider: provider{Address: prometheus.URL}}, logging.NewLogger(), Options{QueryTimeout: 50 * time.Millisecond})
+	assert.NoError(t, pp.init())
+
+	now := time.Now()
+	_, _, err := executeGraphQuery(context.Background(), "up", nil, v1.Range{Start: now.Add(-time.Hour), End: now, Step: time.Minute}, pp)
+	var qe *queryError
+	if assert.ErrorAs(t, err, &qe) {
+		assert.Equal(t, http.StatusGatewayTimeout, qe.status)
+		assert.Equal(t, errCodeTimeout, qe.code)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	assert.Equal(t, 2*time.Minute, parseRetryAfter("120", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("Tue, 14 Nov 2023 22:13:50 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Tue, 14 Nov 2023 22:00:00 GMT", now), "dates in the past")
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	rateLimited := &statusError{statusCode: 429, retryAfter: 20 * time.Millisecond}
+	assert.Equal(t, 20*time.Millisecond, retryDelay(rateLimited, time.Millisecond, 1), "Retry-After is honored")
+	assert.GreaterOrEqual(t, retryDelay(&statusError{statusCode: 429, retryAfter: time.Millisecond}, time.Second, 1), 500*time.Millisecond, "the backoff applies when longer")
+
+	attempts := 0
+	start := time.Now()
+	err := retryWithBackoff(context.Background(), 2, time.Millisecond, func() error {
+		attempts++
+		if attempts < 2 {
+			return rateLimited
+		}
+		return nil
+	}, func() {})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	attempts = 0
+	err = retryWithBackoff(ctx, 3, time.Millisecond, func() error {
+		attempts++
+		return &statusError{statusCode: 429, retryAfter: time.Minute}
+	}, func() {})
+	_, ok := rateLimitedError(err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, attempts, "a Retry-After past the deadline is not waited for")
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// Types of rules.
+const (
+	ruleTypeRecording = "recording"
+	ruleTypeAlerting  = "alerting"
+)
+
+// RulesResponse is the response of a rules request.
+type RulesResponse struct {
+	Groups []RuleGroupStatus `json:"groups"`
+}
+
+// RuleGroupStatus is the evaluation status of a rule group.
+type RuleGroupStatus struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Interval is the evaluation interval of the group, in seconds.
+	Interval float64 `json:"interval"`
+	// Health is err when any rule of the group is unhealthy, unknown when
+	// any has not been evaluated yet, and ok otherwise.
+	Health string `json:"health"`
+	// Unhealthy is the number of rules of the group whose health is err.
+	Unhealthy int `json:"unhealthy"`
+	// LastEvaluation is the most recent evaluation of the rules of the
+	// group, and EvaluationTime the sum of their last evaluation times, in
+	// seconds.
+	LastEvaluation time.Time    `json:"lastEvaluation"`
+	EvaluationTime float64      `json:"evaluationTime"`
+	Rules          []RuleStatus `json:"rules"`
+}
+
+// RuleStatus is the evaluation status of a rule.
+type RuleStatus struct {
+	Name string `json:"name"`
+	// Type is recording or alerting.
+	Type      string `json:"type"`
+	Health    string `json:"health"`
+	LastError string `json:"lastError,omitempty"`
+	// LastEvaluation is the time of the last evaluation of the rule, and
+	// EvaluationTime its duration, in seconds.
+	LastEvaluation time.Time `json:"lastEvaluation"`
+	EvaluationTime float64   `json:"evaluationTime"`
+	// State and ActiveAlerts are set for alerting rules: inactive, pending
+	// or firing, and the number of their pending and firing alerts.
+	State        string `json:"state,omitempty"`
+	ActiveAlerts int    `json:"activeAlerts,omitempty"`
+}
+
+// rules returns the evaluation status of the recording and alerting rule
+// groups of the datasource of the request, shaped for health panels. The
+// groups can be restricted to the names of ?group and the rules to a ?type,
+// recording or alerting. Rules whose query is not allowed by the query
+// policy of the application, or does not select only its enforced labels,
+// are left out, as are the groups left empty.
+func (pp *PrometheusProvider) rules(ctx *gin.Context) {
+	app := pp.config.getApp(ctx.Param("application"))
+	if app == nil {
+		writeQueryError(ctx, newNotFoundError("Requested/Default Application not found"))
+		return
+	}
+	ruleType := ctx.Query("type")
+	switch ruleType {
+	case "", ruleTypeRecording, ruleTypeAlerting:
+	default:
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid type %q: must be recording or alerting", ruleType))
+		return
+	}
+	groups := map[string]bool{}
+	for _, name := range ctx.QueryArray("group") {
+		groups[name] = true
+	}
+
+	queryCtx, err := pp.requestContext(ctx)
+	if err != nil {
+		writeQueryError(ctx, err)
+		return
+	}
+	result, err := pp.queryRules(queryCtx)
+	if err != nil {
+		pp.logger.Errorf("Error querying the rules: %s", err)
+		writeQueryError(ctx, classifyQueryError(err))
+		return
+	}
+
+	response := RulesResponse{Groups: []RuleGroupStatus{}}
+	for _, group := range result.Groups {
+		if len(groups) > 0 && !groups[group.Name] {
+			continue
+		}
+		status := RuleGroupStatus{Name: group.Name, File: group.File, Interval: group.Interval, Rules: []RuleStatus{}}
+		for _, rule := range group.Rules {
+			ruleStatus, query, ok := newRuleStatus(rule)
+			if !ok || (ruleType != "" && ruleStatus.Type != ruleType) {
+				continue
+			}
+			if app.QueryPolicy != nil && app.QueryPolicy.check(query) != nil {
+				continue
+			}
+			if len(app.EnforcedLabels) > 0 && !selectsEnforcedLabels(query, app.EnforcedLabels) {
+				continue
+			}
+			status.add(ruleStatus)
+		}
+		if len(status.Rules) > 0 {
+			response.Groups = append(response.Groups, status)
+		}
+	}
+	sort.SliceStable(response.Groups, func(i, j int) bool {
+		if response.Groups[i].File != response.Groups[j].File {
+			return response.Groups[i].File < response.Groups[j].File
+		}
+		return response.Groups[i].Name < response.Groups[j].Name
+	})
+	ctx.JSON(http.StatusOK, response)
+}
+
+// newRuleStatus returns the status of a recording or alerting rule along
+// with its query, ok being false for rules of unknown types.
+func newRuleStatus(rule interface{}) (RuleStatus, string, bool) {
+	switch r := rule.(type) {
+	case v1.RecordingRule:
+		return RuleStatus{Name: r.Name, Type: ruleTypeRecording, Health: string(r.Health), LastError: r.LastError, LastEvaluation: r.LastEvaluation, EvaluationTime: r.EvaluationTime}, r.Query, true
+	case v1.AlertingRule:
+		status := RuleStatus{Name: r.Name, Type: ruleTypeAlerting, Health: string(r.Health), LastError: r.LastError, LastEvaluation: r.LastEvaluation, EvaluationTime: r.EvaluationTime, State: r.State}
+		for _, alert := range r.Alerts {
+			if alert != nil && (alert.State == v1.AlertStatePending || alert.State == v1.AlertStateFiring) {
+				status.ActiveAlerts++
+			}
+		}
+		return status, r.Query, true
+	}
+	return RuleStatus{}, "", false
+}
+
+// add adds rule to the group, updating the health and evaluation of the
+// group.
+func (g *RuleGroupStatus) add(rule RuleStatus) {
+	g.Rules = append(g.Rules, rule)
+	switch {
+	case rule.Health == string(v1.RuleHealthBad):
+		g.Unhealthy++
+		g.Health = string(v1.RuleHealthBad)
+	case rule.Health != string(v1.RuleHealthGood) && g.Health != string(v1.RuleHealthBad):
+		g.Health = string(v1.RuleHealthUnknown)
+	case g.Health == "":
+		g.Health = string(v1.RuleHealthGood)
+	}
+	if rule.LastEvaluation.After(g.LastEvaluation) {
+		g.LastEvaluation = rule.LastEvaluation
+	}
+	g.EvaluationTime += rule.EvaluationTime
+}
+
+// queryRules returns the rule groups of the datasource of ctx, within the
+// limits, retries and circuit breaker of range queries.
+func (pp *PrometheusProvider) queryRules(ctx context.Context) (v1.RulesResult, error) {
+	var result v1.RulesResult
+	err := pp.callAPI(ctx, "the rules", func(ctx context.Context, client v1.API) error {
+		var err error
+		result, err = client.Rules(ctx)
+		return err
+	})
+	return result, err
+}
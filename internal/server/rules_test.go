@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// getTestRules requests the rules of the test application from pp with
+// the given query params.
+func getTestRules(pp *PrometheusProvider, query url.Values) *httptest.ResponseRecorder {
+	return getTestApplicationRules(pp, "app", query)
+}
+
+// getTestApplicationRules requests the rules of application from pp with
+// the given query params.
+func getTestApplicationRules(pp *PrometheusProvider, application string, query url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": application}, nil)
+	ctx.Request.URL.RawQuery = query.Encode()
+	pp.rules(ctx)
+	return w
+}
+
+func TestRules(t *testing.T) {
+	evaluated := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	api := &mockAPI{rules: v1.RulesResult{Groups: []v1.RuleGroup{
+		{Name: "node", File: "node.yaml", Interval: 60, Rules: v1.Rules{
+			v1.RecordingRule{Name: "node:cpu:rate5m", Query: "rate(node_cpu_seconds_total[5m])", Health: v1.RuleHealthGood, LastEvaluation: evaluated, EvaluationTime: 0.25},
+			v1.AlertingRule{Name: "NodeDown", Query: "up == 0", Health: v1.RuleHealthBad, LastError: "many-to-many matching not allowed", LastEvaluation: evaluated.Add(time.Second), EvaluationTime: 0.5, State: "firing",
+				Alerts: []*v1.Alert{{State: v1.AlertStateFiring}, {State: v1.AlertStatePending}, {State: v1.AlertStateInactive}}},
+		}},
+		{Name: "api", File: "api.yaml", Interval: 30, Rules: v1.Rules{
+			v1.RecordingRule{Name: "job:requests:rate5m", Query: "sum(rate(http_requests_total[5m])) by (job)", Health: v1.RuleHealthUnknown},
+		}},
+	}}}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph"}, api)
+
+	w := getTestRules(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response RulesResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Groups, 2)
+	assert.Equal(t, "api", response.Groups[0].Name, "groups are sorted by file")
+	assert.Equal(t, string(v1.RuleHealthUnknown), response.Groups[0].Health)
+	node := response.Groups[1]
+	assert.Equal(t, string(v1.RuleHealthBad), node.Health)
+	assert.Equal(t, 1, node.Unhealthy)
+	assert.Equal(t, 60.0, node.Interval)
+	assert.Equal(t, 0.75, node.EvaluationTime)
+	assert.Equal(t, evaluated.Add(time.Second), node.LastEvaluation)
+	assert.Equal(t, []RuleStatus{
+		{Name: "node:cpu:rate5m", Type: ruleTypeRecording, Health: "ok", LastEvaluation: evaluated, EvaluationTime: 0.25},
+		{Name: "NodeDown", Type: ruleTypeAlerting, Health: "err", LastError: "many-to-many matching not allowed", LastEvaluation: evaluated.Add(time.Second), EvaluationTime: 0.5, State: "firing", ActiveAlerts: 2},
+	}, node.Rules)
+
+	w = getTestRules(pp, url.Values{"group": {"node"}, "type": {ruleTypeRecording}})
+	response = RulesResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Groups, 1)
+	assert.Equal(t, string(v1.RuleHealthGood), response.Groups[0].Health)
+	assert.Len(t, response.Groups[0].Rules, 1)
+
+	w = getTestRules(pp, url.Values{"type": {"silenced"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = getTestRules(pp, url.Values{"datasource": {"missing"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeNotFound)
+
+	pp.config.Applications[0].QueryPolicy = &QueryPolicy{Metrics: []string{"up"}}
+	w = getTestRules(pp, nil)
+	response = RulesResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Groups, 1, "rules not allowed by the query policy are left out")
+	assert.Equal(t, "NodeDown", response.Groups[0].Rules[0].Name)
+}
+
+func TestRulesUnreachable(t *testing.T) {
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph"}, &mockAPI{err: errors.New("connection refused")})
+
+	w := getTestRules(pp, nil)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeQueryFailed)
+}
+
+func TestRulesApplicationNotFound(t *testing.T) {
+	api := &mockAPI{rules: v1.RulesResult{Groups: []v1.RuleGroup{
+		{Name: "node", File: "node.yaml", Rules: v1.Rules{v1.RecordingRule{Name: "node:cpu:rate5m", Query: "rate(node_cpu_seconds_total[5m])", Health: v1.RuleHealthGood}}},
+	}}}
+	pp := newTestPrometheusProviderWithAPI(t, &Graph{Name: "graph"}, api)
+	pp.config.Applications[0].Default = false
+
+	w := getTestApplicationRules(pp, "unknown", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, errCodeNotFound, response.Error.Code, "the rules of unknown applications are not listed")
+	assert.NotContains(t, w.Body.String(), "node:cpu:rate5m")
+
+	w = getTestApplicationRules(pp, "app", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
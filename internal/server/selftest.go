@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+)
+
+// Statuses of a self-test check.
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// selfTestTimeout bounds the probe query of the self-test when queries have
+// no timeout.
+const selfTestTimeout = 10 * time.Second
+
+// SelfTestCheck is the outcome of one check of a SelfTestReport.
+type SelfTestCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Latency is the round trip time of the probe query.
+	Latency string `json:"latency,omitempty"`
+}
+
+// SelfTestReport is the response of the self-test, which fails when any of
+// its checks fails.
+type SelfTestReport struct {
+	Status   string          `json:"status"`
+	Provider string          `json:"provider"`
+	Address  string          `json:"address,omitempty"`
+	Checks   []SelfTestCheck `json:"checks"`
+	// Breakers is the state of the circuit breakers of the datasources,
+	// when enabled.
+	Breakers []BreakerState `json:"breakers,omitempty"`
+}
+
+// selfTest checks the connection of the server to its provider, for
+// operators debugging graphs without data. It responds with a 503 when a
+// check fails.
+func (ms *O11yServer) selfTest(ctx *gin.Context) {
+	report := SelfTestReport{Status: checkPass}
+	provider := ms.currentProvider()
+	if provider != nil {
+		report.Provider = provider.getType()
+	}
+	if pp, ok := provider.(*PrometheusProvider); ok {
+		report.Address = redactedAddress(pp.config.Provider.Address)
+		report.Checks = pp.selfTest(ctx.Request.Context())
+		report.Breakers = pp.breakerStates()
+	} else {
+		report.Checks = []SelfTestCheck{{Name: "client", Status: checkFail, Message: "the self-test is only supported by the prometheus provider"}}
+	}
+	status := http.StatusOK
+	for _, check := range report.Checks {
+		if check.Status == checkFail {
+			report.Status = checkFail
+			status = http.StatusServiceUnavailable
+		}
+	}
+	ctx.JSON(status, report)
+}
+
+// redactedAddress returns address with its password redacted, so that it
+// can be logged or shown to clients.
+func redactedAddress(address string) string {
+	if u, err := url.Parse(address); err == nil {
+		return u.Redacted()
+	}
+	return address
+}
+
+// selfTest runs the checks of the self-test against the provider: whether
+// its client is initialized, whether authentication headers are configured,
+// without revealing them, whether the circuit breakers of the datasources
+// are closed and whether an up query succeeds.
+func (pp *PrometheusProvider) selfTest(ctx context.Context) []SelfTestCheck {
+	if pp.provider == nil {
+		return []SelfTestCheck{{Name: "client", Status: checkFail, Message: "the prometheus client is not initialized"}}
+	}
+	checks := []SelfTestCheck{{Name: "client", Status: checkPass, Message: "the prometheus client is initialized"}}
+
+	auth := SelfTestCheck{Name: "auth", Status: checkWarn, Message: "no authentication header is configured"}
+	if len(pp.authHeaders) > 0 {
+		auth = SelfTestCheck{Name: "auth", Status: checkPass, Message: "queries are sent with the " + strings.Join(pp.authHeaders, ", ") + " headers"}
+	}
+	checks = append(checks, auth)
+	if pp.breakers != nil {
+		checks = append(checks, pp.breakerCheck())
+	}
+
+	timeout := pp.options.QueryTimeout
+	if timeout <= 0 {
+		timeout = selfTestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	result, _, err := pp.provider.Query(ctx, "up", start)
+	latency := time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		return append(checks, SelfTestCheck{Name: "query", Status: checkFail, Message: "error querying prometheus: " + err.Error(), Latency: latency})
+	}
+	probe := SelfTestCheck{Name: "query", Status: checkPass, Message: "up returned no series", Latency: latency}
+	if vector, ok := result.(model.Vector); ok && len(vector) > 0 {
+		probe.Message = fmt.Sprintf("up returned %d series", len(vector))
+	}
+	return append(checks, probe)
+}
+
+// breakerCheck warns about the datasources whose circuit breaker is not
+// closed, their queries failing fast.
+func (pp *PrometheusProvider) breakerCheck() SelfTestCheck {
+	var open []string
+	for _, state := range pp.breakerStates() {
+		if state.State != breakerClosed {
+			open = append(open, fmt.Sprintf("%s (%s after %d failures)", state.Datasource, state.State, state.Failures))
+		}
+	}
+	if len(open) > 0 {
+		return SelfTestCheck{Name: "circuit", Status: checkWarn, Message: "queries fail fast for the datasources " + strings.Join(open, ", ")}
+	}
+	return SelfTestCheck{Name: "circuit", Status: checkPass, Message: "the circuit breakers of the datasources are closed"}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTest(t *testing.T) {
+	t.Setenv("PROMETHEUS_APIKEY", "secret")
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "up", r.Form.Get("query"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {"job": "app"}, "value": [1700000000, "1"]}]}}`))
+	})
+
+	w := httptest.NewRecorder()
+	ctx, ms := createContextAndNewO11yServer(w)
+	ms.provider = pp
+	ms.selfTest(ctx)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret")
+	var report SelfTestReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, checkPass, report.Status)
+	assert.Equal(t, PROMETHEUS_TYPE, report.Provider)
+	assert.Equal(t, pp.config.Provider.Address, report.Address)
+	assert.Len(t, report.Checks, 3)
+	assert.Equal(t, SelfTestCheck{Name: "auth", Status: checkPass, Message: "queries are sent with the Apikey headers"}, report.Checks[1])
+	assert.Equal(t, "up returned 1 series", report.Checks[2].Message)
+	assert.NotEmpty(t, report.Checks[2].Latency)
+
+	w = httptest.NewRecorder()
+	ctx, ms = createContextAndNewO11yServer(w)
+	ms.provider = newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	ms.selfTest(ctx)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, checkFail, report.Status)
+	assert.Equal(t, checkFail, report.Checks[2].Status)
+}
+
+func TestSelfTestRedactsAddress(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": []}}`))
+	})
+	pp.config.Provider.Address = strings.Replace(pp.config.Provider.Address, "http://", "http://admin:hunter2@", 1)
+
+	w := httptest.NewRecorder()
+	ctx, ms := createContextAndNewO11yServer(w)
+	ms.provider = pp
+	ms.selfTest(ctx)
+	assert.NotContains(t, w.Body.String(), "hunter2")
+	var report SelfTestReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, strings.Replace(pp.config.Provider.Address, "hunter2", "xxxxx", 1), report.Address, "the password of the address is redacted")
+}
@@ -3,36 +3,211 @@ package server
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 
 	tls2 "github.com/argoproj-labs/argocd-metric-ext-server/internal/tls"
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/version"
 )
 
 const PROMETHEUS_TYPE = "prometheus"
 const WAVEFRONT_TYPE = "wavefront"
 
+// Options holds the settings of an O11yServer.
+type Options struct {
+	Port int
+	// BindAddress is the IP address the server listens on, all the
+	// interfaces when empty.
+	BindAddress string
+	// BasePath prefixes every route of the server, e.g.
+	// /extensions/metrics, the routes being served at the root when
+	// empty.
+	BasePath string
+	// GinMode is the gin mode the server runs in, release when empty.
+	GinMode   string
+	EnableTLS bool
+	// TLSCertFile and TLSKeyFile are the PEM encoded certificate and key
+	// served with TLS. A self-signed certificate is generated when unset.
+	TLSCertFile             string
+	TLSKeyFile              string
+	SkipPrometheusTLSVerify bool
+	// CORSAllowedOrigins lists the origins allowed to make cross-origin
+	// requests, "*" allowing any origin. CORS is disabled when empty.
+	CORSAllowedOrigins []string
+	// RowDeadline is the default deadline budget of row requests.
+	RowDeadline time.Duration
+	// DefaultDuration and DefaultStep are used for graph queries that do
+	// not set them.
+	DefaultDuration time.Duration
+	DefaultStep     time.Duration
+	// MaxDuration bounds the duration of graph queries, unlimited when
+	// zero.
+	MaxDuration time.Duration
+	// NegativeCacheTTL is how long errors and empty results are cached,
+	// disabled when zero.
+	NegativeCacheTTL time.Duration
+	// PrometheusHeaderName is the header the PROMETHEUS_APIKEY is sent
+	// in, apikey when empty.
+	PrometheusHeaderName string
+	// PrometheusBasicAuthUser and PrometheusBasicAuthPassword are sent as
+	// the Authorization header of every query when the user is set, which
+	// can not be combined with the PROMETHEUS_APIKEY.
+	PrometheusBasicAuthUser     string
+	PrometheusBasicAuthPassword string
+	// PrometheusMaxIdleConns, PrometheusMaxIdleConnsPerHost and
+	// PrometheusIdleConnTimeout bound the idle connections kept open to
+	// every datasource, the net/http defaults applying when zero.
+	PrometheusMaxIdleConns        int
+	PrometheusMaxIdleConnsPerHost int
+	PrometheusIdleConnTimeout     time.Duration
+	// PrometheusProxyURL is the proxy the Prometheus requests are sent
+	// through, the proxy of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables when nil.
+	PrometheusProxyURL *url.URL
+	// PrometheusOrgID is sent as X-Scope-OrgID to multi-tenant Cortex or
+	// Mimir when set.
+	PrometheusOrgID string
+	// UserAgent is sent with the Prometheus requests, identifying the
+	// server and its version when empty.
+	UserAgent string
+	// QueryOffset shifts the end of the queries back from now for the
+	// dashboards that do not set their own offset.
+	QueryOffset time.Duration
+	// MaxConcurrentQueries bounds the number of concurrent queries
+	// against the provider, unlimited when zero. Queries wait at most
+	// QueryQueueTimeout for a free slot before failing with a 429.
+	MaxConcurrentQueries int
+	QueryQueueTimeout    time.Duration
+	// QueryTimeout bounds the time spent on a single query, retries
+	// included. No timeout is applied when zero.
+	QueryTimeout time.Duration
+	// QueryMaxAttempts is the number of attempts of a query failing with
+	// transient errors, waiting an exponential backoff starting at
+	// QueryRetryBaseDelay between attempts.
+	QueryMaxAttempts    int
+	QueryRetryBaseDelay time.Duration
+	// MaxThresholds bounds the number of thresholds of a graph, each of
+	// which is a query, unlimited when zero. Configs with larger graphs
+	// are rejected.
+	MaxThresholds int
+	// StrictThresholdValues rejects configs with threshold values that are
+	// not numbers, which are otherwise executed as queries.
+	StrictThresholdValues bool
+	// ThresholdConcurrency bounds the number of thresholds of a graph
+	// queried at once, unlimited when zero. ThresholdTimeout bounds the
+	// time spent on the thresholds of a graph, those it interrupts being
+	// returned with an error rather than failing the graph. No timeout is
+	// applied when zero.
+	ThresholdConcurrency int
+	ThresholdTimeout     time.Duration
+	// MaxQuerySeries bounds the number of series a query may return,
+	// unlimited when zero. Queries are checked with a count() query before
+	// being executed.
+	MaxQuerySeries int
+	// StreamSeriesThreshold is the number of series above which graph
+	// results are streamed, disabled when zero.
+	StreamSeriesThreshold int
+	// MaxResponseBytes bounds the size of graph and row responses, which
+	// fail with a 413 when larger. Unlimited when zero.
+	MaxResponseBytes int
+	// CacheMaxAge is the max-age of the Cache-Control header of graph
+	// responses, the step of the graph when zero. Responses are marked
+	// no-store instead when CacheNoStore is set.
+	CacheMaxAge  time.Duration
+	CacheNoStore bool
+	// BreakerFailures is the number of consecutive failures of a
+	// datasource after which its queries fail fast for BreakerCooldown.
+	// The circuit breakers are disabled when zero.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// Timezone is the timezone calendar range presets, e.g. "Today", are
+	// aligned to, UTC when nil.
+	Timezone *time.Location
+	// ReadTimeout, WriteTimeout and IdleTimeout bound how long the server
+	// reads a request, writes its response and keeps an idle connection
+	// open, unlimited when zero. Live graphs are not bound by WriteTimeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// MaxHeaderBytes bounds the size of the request headers, 1MB when
+	// zero.
+	MaxHeaderBytes int
+	// ClientRateLimit is the number of API requests per second every client
+	// can make, in bursts of up to ClientRateBurst requests. Clients are
+	// told apart by the value of the ClientRateLimitHeader request header,
+	// or by IP address. Disabled when zero.
+	ClientRateLimit       float64
+	ClientRateBurst       int
+	ClientRateLimitHeader string
+	// ConfigPaths are the configuration files, and directories of
+	// configuration files, merged into the configuration. app/config.json
+	// when empty.
+	ConfigPaths []string
+	// AdminToken is the bearer token of the admin endpoints, which are
+	// disabled when empty.
+	AdminToken string
+	// DebugResponseBodies logs the body of graph responses at debug level,
+	// besides the summary always logged.
+	DebugResponseBodies bool
+}
+
+// location returns the timezone of the options, UTC by default.
+func (o Options) location() *time.Location {
+	if o.Timezone == nil {
+		return time.UTC
+	}
+	return o.Timezone
+}
+
+// normalizeBasePath returns basePath with a leading slash and without a
+// trailing one, empty for the root.
+func normalizeBasePath(basePath string) string {
+	basePath = path.Clean("/" + basePath)
+	if basePath == "/" {
+		return ""
+	}
+	return basePath
+}
+
+// defaultConfigPath is the path the configuration is read from by default.
+const defaultConfigPath = "app/config.json"
+
 type O11yServer struct {
-	logger                 *zap.SugaredLogger
-	config                 O11yConfig
-	provider               MetricsProvider
-	port                   int
-	enableTLS              bool
-	skipPrometheusTLSVerify bool
+	logger *zap.SugaredLogger
+	// mu guards config and provider, which are swapped on reload.
+	mu       *sync.RWMutex
+	config   O11yConfig
+	provider MetricsProvider
+	options  Options
+	// configPaths are the files and directories the configuration is read
+	// from.
+	configPaths []string
+	metrics     *serverMetrics
+	limiter     *queryLimiter
 }
 
 type MetricsProvider interface {
 	init() error
 	execute(ctx *gin.Context)
+	executeRow(ctx *gin.Context)
+	executeLive(ctx *gin.Context)
+	executeProgressive(ctx *gin.Context)
+	executeBatch(ctx *gin.Context)
+	validateQuery(ctx *gin.Context)
+	labelValues(ctx *gin.Context)
+	rules(ctx *gin.Context)
 	getDashboard(ctx *gin.Context)
 	getType() string
 }
@@ -66,12 +241,23 @@ func validatePathParam(pathParam string, pathParamName string) error {
 	return nil
 }
 
-func NewO11yServer(logger *zap.SugaredLogger, port int, enableTLS bool, skipPrometheusTLSVerify bool) O11yServer {
+func NewO11yServer(logger *zap.SugaredLogger, options Options) O11yServer {
+	if options.GinMode == "" {
+		options.GinMode = gin.ReleaseMode
+	}
+	options.BasePath = normalizeBasePath(options.BasePath)
+	configPaths := options.ConfigPaths
+	if len(configPaths) == 0 {
+		configPaths = []string{defaultConfigPath}
+	}
+	metrics := newServerMetrics()
 	return O11yServer{
-		logger:    logger,
-		port:      port,
-		enableTLS: enableTLS,
-		skipPrometheusTLSVerify: skipPrometheusTLSVerify,
+		metrics:     metrics,
+		limiter:     newQueryLimiter(options.MaxConcurrentQueries, options.QueryQueueTimeout, metrics),
+		logger:      logger,
+		mu:          &sync.RWMutex{},
+		options:     options,
+		configPaths: configPaths,
 	}
 }
 func (ms *O11yServer) Run(ctx context.Context) {
@@ -79,48 +265,88 @@ func (ms *O11yServer) Run(ctx context.Context) {
 	err := ms.readConfig()
 
 	if err != nil {
+		ms.logger.Errorf("Invalid configuration: %v", err)
 		panic(err)
 	}
-	if ms.config.Prometheus != nil {
-		ms.provider = NewPrometheusProvider(ms.config.Prometheus, ms.logger, ms.skipPrometheusTLSVerify)
-		err := ms.provider.init()
-		if err != nil {
-			log.Panic(err)
-		}
-	} else if ms.config.Wavefront != nil {
-		token, found := os.LookupEnv("WAVEFRONT_TOKEN")
-		if !found {
-			ms.logger.Fatal("WAVEFRONT_TOKEN env not set")
-		}
-		ms.provider = NewWavefrontProvider(ms.config.Wavefront, token, ms.logger)
-		err := ms.provider.init()
-		if err != nil {
-			log.Panic(err)
-		}
+	ms.provider, err = ms.newProvider(ms.config)
+	if err != nil {
+		log.Panic(err)
+	}
+	gin.SetMode(ms.options.GinMode)
+	handler := ms.newRouter()
+	if ms.options.BasePath != "" {
+		ms.logger.Infof("Serving routes under base path %s", ms.options.BasePath)
+	}
+
+	v := version.GetVersion()
+	ms.logger.Infof("Version: %s [commit: %s, buildDate: %s, goVersion: %s]", v, v.GitCommit, v.BuildDate, v.GoVersion)
+	address := net.JoinHostPort(ms.options.BindAddress, strconv.Itoa(ms.options.Port))
+	ms.logger.Infof("Server Configs: [address: %s, enableTLS: %t]", address, ms.options.EnableTLS)
+	if ms.options.EnableTLS {
+		ms.runWithTLS(address, handler)
+	} else {
+		ms.run(address, handler)
 	}
-	handler := gin.Default()
-	handler.GET("/", func(c *gin.Context) {
+}
+
+// newRouter returns the gin engine serving the routes of the server under
+// the base path of the options.
+func (ms *O11yServer) newRouter() *gin.Engine {
+	handler := gin.New()
+	handler.Use(requestIDMiddleware(), accessLogMiddleware(ms.logger, ms.options.BasePath), recoveryMiddleware(ms.logger))
+	if len(ms.options.CORSAllowedOrigins) > 0 {
+		ms.logger.Infof("CORS enabled for origins: %v", ms.options.CORSAllowedOrigins)
+		handler.Use(corsMiddleware(ms.options.CORSAllowedOrigins))
+	}
+	if ms.options.ClientRateLimit > 0 {
+		ms.logger.Infof("Rate limiting clients to %g requests per second, in bursts of %d", ms.options.ClientRateLimit, ms.options.ClientRateBurst)
+		handler.Use(rateLimitMiddleware(newClientRateLimiter(ms.options.ClientRateLimit, ms.options.ClientRateBurst, ms.metrics), ms.options.ClientRateLimitHeader, ms.options.BasePath))
+	}
+	// Every route is served under the base path, so that the server can be
+	// mounted at a sub-path of a proxy.
+	routes := handler.Group(ms.options.BasePath)
+	routes.GET("/", func(c *gin.Context) {
 		c.String(http.StatusOK, "healthy")
 	})
-	handler.GET("/healthz", func(c *gin.Context) {
+	routes.GET("/healthz", func(c *gin.Context) {
 		c.String(http.StatusOK, "healthy")
 	})
-	handler.GET("/api/applications/:application/groupkinds/:groupkind/rows/:row/graphs/:graph", ms.queryMetrics)
+	routes.GET("/metrics", gin.WrapH(ms.metrics.handler()))
+	routes.GET("/version", serveVersion)
+	routes.GET("/api/applications/:application/groupkinds/:groupkind/rows/:row/graphs/:graph", ms.queryMetrics)
+	routes.POST("/api/applications/:application/groupkinds/:groupkind/rows/:row/graphs/:graph", ms.queryMetrics)
+
+	routes.GET("/api/applications/:application/groupkinds/:groupkind/rows/:row/graphs/:graph/live", ms.queryLive)
+	routes.GET("/api/applications/:application/groupkinds/:groupkind/rows/:row/graphs/:graph/progressive", ms.queryProgressive)
+	routes.GET("/api/applications/:application/groupkinds/:groupkind/rows/:row", ms.queryRow)
+	routes.POST("/api/batch", ms.queryBatch)
+
+	routes.GET("/api/applications/:application/groupkinds/:groupkind/dashboards", ms.dashboardConfig)
+
+	routes.GET("/api/applications", ms.listApplications)
 
-	handler.GET("/api/applications/:application/groupkinds/:groupkind/dashboards", ms.dashboardConfig)
+	routes.GET("/api/applications/:application/groupkinds/:groupkind/queries", ms.dashboardQueries)
+	routes.GET("/api/applications/:application/groupkinds/:groupkind/ranges", ms.dashboardRanges)
+	routes.GET("/api/applications/:application/labels/:label/values", ms.queryLabelValues)
+	routes.GET("/api/applications/:application/rules", ms.queryRules)
+	routes.POST("/api/reload", adminAuthMiddleware(ms.options.AdminToken), ms.reload)
+	routes.GET("/api/config", adminAuthMiddleware(ms.options.AdminToken), ms.effectiveConfig)
+	routes.POST("/api/validate-query", adminAuthMiddleware(ms.options.AdminToken), ms.validateQuery)
+	routes.GET("/api/diagnostics", ms.selfTest)
 
 	// Add a test endpoint to check Prometheus connectivity and available metrics
-	handler.GET("/test-prometheus", func(c *gin.Context) {
+	routes.GET("/test-prometheus", func(c *gin.Context) {
 		// Only proceed if we have a Prometheus provider
-		if ms.provider == nil || ms.provider.getType() != PROMETHEUS_TYPE {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Prometheus provider not configured"})
+		provider := ms.currentProvider()
+		if provider == nil || provider.getType() != PROMETHEUS_TYPE {
+			writeError(c, http.StatusBadRequest, errCodeInvalidRequest, "Prometheus provider not configured")
 			return
 		}
 
 		// Cast to PrometheusProvider
-		pp, ok := ms.provider.(*PrometheusProvider)
+		pp, ok := provider.(*PrometheusProvider)
 		if !ok {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to cast to PrometheusProvider"})
+			writeError(c, http.StatusInternalServerError, errCodeInternal, "Failed to cast to PrometheusProvider")
 			return
 		}
 
@@ -131,35 +357,26 @@ func (ms *O11yServer) Run(ctx context.Context) {
 		// Get a list of metric names
 		labelNames, warnings, err := clientAPI.LabelNames(ctx, nil, time.Now().Add(-1*time.Hour), time.Now())
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-				"warnings": warnings,
-			})
+			if len(warnings) > 0 {
+				ms.logger.Warnf("Prometheus test query warnings: %v", warnings)
+			}
+			writeError(c, http.StatusInternalServerError, errCodeQueryFailed, err.Error())
 			return
 		}
 
 		// Return the results
 		c.JSON(http.StatusOK, gin.H{
-			"message": "Prometheus connection successful",
+			"message":          "Prometheus connection successful",
 			"available_labels": labelNames,
-			"warnings": warnings,
+			"warnings":         warnings,
 		})
 	})
-
-	address := fmt.Sprintf(":%d", ms.port)
-	ms.logger.Infof("Server Configs: [address: %s, enableTLS: %t]", address, ms.enableTLS)
-	if ms.enableTLS {
-		ms.runWithTLS(address, handler)
-	} else {
-		ms.run(address, handler)
-	}
+	return handler
 }
+
 func (ms *O11yServer) run(address string, handler *gin.Engine) {
 	ms.logger.Infof("Starting Argo Metrics Server.. %s", address)
-	server := http.Server{
-		Addr:    address,
-		Handler: handler,
-	}
+	server := ms.newHTTPServer(address, handler)
 	if err := server.ListenAndServe(); err != nil {
 		ms.logger.Fatal(err)
 	}
@@ -167,35 +384,128 @@ func (ms *O11yServer) run(address string, handler *gin.Engine) {
 
 func (ms *O11yServer) runWithTLS(address string, handler *gin.Engine) {
 	ms.logger.Infof("Starting Argo Metrics Server with TLS.. %s", address)
-	cert, err := tls2.GenerateX509KeyPair()
+	cert, err := ms.serverCertificate()
 	if err != nil {
-		panic(err)
-	}
-	server := http.Server{
-		Addr:      address,
-		Handler:   handler,
-		TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12},
+		ms.logger.Fatal(err)
 	}
+	server := ms.newHTTPServer(address, handler)
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}
 	if err := server.ListenAndServeTLS("", ""); err != nil {
 		ms.logger.Fatal(err)
 	}
 }
 
+// newHTTPServer returns the HTTP server serving handler on address, with
+// the timeouts and header size limit of the options so that slow or hanging
+// clients can not hold connections forever.
+func (ms *O11yServer) newHTTPServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: ms.options.ReadTimeout,
+		ReadTimeout:       ms.options.ReadTimeout,
+		WriteTimeout:      ms.options.WriteTimeout,
+		IdleTimeout:       ms.options.IdleTimeout,
+		MaxHeaderBytes:    ms.options.MaxHeaderBytes,
+	}
+}
+
+// serverCertificate returns the certificate served with TLS: the configured
+// key pair, or a generated self-signed certificate when none is configured.
+func (ms *O11yServer) serverCertificate() (*tls.Certificate, error) {
+	certFile, keyFile := ms.options.TLSCertFile, ms.options.TLSKeyFile
+	if certFile == "" && keyFile == "" {
+		ms.logger.Info("No TLS certificate configured, using a generated self-signed certificate for localhost")
+		return tls2.GenerateX509KeyPair()
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and key file are required, got certificate %q and key %q", certFile, keyFile)
+	}
+	ms.logger.Infof("Using TLS certificate %s and key %s", certFile, keyFile)
+	return tls2.LoadX509KeyPair(certFile, keyFile)
+}
+
+// serveVersion returns the build information of the server.
+func serveVersion(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, version.GetVersion())
+}
+
 func (ms *O11yServer) queryMetrics(ctx *gin.Context) {
+	if !ms.validateQueryRequest(ctx) {
+		return
+	}
+	ms.currentProvider().execute(ctx)
+}
+
+func (ms *O11yServer) queryRow(ctx *gin.Context) {
+	if !ms.validateQueryRequest(ctx) {
+		return
+	}
+	ms.currentProvider().executeRow(ctx)
+}
+
+func (ms *O11yServer) queryLive(ctx *gin.Context) {
+	if !ms.validateQueryRequest(ctx) {
+		return
+	}
+	ms.currentProvider().executeLive(ctx)
+}
+
+func (ms *O11yServer) queryProgressive(ctx *gin.Context) {
+	if !ms.validateQueryRequest(ctx) {
+		return
+	}
+	ms.currentProvider().executeProgressive(ctx)
+}
+
+func (ms *O11yServer) queryBatch(ctx *gin.Context) {
+	if !ms.validateQueryRequest(ctx) {
+		return
+	}
+	ms.currentProvider().executeBatch(ctx)
+}
+
+// queryLabelValues returns the values of a label, e.g. for the dropdown of
+// a query param.
+func (ms *O11yServer) queryLabelValues(ctx *gin.Context) {
+	if !ms.validateQueryRequest(ctx) {
+		return
+	}
+	ms.currentProvider().labelValues(ctx)
+}
+
+// queryRules returns the evaluation status of the recording and alerting
+// rules, e.g. for rule health panels.
+func (ms *O11yServer) queryRules(ctx *gin.Context) {
+	if !ms.validateQueryRequest(ctx) {
+		return
+	}
+	ms.currentProvider().rules(ctx)
+}
+
+// validateQuery validates an arbitrary query, letting dashboard authors test
+// it before adding it to the configuration.
+func (ms *O11yServer) validateQuery(ctx *gin.Context) {
+	ms.currentProvider().validateQuery(ctx)
+}
+
+// validateQueryRequest checks that the application and project of a query
+// request match the ones sent by Argo CD, writing a 400 response otherwise.
+func (ms *O11yServer) validateQueryRequest(ctx *gin.Context) bool {
 	headers := ctx.Request.Header
 
 	if err := validateHeader(headers, "Argocd-Application-Name"); err != nil {
 		ms.logger.Warn(err)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
 	val := headers["Argocd-Application-Name"]
 	applicationNameHeader := strings.Split(val[0], ":")[1]
 
 	if err := validateHeader(headers, "Argocd-Project-Name"); err != nil {
 		ms.logger.Warn(err)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
 	temp := headers["Argocd-Project-Name"]
 	projectHeader := temp[0]
@@ -204,43 +514,108 @@ func (ms *O11yServer) queryMetrics(ctx *gin.Context) {
 
 	if err := validateQueryParam(applicationNameQueryParam, "application_name"); err != nil {
 		ms.logger.Warn(err)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
 
 	projectQueryParam := ctx.Query("project")
 
 	if err := validateQueryParam(projectQueryParam, "project"); err != nil {
 		ms.logger.Warn(err)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
 
 	if applicationNameHeader != applicationNameQueryParam {
 		msg := "Application name mismatch. Value from the header is different from the url."
 		err := errors.New(msg)
 		ms.logger.Warn(msg)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
 
 	if projectHeader != projectQueryParam {
 		msg := "Project mismatch. Value from the header is different from the url."
 		err := errors.New(msg)
 		ms.logger.Warn(msg)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
-	ms.provider.execute(ctx)
+	return true
 }
 
 func (ms *O11yServer) dashboardConfig(ctx *gin.Context) {
+	if !ms.validateDashboardRequest(ctx) {
+		return
+	}
+	ms.currentProvider().getDashboard(ctx)
+}
+
+// dashboardQueries returns the rendered queries of every graph of a
+// dashboard without executing them. The request query params are used as
+// template variables, like for graph requests.
+func (ms *O11yServer) dashboardQueries(ctx *gin.Context) {
+	if !ms.validateDashboardRequest(ctx) {
+		return
+	}
+	app, dash := ms.requestedDashboard(ctx)
+	if dash == nil {
+		return
+	}
+	var templates map[string]string
+	if config := ms.metricsConfig(); config != nil {
+		templates = config.QueryTemplates
+	}
+	ctx.JSON(http.StatusOK, gin.H{"queries": renderDashboardQueries(dash, app.queryEnv(ctx.Request.URL.Query()), templates, app.EnforcedLabels)})
+}
+
+// dashboardRanges returns the time range presets of a dashboard.
+func (ms *O11yServer) dashboardRanges(ctx *gin.Context) {
+	if !ms.validateDashboardRequest(ctx) {
+		return
+	}
+	_, dash := ms.requestedDashboard(ctx)
+	if dash == nil {
+		return
+	}
+	ranges := dash.Ranges
+	if ranges == nil {
+		ranges = []TimeRange{}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"ranges": ranges, "timezone": ms.options.location().String()})
+}
+
+// requestedDashboard returns the application of the request and its
+// dashboard of the group kind of the request, writing a 400 response when
+// there is none.
+func (ms *O11yServer) requestedDashboard(ctx *gin.Context) (*Application, *Dashboard) {
+	config := ms.metricsConfig()
+	if config == nil {
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested/Default Application not found")
+		return nil, nil
+	}
+	app := config.getApp(ctx.Param("application"))
+	if app == nil {
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested/Default Application not found")
+		return nil, nil
+	}
+	dash := app.getDashBoard(ctx.Param("groupkind"))
+	if dash == nil {
+		writeQueryError(ctx, app.dashboardNotFound(ctx.Param("groupkind")))
+		return nil, nil
+	}
+	return app, dash
+}
+
+// validateDashboardRequest checks that the application of a dashboard
+// request matches the one sent by Argo CD, writing a 400 response otherwise.
+func (ms *O11yServer) validateDashboardRequest(ctx *gin.Context) bool {
 	headers := ctx.Request.Header
 
 	if err := validateHeader(headers, "Argocd-Application-Name"); err != nil {
 		ms.logger.Warn(err)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
 
 	val := headers["Argocd-Application-Name"]
@@ -250,31 +625,51 @@ func (ms *O11yServer) dashboardConfig(ctx *gin.Context) {
 
 	if err := validatePathParam(applicationNamePathParam, "application"); err != nil {
 		ms.logger.Warn(err)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
 	if applicationNameHeader != applicationNamePathParam {
 		msg := "Application name mismatch. Value from the header is different from the url."
 		err := errors.New(msg)
 		ms.logger.Warn(msg)
-		ctx.JSON(400, gin.H{"error": err.Error()})
-		return
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
 	}
-	ms.provider.getDashboard(ctx)
+	return true
 }
 
-func (ms *O11yServer) readConfig() error {
-	yamlFile, err := os.ReadFile("app/config.json")
-	if err != nil {
-		fmt.Printf("yamlFile.Get err   #%v ", err)
+// metricsConfig returns the configuration of the provider in use.
+func (ms *O11yServer) metricsConfig() *MetricsConfigProvider {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.config.Prometheus != nil {
+		return ms.config.Prometheus
 	}
-	//var configData map[string]string
-	fmt.Println(string(yamlFile))
-	err = json.Unmarshal(yamlFile, &ms.config)
+	return ms.config.Wavefront
+}
 
+// listApplications returns the configured applications with their dashboards.
+func (ms *O11yServer) listApplications(ctx *gin.Context) {
+	config := ms.metricsConfig()
+	if config == nil {
+		ctx.JSON(http.StatusOK, gin.H{"applications": []ApplicationSummary{}})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"applications": config.summarize()})
+}
+
+func (ms *O11yServer) readConfig() error {
+	config, err := loadConfig(ms.configPaths, ms.options)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
 		return err
 	}
+	ms.config = config
 	return nil
 }
+
+// currentProvider returns the provider in use.
+func (ms *O11yServer) currentProvider() MetricsProvider {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.provider
+}
@@ -1,13 +1,17 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/version"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -22,6 +26,34 @@ func (ms MockO11yServer) execute(ctx *gin.Context) {
 
 }
 
+func (ms MockO11yServer) executeRow(ctx *gin.Context) {
+
+}
+
+func (ms MockO11yServer) executeLive(ctx *gin.Context) {
+
+}
+
+func (ms MockO11yServer) executeProgressive(ctx *gin.Context) {
+
+}
+
+func (ms MockO11yServer) executeBatch(ctx *gin.Context) {
+
+}
+
+func (ms MockO11yServer) validateQuery(ctx *gin.Context) {
+
+}
+
+func (ms MockO11yServer) labelValues(ctx *gin.Context) {
+
+}
+
+func (ms MockO11yServer) rules(ctx *gin.Context) {
+
+}
+
 func (ms MockO11yServer) getDashboard(ctx *gin.Context) {
 
 }
@@ -113,11 +145,8 @@ func TestQueryMetrics(t *testing.T) {
 }
 
 func createContextAndNewO11yServer(w *httptest.ResponseRecorder) (ctx *gin.Context, ms O11yServer) {
-	var port int
-	var enableTLS bool
-	var skipPrometheusTLSVerify bool
-	logger := logging.NewLogger().Named("metric-sever")
-	ms = NewO11yServer(logger, port, enableTLS, skipPrometheusTLSVerify)
+	logger := logging.NewLogger().Named("metric-server")
+	ms = NewO11yServer(logger, Options{})
 	var temp MetricsProvider = MockO11yServer{}
 	ms.provider = temp
 	ctx = GetTestGinContext(w)
@@ -195,6 +224,27 @@ func TestDashboardConfig(t *testing.T) {
 	}
 }
 
+func TestListApplications(t *testing.T) {
+	w := httptest.NewRecorder()
+	ctx, ms := createContextAndNewO11yServer(w)
+	ms.config.Prometheus = &MetricsConfigProvider{
+		Applications: []Application{
+			{
+				Name:    "default",
+				Default: true,
+				Dashboards: []*Dashboard{
+					{GroupKind: "pod", Rows: []*Row{{Name: "pod", Graphs: []*Graph{{Name: "pod_cpu_line"}, {Name: "pod_memory_line"}}}}},
+				},
+			},
+		},
+	}
+	ms.listApplications(ctx)
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"applications": [{"name": "default", "default": true, "dashboards": [
+		{"groupKind": "pod", "rows": [{"name": "pod", "graphs": ["pod_cpu_line", "pod_memory_line"]}]}
+	]}]}`, w.Body.String())
+}
+
 // mock gin context
 func GetTestGinContext(w *httptest.ResponseRecorder) *gin.Context {
 	gin.SetMode(gin.TestMode)
@@ -220,3 +270,75 @@ func MockJsonGet(c *gin.Context, header map[string][]string, pathParams map[stri
 	}
 	c.Request.URL.RawQuery = temp.Encode()
 }
+
+func TestServeVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveVersion(GetTestGinContext(w))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var v version.Version
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	assert.Equal(t, version.GetVersion(), v)
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	ms := NewO11yServer(logging.NewLogger(), Options{ReadTimeout: time.Second, WriteTimeout: time.Minute, IdleTimeout: 2 * time.Minute, MaxHeaderBytes: 1024})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := ms.newHTTPServer("127.0.0.1:0", handler)
+	assert.Equal(t, time.Second, server.ReadHeaderTimeout)
+	assert.Equal(t, time.Second, server.ReadTimeout)
+	assert.Equal(t, time.Minute, server.WriteTimeout)
+	assert.Equal(t, 2*time.Minute, server.IdleTimeout)
+
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config = server
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-Large", strings.Repeat("a", 16*1024))
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	for basePath, expected := range map[string]string{
+		"":                     "",
+		"/":                    "",
+		"extensions/metrics":   "/extensions/metrics",
+		"/extensions/metrics/": "/extensions/metrics",
+	} {
+		assert.Equal(t, expected, normalizeBasePath(basePath), basePath)
+	}
+}
+
+func TestRouterBasePath(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ms := NewO11yServer(logging.NewLogger(), Options{BasePath: "extensions/metrics/"})
+	ms.config = O11yConfig{Prometheus: &MetricsConfigProvider{
+		Applications: []Application{{Name: "default", Default: true}},
+	}}
+	handler := ms.newRouter()
+
+	for path, expected := range map[string]int{
+		"/extensions/metrics/healthz":          http.StatusOK,
+		"/extensions/metrics/metrics":          http.StatusOK,
+		"/extensions/metrics/version":          http.StatusOK,
+		"/extensions/metrics/api/applications": http.StatusOK,
+		"/healthz":                             http.StatusNotFound,
+		"/api/applications":                    http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, expected, w.Code, path)
+	}
+}
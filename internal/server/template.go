@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// missingKeyRE extracts the name of the missing param from the error of a
+// template referencing a param the request does not provide.
+var missingKeyRE = regexp.MustCompile(`map has no entry for key "([^"]*)"`)
+
+// paramValues are the values of a query param. They are rendered joined
+// with commas, and can be passed to the helper functions as a list.
+type paramValues []string
+
+func (v paramValues) String() string {
+	return strings.Join(v, ",")
+}
+
+// queryFuncs are the helper functions of query templates. Values are
+// escaped by html/template, which keeps them from closing the PromQL
+// string they are rendered in, so quote and regexEscape escape them for a
+// PromQL string themselves.
+var queryFuncs = template.FuncMap{
+	// quote renders the values as a PromQL string literal.
+	"quote": func(value interface{}) template.HTML {
+		return template.HTML(strconv.Quote(strings.Join(toValues(value), ",")))
+	},
+	// join joins the values with sep.
+	"join": func(value interface{}, sep string) string {
+		return strings.Join(toValues(value), sep)
+	},
+	// regexEscape escapes the values for a regex matcher, joined into an
+	// alternation, e.g. pod=~"{{ regexEscape .pod }}".
+	"regexEscape": func(value interface{}) template.HTML {
+		values := toValues(value)
+		escaped := make([]string, len(values))
+		for i, v := range values {
+			escaped[i] = promQLStringEscaper.Replace(regexp.QuoteMeta(v))
+		}
+		return template.HTML(strings.Join(escaped, "|"))
+	},
+	// default returns value, or fallback when value is empty, e.g.
+	// {{ default "5m" (index . "window") }} for an optional param.
+	"default": func(fallback interface{}, value interface{}) interface{} {
+		if strings.Join(toValues(value), "") == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// promQLStringEscaper escapes a string for a double-quoted PromQL string.
+var promQLStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// toValues returns the values of a helper function argument: the values
+// of a query param, or a single string.
+func toValues(value interface{}) []string {
+	switch v := value.(type) {
+	case paramValues:
+		return v
+	case []string:
+		return v
+	case nil:
+		return nil
+	case template.HTML:
+		return []string{string(v)}
+	case string:
+		return []string{v}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// queryTemplateName is the name of the query expression template, which
+// can not be used by the query templates of the configuration.
+const queryTemplateName = "query"
+
+// parseQueryTemplate parses a query expression template, along with the
+// named query templates it can include, e.g. {{ template "selector" . }}.
+func parseQueryTemplate(queryExpression string, templates map[string]string) (*template.Template, error) {
+	tmpl := template.New(queryTemplateName).Funcs(queryFuncs).Option("missingkey=error")
+	for name, body := range templates {
+		if _, err := tmpl.New(name).Parse(body); err != nil {
+			return nil, fmt.Errorf("error parsing query template %s: %s", name, err)
+		}
+	}
+	if _, err := tmpl.Parse(queryExpression); err != nil {
+		return nil, fmt.Errorf("error parsing query template: %s", err)
+	}
+	return tmpl, nil
+}
+
+// renderQuery renders a query expression template against the request
+// query params, with the helper functions of queryFuncs and the query
+// templates of the configuration. Multi-valued params are joined with
+// commas. A template referencing a param the request does not provide fails
+// with a 400 naming it, rather than querying with <no value> in place of
+// the param.
+func renderQuery(queryExpression string, env map[string][]string, templates map[string]string) (string, error) {
+	tmpl, err := parseQueryTemplate(queryExpression, templates)
+	if err != nil {
+		return "", err
+	}
+
+	env1 := make(map[string]paramValues)
+	for k, v := range env {
+		env1[k] = v
+	}
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, env1)
+	if matches := missingKeyRE.FindStringSubmatch(fmt.Sprint(err)); matches != nil {
+		return "", newQueryError(http.StatusBadRequest, fmt.Sprintf("Query param %q is required by the query", matches[1]))
+	}
+	if err != nil {
+		return "", fmt.Errorf("error executing template: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// renderEnforcedQuery renders queryExpression like renderQuery and sets the
+// matchers of the enforced labels on its selectors, as executed.
+func renderEnforcedQuery(queryExpression string, env map[string][]string, templates map[string]string, enforced map[string]string) (string, error) {
+	query, err := renderQuery(queryExpression, env, templates)
+	if err != nil {
+		return "", err
+	}
+	return enforceLabels(query, enforced)
+}
+
+// RenderedQuery is a query of a dashboard rendered without being executed.
+type RenderedQuery struct {
+	Row   string `json:"row"`
+	Graph string `json:"graph"`
+	// Kind is one of graph, baseline, annotation or threshold.
+	Kind  string `json:"kind"`
+	Name  string `json:"name,omitempty"`
+	Query string `json:"query,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// renderDashboardQueries renders every query of a dashboard, in the order
+// they are executed, with the enforced labels.
+func renderDashboardQueries(dashboard *Dashboard, env map[string][]string, templates map[string]string, enforced map[string]string) []RenderedQuery {
+	var queries []RenderedQuery
+	add := func(row *Row, graph *Graph, kind string, name string, expression string) {
+		rendered := RenderedQuery{Row: row.Name, Graph: graph.Name, Kind: kind, Name: name}
+		query, err := renderEnforcedQuery(expression, env, templates, enforced)
+		if err != nil {
+			rendered.Error = err.Error()
+		} else {
+			rendered.Query = query
+		}
+		queries = append(queries, rendered)
+	}
+	for _, row := range dashboard.Rows {
+		for _, graph := range row.Graphs {
+			queries := graph.queries()
+			if len(queries) == 0 {
+				add(row, graph, "graph", "", graph.QueryExpression)
+			}
+			for i, query := range queries {
+				add(row, graph, "graph", query.alias(i), query.QueryExpression)
+			}
+			if graph.Baseline != nil {
+				add(row, graph, "baseline", "", graph.Baseline.QueryExpression)
+			}
+			for _, annotation := range graph.Annotations {
+				add(row, graph, "annotation", annotation.Name, annotation.QueryExpression)
+			}
+			for _, threshold := range graph.Thresholds {
+				if _, ok := threshold.literal(); !ok {
+					add(row, graph, "threshold", threshold.Key, threshold.expression())
+				}
+			}
+		}
+	}
+	return queries
+}
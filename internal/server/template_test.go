@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderDashboardQueries(t *testing.T) {
+	dashboard := &Dashboard{
+		Rows: []*Row{
+			{
+				Name: "pod",
+				Graphs: []*Graph{
+					{
+						Name:            "pod_cpu_line",
+						QueryExpression: `sum(rate(container_cpu_usage_seconds_total{namespace="{{.namespace}}"}[5m]))`,
+						Thresholds:      []Threshold{{Key: "limit", QueryExpression: `sum(kube_pod_container_resource_limits{namespace="{{.namespace}}"})`}},
+					},
+					{
+						Name:            "broken",
+						QueryExpression: `sum({{.namespace`,
+					},
+				},
+			},
+		},
+	}
+	queries := renderDashboardQueries(dashboard, map[string][]string{"namespace": {"demo"}}, nil, nil)
+	assert.Len(t, queries, 3)
+	assert.Equal(t, RenderedQuery{Row: "pod", Graph: "pod_cpu_line", Kind: "graph", Query: `sum(rate(container_cpu_usage_seconds_total{namespace="demo"}[5m]))`}, queries[0])
+	assert.Equal(t, RenderedQuery{Row: "pod", Graph: "pod_cpu_line", Kind: "threshold", Name: "limit", Query: `sum(kube_pod_container_resource_limits{namespace="demo"})`}, queries[1])
+	assert.Equal(t, "broken", queries[2].Graph)
+	assert.NotEmpty(t, queries[2].Error)
+}
+
+func TestRenderQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		env      map[string][]string
+		expected string
+		err      string
+	}{
+		{name: "no params", query: `up`, env: nil, expected: `up`},
+		{name: "empty env", query: `up{namespace="{{.namespace}}"}`, env: map[string][]string{}, err: `Query param "namespace" is required by the query`},
+		{name: "missing param", query: `up{namespace="{{.namespace}}", pod="{{.pod}}"}`, env: map[string][]string{"namespace": {"shop"}}, err: `Query param "pod" is required by the query`},
+		{name: "single value", query: `up{namespace="{{.namespace}}"}`, env: map[string][]string{"namespace": {"shop"}}, expected: `up{namespace="shop"}`},
+		{name: "multi-valued param", query: `up{pod=~"{{.pod}}"}`, env: map[string][]string{"pod": {"web-0", "web-1"}}, expected: `up{pod=~"web-0,web-1"}`},
+		{name: "empty value", query: `up{pod="{{.pod}}"}`, env: map[string][]string{"pod": {""}}, expected: `up{pod=""}`},
+		{name: "unicode", query: `up{team="{{.team}}"}`, env: map[string][]string{"team": {"équipe-数据"}}, expected: `up{team="équipe-数据"}`},
+		{name: "quotes are escaped", query: `up{pod="{{.pod}}"}`, env: map[string][]string{"pod": {`a"} or vector(1) or up{x="`}}, expected: `up{pod="a&#34;} or vector(1) or up{x=&#34;"}`},
+		{name: "invalid template", query: `up{pod="{{.pod"}`, env: map[string][]string{"pod": {"a"}}, err: "error parsing query template"},
+		{name: "join", query: `up{pod=~"{{ join .pod "|" }}"}`, env: map[string][]string{"pod": {"web-0", "web-1"}}, expected: `up{pod=~"web-0|web-1"}`},
+		{name: "join escapes quotes", query: `up{pod=~"{{ join .pod "|" }}"}`, env: map[string][]string{"pod": {`a"`, "b"}}, expected: `up{pod=~"a&#34;|b"}`},
+		{name: "quote", query: `up{pod={{ quote .pod }}}`, env: map[string][]string{"pod": {`a"} or vector(1) or up{x="`}}, expected: `up{pod="a\"} or vector(1) or up{x=\""}`},
+		{name: "regexEscape", query: `up{pod=~"{{ regexEscape .pod }}"}`, env: map[string][]string{"pod": {"web.0", `a"+b`}}, expected: `up{pod=~"web\\.0|a\"\\+b"}`},
+		{name: "default for an empty value", query: `rate(up[{{ default "5m" .window }}])`, env: map[string][]string{"window": {""}}, expected: `rate(up[5m])`},
+		{name: "default for a missing param", query: `rate(up[{{ default "5m" (index . "window") }}])`, env: nil, expected: `rate(up[5m])`},
+		{name: "default with a value", query: `rate(up[{{ default "5m" .window }}])`, env: map[string][]string{"window": {"1m"}}, expected: `rate(up[1m])`},
+		{name: "if on a param", query: `up{{ if .pod }}{pod="{{ .pod }}"}{{ end }}`, env: map[string][]string{"pod": {"a"}}, expected: `up{pod="a"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := renderQuery(tt.query, tt.env, nil)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, query)
+		})
+	}
+
+	_, err := renderQuery(`up{pod="{{.pod}}"}`, nil, nil)
+	var qe *queryError
+	assert.ErrorAs(t, err, &qe)
+	assert.Equal(t, http.StatusBadRequest, qe.status)
+}
+
+func TestRenderQueryTemplates(t *testing.T) {
+	templates := map[string]string{
+		"selector": `namespace="{{ .namespace }}", container!=""`,
+		"window":   `{{ default "5m" (index . "window") }}`,
+	}
+	query, err := renderQuery(`sum(rate(container_cpu_usage_seconds_total{ {{- template "selector" . -}} }[{{ template "window" . }}]))`, map[string][]string{"namespace": {"shop"}}, templates)
+	assert.NoError(t, err)
+	assert.Equal(t, `sum(rate(container_cpu_usage_seconds_total{namespace="shop", container!=""}[5m]))`, query)
+
+	_, err = renderQuery(`up{ {{- template "selector" . }} }`, nil, templates)
+	assert.ErrorContains(t, err, `Query param "namespace" is required by the query`, "params of the templates are required")
+
+	_, err = renderQuery(`up{ {{- template "missing" . }} }`, nil, templates)
+	assert.ErrorContains(t, err, "error executing template")
+
+	_, err = renderQuery(`up`, nil, map[string]string{"broken": `{{ .pod`})
+	assert.ErrorContains(t, err, "error parsing query template broken")
+}
+
+func FuzzRenderQuery(f *testing.F) {
+	f.Add(`up{pod="{{.pod}}"}`, "pod", "web-0")
+	f.Add(`sum(rate(x{namespace="{{.namespace}}"}[5m]))`, "namespace", "")
+	f.Add(`{{.a}}{{.b}}`, "a", "数据")
+	f.Add(`{{if .pod}}{{.pod}}{{end}}`, "other", "\x00")
+	f.Fuzz(func(t *testing.T, query, name, value string) {
+		rendered, err := renderQuery(query, map[string][]string{name: {value}}, nil)
+		if err == nil {
+			assert.NotContains(t, rendered, "<no value>", "missing params are never rendered")
+		}
+	})
+}
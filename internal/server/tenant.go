@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantSeparator joins the tenants of a request, for the tenant federation
+// of Cortex and Mimir.
+const tenantSeparator = "|"
+
+// TenantConfig derives the tenants the queries of a request are sent to, as
+// X-Scope-OrgID, from the identity Argo CD forwards with the request.
+type TenantConfig struct {
+	// Header is the request header the identity is read from, e.g.
+	// Argocd-User-Groups, whose comma separated values are each mapped.
+	Header string `json:"header,omitempty"`
+	// Cookie reads the identity from a cookie instead of Header, e.g.
+	// argocd.token.
+	Cookie string `json:"cookie,omitempty"`
+	// Claim reads the identity from a claim of the JWT held by the header or
+	// cookie, e.g. groups, a Bearer prefix being stripped. The token is not
+	// verified, Argo CD having authenticated the request.
+	Claim string `json:"claim,omitempty"`
+	// Tenants maps identities to tenants. Requests without any mapped
+	// identity are rejected rather than sent without a tenant.
+	Tenants map[string]string `json:"tenants"`
+}
+
+// validate checks that the config tells where the identity is read from
+// and maps it to tenants.
+func (tc *TenantConfig) validate() error {
+	if (tc.Header == "") == (tc.Cookie == "") {
+		return errors.New("exactly one of header and cookie must be set")
+	}
+	if len(tc.Tenants) == 0 {
+		return errors.New("has no tenants")
+	}
+	return nil
+}
+
+// identities returns the identities of the request req.
+func (tc *TenantConfig) identities(req *http.Request) ([]string, error) {
+	value := req.Header.Get(tc.Header)
+	if tc.Cookie != "" {
+		cookie, err := req.Cookie(tc.Cookie)
+		if err != nil {
+			return nil, nil
+		}
+		value = cookie.Value
+	}
+	if value == "" {
+		return nil, nil
+	}
+	if tc.Claim != "" {
+		return jwtClaim(value, tc.Claim)
+	}
+	var identities []string
+	for _, identity := range strings.Split(value, ",") {
+		if identity = strings.TrimSpace(identity); identity != "" {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+// tenant returns the tenants the identities of req map to, joined with
+// tenantSeparator, failing with a 403 when none does.
+func (tc *TenantConfig) tenant(req *http.Request) (string, error) {
+	identities, err := tc.identities(req)
+	if err != nil {
+		return "", newQueryError(http.StatusForbidden, "Can not read the identity of the request: "+err.Error())
+	}
+	seen := map[string]bool{}
+	var tenants []string
+	for _, identity := range identities {
+		if tenant, ok := tc.Tenants[identity]; ok && !seen[tenant] {
+			seen[tenant] = true
+			tenants = append(tenants, tenant)
+		}
+	}
+	if len(tenants) == 0 {
+		return "", newQueryError(http.StatusForbidden, "No tenant is mapped to the identity of the request")
+	}
+	sort.Strings(tenants)
+	return strings.Join(tenants, tenantSeparator), nil
+}
+
+// jwtClaim returns the values of the string or string list claim of a JWT,
+// without verifying it.
+func jwtClaim(token string, claim string) ([]string, error) {
+	token = strings.TrimSpace(token)
+	if len(token) > len("Bearer ") && strings.EqualFold(token[:len("Bearer ")], "Bearer ") {
+		token = token[len("Bearer "):]
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values, nil
+	}
+	return nil, nil
+}
+
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx whose queries are sent to tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant the queries of ctx are sent to, or
+// an empty string for the provider default one.
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// requestTenant returns the tenant of the request when the provider derives
+// tenants from the identity of the requests, else an empty string.
+func (pp *PrometheusProvider) requestTenant(ctx *gin.Context) (string, error) {
+	if pp.config.Provider.Tenant == nil {
+		return "", nil
+	}
+	return pp.config.Provider.Tenant.tenant(ctx.Request)
+}
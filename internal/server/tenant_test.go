@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantConfig(t *testing.T) {
+	token := "header." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub": "alice", "groups": ["team-b", "team-a", "admins"]}`)) + ".signature"
+	tenants := map[string]string{"team-a": "tenant-a", "team-b": "tenant-b", "admins": "tenant-a"}
+	tests := []struct {
+		name     string
+		config   TenantConfig
+		header   http.Header
+		expected string
+		err      string
+	}{
+		{
+			name:     "header values",
+			config:   TenantConfig{Header: "Argocd-User-Groups", Tenants: tenants},
+			header:   http.Header{"Argocd-User-Groups": {"team-a, viewers"}},
+			expected: "tenant-a",
+		},
+		{
+			name:     "bearer token claim",
+			config:   TenantConfig{Header: "Authorization", Claim: "groups", Tenants: tenants},
+			header:   http.Header{"Authorization": {"Bearer " + token}},
+			expected: "tenant-a|tenant-b",
+		},
+		{
+			name:     "cookie token claim",
+			config:   TenantConfig{Cookie: "argocd.token", Claim: "sub", Tenants: map[string]string{"alice": "tenant-alice"}},
+			header:   http.Header{"Cookie": {"argocd.token=" + token}},
+			expected: "tenant-alice",
+		},
+		{
+			name:   "no mapped identity",
+			config: TenantConfig{Header: "Argocd-User-Groups", Tenants: tenants},
+			header: http.Header{"Argocd-User-Groups": {"viewers"}},
+			err:    "No tenant is mapped to the identity of the request",
+		},
+		{
+			name:   "no identity",
+			config: TenantConfig{Header: "Argocd-User-Groups", Tenants: tenants},
+			header: http.Header{},
+			err:    "No tenant is mapped to the identity of the request",
+		},
+		{
+			name:   "invalid token",
+			config: TenantConfig{Header: "Authorization", Claim: "groups", Tenants: tenants},
+			header: http.Header{"Authorization": {"Bearer opaque"}},
+			err:    "Can not read the identity of the request: not a JWT",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant, err := tt.config.tenant(&http.Request{Header: tt.header})
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, tenant)
+		})
+	}
+
+	assert.EqualError(t, (&TenantConfig{Tenants: tenants}).validate(), "exactly one of header and cookie must be set")
+	assert.EqualError(t, (&TenantConfig{Header: "Argocd-User-Groups"}).validate(), "has no tenants")
+}
+
+func TestExecuteTenant(t *testing.T) {
+	var orgID string
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "up"}, func(w http.ResponseWriter, r *http.Request) {
+		orgID = r.Header.Get(orgIDHeader)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": []}}`))
+	})
+	pp.config.Provider.Tenant = &TenantConfig{Header: "Argocd-User-Groups", Tenants: map[string]string{"team-a": "tenant-a"}}
+
+	execute := func(groups string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx := GetTestGinContext(w)
+		MockJsonGet(ctx, http.Header{"Argocd-User-Groups": {groups}}, map[string]string{"application": "app", "groupkind": "pod", "row": "row", "graph": "graph"}, nil)
+		pp.execute(ctx)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, execute("team-a").Code)
+	assert.Equal(t, "tenant-a", orgID)
+
+	orgID = ""
+	w := execute("team-b")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, orgID, "requests without a tenant are not sent")
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// literal returns the value of a threshold whose value is a number, which is
+// returned as is rather than queried.
+func (t Threshold) literal() (float64, bool) {
+	if t.Value == "" {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(t.Value), 64)
+	return value, err == nil
+}
+
+// expression returns the query of a threshold whose value is not a number:
+// its value, for configs predating literal values, or its queryExpression.
+func (t Threshold) expression() string {
+	if t.Value != "" {
+		return t.Value
+	}
+	return t.QueryExpression
+}
+
+// validateRange returns an error if the instant or duration of the threshold
+// are invalid or do not apply to it.
+func (t Threshold) validateRange() error {
+	if _, ok := t.literal(); ok {
+		return errors.New("has a value, which is not queried, and can not be instant nor set a duration")
+	}
+	if t.Instant && t.Duration != "" {
+		return errors.New("can not be both instant and set a duration")
+	}
+	if t.Duration != "" {
+		if d, err := parseDuration(t.Duration); err != nil || d <= 0 {
+			return fmt.Errorf("has an invalid duration %q: must be a positive duration", t.Duration)
+		}
+	}
+	return nil
+}
+
+// queryRange returns the range the query of the threshold is run over for a
+// graph queried over r: the end of r for instant thresholds, the steps of r
+// covering the last duration of the threshold, or r itself.
+func (t Threshold) queryRange(r v1.Range) v1.Range {
+	if t.Instant {
+		return v1.Range{Start: r.End, End: r.End, Step: r.Step}
+	}
+	if t.Duration == "" {
+		return r
+	}
+	d, err := parseDuration(t.Duration)
+	if err != nil || d <= 0 {
+		return r
+	}
+	offset := r.End.Sub(r.Start) - d
+	if offset <= 0 {
+		return r
+	}
+	// Start on a step of r, so that the threshold samples line up with
+	// the graph samples.
+	if r.Step > 0 {
+		offset = offset.Truncate(r.Step)
+	}
+	return v1.Range{Start: r.Start.Add(offset), End: r.End, Step: r.Step}
+}
+
+// spreadLatest returns every series of value as its latest value at every
+// step of r, so that instant thresholds are drawn across the graph like
+// thresholds queried over its range.
+func spreadLatest(value model.Value, r v1.Range) model.Matrix {
+	spread := model.Matrix{}
+	for _, sample := range latestSamples(value) {
+		series := constantMatrix(float64(sample.Value), r)[0]
+		series.Metric = sample.Metric
+		spread = append(spread, series)
+	}
+	return spread
+}
+
+// constantMatrix returns a single series without labels of value at every
+// step of r, as Prometheus returns for a number queried over r.
+func constantMatrix(value float64, r v1.Range) model.Matrix {
+	stream := &model.SampleStream{Metric: model.Metric{}}
+	if r.Step <= 0 {
+		r.Step = r.End.Sub(r.Start) + time.Nanosecond
+	}
+	for ts := r.Start; !ts.After(r.End); ts = ts.Add(r.Step) {
+		stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.TimeFromUnixNano(ts.UnixNano()), Value: model.SampleValue(value)})
+	}
+	return model.Matrix{stream}
+}
+
+// Comparison operators of thresholds. A threshold without an operator is
+// breached by values greater than it.
+const (
+	operatorGreaterThan    = "gt"
+	operatorGreaterOrEqual = "gte"
+	operatorLessThan       = "lt"
+	operatorLessOrEqual    = "lte"
+)
+
+func validOperator(operator string) bool {
+	switch operator {
+	case "", operatorGreaterThan, operatorGreaterOrEqual, operatorLessThan, operatorLessOrEqual:
+		return true
+	}
+	return false
+}
+
+// breaches reports whether value crosses level according to operator.
+func breaches(value, level float64, operator string) bool {
+	switch operator {
+	case operatorGreaterOrEqual:
+		return value >= level
+	case operatorLessThan:
+		return value < level
+	case operatorLessOrEqual:
+		return value <= level
+	default:
+		return value > level
+	}
+}
+
+// latestValues returns the latest value of every series of value, keyed by
+// seriesKey. NaN samples are ignored, as is the other series of a topN
+// graph, whose sum is not comparable to the thresholds of single series.
+func latestValues(value model.Value) map[model.Fingerprint]float64 {
+	latest := map[model.Fingerprint]float64{}
+	switch v := value.(type) {
+	case model.Matrix:
+		for _, series := range v {
+			if isOtherSeries(series.Metric) {
+				continue
+			}
+			for i := len(series.Values) - 1; i >= 0; i-- {
+				if sample := float64(series.Values[i].Value); !math.IsNaN(sample) {
+					latest[seriesKey(series.Metric)] = sample
+					break
+				}
+			}
+		}
+	case model.Vector:
+		for _, sample := range v {
+			if !math.IsNaN(float64(sample.Value)) {
+				latest[seriesKey(sample.Metric)] = float64(sample.Value)
+			}
+		}
+	case *model.Scalar:
+		if v != nil && !math.IsNaN(float64(v.Value)) {
+			latest[seriesKey(model.Metric{})] = float64(v.Value)
+		}
+	}
+	return latest
+}
+
+// evaluateThreshold compares the latest value of every series of data, in
+// dataUnit, against the latest value of the threshold series, in
+// thresholdUnit. Series are matched by labels like baselines, and a
+// threshold with a single series applies to every series of data. It
+// returns whether any series breaches the threshold, and the breaching
+// value furthest past it.
+func evaluateThreshold(data, threshold model.Value, operator, dataUnit, thresholdUnit string) (bool, *float64, error) {
+	levels := latestValues(threshold)
+	var single *float64
+	if len(levels) == 1 {
+		for _, level := range levels {
+			level := level
+			single = &level
+		}
+	}
+
+	var breaching *float64
+	for key, value := range latestValues(data) {
+		level, ok := levels[key]
+		if !ok {
+			if single == nil {
+				continue
+			}
+			level = *single
+		}
+		level, err := convertUnit(level, thresholdUnit, dataUnit)
+		if err != nil {
+			return false, nil, fmt.Errorf("error converting the threshold: %w", err)
+		}
+		if !breaches(value, level, operator) {
+			continue
+		}
+		if breaching == nil || breaches(value, *breaching, operator) {
+			value := value
+			breaching = &value
+		}
+	}
+	return breaching != nil, breaching, nil
+}
+
+// evaluateThresholds queries the thresholds of graph, at most
+// ThresholdConcurrency at once, and evaluates them against the graph
+// result. The thresholds share ThresholdTimeout on top of the timeout of
+// their queries: those it interrupts are returned with a timeout error
+// rather than failing the graph, whose series remain useful without them.
+// Thresholds are returned in the order of the graph.
+func (pp *PrometheusProvider) evaluateThresholds(ctx context.Context, graph *Graph, graphResult model.Value, env map[string][]string, r v1.Range) ([]ThresholdResponse, error) {
+	if len(graph.Thresholds) == 0 {
+		return nil, nil
+	}
+	thresholdCtx := ctx
+	if pp.options.ThresholdTimeout > 0 {
+		var cancel context.CancelFunc
+		thresholdCtx, cancel = context.WithTimeout(ctx, pp.options.ThresholdTimeout)
+		defer cancel()
+	}
+	concurrency := pp.options.ThresholdConcurrency
+	if concurrency <= 0 {
+		concurrency = len(graph.Thresholds)
+	}
+	responses := make([]ThresholdResponse, len(graph.Thresholds))
+	errs := make([]error, len(graph.Thresholds))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range graph.Thresholds {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			threshold := graph.Thresholds[i]
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				responses[i], errs[i] = pp.evaluateThreshold(thresholdCtx, graph, threshold, graphResult, env, r)
+			case <-thresholdCtx.Done():
+				errs[i] = thresholdCtx.Err()
+			}
+			// Only the thresholds interrupted by ThresholdTimeout are reported
+			// as timed out: the other errors still fail the graph.
+			if errors.Is(errs[i], context.DeadlineExceeded) && ctx.Err() == nil && thresholdCtx.Err() != nil {
+				pp.logger.Warnf("Threshold %s of graph %s timed out after %s", threshold.Key, graph.Name, pp.options.ThresholdTimeout)
+				responses[i] = threshold.response()
+				responses[i].Error = &ErrorDetail{Code: errCodeTimeout, Message: fmt.Sprintf("threshold did not complete within %s", pp.options.ThresholdTimeout)}
+				errs[i] = nil
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return responses, nil
+}
+
+// evaluateThreshold queries threshold, or returns its value, and evaluates
+// it against the graph result.
+func (pp *PrometheusProvider) evaluateThreshold(ctx context.Context, graph *Graph, threshold Threshold, graphResult model.Value, env map[string][]string, r v1.Range) (ThresholdResponse, error) {
+	var result model.Value
+	var warnings v1.Warnings
+	var err error
+
+	// A threshold value is a number returned as is, without a query, its
+	// expression being executed otherwise.
+	if value, ok := threshold.literal(); ok {
+		result = constantMatrix(value, r)
+	} else {
+		result, warnings, err = executeGraphQuery(ctx, threshold.expression(), env, threshold.queryRange(r), pp)
+		if err == nil && threshold.Instant {
+			result = spreadLatest(result, r)
+		}
+	}
+	if err != nil {
+		return ThresholdResponse{}, err
+	}
+	if len(warnings) > 0 {
+		return ThresholdResponse{}, fmt.Errorf("query warnings: %s", warnings)
+	}
+	response := threshold.response()
+	thresholdData := result
+	if matrix, ok := matrixOf(result); ok {
+		thresholdData = matrix
+	}
+	response.Data, err = json.Marshal(thresholdData)
+	if err != nil {
+		return ThresholdResponse{}, fmt.Errorf("error marshaling the threshold response: %s", err)
+	}
+	response.Breached, response.BreachingValue, err = evaluateThreshold(graphResult, result, threshold.Operator, graph.unit(), threshold.Unit)
+	if err != nil {
+		return ThresholdResponse{}, err
+	}
+	format := threshold.Format
+	if format == nil {
+		format = graph.Format
+	}
+	if format != nil && response.BreachingValue != nil {
+		// Breaching values are graph values, in the graph unit.
+		response.FormattedBreachingValue = formatValue(*response.BreachingValue, graph.unit(), format)
+	}
+	return response, nil
+}
+
+// response returns the response of the threshold, without its data.
+func (t Threshold) response() ThresholdResponse {
+	return ThresholdResponse{Key: t.Key, Name: t.Name, Color: t.Color, Value: t.Value, Unit: t.Unit}
+}
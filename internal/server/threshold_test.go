@@ -0,0 +1,307 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from     string
+		to       string
+		expected float64
+	}{
+		{value: 1, from: "GiB", to: "MiB", expected: 1024},
+		{value: 500, from: "ms", to: "s", expected: 0.5},
+		{value: 80, from: "%", to: "ratio", expected: 0.8},
+		{value: 3, from: "requests", to: "s", expected: 3},
+		{value: 3, from: "", to: "GB", expected: 3},
+	}
+	for _, tt := range tests {
+		value, err := convertUnit(tt.value, tt.from, tt.to)
+		assert.NoError(t, err)
+		assert.InDelta(t, tt.expected, value, 1e-9, "%v %s to %s", tt.value, tt.from, tt.to)
+	}
+
+	_, err := convertUnit(1, "GiB", "s")
+	assert.EqualError(t, err, "can not convert GiB to s")
+}
+
+func TestDisplayFactor(t *testing.T) {
+	tests := []struct {
+		yAxisUnit   string
+		displayUnit string
+		expected    float64
+	}{
+		{yAxisUnit: "B", displayUnit: "GiB", expected: 1.0 / (1 << 30)},
+		{yAxisUnit: "bytes", displayUnit: "MB", expected: 1e-6},
+		{yAxisUnit: "s", displayUnit: "ms", expected: 1000},
+		{yAxisUnit: "ns", displayUnit: "µs", expected: 1e-3},
+		{yAxisUnit: "ratio", displayUnit: "percent", expected: 100},
+		{yAxisUnit: "s", displayUnit: "", expected: 1},
+		{yAxisUnit: "s", displayUnit: "B", expected: 1},
+		{yAxisUnit: "requests", displayUnit: "ms", expected: 1},
+	}
+	for _, tt := range tests {
+		graph := &Graph{YAxisUnit: tt.yAxisUnit, DisplayUnit: tt.displayUnit}
+		assert.InDelta(t, tt.expected, graph.displayFactor(), 1e-12, "%s to %s", tt.yAxisUnit, tt.displayUnit)
+	}
+	assert.Equal(t, "ms", (&Graph{YAxisUnit: "s", DisplayUnit: "ms"}).unit())
+	assert.Equal(t, "s", (&Graph{YAxisUnit: "s"}).unit())
+}
+
+func TestScaleResult(t *testing.T) {
+	matrix := model.Matrix{{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 0.25}, {Timestamp: 2000, Value: 1.5}}}}
+	scaled := scaleResult(matrix, 1000)
+	assert.Equal(t, model.Matrix{{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 250}, {Timestamp: 2000, Value: 1500}}}}, scaled)
+	assert.Equal(t, model.SampleValue(0.25), matrix[0].Values[0].Value, "the result is not modified in place")
+
+	vector := model.Vector{{Metric: model.Metric{"pod": "a"}, Timestamp: 1000, Value: 2}}
+	assert.Equal(t, model.Vector{{Metric: model.Metric{"pod": "a"}, Timestamp: 1000, Value: 200}}, scaleResult(vector, 100))
+	assert.Equal(t, &model.Scalar{Timestamp: 1000, Value: 0.5}, scaleResult(&model.Scalar{Timestamp: 1000, Value: 50}, 0.01))
+	assert.Same(t, matrix[0], scaleResult(matrix, 1).(model.Matrix)[0])
+}
+
+func TestEvaluateThreshold(t *testing.T) {
+	series := func(pod string, values ...model.SampleValue) *model.SampleStream {
+		stream := &model.SampleStream{Metric: model.Metric{"pod": model.LabelValue(pod)}}
+		for i, v := range values {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(i), Value: v})
+		}
+		return stream
+	}
+	constant := func(v model.SampleValue) model.Matrix {
+		return model.Matrix{{Metric: model.Metric{}, Values: []model.SamplePair{{Timestamp: 0, Value: v}}}}
+	}
+	data := model.Matrix{series("a", 90, 70), series("b", 50, 85), series("c", 10, 95)}
+
+	tests := []struct {
+		name          string
+		threshold     model.Value
+		operator      string
+		dataUnit      string
+		thresholdUnit string
+		breached      bool
+		value         float64
+	}{
+		{name: "latest values above the threshold", threshold: constant(80), breached: true, value: 95},
+		{name: "earlier values are ignored", threshold: constant(96)},
+		{name: "equal values with gte", threshold: constant(95), operator: operatorGreaterOrEqual, breached: true, value: 95},
+		{name: "latest values below the threshold", threshold: constant(80), operator: operatorLessThan, breached: true, value: 70},
+		{name: "threshold converted to the graph unit", threshold: constant(0.9), dataUnit: "%", thresholdUnit: "ratio", breached: true, value: 95},
+		{
+			name:      "series matched by labels",
+			threshold: model.Matrix{series("a", 60), series("b", 90), series("c", 99)},
+			breached:  true, value: 70,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breached, value, err := evaluateThreshold(data, tt.threshold, tt.operator, tt.dataUnit, tt.thresholdUnit)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.breached, breached)
+			if tt.breached {
+				assert.Equal(t, tt.value, *value)
+			} else {
+				assert.Nil(t, value)
+			}
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	decimals := func(n int) *int { return &n }
+	tests := []struct {
+		value    float64
+		unit     string
+		format   ValueFormat
+		expected string
+	}{
+		{value: 0.9834729834, format: ValueFormat{}, expected: "0.98"},
+		{value: 0.9834729834, unit: "ratio", format: ValueFormat{Decimals: decimals(3), Scale: scaleSI}, expected: "0.983 ratio"},
+		{value: 98.34729834, unit: "%", format: ValueFormat{Decimals: decimals(1)}, expected: "98.3 %"},
+		{value: 1610612736, unit: "B", format: ValueFormat{Scale: scaleBinary}, expected: "1.50 GiB"},
+		{value: 1536, unit: "MiB", format: ValueFormat{Scale: scaleBinary}, expected: "1.50 GiB"},
+		{value: 1500000, unit: "bytes", format: ValueFormat{Decimals: decimals(1), Scale: scaleSI}, expected: "1.5 MB"},
+		{value: 0.0025, unit: "s", format: ValueFormat{Scale: scaleSI}, expected: "2.50 ms"},
+		{value: 250, unit: "ms", format: ValueFormat{Decimals: decimals(0), Scale: scaleSI}, expected: "250 ms"},
+		{value: 12000, unit: "req/s", format: ValueFormat{Scale: scaleSI}, expected: "12.00 kreq/s"},
+		{value: 0, unit: "B", format: ValueFormat{Scale: scaleBinary}, expected: "0.00 B"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, formatValue(tt.value, tt.unit, &tt.format), "%v %s", tt.value, tt.unit)
+	}
+}
+
+func TestThresholdLiteral(t *testing.T) {
+	tests := []struct {
+		threshold Threshold
+		value     float64
+		literal   bool
+	}{
+		{threshold: Threshold{Value: "80"}, value: 80, literal: true},
+		{threshold: Threshold{Value: " 0.5", QueryExpression: "limit"}, value: 0.5, literal: true},
+		{threshold: Threshold{Value: "1e3"}, value: 1000, literal: true},
+		{threshold: Threshold{Value: "limit * 0.8"}},
+		{threshold: Threshold{QueryExpression: "80"}},
+	}
+	for _, tt := range tests {
+		value, ok := tt.threshold.literal()
+		assert.Equal(t, tt.literal, ok, tt.threshold)
+		assert.Equal(t, tt.value, value, tt.threshold)
+	}
+}
+
+func TestConstantMatrix(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	matrix := constantMatrix(80, v1.Range{Start: start, End: start.Add(150 * time.Second), Step: time.Minute})
+	assert.Equal(t, model.Matrix{{Metric: model.Metric{}, Values: []model.SamplePair{
+		{Timestamp: 1700000000000, Value: 80},
+		{Timestamp: 1700000060000, Value: 80},
+		{Timestamp: 1700000120000, Value: 80},
+	}}}, matrix)
+}
+
+func TestThresholdQueryRange(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := v1.Range{Start: start, End: start.Add(24 * time.Hour), Step: 5 * time.Minute}
+
+	assert.Equal(t, r, Threshold{}.queryRange(r))
+	assert.Equal(t, v1.Range{Start: r.End, End: r.End, Step: r.Step}, Threshold{Instant: true}.queryRange(r))
+	assert.Equal(t, v1.Range{Start: r.End.Add(-time.Hour), End: r.End, Step: r.Step}, Threshold{Duration: "1h"}.queryRange(r))
+	assert.Equal(t, v1.Range{Start: r.End.Add(-10 * time.Minute), End: r.End, Step: r.Step}, Threshold{Duration: "7m"}.queryRange(r), "the range starts on a step of the graph")
+	assert.Equal(t, r, Threshold{Duration: "48h"}.queryRange(r), "the range of the graph is never exceeded")
+}
+
+func TestSpreadLatest(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	r := v1.Range{Start: start, End: start.Add(2 * time.Minute), Step: time.Minute}
+	value := model.Matrix{{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: model.TimeFromUnixNano(start.Add(2 * time.Minute).UnixNano()), Value: 4}}}}
+
+	spread := spreadLatest(value, r)
+	assert.Len(t, spread, 1)
+	assert.Equal(t, model.Metric{"pod": "a"}, spread[0].Metric)
+	assert.Len(t, spread[0].Values, 3)
+	for _, sample := range spread[0].Values {
+		assert.Equal(t, model.SampleValue(4), sample.Value)
+	}
+	assert.Empty(t, spreadLatest(model.Matrix{}, r))
+}
+
+func TestEvaluateThresholdsConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "usage", Thresholds: []Threshold{
+		{Key: "a", QueryExpression: "a"},
+		{Key: "b", QueryExpression: "b"},
+		{Key: "c", QueryExpression: "c"},
+		{Key: "d", QueryExpression: "d"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("query") != "usage" {
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {}, "values": [[1700000000, "1"]]}]}}`))
+	})
+	pp.options.ThresholdConcurrency = 2
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	var keys []string
+	for _, threshold := range response.Thresholds {
+		keys = append(keys, threshold.Key)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d"}, keys, "thresholds are returned in order")
+	assert.LessOrEqual(t, maxRunning, 2)
+}
+
+func TestEvaluateThresholdsTimeout(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "usage", Thresholds: []Threshold{
+		{Key: "limit", QueryExpression: "limit"},
+		{Key: "slow", QueryExpression: "slow"},
+		{Key: "target", Value: "1"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("query") == "slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a"}, "values": [[1700000000, "2"]]}]}}`))
+	})
+	pp.options.ThresholdTimeout = 50 * time.Millisecond
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "a slow threshold does not fail the graph")
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.SeriesCount)
+	assert.Len(t, response.Thresholds, 3)
+	assert.Nil(t, response.Thresholds[0].Error)
+	assert.NotEmpty(t, response.Thresholds[0].Data)
+	slow := response.Thresholds[1]
+	assert.Equal(t, "slow", slow.Key)
+	assert.Equal(t, &ErrorDetail{Code: errCodeTimeout, Message: "threshold did not complete within 50ms"}, slow.Error)
+	assert.Equal(t, "null", string(slow.Data))
+	assert.False(t, slow.Breached)
+	assert.Nil(t, response.Thresholds[2].Error)
+	assert.True(t, response.Thresholds[2].Breached)
+}
+
+func TestEvaluateThresholdsTimeoutErrors(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph", QueryExpression: "usage", Thresholds: []Threshold{
+		{Key: "slow", QueryExpression: "slow"},
+		{Key: "queued", QueryExpression: "slow"},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.Form.Get("query") {
+		case "slow":
+			<-r.Context().Done()
+			return
+		case "broken":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status": "error", "errorType": "execution", "error": "many-to-many matching not allowed"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [{"metric": {"pod": "a"}, "values": [[1700000000, "2"]]}]}}`))
+	})
+	pp.options.ThresholdTimeout = 50 * time.Millisecond
+	pp.options.ThresholdConcurrency = 1
+
+	w := executeTestGraph(pp, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	if assert.Len(t, response.Thresholds, 2) {
+		timeout := &ErrorDetail{Code: errCodeTimeout, Message: "threshold did not complete within 50ms"}
+		assert.Equal(t, timeout, response.Thresholds[0].Error)
+		assert.Equal(t, timeout, response.Thresholds[1].Error, "the thresholds still waiting for a slot time out too")
+	}
+
+	graph := pp.config.Applications[0].DefaultDashboard.Rows[0].Graphs[0]
+	graph.Thresholds = []Threshold{{Key: "broken", QueryExpression: "broken"}, {Key: "slow", QueryExpression: "slow"}}
+	pp.options.ThresholdConcurrency = 2
+	w = executeTestGraph(pp, nil)
+	assert.NotEqual(t, http.StatusOK, w.Code, "a failing threshold fails the graph even when another one times out")
+	assert.Contains(t, w.Body.String(), "many-to-many matching not allowed")
+}
@@ -0,0 +1,488 @@
+package server
+
+import (
+	"math"
+	"sort"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// countSeries returns the number of series and samples of a query result.
+// Scalar and string results count as a single series with one sample.
+func countSeries(value model.Value) (series int, samples int) {
+	switch v := value.(type) {
+	case model.Matrix:
+		for _, stream := range v {
+			samples += len(stream.Values)
+		}
+		return len(v), samples
+	case model.Vector:
+		return len(v), len(v)
+	case *model.Scalar:
+		if v != nil {
+			return 1, 1
+		}
+	case *model.String:
+		if v != nil {
+			return 1, 1
+		}
+	}
+	return 0, 0
+}
+
+// timeBounds returns the timestamps of the first and last samples of a query
+// result, ok being false when it has no samples.
+func timeBounds(value model.Value) (first model.Time, last model.Time, ok bool) {
+	add := func(ts model.Time) {
+		if !ok || ts < first {
+			first = ts
+		}
+		if !ok || ts > last {
+			last = ts
+		}
+		ok = true
+	}
+	switch v := value.(type) {
+	case model.Matrix:
+		for _, stream := range v {
+			if len(stream.Values) > 0 {
+				add(stream.Values[0].Timestamp)
+				add(stream.Values[len(stream.Values)-1].Timestamp)
+			}
+		}
+	case model.Vector:
+		for _, sample := range v {
+			add(sample.Timestamp)
+		}
+	case *model.Scalar:
+		if v != nil {
+			add(v.Timestamp)
+		}
+	case *model.String:
+		if v != nil {
+			add(v.Timestamp)
+		}
+	}
+	return first, last, ok
+}
+
+// matrixOf returns a scalar result as a single series of a single sample,
+// and a string result as no series, so that graph responses have the shape
+// of a matrix whatever the result type. Matrices are returned as is, and ok
+// is false for vectors.
+func matrixOf(value model.Value) (matrix model.Matrix, ok bool) {
+	switch v := value.(type) {
+	case model.Matrix:
+		return v, true
+	case *model.Scalar:
+		if v == nil {
+			return model.Matrix{}, true
+		}
+		return model.Matrix{{Metric: model.Metric{}, Values: []model.SamplePair{{Timestamp: v.Timestamp, Value: v.Value}}}}, true
+	case *model.String:
+		return model.Matrix{}, true
+	}
+	return nil, false
+}
+
+// LatestSample is the most recent sample of a series.
+type LatestSample struct {
+	Metric    model.Metric      `json:"metric"`
+	Timestamp model.Time        `json:"timestamp"`
+	Value     model.SampleValue `json:"value"`
+	// Formatted is the value formatted with the format of the graph, when
+	// it has one.
+	Formatted string `json:"formatted,omitempty"`
+}
+
+// latestSamples returns the most recent sample of every series of value.
+// Series without samples are left out, and a scalar is returned as a
+// sample without labels.
+func latestSamples(value model.Value) []LatestSample {
+	latest := []LatestSample{}
+	switch v := value.(type) {
+	case model.Matrix:
+		for _, series := range v {
+			if len(series.Values) == 0 {
+				continue
+			}
+			last := series.Values[len(series.Values)-1]
+			latest = append(latest, LatestSample{Metric: series.Metric, Timestamp: last.Timestamp, Value: last.Value})
+		}
+	case model.Vector:
+		for _, sample := range v {
+			latest = append(latest, LatestSample{Metric: sample.Metric, Timestamp: sample.Timestamp, Value: sample.Value})
+		}
+	case *model.Scalar:
+		if v != nil {
+			latest = append(latest, LatestSample{Metric: model.Metric{}, Timestamp: v.Timestamp, Value: v.Value})
+		}
+	}
+	return latest
+}
+
+// seriesKey identifies a series by its label set, ignoring the metric name so
+// that series produced by different expressions can be matched.
+func seriesKey(metric model.Metric) model.Fingerprint {
+	if _, ok := metric[model.MetricNameLabel]; !ok {
+		return metric.Fingerprint()
+	}
+	labels := metric.Clone()
+	delete(labels, model.MetricNameLabel)
+	return labels.Fingerprint()
+}
+
+// gridSlot returns the index of the step of r closest to ts.
+func gridSlot(ts model.Time, r v1.Range) int64 {
+	if r.Step <= 0 {
+		return int64(ts)
+	}
+	return int64(math.Round(float64(ts.Time().Sub(r.Start)) / float64(r.Step)))
+}
+
+// deltaMatrix subtracts the baseline series from the current series on the
+// step grid of r. Current series are matched to the baseline series with the
+// same labels (ignoring the metric name); a baseline with a single series is
+// compared against every current series. Points without a baseline sample in
+// the same grid slot are dropped rather than treated as zero, and current
+// series without a matching baseline series are left out of the result.
+func deltaMatrix(current, baseline model.Matrix, r v1.Range) model.Matrix {
+	slots := make(map[model.Fingerprint]map[int64]model.SampleValue, len(baseline))
+	for _, series := range baseline {
+		values := make(map[int64]model.SampleValue, len(series.Values))
+		for _, sample := range series.Values {
+			values[gridSlot(sample.Timestamp, r)] = sample.Value
+		}
+		slots[seriesKey(series.Metric)] = values
+	}
+
+	var single map[int64]model.SampleValue
+	if len(baseline) == 1 {
+		single = slots[seriesKey(baseline[0].Metric)]
+	}
+
+	delta := make(model.Matrix, 0, len(current))
+	for _, series := range current {
+		base, ok := slots[seriesKey(series.Metric)]
+		if !ok {
+			if single == nil {
+				continue
+			}
+			base = single
+		}
+		values := make([]model.SamplePair, 0, len(series.Values))
+		for _, sample := range series.Values {
+			baseValue, ok := base[gridSlot(sample.Timestamp, r)]
+			if !ok {
+				continue
+			}
+			values = append(values, model.SamplePair{
+				Timestamp: sample.Timestamp,
+				Value:     sample.Value - baseValue,
+			})
+		}
+		delta = append(delta, &model.SampleStream{Metric: series.Metric, Values: values})
+	}
+	return delta
+}
+
+// Interpolation methods used to resample series onto client timestamps.
+const (
+	// resampleNearest takes the sample closest to the timestamp, the
+	// earlier one on ties.
+	resampleNearest = "nearest"
+	// resamplePrevious takes the last sample at or before the timestamp.
+	resamplePrevious = "previous"
+)
+
+// resampleMatrix returns the series of matrix sampled at the given
+// timestamps, which must be sorted. Timestamps for which a series has no
+// sample to pick from (an empty series, or no earlier sample with the
+// previous method) are left out of that series.
+func resampleMatrix(matrix model.Matrix, timestamps []model.Time, method string) model.Matrix {
+	resampled := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		samples := series.Values
+		values := make([]model.SamplePair, 0, len(timestamps))
+		for _, ts := range timestamps {
+			// Index of the first sample after ts.
+			i := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp > ts })
+			var picked *model.SamplePair
+			switch method {
+			case resamplePrevious:
+				if i > 0 {
+					picked = &samples[i-1]
+				}
+			default:
+				if i > 0 {
+					picked = &samples[i-1]
+				}
+				if i < len(samples) && (picked == nil || samples[i].Timestamp-ts < ts-picked.Timestamp) {
+					picked = &samples[i]
+				}
+			}
+			if picked != nil {
+				values = append(values, model.SamplePair{Timestamp: ts, Value: picked.Value})
+			}
+		}
+		resampled = append(resampled, &model.SampleStream{Metric: series.Metric, Values: values})
+	}
+	return resampled
+}
+
+// smoothMatrix returns the series of matrix smoothed with a trailing moving
+// average over window samples. Each point is the mean of itself and up to
+// window-1 preceding samples of its series.
+func smoothMatrix(matrix model.Matrix, window int) model.Matrix {
+	smoothed := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		values := make([]model.SamplePair, len(series.Values))
+		var sum model.SampleValue
+		for i, sample := range series.Values {
+			sum += sample.Value
+			if i >= window {
+				sum -= series.Values[i-window].Value
+			}
+			n := i + 1
+			if n > window {
+				n = window
+			}
+			values[i] = model.SamplePair{Timestamp: sample.Timestamp, Value: sum / model.SampleValue(n)}
+		}
+		smoothed = append(smoothed, &model.SampleStream{Metric: series.Metric, Values: values})
+	}
+	return smoothed
+}
+
+// Bucketing modes used to downsample series.
+const (
+	// downsampleMinMax keeps the lowest and highest sample of every bucket,
+	// preserving spikes.
+	downsampleMinMax = "minmax"
+	downsampleAvg    = "avg"
+	downsampleMin    = "min"
+	downsampleMax    = "max"
+)
+
+// downsampleMatrix reduces every series of matrix to at most maxPoints
+// samples by splitting it into buckets of consecutive samples and keeping
+// one (avg, min, max) or two (minmax) samples per bucket. Kept samples retain
+// their own timestamp, except with avg where the bucket average is placed
+// at the timestamp of the first sample of the bucket. Series with at most
+// maxPoints samples are returned unchanged.
+func downsampleMatrix(matrix model.Matrix, maxPoints int, mode string) model.Matrix {
+	downsampled := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		downsampled = append(downsampled, &model.SampleStream{
+			Metric: series.Metric,
+			Values: downsampleValues(series.Values, maxPoints, mode),
+		})
+	}
+	return downsampled
+}
+
+func downsampleValues(values []model.SamplePair, maxPoints int, mode string) []model.SamplePair {
+	if len(values) <= maxPoints {
+		return values
+	}
+	buckets := maxPoints
+	if mode == downsampleMinMax {
+		buckets = maxPoints / 2
+	}
+	if buckets < 1 {
+		buckets = 1
+	}
+	result := make([]model.SamplePair, 0, maxPoints)
+	for b := 0; b < buckets; b++ {
+		bucket := values[b*len(values)/buckets : (b+1)*len(values)/buckets]
+		if len(bucket) == 0 {
+			continue
+		}
+		minIdx, maxIdx := 0, 0
+		var sum model.SampleValue
+		for i, sample := range bucket {
+			sum += sample.Value
+			if sample.Value < bucket[minIdx].Value {
+				minIdx = i
+			}
+			if sample.Value > bucket[maxIdx].Value {
+				maxIdx = i
+			}
+		}
+		switch mode {
+		case downsampleAvg:
+			result = append(result, model.SamplePair{Timestamp: bucket[0].Timestamp, Value: sum / model.SampleValue(len(bucket))})
+		case downsampleMin:
+			result = append(result, bucket[minIdx])
+		case downsampleMax:
+			result = append(result, bucket[maxIdx])
+		default:
+			first, second := minIdx, maxIdx
+			if first > second {
+				first, second = second, first
+			}
+			result = append(result, bucket[first])
+			if second != first {
+				result = append(result, bucket[second])
+			}
+		}
+	}
+	return result
+}
+
+// Ranking functions used to select the series kept by topSeries.
+const (
+	rankByMax  = "max"
+	rankByAvg  = "avg"
+	rankByLast = "last"
+	rankBySum  = "sum"
+)
+
+func validRankBy(rankBy string) bool {
+	switch rankBy {
+	case rankByMax, rankByAvg, rankByLast, rankBySum:
+		return true
+	}
+	return false
+}
+
+// seriesScore returns the value a series is ranked by.
+func seriesScore(values []model.SamplePair, rankBy string) float64 {
+	if len(values) == 0 {
+		return math.Inf(-1)
+	}
+	switch rankBy {
+	case rankByAvg, rankBySum:
+		var sum float64
+		for _, sample := range values {
+			sum += float64(sample.Value)
+		}
+		if rankBy == rankBySum {
+			return sum
+		}
+		return sum / float64(len(values))
+	case rankByLast:
+		return float64(values[len(values)-1].Value)
+	default:
+		score := math.Inf(-1)
+		for _, sample := range values {
+			if v := float64(sample.Value); v > score {
+				score = v
+			}
+		}
+		return score
+	}
+}
+
+// topSeries keeps the n series of matrix ranked highest by rankBy, and
+// returns them along with the sorted keys of all the series of matrix. Ties
+// and NaN scores are broken by series key, and the kept series are sorted
+// by key, so the same series are shown in the same order across refreshes.
+func topSeries(matrix model.Matrix, n int, rankBy string) (model.Matrix, []string) {
+	kept, _, keys := splitTopSeries(matrix, n, rankBy)
+	return kept, keys
+}
+
+// splitTopSeries ranks the series of matrix like topSeries, returning the
+// n kept series, the others and the sorted keys of all of them.
+func splitTopSeries(matrix model.Matrix, n int, rankBy string) (model.Matrix, model.Matrix, []string) {
+	type ranked struct {
+		series *model.SampleStream
+		key    string
+		score  float64
+	}
+	all := make([]ranked, 0, len(matrix))
+	keys := make([]string, 0, len(matrix))
+	for _, series := range matrix {
+		key := series.Metric.String()
+		score := seriesScore(series.Values, rankBy)
+		if math.IsNaN(score) {
+			score = math.Inf(-1)
+		}
+		all = append(all, ranked{series: series, key: key, score: score})
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].score != all[j].score {
+			return all[i].score > all[j].score
+		}
+		return all[i].key < all[j].key
+	})
+	var rest model.Matrix
+	if len(all) > n {
+		for _, r := range all[n:] {
+			rest = append(rest, r.series)
+		}
+		all = all[:n]
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].key < all[j].key })
+
+	kept := make(model.Matrix, 0, len(all))
+	for _, r := range all {
+		kept = append(kept, r.series)
+	}
+	return kept, rest, keys
+}
+
+// otherSeriesLabel is the only label of the other series of a graph,
+// summing the series left out of its top N.
+const otherSeriesLabel = "other"
+
+// otherSeriesLegend is the legend of the other series of a graph.
+const otherSeriesLegend = "Other"
+
+// isOtherSeries reports whether metric labels the other series of a graph.
+func isOtherSeries(metric model.Metric) bool {
+	return len(metric) == 1 && metric[otherSeriesLabel] == "true"
+}
+
+// topSeriesWithOther keeps the top topN.Count series of matrix like
+// topSeries, and sums the others into a single series labeled
+// other="true", appended last, at every timestamp any of them has a sample.
+// NaN samples are left out of the sums. It also returns the number of
+// series summed into the other series.
+func topSeriesWithOther(matrix model.Matrix, topN *TopN) (model.Matrix, []string, int) {
+	kept, rest, keys := splitTopSeries(matrix, topN.Count, topN.rankBy())
+	if len(rest) == 0 {
+		return kept, keys, 0
+	}
+	sums := map[model.Time]model.SampleValue{}
+	for _, series := range rest {
+		for _, sample := range series.Values {
+			if !math.IsNaN(float64(sample.Value)) {
+				sums[sample.Timestamp] += sample.Value
+			}
+		}
+	}
+	values := make([]model.SamplePair, 0, len(sums))
+	for ts, sum := range sums {
+		values = append(values, model.SamplePair{Timestamp: ts, Value: sum})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Timestamp < values[j].Timestamp })
+	other := &model.SampleStream{Metric: model.Metric{otherSeriesLabel: "true"}, Values: values}
+	return append(kept, other), keys, len(rest)
+}
+
+// relabelMatrix returns the series of matrix with the labels in drop
+// removed and the labels in rename renamed. Series ending up with the same
+// labels are all kept.
+func relabelMatrix(matrix model.Matrix, relabel *Relabel) model.Matrix {
+	relabeled := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		metric := series.Metric.Clone()
+		for _, name := range relabel.Drop {
+			delete(metric, model.LabelName(name))
+		}
+		for from, to := range relabel.Rename {
+			if value, ok := series.Metric[model.LabelName(from)]; ok {
+				delete(metric, model.LabelName(from))
+				metric[model.LabelName(to)] = value
+			}
+		}
+		relabeled = append(relabeled, &model.SampleStream{Metric: metric, Values: series.Values})
+	}
+	return relabeled
+}
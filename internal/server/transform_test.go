@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaMatrix(t *testing.T) {
+	start := time.Unix(0, 0)
+	r := v1.Range{Start: start, End: start.Add(3 * time.Minute), Step: time.Minute}
+	at := func(minutes int) model.Time {
+		return model.TimeFromUnixNano(start.Add(time.Duration(minutes) * time.Minute).UnixNano())
+	}
+
+	current := model.Matrix{
+		{
+			Metric: model.Metric{"__name__": "requests", "pod": "a"},
+			Values: []model.SamplePair{{Timestamp: at(0), Value: 10}, {Timestamp: at(1), Value: 12}, {Timestamp: at(2), Value: 15}},
+		},
+		{
+			Metric: model.Metric{"pod": "b"},
+			Values: []model.SamplePair{{Timestamp: at(0), Value: 1}},
+		},
+	}
+
+	t.Run("series are matched by labels and missing points are dropped", func(t *testing.T) {
+		baseline := model.Matrix{
+			{
+				// Slightly off-grid timestamps still land in the same slot.
+				Metric: model.Metric{"__name__": "requests_baseline", "pod": "a"},
+				Values: []model.SamplePair{{Timestamp: at(0) + 500, Value: 8}, {Timestamp: at(2), Value: 5}},
+			},
+			{
+				Metric: model.Metric{"pod": "c"},
+				Values: []model.SamplePair{{Timestamp: at(0), Value: 1}},
+			},
+		}
+		delta := deltaMatrix(current, baseline, r)
+		assert.Len(t, delta, 1)
+		assert.Equal(t, model.LabelValue("a"), delta[0].Metric["pod"])
+		assert.Equal(t, []model.SamplePair{{Timestamp: at(0), Value: 2}, {Timestamp: at(2), Value: 10}}, delta[0].Values)
+	})
+
+	t.Run("a single baseline series applies to every series", func(t *testing.T) {
+		baseline := model.Matrix{
+			{
+				Metric: model.Metric{"job": "baseline"},
+				Values: []model.SamplePair{{Timestamp: at(0), Value: 1}},
+			},
+		}
+		delta := deltaMatrix(current, baseline, r)
+		assert.Len(t, delta, 2)
+		assert.Equal(t, []model.SamplePair{{Timestamp: at(0), Value: 9}}, delta[0].Values)
+		assert.Equal(t, []model.SamplePair{{Timestamp: at(0), Value: 0}}, delta[1].Values)
+	})
+}
+
+func TestCountSeries(t *testing.T) {
+	tests := []struct {
+		testName        string
+		value           model.Value
+		expectedSeries  int
+		expectedSamples int
+	}{
+		{testName: "nil result", value: nil},
+		{testName: "empty matrix", value: model.Matrix{}},
+		{testName: "matrix with series but no samples", value: model.Matrix{{Metric: model.Metric{"pod": "a"}}}, expectedSeries: 1},
+		{testName: "matrix", value: model.Matrix{{Values: []model.SamplePair{{}, {}}}, {Values: []model.SamplePair{{}}}}, expectedSeries: 2, expectedSamples: 3},
+		{testName: "empty vector", value: model.Vector{}},
+		{testName: "vector", value: model.Vector{{}, {}}, expectedSeries: 2, expectedSamples: 2},
+		{testName: "scalar", value: &model.Scalar{Value: 1}, expectedSeries: 1, expectedSamples: 1},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			series, samples := countSeries(test.value)
+			assert.Equal(t, test.expectedSeries, series)
+			assert.Equal(t, test.expectedSamples, samples)
+		})
+	}
+}
+
+func TestResampleMatrix(t *testing.T) {
+	matrix := model.Matrix{
+		{
+			Metric: model.Metric{"pod": "a"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}, {Timestamp: 3000, Value: 3}},
+		},
+		{Metric: model.Metric{"pod": "b"}},
+	}
+	timestamps := []model.Time{500, 1400, 1500, 1600, 5000}
+
+	nearest := resampleMatrix(matrix, timestamps, resampleNearest)
+	assert.Equal(t, []model.SamplePair{{Timestamp: 500, Value: 1}, {Timestamp: 1400, Value: 1}, {Timestamp: 1500, Value: 1}, {Timestamp: 1600, Value: 2}, {Timestamp: 5000, Value: 3}}, nearest[0].Values)
+	assert.Empty(t, nearest[1].Values)
+
+	previous := resampleMatrix(matrix, timestamps, resamplePrevious)
+	assert.Equal(t, []model.SamplePair{{Timestamp: 1400, Value: 1}, {Timestamp: 1500, Value: 1}, {Timestamp: 1600, Value: 1}, {Timestamp: 5000, Value: 3}}, previous[0].Values)
+}
+
+func TestSmoothMatrix(t *testing.T) {
+	matrix := model.Matrix{
+		{Values: []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 3}, {Timestamp: 3, Value: 5}, {Timestamp: 4, Value: 10}}},
+	}
+	smoothed := smoothMatrix(matrix, 2)
+	assert.Equal(t, []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 4}, {Timestamp: 4, Value: 7.5}}, smoothed[0].Values)
+	assert.Equal(t, model.SampleValue(3), matrix[0].Values[1].Value, "the raw matrix is left untouched")
+	assert.Equal(t, matrix[0].Values, smoothMatrix(matrix, 1)[0].Values)
+}
+
+func TestDownsampleMatrix(t *testing.T) {
+	var values []model.SamplePair
+	for i, v := range []model.SampleValue{1, 9, 2, 3, 0, 4, 5, 6} {
+		values = append(values, model.SamplePair{Timestamp: model.Time(i), Value: v})
+	}
+	matrix := model.Matrix{{Values: values}}
+
+	assert.Equal(t, values, downsampleMatrix(matrix, 8, downsampleMinMax)[0].Values, "series with few points are unchanged")
+	assert.Equal(t, []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 1, Value: 9}, {Timestamp: 4, Value: 0}, {Timestamp: 7, Value: 6}},
+		downsampleMatrix(matrix, 4, downsampleMinMax)[0].Values)
+	assert.Equal(t, []model.SamplePair{{Timestamp: 0, Value: 3.75}, {Timestamp: 4, Value: 3.75}},
+		downsampleMatrix(matrix, 2, downsampleAvg)[0].Values)
+	assert.Equal(t, []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 4, Value: 0}},
+		downsampleMatrix(matrix, 2, downsampleMin)[0].Values)
+	assert.Equal(t, []model.SamplePair{{Timestamp: 1, Value: 9}, {Timestamp: 7, Value: 6}},
+		downsampleMatrix(matrix, 2, downsampleMax)[0].Values)
+}
+
+func TestTopSeries(t *testing.T) {
+	series := func(pod string, values ...model.SampleValue) *model.SampleStream {
+		stream := &model.SampleStream{Metric: model.Metric{"pod": model.LabelValue(pod)}}
+		for i, v := range values {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(i), Value: v})
+		}
+		return stream
+	}
+	matrix := model.Matrix{series("d", 1, 5), series("c", 5, 1), series("b", 3, 3), series("a", 1, 5)}
+	names := func(m model.Matrix) []string {
+		var pods []string
+		for _, s := range m {
+			pods = append(pods, string(s.Metric["pod"]))
+		}
+		return pods
+	}
+
+	kept, keys := topSeries(matrix, 2, rankByMax)
+	assert.Equal(t, []string{"a", "c"}, names(kept), "ties are broken by series key")
+	assert.Equal(t, []string{`{pod="a"}`, `{pod="b"}`, `{pod="c"}`, `{pod="d"}`}, keys)
+
+	reversed := model.Matrix{matrix[3], matrix[2], matrix[1], matrix[0]}
+	kept, _ = topSeries(reversed, 2, rankByMax)
+	assert.Equal(t, []string{"a", "c"}, names(kept), "selection does not depend on the input order")
+
+	kept, _ = topSeries(matrix, 1, rankByAvg)
+	assert.Equal(t, []string{"a"}, names(kept))
+	kept, _ = topSeries(matrix, 3, rankByLast)
+	assert.Equal(t, []string{"a", "b", "d"}, names(kept))
+}
+
+func TestTopSeriesWithOther(t *testing.T) {
+	matrix := model.Matrix{
+		{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 9}}},
+		{Metric: model.Metric{"pod": "b"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 4}, {Timestamp: 2000, Value: 4}}},
+		{Metric: model.Metric{"pod": "c"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 2}, {Timestamp: 3000, Value: 1}}},
+		{Metric: model.Metric{"pod": "d"}, Values: []model.SamplePair{{Timestamp: 2000, Value: model.SampleValue(math.NaN())}, {Timestamp: 3000, Value: 2}}},
+	}
+
+	kept, keys, others := topSeriesWithOther(matrix, &TopN{Count: 1})
+	assert.Len(t, keys, 4)
+	assert.Equal(t, 3, others)
+	assert.Len(t, kept, 2)
+	assert.Equal(t, model.Metric{"pod": "a"}, kept[0].Metric)
+	assert.True(t, isOtherSeries(kept[1].Metric))
+	assert.Equal(t, []model.SamplePair{{Timestamp: 1000, Value: 6}, {Timestamp: 2000, Value: 4}, {Timestamp: 3000, Value: 3}}, kept[1].Values, "NaN samples are left out of the sums")
+	assert.Equal(t, otherSeriesLegend, newLegender("{{ .pod }}").legend(kept[1].Metric))
+
+	kept, _, others = topSeriesWithOther(matrix, &TopN{Count: 1, RankBy: rankBySum})
+	assert.Equal(t, 3, others)
+	assert.Equal(t, model.Metric{"pod": "a"}, kept[0].Metric)
+	kept, _, _ = topSeriesWithOther(matrix, &TopN{Count: 1, RankBy: rankByLast})
+	assert.Equal(t, model.Metric{"pod": "a"}, kept[0].Metric)
+	kept, _, _ = topSeriesWithOther(matrix, &TopN{Count: 2, RankBy: rankBySum})
+	assert.Equal(t, []model.Metric{{"pod": "a"}, {"pod": "b"}}, []model.Metric{kept[0].Metric, kept[1].Metric})
+
+	kept, _, others = topSeriesWithOther(matrix, &TopN{Count: 4})
+	assert.Equal(t, 0, others)
+	assert.Len(t, kept, 4, "no other series is added when every series is kept")
+
+	breached, value, err := evaluateThreshold(model.Matrix{matrix[0], {Metric: model.Metric{otherSeriesLabel: "true"}, Values: []model.SamplePair{{Timestamp: 2000, Value: 100}}}}, constantMatrix(50, v1.Range{}), "", "", "")
+	assert.NoError(t, err)
+	assert.False(t, breached, "the other series is not compared against thresholds")
+	assert.Nil(t, value)
+}
+
+func TestLatestSamples(t *testing.T) {
+	matrix := model.Matrix{
+		{Metric: model.Metric{"pod": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}}},
+		{Metric: model.Metric{"pod": "b"}},
+	}
+	assert.Equal(t, []LatestSample{{Metric: model.Metric{"pod": "a"}, Timestamp: 2000, Value: 2}}, latestSamples(matrix))
+
+	vector := model.Vector{{Metric: model.Metric{"pod": "a"}, Timestamp: 1000, Value: 3}}
+	assert.Equal(t, []LatestSample{{Metric: model.Metric{"pod": "a"}, Timestamp: 1000, Value: 3}}, latestSamples(vector))
+
+	scalar := &model.Scalar{Timestamp: 1000, Value: 4}
+	assert.Equal(t, []LatestSample{{Metric: model.Metric{}, Timestamp: 1000, Value: 4}}, latestSamples(scalar))
+
+	body, err := json.Marshal(latestSamples(vector))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"metric":{"pod":"a"},"timestamp":1,"value":"3"}]`, string(body))
+	assert.Empty(t, latestSamples(model.Matrix{}))
+}
+
+func TestRelabelMatrix(t *testing.T) {
+	values := []model.SamplePair{{Timestamp: 0, Value: 1}}
+	matrix := model.Matrix{
+		{Metric: model.Metric{"__name__": "up", "instance": "10.0.0.1:8080", "job": "app", "pod": "a"}, Values: values},
+		{Metric: model.Metric{"job": "app"}, Values: values},
+	}
+	relabeled := relabelMatrix(matrix, &Relabel{Drop: []string{"__name__", "instance"}, Rename: map[string]string{"job": "service"}})
+	assert.Equal(t, model.Matrix{
+		{Metric: model.Metric{"service": "app", "pod": "a"}, Values: values},
+		{Metric: model.Metric{"service": "app"}, Values: values},
+	}, relabeled)
+	assert.Equal(t, model.LabelValue("up"), matrix[0].Metric["__name__"], "the query result is left untouched")
+}
+
+func TestMatrixOf(t *testing.T) {
+	matrix := model.Matrix{{Metric: model.Metric{"pod": "a"}}}
+	got, ok := matrixOf(matrix)
+	assert.True(t, ok)
+	assert.Equal(t, matrix, got)
+
+	got, ok = matrixOf(&model.Scalar{Timestamp: 1000, Value: 2})
+	assert.True(t, ok)
+	assert.Equal(t, model.Matrix{{Metric: model.Metric{}, Values: []model.SamplePair{{Timestamp: 1000, Value: 2}}}}, got)
+
+	got, ok = matrixOf(&model.String{Timestamp: 1000, Value: "v1"})
+	assert.True(t, ok)
+	assert.Empty(t, got)
+
+	_, ok = matrixOf(model.Vector{})
+	assert.False(t, ok)
+}
+
+func TestTimeBounds(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         model.Value
+		first, last   model.Time
+		expectSamples bool
+	}{
+		{
+			name: "matrix",
+			value: model.Matrix{
+				{Values: []model.SamplePair{{Timestamp: 2000, Value: 1}, {Timestamp: 5000, Value: 1}}},
+				{Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 3000, Value: 1}}},
+				{},
+			},
+			first: 1000, last: 5000, expectSamples: true,
+		},
+		{name: "vector", value: model.Vector{{Timestamp: 4000}, {Timestamp: 2000}}, first: 2000, last: 4000, expectSamples: true},
+		{name: "scalar", value: &model.Scalar{Timestamp: 3000}, first: 3000, last: 3000, expectSamples: true},
+		{name: "empty matrix", value: model.Matrix{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last, ok := timeBounds(tt.value)
+			assert.Equal(t, tt.expectSamples, ok)
+			assert.Equal(t, tt.first, first)
+			assert.Equal(t, tt.last, last)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+// unit is a unit of measure of graph and threshold values.
+type unit struct {
+	// dimension groups the units values can be converted between.
+	dimension string
+	// factor converts a value in the unit to the base unit of its dimension.
+	factor float64
+}
+
+// Dimensions of the known units.
+const (
+	dimensionBytes = "bytes"
+	dimensionTime  = "time"
+	dimensionRatio = "ratio"
+)
+
+// units are the units values can be converted between. Units missing from
+// the table are descriptive only.
+var units = map[string]unit{
+	"B":     {dimensionBytes, 1},
+	"bytes": {dimensionBytes, 1},
+	"KB":    {dimensionBytes, 1e3},
+	"MB":    {dimensionBytes, 1e6},
+	"GB":    {dimensionBytes, 1e9},
+	"TB":    {dimensionBytes, 1e12},
+	"KiB":   {dimensionBytes, 1 << 10},
+	"MiB":   {dimensionBytes, 1 << 20},
+	"GiB":   {dimensionBytes, 1 << 30},
+	"TiB":   {dimensionBytes, 1 << 40},
+
+	"ns":      {dimensionTime, 1e-9},
+	"us":      {dimensionTime, 1e-6},
+	"µs":      {dimensionTime, 1e-6},
+	"ms":      {dimensionTime, 1e-3},
+	"s":       {dimensionTime, 1},
+	"seconds": {dimensionTime, 1},
+	"min":     {dimensionTime, 60},
+	"h":       {dimensionTime, 3600},
+	"d":       {dimensionTime, 86400},
+
+	"ratio":   {dimensionRatio, 1},
+	"%":       {dimensionRatio, 0.01},
+	"percent": {dimensionRatio, 0.01},
+}
+
+// checkUnits returns an error if values in unit from can not be compared to
+// values in unit to, i.e. if both are known units of different dimensions.
+func checkUnits(from, to string) error {
+	fromUnit, fromOK := units[from]
+	toUnit, toOK := units[to]
+	if fromOK && toOK && fromUnit.dimension != toUnit.dimension {
+		return fmt.Errorf("can not convert %s to %s", from, to)
+	}
+	return nil
+}
+
+// convertUnit converts value from unit from to unit to. Values are returned
+// as is when either unit is unknown or empty.
+func convertUnit(value float64, from, to string) (float64, error) {
+	if err := checkUnits(from, to); err != nil {
+		return 0, err
+	}
+	fromUnit, fromOK := units[from]
+	toUnit, toOK := units[to]
+	if !fromOK || !toOK {
+		return value, nil
+	}
+	return value * fromUnit.factor / toUnit.factor, nil
+}
+
+// checkDisplayUnit returns an error if the values of a graph in unit from
+// can not be converted to its display unit to, which requires both to be
+// known units of the same dimension.
+func checkDisplayUnit(from, to string) error {
+	if _, ok := units[from]; !ok {
+		return fmt.Errorf("can not convert unknown unit %q to %s", from, to)
+	}
+	if _, ok := units[to]; !ok {
+		return fmt.Errorf("can not convert %s to unknown unit %q", from, to)
+	}
+	return checkUnits(from, to)
+}
+
+// unit returns the unit of the values of the graph responses: its display
+// unit when it has one, else its y axis unit.
+func (g *Graph) unit() string {
+	if g.DisplayUnit != "" {
+		return g.DisplayUnit
+	}
+	return g.YAxisUnit
+}
+
+// displayFactor returns the factor converting the values of the graph from
+// its y axis unit to its display unit, 1 when it has none or can not be
+// converted.
+func (g *Graph) displayFactor() float64 {
+	if g.DisplayUnit == "" || checkDisplayUnit(g.YAxisUnit, g.DisplayUnit) != nil {
+		return 1
+	}
+	return units[g.YAxisUnit].factor / units[g.DisplayUnit].factor
+}
+
+// scaleResult returns a copy of value with every sample multiplied by
+// factor, or value itself when factor is 1. The samples of value are left
+// untouched, since query results may be shared through the cache.
+func scaleResult(value model.Value, factor float64) model.Value {
+	if factor == 1 {
+		return value
+	}
+	switch v := value.(type) {
+	case model.Matrix:
+		scaled := make(model.Matrix, len(v))
+		for i, stream := range v {
+			values := make([]model.SamplePair, len(stream.Values))
+			for j, pair := range stream.Values {
+				values[j] = model.SamplePair{Timestamp: pair.Timestamp, Value: pair.Value * model.SampleValue(factor)}
+			}
+			scaled[i] = &model.SampleStream{Metric: stream.Metric, Values: values}
+		}
+		return scaled
+	case model.Vector:
+		scaled := make(model.Vector, len(v))
+		for i, sample := range v {
+			scaled[i] = &model.Sample{Metric: sample.Metric, Timestamp: sample.Timestamp, Value: sample.Value * model.SampleValue(factor)}
+		}
+		return scaled
+	case *model.Scalar:
+		if v != nil {
+			return &model.Scalar{Timestamp: v.Timestamp, Value: v.Value * model.SampleValue(factor)}
+		}
+	}
+	return value
+}
+
+// Scales of formatted values.
+const (
+	scaleSI     = "si"
+	scaleBinary = "binary"
+)
+
+// baseUnits are the units values of a dimension are scaled from.
+var baseUnits = map[string]string{
+	dimensionBytes: "B",
+	dimensionTime:  "s",
+}
+
+var (
+	siPrefixes     = []string{"n", "µ", "m", "", "k", "M", "G", "T", "P", "E"}
+	binaryPrefixes = []string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+)
+
+// siUnprefixed is the index of the empty prefix in siPrefixes.
+const siUnprefixed = 3
+
+// formatValue formats value, in unit, for display: rounded to the decimals
+// of format and, with an si or binary scale, scaled to the prefix of the
+// unit keeping it readable, e.g. 1610612736 B as "1.50 GiB". Ratios are
+// never scaled.
+func formatValue(value float64, unit string, format *ValueFormat) string {
+	decimals := format.decimals()
+	prefix := ""
+	scale := format.Scale != "" && !math.IsNaN(value) && !math.IsInf(value, 0)
+	if u, ok := units[unit]; ok && scale {
+		base, ok := baseUnits[u.dimension]
+		if ok {
+			value, unit = value*u.factor, base
+		}
+		scale = ok
+	}
+	if scale {
+		value, prefix = scaleValue(value, format.Scale)
+	}
+	formatted := strconv.FormatFloat(value, 'f', decimals, 64)
+	if prefix+unit == "" {
+		return formatted
+	}
+	return formatted + " " + prefix + unit
+}
+
+// scaleValue returns value scaled to the largest prefix of scale keeping it
+// at least 1, and that prefix.
+func scaleValue(value float64, scale string) (float64, string) {
+	if value == 0 {
+		return 0, ""
+	}
+	if scale == scaleBinary {
+		i := 0
+		for i < len(binaryPrefixes)-1 && math.Abs(value) >= 1024 {
+			value /= 1024
+			i++
+		}
+		return value, binaryPrefixes[i]
+	}
+	i := siUnprefixed
+	for i < len(siPrefixes)-1 && math.Abs(value) >= 1000 {
+		value /= 1000
+		i++
+	}
+	for i > 0 && math.Abs(value) < 1 {
+		value *= 1000
+		i--
+	}
+	return value, siPrefixes[i]
+}
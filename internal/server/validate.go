@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// maxValidateSamples bounds the samples returned by a query validation.
+const maxValidateSamples = 10
+
+// ValidateQueryRequest is the body of a query validation request.
+type ValidateQueryRequest struct {
+	// Query is a query expression template, like the queryExpression of a
+	// graph.
+	Query string `json:"query"`
+	// Env holds the template variables the query is rendered with.
+	Env map[string][]string `json:"env,omitempty"`
+	// Application, when set, renders the query with the labels of the
+	// application and checks it against its query policy.
+	Application string `json:"application,omitempty"`
+	// Datasource is the datasource the query is executed against, the
+	// provider by default.
+	Datasource string `json:"datasource,omitempty"`
+	// Execute runs the query as an instant query to check that it returns
+	// data.
+	Execute bool `json:"execute,omitempty"`
+	// At is the RFC 3339 evaluation time of the executed query, now by
+	// default.
+	At *time.Time `json:"at,omitempty"`
+}
+
+// ValidateQueryResponse is the result of a query validation.
+type ValidateQueryResponse struct {
+	Valid bool `json:"valid"`
+	// Query is the rendered query, when it could be rendered.
+	Query string `json:"query,omitempty"`
+	// Error tells why the query is not valid.
+	Error string `json:"error,omitempty"`
+	// ResultType, SeriesCount and Sample are set when the query is
+	// executed, Sample holding the latest value of at most 10 series.
+	ResultType  model.ValueType `json:"resultType,omitempty"`
+	SeriesCount int             `json:"seriesCount,omitempty"`
+	Sample      []LatestSample  `json:"sample,omitempty"`
+	Warnings    []string        `json:"warnings,omitempty"`
+}
+
+// validateQuery renders and parses the query of a validation request,
+// optionally executing it as an instant query. Queries that can not be
+// rendered, parsed or executed are reported as not valid in a 200 response,
+// while invalid requests and unreachable datasources fail the request.
+func (pp *PrometheusProvider) validateQuery(ctx *gin.Context) {
+	var req ValidateQueryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, "Invalid query validation request: "+err.Error())
+		return
+	}
+	if req.Query == "" {
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, "Query validation request must have a query")
+		return
+	}
+	at := time.Now()
+	if req.At != nil {
+		if err := checkEvaluationTime(*req.At); err != nil {
+			writeQueryError(ctx, err)
+			return
+		}
+		at = *req.At
+	}
+	env := req.Env
+	var policy *QueryPolicy
+	var enforced map[string]string
+	if req.Application != "" {
+		app := pp.config.getApp(req.Application)
+		if app == nil || app.Name != req.Application {
+			writeQueryError(ctx, newNotFoundError("Requested Application not found"))
+			return
+		}
+		env = app.queryEnv(env)
+		policy = app.QueryPolicy
+		enforced = app.EnforcedLabels
+	}
+	if req.Datasource != "" && req.Datasource != pp.config.Provider.Name && !pp.config.hasDatasource(req.Datasource) {
+		writeQueryError(ctx, newNotFoundError(fmt.Sprintf("Requested Datasource %s not found", req.Datasource)))
+		return
+	}
+
+	response := ValidateQueryResponse{}
+	query, err := renderEnforcedQuery(req.Query, env, pp.config.QueryTemplates, enforced)
+	if err != nil {
+		response.Error = err.Error()
+		ctx.JSON(http.StatusOK, response)
+		return
+	}
+	response.Query = query
+	if _, err := parser.ParseExpr(query); err != nil {
+		response.Error = "invalid query: " + err.Error()
+		ctx.JSON(http.StatusOK, response)
+		return
+	}
+	if policy != nil {
+		if err := policy.check(query); err != nil {
+			response.Error = err.Error()
+			ctx.JSON(http.StatusOK, response)
+			return
+		}
+	}
+	if req.Execute {
+		queryCtx := ctx.Request.Context()
+		if req.Datasource != "" && req.Datasource != pp.config.Provider.Name {
+			queryCtx = withDatasource(queryCtx, req.Datasource)
+		}
+		result, warnings, err := pp.queryInstant(queryCtx, query, at)
+		if err != nil {
+			err = classifyQueryError(err)
+			if !isInvalidQuery(err) {
+				writeQueryError(ctx, err)
+				return
+			}
+			response.Error = err.Error()
+			ctx.JSON(http.StatusOK, response)
+			return
+		}
+		response.ResultType = result.Type()
+		response.SeriesCount, _ = countSeries(result)
+		response.Sample = latestSamples(result)
+		if len(response.Sample) > maxValidateSamples {
+			response.Sample = response.Sample[:maxValidateSamples]
+		}
+		response.Warnings = warnings
+	}
+	response.Valid = true
+	ctx.JSON(http.StatusOK, response)
+}
+
+// isInvalidQuery returns whether err is the error of a query Prometheus
+// rejected, as classified by classifyQueryError.
+func isInvalidQuery(err error) bool {
+	var qe *queryError
+	return errors.As(err, &qe) && qe.code == errCodeInvalidQuery
+}
+
+// queryInstant executes query as an instant query at ts against the
+// datasource of ctx, within the limits and circuit breaker of range queries
+// but without caching its result.
+func (pp *PrometheusProvider) queryInstant(ctx context.Context, query string, ts time.Time) (model.Value, []string, error) {
+	client, err := pp.api(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	breaker := pp.breaker(ctx)
+	if err := breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	if pp.options.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pp.options.QueryTimeout)
+		defer cancel()
+	}
+	release, err := pp.limiter.acquire(ctx)
+	if err != nil {
+		breaker.abort()
+		return nil, nil, err
+	}
+	defer release()
+	result, warnings, err := client.Query(ctx, query, ts)
+	if errors.Is(err, context.Canceled) {
+		breaker.abort()
+	} else {
+		breaker.record(err)
+	}
+	return result, warnings, err
+}
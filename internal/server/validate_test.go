@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// executeTestValidateQuery runs a query validation request with body against
+// pp.
+func executeTestValidateQuery(pp *PrometheusProvider, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/api/validate-query", strings.NewReader(body))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	pp.validateQuery(ctx)
+	return w
+}
+
+func TestValidateQuery(t *testing.T) {
+	var instantQueries []string
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		query := r.Form.Get("query")
+		instantQueries = append(instantQueries, query)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(query, "label_replace") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status": "error", "errorType": "execution", "error": "invalid regular expression"}`))
+			return
+		}
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": [
+			{"metric": {"pod": "a"}, "value": [1700000000, "1"]},
+			{"metric": {"pod": "b"}, "value": [1700000000, "2"]}
+		]}}`))
+	})
+	pp.config.Applications[0].ApplicationLabels = map[string]string{"namespace": "shop"}
+	pp.config.Applications[0].QueryPolicy = &QueryPolicy{Functions: []string{"rate"}}
+
+	tests := []struct {
+		name     string
+		body     string
+		expected ValidateQueryResponse
+	}{
+		{
+			name:     "rendered and parsed",
+			body:     `{"query": "up{pod=\"{{.pod}}\"}", "env": {"pod": ["a"]}}`,
+			expected: ValidateQueryResponse{Valid: true, Query: `up{pod="a"}`},
+		},
+		{
+			name:     "missing variable",
+			body:     `{"query": "up{pod=\"{{.pod}}\"}"}`,
+			expected: ValidateQueryResponse{Error: `Query param "pod" is required by the query`},
+		},
+		{
+			name:     "parse error",
+			body:     `{"query": "sum(up"}`,
+			expected: ValidateQueryResponse{Query: "sum(up", Error: "invalid query: 1:7: parse error: unclosed left parenthesis"},
+		},
+		{
+			name:     "application labels and policy",
+			body:     `{"query": "sum(up{namespace=\"{{.namespace}}\"})", "application": "app"}`,
+			expected: ValidateQueryResponse{Query: `sum(up{namespace="shop"})`, Error: "Query uses aggregation sum, which is not allowed for the application"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := executeTestValidateQuery(pp, tt.body)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var response ValidateQueryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.expected, response)
+		})
+	}
+	assert.Empty(t, instantQueries, "queries are only executed when requested")
+
+	w := executeTestValidateQuery(pp, `{"query": "up", "execute": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"valid": true, "query": "up", "resultType": "vector", "seriesCount": 2, "sample": [
+		{"metric": {"pod": "a"}, "timestamp": 1700000000, "value": "1"},
+		{"metric": {"pod": "b"}, "timestamp": 1700000000, "value": "2"}
+	]}`, w.Body.String())
+	assert.Equal(t, []string{"up"}, instantQueries)
+
+	var times []string
+	fixed := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		times = append(times, r.Form.Get("time"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": []}}`))
+	})
+	w = executeTestValidateQuery(fixed, `{"query": "up", "execute": true, "at": "2023-11-14T22:13:20Z"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"1700000000"}, times)
+	w = executeTestValidateQuery(fixed, `{"query": "up", "execute": true, "at": "2999-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = executeTestValidateQuery(pp, `{"query": "label_replace(up, \"a\", \"$1\", \"b\", \"(\")", "execute": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"valid":false`)
+	assert.Contains(t, w.Body.String(), `"error":"invalid query: invalid regular expression"`, "PromQL errors of the execution make the query invalid")
+
+	w = executeTestValidateQuery(pp, `{"query": "up", "application": "other"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"not_found"`)
+
+	w = executeTestValidateQuery(pp, `{"query": "up", "datasource": "thanos"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Requested Datasource thanos not found")
+
+	w = executeTestValidateQuery(pp, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"invalid_request"`)
+}
+
+func TestValidateQueryUnreachable(t *testing.T) {
+	pp := newTestPrometheusProviderWithHandler(t, &Graph{Name: "graph"}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	w := executeTestValidateQuery(pp, `{"query": "up", "execute": true}`)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "error querying prometheus")
+}
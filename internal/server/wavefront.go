@@ -1,19 +1,17 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"html/template"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"go.uber.org/zap"
 
 	wavefront "github.com/WavefrontHQ/go-wavefront-management-api"
 	"github.com/gin-gonic/gin"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 )
 
 type WaveFrontProvider struct {
@@ -21,6 +19,7 @@ type WaveFrontProvider struct {
 	provider *wavefront.Client
 	config   *MetricsConfigProvider
 	token    string
+	options  Options
 }
 
 // getDashboard returns the dashboard configuration for the specified application
@@ -29,20 +28,20 @@ func (wf *WaveFrontProvider) getDashboard(ctx *gin.Context) {
 	groupKind := ctx.Param("groupkind")
 	app := wf.config.getApp(appName)
 	if app == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Application not found")
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested/Default Application not found")
 		return
 	}
 	dash := app.getDashBoard(groupKind)
 	if dash == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Dashboard not found")
+		writeQueryError(ctx, app.dashboardNotFound(groupKind))
 		return
 	}
 	dash.ProviderType = wf.getType()
 	ctx.JSON(http.StatusOK, dash)
 }
 
-func NewWavefrontProvider(waveFrontConfig *MetricsConfigProvider, token string, logger *zap.SugaredLogger) *WaveFrontProvider {
-	return &WaveFrontProvider{config: waveFrontConfig, token: token, logger: logger}
+func NewWavefrontProvider(waveFrontConfig *MetricsConfigProvider, token string, logger *zap.SugaredLogger, options Options) *WaveFrontProvider {
+	return &WaveFrontProvider{config: waveFrontConfig, token: token, logger: logger, options: options}
 }
 
 func (wf *WaveFrontProvider) init() error {
@@ -63,26 +62,33 @@ func (wf *WaveFrontProvider) getType() string {
 	return WAVEFRONT_TYPE
 }
 
+// executeLive is not supported by the wavefront provider yet.
+func (wf *WaveFrontProvider) executeLive(ctx *gin.Context) {
+	writeError(ctx, http.StatusNotImplemented, errCodeNotImplemented, "Live graphs are not supported by the wavefront provider")
+}
+
+// executeProgressive is not supported by the wavefront provider yet.
+func (wf *WaveFrontProvider) executeProgressive(ctx *gin.Context) {
+	writeError(ctx, http.StatusNotImplemented, errCodeNotImplemented, "Progressive graphs are not supported by the wavefront provider")
+}
+
+// labelValues is not supported by the wavefront provider yet.
+func (wf *WaveFrontProvider) labelValues(ctx *gin.Context) {
+	writeError(ctx, http.StatusNotImplemented, errCodeNotImplemented, "Label values are not supported by the wavefront provider")
+}
+
+// rules is not supported by the wavefront provider, which has no rules.
+func (wf *WaveFrontProvider) rules(ctx *gin.Context) {
+	writeError(ctx, http.StatusNotImplemented, errCodeNotImplemented, "Rules are not supported by the wavefront provider")
+}
+
 // This function is still in development(alpha phase) and should be tested extensively before being used in the production environment.
 // executeGraphQuery executes a wavefront query and returns the result.
 func executeWavefrontGraphQuery(queryExpression string, env map[string][]string, duration time.Duration, wf *WaveFrontProvider) (*wavefront.QueryResponse, error) {
-	tmpl, err := template.New("query").Parse(queryExpression)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing query template: %s", err)
-	}
-
-	env1 := make(map[string]string)
-	for k, v := range env {
-		env1[k] = strings.Join(v, ",")
-	}
-
-	buf := new(bytes.Buffer)
-	err = tmpl.Execute(buf, env1)
+	strQuery, err := renderQuery(queryExpression, env, wf.config.QueryTemplates)
 	if err != nil {
-		return nil, fmt.Errorf("error executing template: %s", err)
+		return nil, err
 	}
-
-	strQuery := buf.String()
 	startTime := time.Now().Add(-duration)
 	endTime := time.Now()
 	wfQuery := wavefront.NewQueryParams(strQuery)
@@ -97,6 +103,21 @@ func executeWavefrontGraphQuery(queryExpression string, env map[string][]string,
 	return result, nil
 }
 
+// executeRow is not supported by the wavefront provider yet.
+func (wf *WaveFrontProvider) executeRow(ctx *gin.Context) {
+	writeError(ctx, http.StatusNotImplemented, errCodeNotImplemented, "Row queries are not supported by the wavefront provider")
+}
+
+// executeBatch is not supported by the wavefront provider yet.
+func (wf *WaveFrontProvider) executeBatch(ctx *gin.Context) {
+	writeError(ctx, http.StatusNotImplemented, errCodeNotImplemented, "Batch queries are not supported by the wavefront provider")
+}
+
+// validateQuery is not supported by the wavefront provider yet.
+func (wf *WaveFrontProvider) validateQuery(ctx *gin.Context) {
+	writeError(ctx, http.StatusNotImplemented, errCodeNotImplemented, "Query validation is not supported by the wavefront provider")
+}
+
 // This function is still in development(alpha phase) and should be tested extensively before being used in the production environment.
 // execute handles the execution of a graph queryExpression and graph thresholds
 func (wf *WaveFrontProvider) execute(ctx *gin.Context) {
@@ -104,87 +125,91 @@ func (wf *WaveFrontProvider) execute(ctx *gin.Context) {
 	groupKind := ctx.Param("groupkind")
 	rowName := ctx.Param("row")
 	graphName := ctx.Param("graph")
-	durationStr := ctx.Query("duration")
-	if durationStr == "" {
-		durationStr = "1h"
+	duration := wf.options.DefaultDuration
+	if durationStr := ctx.Query("duration"); durationStr != "" {
+		var err error
+		duration, err = parseDuration(durationStr)
+		if err != nil {
+			writeError(ctx, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid duration %q: %s", durationStr, err))
+			return
+		}
 	}
-	duration, err := time.ParseDuration(durationStr)
-	if err != nil {
-		ctx.JSON(http.StatusBadRequest, "Invalid duration format :"+err.Error())
+	if err := checkDuration(duration, wf.options); err != nil {
+		writeQueryError(ctx, err)
 		return
 	}
 	env := ctx.Request.URL.Query()
 
 	application := wf.config.getApp(app)
 	if application == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Application not found")
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested/Default Application not found")
 		return
 	}
 	dashboard := application.getDashBoard(groupKind)
 	if dashboard == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested/Default Dashboard not found")
+		writeQueryError(ctx, application.dashboardNotFound(groupKind))
 		return
 	}
 	row := dashboard.getRow(rowName)
 	if row == nil {
-		ctx.JSON(http.StatusBadRequest, "Requested Row not found")
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested Row not found")
 		return
 	}
 	graph := row.getGraph(graphName)
-	if graph != nil {
-		wf.logger.Infow("Query execution", zap.Any("query", graph.QueryExpression), zap.Any("graphName", graph.Name), zap.Any("rowName", row.Name))
-
-		var data AggregatedResponse
-		result, err := executeWavefrontGraphQuery(graph.QueryExpression, env, duration, wf)
-
-		if err != nil {
-			wf.logger.Errorw("Error in query execution on wavefront", zap.Error(err))
-			ctx.JSON(http.StatusBadRequest, err)
-			return
-		}
+	if graph == nil {
+		writeError(ctx, http.StatusBadRequest, errCodeNotFound, "Requested Graph not found")
+		return
+	}
+	if err := graph.checkThresholds(wf.options.MaxThresholds); err != nil {
+		writeError(ctx, http.StatusBadRequest, errCodeInvalidConfig, fmt.Sprintf("graph %s %s", graph.Name, err))
+		return
+	}
+	wf.logger.Infow("Query execution", zap.Any("query", graph.QueryExpression), zap.Any("graphName", graph.Name), zap.Any("rowName", row.Name))
 
-		data.Data, err = json.Marshal(result)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, fmt.Errorf("error marshaling the data: %s", err))
-			return
-		}
+	var data AggregatedResponse
+	result, err := executeWavefrontGraphQuery(graph.QueryExpression, env, duration, wf)
 
-		var finalResultArr []ThresholdResponse
-		if graph.Thresholds != nil {
+	if err != nil {
+		wf.logger.Errorw("Error in query execution on wavefront", zap.Error(err))
+		writeQueryError(ctx, err)
+		return
+	}
 
-			for _, threshold := range graph.Thresholds {
-				var result *wavefront.QueryResponse
-				var err error
+	data.Data, err = json.Marshal(result)
+	if err != nil {
+		writeError(ctx, http.StatusInternalServerError, errCodeInternal, "error marshaling the data: "+err.Error())
+		return
+	}
 
-				//If threshold.value present, threshold.value gets executed else,threshold.queryExpression gets executed.
-				if threshold.Value != "" {
-					result, err = executeWavefrontGraphQuery(threshold.Value, env, duration, wf)
-				} else {
-					result, err = executeWavefrontGraphQuery(threshold.QueryExpression, env, duration, wf)
-				}
-				if err != nil {
-					ctx.JSON(http.StatusBadRequest, err)
-					return
-				}
-				var temp ThresholdResponse
-				temp.Unit = threshold.Unit
-				temp.Name = threshold.Name
-				temp.Value = threshold.Value
-				temp.Key = threshold.Key
-				temp.Color = threshold.Color
-				temp.Data, err = json.Marshal(result)
+	var finalResultArr []ThresholdResponse
+	if graph.Thresholds != nil {
+		for _, threshold := range graph.Thresholds {
+			var result interface{}
+			var err error
+
+			// Threshold values are numbers returned as a constant series, as
+			// by the Prometheus provider, the expression being executed
+			// otherwise.
+			if value, ok := threshold.literal(); ok {
+				now := time.Now()
+				result = constantMatrix(value, v1.Range{Start: now.Add(-duration), End: now, Step: wf.options.DefaultStep})
+			} else {
+				result, err = executeWavefrontGraphQuery(threshold.expression(), env, duration, wf)
 				if err != nil {
-					ctx.JSON(http.StatusBadRequest, fmt.Errorf("error marshaling the threshold response: %s", err))
+					writeQueryError(ctx, err)
 					return
 				}
-
-				finalResultArr = append(finalResultArr, temp)
 			}
-			data.Thresholds = finalResultArr
-
-			ctx.JSON(http.StatusOK, data)
+			temp := threshold.response()
+			temp.Data, err = json.Marshal(result)
+			if err != nil {
+				writeError(ctx, http.StatusInternalServerError, errCodeInternal, "error marshaling the threshold response: "+err.Error())
+				return
+			}
 
-			return
+			finalResultArr = append(finalResultArr, temp)
 		}
+		data.Thresholds = finalResultArr
 	}
+	ctx.JSON(http.StatusOK, data)
 }
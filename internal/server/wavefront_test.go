@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-metric-ext-server/internal/logging"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWavefrontThresholds(t *testing.T) {
+	var queries []string
+	wavefront := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/chart/api", r.URL.Path)
+		queries = append(queries, r.URL.Query().Get("q"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name": "` + r.URL.Query().Get("q") + `"}`))
+	}))
+	t.Cleanup(wavefront.Close)
+	graph := &Graph{Name: "graph", QueryExpression: "ts(cpu)", Thresholds: []Threshold{
+		{Key: "literal", Value: "80"},
+		{Key: "expression", QueryExpression: "ts(limit)"},
+	}}
+	config := &MetricsConfigProvider{
+		Provider: provider{Address: wavefront.URL},
+		Applications: []Application{{
+			Name:    "app",
+			Default: true,
+			DefaultDashboard: &Dashboard{
+				GroupKind: "pod",
+				Rows:      []*Row{{Name: "row", Graphs: []*Graph{graph}}},
+			},
+		}},
+	}
+	wf := NewWavefrontProvider(config, "token", logging.NewLogger(), Options{DefaultDuration: time.Hour, DefaultStep: 30 * time.Minute})
+	assert.NoError(t, wf.init())
+
+	w := httptest.NewRecorder()
+	ctx := GetTestGinContext(w)
+	MockJsonGet(ctx, http.Header{}, map[string]string{"application": "app", "groupkind": "pod", "row": "row", "graph": "graph"}, nil)
+	wf.execute(ctx)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"ts(cpu)", "ts(limit)"}, queries, "literal thresholds are not queried")
+	var response AggregatedResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Thresholds, 2)
+	var literal model.Matrix
+	assert.NoError(t, json.Unmarshal(response.Thresholds[0].Data, &literal))
+	if assert.Len(t, literal, 1, "literal thresholds are a constant series, as with Prometheus") {
+		assert.Len(t, literal[0].Values, 3, "a sample at every step")
+		assert.Equal(t, model.SampleValue(80), literal[0].Values[0].Value)
+	}
+	assert.Contains(t, string(response.Thresholds[1].Data), `"name":"ts(limit)"`, "the other thresholds return the wavefront response")
+}
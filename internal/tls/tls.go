@@ -14,6 +14,7 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"os"
 	"time"
 )
 
@@ -100,6 +101,22 @@ func GenerateX509KeyPair() (*tls.Certificate, error) {
 	return &cert, nil
 }
 
+// LoadX509KeyPair loads a X509 key pair from PEM encoded certificate and key
+// files, checking that the files exist and that the key matches the
+// certificate.
+func LoadX509KeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pair %s, %s: %w", certFile, keyFile, err)
+	}
+	return &cert, nil
+}
+
 func certTemplate(org string, hosts []string, notAfter time.Time) (*x509.Certificate, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -0,0 +1,35 @@
+package tls
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadX509KeyPair(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, data, 0o600))
+		return path
+	}
+	certPEM, keyPEM, err := generatePEM()
+	assert.NoError(t, err)
+	_, otherKeyPEM, err := generatePEM()
+	assert.NoError(t, err)
+	certFile := write("tls.crt", certPEM)
+	keyFile := write("tls.key", keyPEM)
+	otherKeyFile := write("other.key", otherKeyPEM)
+
+	cert, err := LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+	assert.NotNil(t, cert)
+
+	_, err = LoadX509KeyPair(filepath.Join(dir, "missing.crt"), keyFile)
+	assert.ErrorContains(t, err, "missing.crt")
+
+	_, err = LoadX509KeyPair(certFile, otherKeyFile)
+	assert.ErrorContains(t, err, "invalid key pair")
+}
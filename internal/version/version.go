@@ -0,0 +1,59 @@
+// Package version holds the build information of the server, set at build
+// time with -ldflags, e.g. -X ${PACKAGE}.version=v0.2.0.
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	version      = "latest"
+	buildDate    = "1970-01-01T00:00:00Z"
+	gitCommit    = ""
+	gitTag       = ""
+	gitTreeState = ""
+)
+
+// Version is the build information of the server.
+type Version struct {
+	Version      string `json:"version"`
+	BuildDate    string `json:"buildDate"`
+	GitCommit    string `json:"gitCommit"`
+	GitTag       string `json:"gitTag,omitempty"`
+	GitTreeState string `json:"gitTreeState"`
+	GoVersion    string `json:"goVersion"`
+	Platform     string `json:"platform"`
+}
+
+func (v Version) String() string {
+	return v.Version
+}
+
+// GetVersion returns the build information of the server. Untagged builds
+// are versioned with the short commit they were built from, e.g.
+// latest+1a2b3c4, marked dirty when built with local changes.
+func GetVersion() Version {
+	v := version
+	if gitTag == "" && len(gitCommit) >= 7 {
+		v += "+" + gitCommit[:7]
+		if gitTreeState == "dirty" {
+			v += ".dirty"
+		}
+	}
+	return Version{
+		Version:      v,
+		BuildDate:    buildDate,
+		GitCommit:    gitCommit,
+		GitTag:       gitTag,
+		GitTreeState: gitTreeState,
+		GoVersion:    runtime.Version(),
+		Platform:     fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+	}
+}
+
+// UserAgent returns the User-Agent the server identifies itself with in
+// upstream requests, e.g. argocd-metric-ext-server/v0.2.0.
+func UserAgent() string {
+	return "argocd-metric-ext-server/" + GetVersion().Version
+}